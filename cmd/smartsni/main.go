@@ -0,0 +1,243 @@
+// Command smartsni runs the DoH/DoT/DNS resolver, the SNI proxy and the
+// web panel from a single config.json in the working directory.
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sync"
+	"syscall"
+
+	"smartSNI/config"
+	"smartSNI/dnsserver"
+	"smartSNI/metrics"
+	"smartSNI/panel"
+	"smartSNI/sniproxy"
+	"smartSNI/users"
+)
+
+const configPath = "config.json"
+
+func initLogger(level string) *slog.Logger {
+	var logLevel slog.Level
+	switch level {
+	case "debug":
+		logLevel = slog.LevelDebug
+	case "info":
+		logLevel = slog.LevelInfo
+	case "warn":
+		logLevel = slog.LevelWarn
+	case "error":
+		logLevel = slog.LevelError
+	default:
+		logLevel = slog.LevelInfo
+	}
+
+	opts := &slog.HandlerOptions{
+		Level: logLevel,
+	}
+	handler := slog.NewJSONHandler(os.Stdout, opts)
+	return slog.New(handler)
+}
+
+// reloadOnSIGHUP reloads config.json (and with it the hosted zones) whenever
+// the process receives SIGHUP.
+func reloadOnSIGHUP(ctx context.Context, logger *slog.Logger, reload func() error) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+			if err := reload(); err != nil {
+				logger.Error("reload on SIGHUP failed", "error", err)
+			}
+		}
+	}
+}
+
+func main() {
+	// Effective GC tuning at runtime (unlike setting env var)
+	debug.SetGCPercent(50)
+
+	// Load configuration
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	store := config.NewStore(cfg)
+
+	// Initialize logger
+	logger := initLogger(cfg.LogLevel)
+	logger.Info("smartSNI starting", "version", "2.0")
+
+	m := metrics.New()
+	userStore := users.NewStore(logger)
+
+	var dns *dnsserver.Server
+	reload := func() error {
+		newConfig, err := config.Load(configPath)
+		if err != nil {
+			return err
+		}
+		if err := dns.Reload(newConfig); err != nil {
+			return err
+		}
+		logger.Info("configuration reloaded successfully")
+		return nil
+	}
+
+	dns, err = dnsserver.New(dnsserver.Options{
+		Config:       store,
+		Users:        userStore,
+		Metrics:      m,
+		Logger:       logger,
+		ReloadConfig: reload,
+	})
+	if err != nil {
+		log.Fatalf("Failed to initialize DNS server: %v", err)
+	}
+
+	sni := sniproxy.New(sniproxy.Options{
+		Config:   store,
+		Users:    userStore,
+		Metrics:  m,
+		Logger:   logger,
+		Resolver: dns,
+	})
+
+	pnl := panel.New(panel.Options{
+		Config:      store,
+		ConfigPath:  configPath,
+		Users:       userStore,
+		Metrics:     m,
+		Logger:      logger,
+		ApplyConfig: dns.Reload,
+		Connections: sni,
+	})
+
+	logger.Info("configuration loaded",
+		"host", cfg.Host,
+		"domains", len(cfg.Domains),
+		"cache_ttl", cfg.CacheTTL,
+		"upstream_servers", len(cfg.UpstreamDOH),
+		"auth_enabled", cfg.EnableAuth,
+		"metrics_enabled", cfg.MetricsEnabled,
+	)
+
+	// Setup signal handling
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Start cache and session cleanup goroutines
+	go dns.CleanExpiredCache(ctx)
+	go pnl.CleanExpiredSessions(ctx)
+
+	// Start user expiration checker if user management is enabled
+	if cfg.UserManagement {
+		go userStore.RunExpirationChecker(ctx)
+		logger.Info("user expiration checker started")
+
+		// Migrate old users without API keys
+		userStore.MigrateAPIKeys()
+	}
+
+	go reloadOnSIGHUP(ctx, logger, reload)
+
+	// Start auto-backup scheduler
+	go pnl.RunAutoBackup(ctx)
+	logger.Info("auto-backup scheduler started (runs daily)")
+
+	// Start all servers
+	var wg sync.WaitGroup
+	run := func(serve func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve()
+		}()
+	}
+
+	run(func() {
+		if err := dns.ListenAndServeDoH(ctx, "127.0.0.1:8080"); err != nil {
+			log.Fatalf("%v", err)
+		}
+	})
+	run(func() {
+		if err := dns.ListenAndServeDoT(ctx); err != nil {
+			log.Fatal(err)
+		}
+	})
+	run(func() {
+		if err := sni.ListenAndServe(ctx); err != nil {
+			logger.Error("SNI: failed to listen", "error", err)
+			logger.Warn("SNI proxy disabled due to port conflict")
+		}
+	})
+
+	// Start plain HTTP Host proxy if configured
+	if cfg.HTTPPort > 0 {
+		run(func() {
+			if err := sni.ListenAndServeHTTP(ctx); err != nil {
+				logger.Error("HTTP proxy error", "error", err)
+			}
+		})
+	}
+
+	// Start QUIC proxy if configured
+	if cfg.QUICPort > 0 {
+		run(func() {
+			if err := sni.ListenAndServeQUIC(ctx); err != nil {
+				logger.Error("QUIC proxy error", "error", err)
+			}
+		})
+	}
+
+	// Start DNS server if enabled
+	if cfg.DNSEnabled {
+		run(func() {
+			if err := dns.ListenAndServeDNS(ctx); err != nil {
+				logger.Error("DNS server error", "error", err)
+			}
+		})
+	}
+
+	// Start web panel if enabled
+	if cfg.WebPanelEnabled && cfg.WebPanelUsername != "" && cfg.WebPanelPassword != "" {
+		run(func() {
+			if err := pnl.ListenAndServe(ctx); err != nil {
+				logger.Error("web panel server error", "error", err)
+			}
+		})
+	}
+
+	sniPort := cfg.SNIPort
+	if sniPort == 0 {
+		sniPort = 443
+	}
+
+	logger.Info("all servers started",
+		"dns_enabled", cfg.DNSEnabled,
+		"sni_port", sniPort,
+		"http_port", cfg.HTTPPort,
+		"quic_port", cfg.QUICPort,
+		"dot_port", 853,
+		"doh_address", "127.0.0.1:8080",
+		"web_panel_enabled", cfg.WebPanelEnabled,
+		"web_panel_port", cfg.WebPanelPort,
+	)
+
+	// Wait for shutdown signal
+	<-ctx.Done()
+	logger.Info("shutdown signal received, stopping servers...")
+
+	// Wait for all servers to stop
+	wg.Wait()
+	logger.Info("shutdown complete")
+}
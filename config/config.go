@@ -0,0 +1,559 @@
+// Package config loads, validates and stores the smartSNI configuration
+// shared by the DNS servers, the SNI proxy and the web panel.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+
+	"smartSNI/internal/egress"
+)
+
+// Alias modes for Domains values that are hostnames
+const (
+	AliasModeFlatten = "flatten" // answer with the target's A/AAAA under the queried name
+	AliasModeCNAME   = "cname"   // answer with a CNAME to the target followed by its records
+)
+
+// Policies for ClientHellos offering Encrypted Client Hello, whose
+// server_name is only the public name of the client-facing server
+const (
+	ECHPolicyOuter = "outer" // route by the outer server name (default)
+	ECHPolicyBlock = "block" // close the connection
+)
+
+// Names whose HTTPS/SVCB answers lose their ech parameter
+const (
+	ECHStripProxied = "proxied" // names with a domains rule or an SNI route
+	ECHStripAll     = "all"     // every name
+)
+
+// Default EDNS Client Subnet prefix lengths
+const (
+	DefaultECSPrefixV4 = 24
+	DefaultECSPrefixV6 = 56
+)
+
+// RecursiveUpstream selects the built-in iterative resolver when used as an
+// entry of upstream_doh.
+const RecursiveUpstream = "recursive"
+
+// Config holds the main configuration
+type Config struct {
+	Host                string               `json:"host"`
+	Domains             map[string]string    `json:"domains"`                                        // pattern -> IP or alias hostname (supports exact or "*.example.com")
+	DomainAliasMode     string               `json:"domain_alias_mode,omitempty"`                    // hostname targets: flatten (default) or cname
+	DomainSets          map[string]DomainSet `json:"domain_sets,omitempty"`                          // named domain sets assignable to users
+	Plans               map[string][]string  `json:"plans,omitempty"`                                // plan name -> domain set names
+	SNIPort             int                  `json:"sni_port,omitempty"`                             // SNI proxy port (default 443)
+	HTTPPort            int                  `json:"http_port,omitempty"`                            // plain HTTP Host proxy port (0 = disabled)
+	QUICPort            int                  `json:"quic_port,omitempty"`                            // UDP port of the QUIC SNI proxy (0 = disabled)
+	SNIRoutes           []SNIRoute           `json:"sni_routes,omitempty"`                           // SNI proxy routing rules, first match wins
+	SNIBlockedFP        []string             `json:"sni_blocked_fingerprints,omitempty"`             // JA3 hashes or JA4 fingerprints to drop
+	SNILogClientHello   bool                 `json:"sni_log_client_hello,omitempty"`                 // Log ALPN, versions and fingerprints of every connection
+	SNIECHPolicy        string               `json:"sni_ech_policy,omitempty"`                       // connections offering ECH: outer (default) or block
+	SNIIdleTimeout      int                  `json:"sni_idle_timeout,omitempty"`                     // seconds without traffic before a relay is closed (0 = never)
+	SNIMaxLifetime      int                  `json:"sni_max_lifetime,omitempty"`                     // seconds a relay may last (0 = unlimited)
+	SNIMaxConns         int                  `json:"sni_max_connections,omitempty"`                  // concurrent SNI connections (0 = unlimited)
+	SNIMaxConnsPerIP    int                  `json:"sni_max_connections_per_ip,omitempty"`           // concurrent SNI connections per client IP (0 = unlimited)
+	SNIDrainTimeout     int                  `json:"sni_drain_timeout,omitempty"`                    // seconds relays may finish after shutdown starts (default 30)
+	SNIRateLimits       []SNIRateLimit       `json:"sni_rate_limits,omitempty"`                      // byte-rate limits on SNI relays; every matching rule applies
+	SourcePools         map[string]AddrPool  `json:"source_pools,omitempty"`                         // named outbound address pools for SNI routes and users
+	DNSEnabled          bool                 `json:"dns_enabled,omitempty"`                          // Enable standard DNS on port 53
+	DNSUDPSockets       int                  `json:"dns_udp_sockets,omitempty"`                      // SO_REUSEPORT sockets for UDP:53 (0 = one per CPU)
+	DNSUDPWorkers       int                  `json:"dns_udp_workers,omitempty"`                      // UDP query workers (0 = 64 per CPU, at least 512)
+	DNSUDPQueueSize     int                  `json:"dns_udp_queue_size,omitempty"`                   // pending UDP queries before reads block (0 = 4 per worker)
+	Zones               map[string]string    `json:"zones,omitempty"`                                // zone origin -> RFC 1035 zone file served authoritatively
+	DNSPlugins          []string             `json:"dns_plugins,omitempty"`                          // query chain in order (default: blocklist, zones, ecs, ech, cache, local, rewrite)
+	DNSStripECH         string               `json:"dns_strip_ech,omitempty"`                        // remove ech from HTTPS/SVCB answers: proxied or all (default: keep); needs ech in dns_plugins
+	UpstreamDOH         []string             `json:"upstream_doh,omitempty"`                         // DoH URLs, or "recursive" for the built-in resolver
+	UpstreamDoHEgress   []string             `json:"upstream_doh_egress,omitempty"`                  // proxy chain for DoH upstream requests (socks5:// or http:// URLs)
+	RecursiveRootHints  []string             `json:"recursive_root_hints,omitempty"`                 // root server IPs for "recursive" (default: IANA root servers)
+	RecursiveNoQNAMEMin bool                 `json:"recursive_disable_qname_minimization,omitempty"` // send full names to every zone
+	ECSEnabled          bool                 `json:"ecs_enabled,omitempty"`                          // Send EDNS Client Subnet upstream (RFC 7871)
+	ECSPrefixV4         *int                 `json:"ecs_prefix_v4,omitempty"`                        // IPv4 source prefix length (default 24, 0 sends no address bits)
+	ECSPrefixV6         *int                 `json:"ecs_prefix_v6,omitempty"`                        // IPv6 source prefix length (default 56, 0 sends no address bits)
+	ECSStripClient      bool                 `json:"ecs_strip_client,omitempty"`                     // Drop ECS options sent by clients
+	DNSSECValidate      bool                 `json:"dnssec_validate,omitempty"`                      // Validate upstream answers (AD bit / SERVFAIL on bogus)
+	DNSSECTrustAnchors  []string             `json:"dnssec_trust_anchors,omitempty"`                 // DS records in zone file format (default: IANA root KSKs)
+	AuthTokens          []string             `json:"auth_tokens,omitempty"`
+	EnableAuth          bool                 `json:"enable_auth,omitempty"`
+	CacheTTL            int                  `json:"cache_ttl,omitempty"`         // seconds
+	RateLimitPerIP      int                  `json:"rate_limit_per_ip,omitempty"` // requests per second
+	RateLimitBurstIP    int                  `json:"rate_limit_burst_ip,omitempty"`
+	LogLevel            string               `json:"log_level,omitempty"` // debug, info, warn, error
+	TrustedProxies      []string             `json:"trusted_proxies,omitempty"`
+	BlockedDomains      []string             `json:"blocked_domains,omitempty"`
+	MetricsEnabled      bool                 `json:"metrics_enabled,omitempty"`
+	WebPanelEnabled     bool                 `json:"web_panel_enabled,omitempty"`
+	WebPanelUsername    string               `json:"web_panel_username,omitempty"`
+	WebPanelPassword    string               `json:"web_panel_password,omitempty"` // SHA256 hash
+	WebPanelPort        int                  `json:"web_panel_port,omitempty"`
+	UserManagement      bool                 `json:"user_management,omitempty"` // Enable user-based access control
+}
+
+// DomainSet is a named group of redirections and blocks that can be given
+// to users directly or through their plan.
+type DomainSet struct {
+	Domains map[string]string `json:"domains,omitempty"` // pattern -> IP or alias hostname
+	Blocked []string          `json:"blocked,omitempty"` // patterns answered with REFUSED
+}
+
+// Load-balancing policies for SNI routes with several backends
+const (
+	SNIPolicyRoundRobin = "round_robin" // weighted rotation (default)
+	SNIPolicyRandom     = "random"      // weighted random choice
+	SNIPolicyLeastConn  = "least_conn"  // fewest active connections per unit of weight
+	SNIPolicyHash       = "hash"        // weighted by client IP, so each client sticks to one backend
+	SNIPolicyFailover   = "failover"    // first backend that answers, in listed order
+)
+
+// SNIRoute sends SNI proxy connections matching a server name pattern and,
+// optionally, an offered ALPN protocol to a set of backends or drops them.
+type SNIRoute struct {
+	SNI      string       `json:"sni"`                   // pattern (exact or "*.example.com"); "*" matches any name
+	ALPN     []string     `json:"alpn,omitempty"`        // match only clients offering one of these protocols
+	Backend  string       `json:"backend,omitempty"`     // single backend, shorthand for backends
+	Backends []SNIBackend `json:"backends,omitempty"`    // backends to spread connections over
+	Policy   string       `json:"policy,omitempty"`      // load-balancing policy (default round_robin)
+	Fallback bool         `json:"fallback,omitempty"`    // when no backend answers, use the default <sni>:443 route
+	Egress   []string     `json:"egress,omitempty"`      // proxy chain to dial through (socks5:// or http:// URLs)
+	Source   string       `json:"source_pool,omitempty"` // source_pools entry to dial from
+	Block    bool         `json:"block,omitempty"`       // close matching connections
+}
+
+// SNIRateLimit caps the byte rate of the SNI relays it selects, in each
+// direction. A rule selects connections matching all of its SNI, User and
+// Plan fields; empty fields match anything.
+type SNIRateLimit struct {
+	SNI    string `json:"sni,omitempty"`         // pattern (exact or "*.example.com"); "*" or empty matches any name
+	User   string `json:"user,omitempty"`        // user ID
+	Plan   string `json:"plan,omitempty"`        // users on this plan
+	Rate   int64  `json:"bytes_per_second"`      // sustained rate per direction
+	Burst  int64  `json:"burst_bytes,omitempty"` // bucket size (default: one second of rate)
+	Shared bool   `json:"shared,omitempty"`      // one bucket for every selected connection instead of one per client
+}
+
+// Matches reports whether a connection for serverName by a user (ID and
+// plan, empty for anonymous clients) falls under the rule.
+func (l *SNIRateLimit) Matches(serverName, user, plan string) bool {
+	if l.SNI != "" && l.SNI != "*" && !Matches(serverName, l.SNI) {
+		return false
+	}
+	if l.User != "" && l.User != user {
+		return false
+	}
+	return l.Plan == "" || l.Plan == plan
+}
+
+// BurstBytes returns the bucket size of the rule.
+func (l *SNIRateLimit) BurstBytes() int64 {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Rate
+}
+
+// AddrPool is a set of local addresses the SNI proxy dials from.
+type AddrPool struct {
+	Addrs  []string `json:"addrs"`            // IPs or prefixes; a prefix such as an IPv6 /64 yields addresses across it
+	Sticky bool     `json:"sticky,omitempty"` // keep each client on the same source address
+}
+
+// ParseSourceAddr parses a source_pools address: a single IP or a CIDR
+// prefix, returned as a prefix.
+func ParseSourceAddr(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return p.Masked(), nil
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()), nil
+}
+
+// ValidateSourcePool checks that name (if any) is a defined source pool.
+func (c *Config) ValidateSourcePool(name string) error {
+	if _, ok := c.SourcePools[name]; name != "" && !ok {
+		return fmt.Errorf("unknown source pool: %s", name)
+	}
+	return nil
+}
+
+// SNIBackend is one destination of an SNI route.
+type SNIBackend struct {
+	Address string `json:"address"`          // host:port or unix:/path/to.sock
+	Weight  int    `json:"weight,omitempty"` // relative share of connections (default 1)
+}
+
+// Targets returns the route's backends, including the backend shorthand.
+func (r *SNIRoute) Targets() []SNIBackend {
+	if r.Backend == "" {
+		return r.Backends
+	}
+	return append([]SNIBackend{{Address: r.Backend}}, r.Backends...)
+}
+
+// BackendNetwork splits an SNI backend address into the network and address
+// to dial: "unix:/path" is a unix socket, anything else host:port over TCP.
+func BackendNetwork(address string) (network, addr string, err error) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		if path == "" {
+			return "", "", errors.New("empty unix socket path")
+		}
+		return "unix", path, nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", err
+	}
+	return "tcp", address, nil
+}
+
+func (r *SNIRoute) validate() error {
+	if r.SNI == "" {
+		return errors.New("sni pattern cannot be empty")
+	}
+	targets := r.Targets()
+	if r.Block == (len(targets) > 0 || len(r.Egress) > 0) {
+		return errors.New("exactly one of backend(s), egress or block is required")
+	}
+	if _, err := egress.ParseChain(r.Egress); err != nil {
+		return fmt.Errorf("egress: %w", err)
+	}
+	for _, b := range targets {
+		network, _, err := BackendNetwork(b.Address)
+		if err != nil {
+			return fmt.Errorf("invalid backend %q: %w", b.Address, err)
+		}
+		if network == "unix" && len(r.Egress) > 0 {
+			return fmt.Errorf("backend %s: unix sockets cannot be reached through egress", b.Address)
+		}
+		if b.Weight < 0 {
+			return fmt.Errorf("backend %s: weight cannot be negative", b.Address)
+		}
+	}
+	switch r.Policy {
+	case "", SNIPolicyRoundRobin, SNIPolicyRandom, SNIPolicyLeastConn, SNIPolicyHash, SNIPolicyFailover:
+	default:
+		return fmt.Errorf("unknown policy %q", r.Policy)
+	}
+	return nil
+}
+
+// Matches reports whether a connection for serverName offering alpn falls
+// under the route.
+func (r *SNIRoute) Matches(serverName string, alpn []string) bool {
+	if r.SNI != "*" && !Matches(serverName, r.SNI) {
+		return false
+	}
+	if len(r.ALPN) == 0 {
+		return true
+	}
+	for _, want := range r.ALPN {
+		for _, offered := range alpn {
+			if want == offered {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Load reads filename, fills in defaults and validates the result.
+func Load(filename string) (*Config, error) {
+	var c Config
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+
+	c.SetDefaults()
+
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("config validation failed: %w", err)
+	}
+
+	return &c, nil
+}
+
+// SetDefaults fills in every unset option that has a default.
+func (c *Config) SetDefaults() {
+	if len(c.UpstreamDOH) == 0 {
+		c.UpstreamDOH = []string{"https://1.1.1.1/dns-query", "https://8.8.8.8/dns-query"}
+	}
+	if c.CacheTTL == 0 {
+		c.CacheTTL = 300 // 5 minutes default
+	}
+	if c.RateLimitPerIP == 0 {
+		c.RateLimitPerIP = 10
+	}
+	if c.RateLimitBurstIP == 0 {
+		c.RateLimitBurstIP = 20
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+	if c.WebPanelPort == 0 {
+		c.WebPanelPort = 8088
+	}
+	if c.DomainAliasMode == "" {
+		c.DomainAliasMode = AliasModeFlatten
+	}
+}
+
+// ECSPrefixes returns the EDNS Client Subnet source prefix lengths, with
+// the defaults for those not set. An explicit 0 is kept: RFC 7871 uses it
+// to ask for answers that do not depend on the client's location.
+func (c *Config) ECSPrefixes() (v4, v6 int) {
+	v4, v6 = DefaultECSPrefixV4, DefaultECSPrefixV6
+	if c.ECSPrefixV4 != nil {
+		v4 = *c.ECSPrefixV4
+	}
+	if c.ECSPrefixV6 != nil {
+		v6 = *c.ECSPrefixV6
+	}
+	return v4, v6
+}
+
+// Save writes c to filename as indented JSON.
+func Save(filename string, c *Config) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+
+	return nil
+}
+
+// Validate checks the settings that can be judged on their own. Options
+// that need a running server to interpret (DNS plugin names, DNSSEC trust
+// anchors) are checked when the DNS server applies the config.
+func (c *Config) Validate() error {
+	if c.Host == "" {
+		return errors.New("host cannot be empty")
+	}
+	if len(c.Domains) == 0 {
+		return errors.New("domains cannot be empty")
+	}
+	for pattern, target := range c.Domains {
+		if pattern == "" {
+			return errors.New("domain pattern cannot be empty")
+		}
+		if err := ValidateDomainTarget(target); err != nil {
+			return fmt.Errorf("invalid target for domain %s: %w", pattern, err)
+		}
+	}
+	if err := c.validateDomainSets(); err != nil {
+		return err
+	}
+	for name, v := range map[string]int{
+		"sni_idle_timeout":           c.SNIIdleTimeout,
+		"sni_max_lifetime":           c.SNIMaxLifetime,
+		"sni_max_connections":        c.SNIMaxConns,
+		"sni_max_connections_per_ip": c.SNIMaxConnsPerIP,
+		"sni_drain_timeout":          c.SNIDrainTimeout,
+	} {
+		if v < 0 {
+			return fmt.Errorf("%s cannot be negative", name)
+		}
+	}
+	for i, l := range c.SNIRateLimits {
+		if l.Rate <= 0 || l.Burst < 0 {
+			return fmt.Errorf("sni_rate_limits[%d]: bytes_per_second must be positive and burst_bytes not negative", i)
+		}
+		if _, ok := c.Plans[l.Plan]; l.Plan != "" && !ok {
+			return fmt.Errorf("sni_rate_limits[%d]: unknown plan: %s", i, l.Plan)
+		}
+	}
+	for name, pool := range c.SourcePools {
+		if len(pool.Addrs) == 0 {
+			return fmt.Errorf("source pool %s: addrs cannot be empty", name)
+		}
+		for _, a := range pool.Addrs {
+			if _, err := ParseSourceAddr(a); err != nil {
+				return fmt.Errorf("source pool %s: %w", name, err)
+			}
+		}
+	}
+	for i := range c.SNIRoutes {
+		if err := c.SNIRoutes[i].validate(); err != nil {
+			return fmt.Errorf("sni_routes[%d]: %w", i, err)
+		}
+		if err := c.ValidateSourcePool(c.SNIRoutes[i].Source); err != nil {
+			return fmt.Errorf("sni_routes[%d]: %w", i, err)
+		}
+	}
+	if c.DomainAliasMode != "" && c.DomainAliasMode != AliasModeFlatten && c.DomainAliasMode != AliasModeCNAME {
+		return fmt.Errorf("invalid domain_alias_mode: %s", c.DomainAliasMode)
+	}
+	if c.SNIECHPolicy != "" && c.SNIECHPolicy != ECHPolicyOuter && c.SNIECHPolicy != ECHPolicyBlock {
+		return fmt.Errorf("invalid sni_ech_policy: %s", c.SNIECHPolicy)
+	}
+	if c.DNSStripECH != "" && c.DNSStripECH != ECHStripProxied && c.DNSStripECH != ECHStripAll {
+		return fmt.Errorf("invalid dns_strip_ech: %s", c.DNSStripECH)
+	}
+	if c.DNSStripECH != "" && len(c.DNSPlugins) > 0 {
+		// An explicit chain written before the ech plugin existed would
+		// silently leave answers untouched
+		hasECH := false
+		for _, name := range c.DNSPlugins {
+			hasECH = hasECH || name == "ech"
+		}
+		if !hasECH {
+			return errors.New("dns_strip_ech needs the ech plugin in dns_plugins")
+		}
+	}
+	for _, u := range c.UpstreamDOH {
+		if err := ValidateUpstream(u); err != nil {
+			return err
+		}
+	}
+	if _, err := egress.ParseChain(c.UpstreamDoHEgress); err != nil {
+		return fmt.Errorf("upstream_doh_egress: %w", err)
+	}
+	for _, hint := range c.RecursiveRootHints {
+		if net.ParseIP(hint) == nil {
+			return fmt.Errorf("invalid recursive root hint: %s", hint)
+		}
+	}
+	if v4, v6 := c.ECSPrefixes(); v4 < 0 || v4 > 32 {
+		return fmt.Errorf("invalid ecs_prefix_v4: %d", v4)
+	} else if v6 < 0 || v6 > 128 {
+		return fmt.Errorf("invalid ecs_prefix_v6: %d", v6)
+	}
+	validLevels := map[string]bool{"debug": true, "info": true, "warn": true, "error": true}
+	if !validLevels[c.LogLevel] {
+		return fmt.Errorf("invalid log level: %s", c.LogLevel)
+	}
+	return nil
+}
+
+// ValidateDomainTarget accepts a literal IP or a hostname as a Domains value.
+func ValidateDomainTarget(target string) error {
+	if net.ParseIP(target) != nil {
+		return nil
+	}
+	if _, ok := dns.IsDomainName(target); !ok || target == "" || target[0] == '*' {
+		return fmt.Errorf("not an IP address or hostname: %s", target)
+	}
+	return nil
+}
+
+// ValidateUpstream accepts a DoH URL or RecursiveUpstream.
+func ValidateUpstream(u string) error {
+	if u == RecursiveUpstream {
+		return nil
+	}
+	if !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+		return fmt.Errorf("invalid upstream %q: must be a DoH URL or %q", u, RecursiveUpstream)
+	}
+	return nil
+}
+
+func (c *Config) validateDomainSets() error {
+	for name, set := range c.DomainSets {
+		if name == "" {
+			return errors.New("domain set name cannot be empty")
+		}
+		for pattern, target := range set.Domains {
+			if err := ValidateDomainTarget(target); err != nil {
+				return fmt.Errorf("invalid target for domain %s in set %s: %w", pattern, name, err)
+			}
+		}
+	}
+	for plan, sets := range c.Plans {
+		for _, name := range sets {
+			if _, ok := c.DomainSets[name]; !ok {
+				return fmt.Errorf("plan %s uses unknown domain set %s", plan, name)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateUserSets checks that plan (if any) and sets are defined.
+func (c *Config) ValidateUserSets(plan string, sets []string) error {
+	if _, ok := c.Plans[plan]; plan != "" && !ok {
+		return fmt.Errorf("unknown plan: %s", plan)
+	}
+	for _, name := range sets {
+		if _, ok := c.DomainSets[name]; !ok {
+			return fmt.Errorf("unknown domain set: %s", name)
+		}
+	}
+	return nil
+}
+
+// ======================== Store ========================
+
+// Store holds the live configuration and lets readers pick up reloads
+// without locking.
+type Store struct {
+	v atomic.Value // *Config
+}
+
+// NewStore returns a Store holding c.
+func NewStore(c *Config) *Store {
+	s := &Store{}
+	s.Set(c)
+	return s
+}
+
+// Get returns the current configuration. It must not be modified.
+func (s *Store) Get() *Config {
+	c, _ := s.v.Load().(*Config)
+	return c
+}
+
+// Set replaces the current configuration.
+func (s *Store) Set(c *Config) {
+	s.v.Store(c)
+}
+
+// ======================== Domain Matching ========================
+
+// Matches reports whether host matches pattern, which is either an exact
+// name or a wildcard like "*.example.com".
+func Matches(host, pattern string) bool {
+	h := strings.ToLower(strings.TrimSuffix(host, "."))
+	p := strings.ToLower(strings.TrimSuffix(pattern, "."))
+	if p == "" {
+		return false
+	}
+	if strings.HasPrefix(p, "*.") {
+		suf := p[1:] // ".example.com"
+		// require suffix match and at least as many labels as the pattern
+		return strings.HasSuffix(h, suf) && strings.Count(h, ".") >= strings.Count(p, ".")
+	}
+	return h == p
+}
+
+// FindValueByPattern returns the value of the first pattern in m matching host.
+func FindValueByPattern(m map[string]string, host string) (string, bool) {
+	for k, v := range m {
+		if Matches(host, k) {
+			return v, true
+		}
+	}
+	return "", false
+}
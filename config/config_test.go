@@ -0,0 +1,265 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateDomainTarget(t *testing.T) {
+	for _, ok := range []string{"1.2.3.4", "2001:db8::1", "edge.ourcdn.net", "edge.ourcdn.net."} {
+		if err := ValidateDomainTarget(ok); err != nil {
+			t.Errorf("%q rejected: %v", ok, err)
+		}
+	}
+	for _, bad := range []string{"", "*.ourcdn.net", "bad..name"} {
+		if ValidateDomainTarget(bad) == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestValidateRejectsUnknownDomainSet(t *testing.T) {
+	cfg := &Config{
+		DomainSets: map[string]DomainSet{"youtube": {Domains: map[string]string{"*.youtube.com": "10.0.0.2"}}},
+		Plans:      map[string][]string{"broken": {"missing"}},
+	}
+	if cfg.Validate() == nil {
+		t.Fatal("plan referencing an unknown set accepted")
+	}
+	if cfg.ValidateUserSets("", []string{"youtube"}) != nil {
+		t.Fatal("known set rejected")
+	}
+	if cfg.ValidateUserSets("gold", nil) == nil {
+		t.Fatal("unknown plan accepted")
+	}
+}
+
+func TestLoadAppliesDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"host":"example.com","domains":{"*.youtube.com":"10.0.0.1"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CacheTTL == 0 || len(cfg.UpstreamDOH) == 0 {
+		t.Fatalf("defaults not applied: %+v", cfg)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"domains":{"x.test":"*.bad"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Fatal("invalid domain target accepted")
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		host, pattern string
+		want          bool
+		desc          string
+	}{
+		{"example.com", "example.com", true, "exact match"},
+		{"Example.COM", "example.com", true, "case is ignored"},
+		{"example.com", "*.example.com", false, "wildcard does not match the bare domain"},
+		{"www.example.com", "*.example.com", true, "wildcard matches one label"},
+		{"cdn.api.example.com", "*.example.com", true, "wildcard matches several labels"},
+		{"notexample.com", "*.example.com", false, "suffix must start at a label"},
+		{"example.com.", "example.com", true, "trailing dot on the host"},
+		{"www.example.com.", "*.example.com.", true, "trailing dot on both"},
+		{"example.com", "", false, "empty pattern"},
+	}
+	for _, tt := range tests {
+		if got := Matches(tt.host, tt.pattern); got != tt.want {
+			t.Errorf("%s: Matches(%q, %q) = %v, want %v", tt.desc, tt.host, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestFindValueByPattern(t *testing.T) {
+	m := map[string]string{"*.youtube.com": "10.0.0.1", "netflix.com": "10.0.0.2"}
+	if v, ok := FindValueByPattern(m, "www.youtube.com."); !ok || v != "10.0.0.1" {
+		t.Errorf("wildcard lookup: got %q, %v", v, ok)
+	}
+	if _, ok := FindValueByPattern(m, "www.netflix.com"); ok {
+		t.Error("exact pattern matched a subdomain")
+	}
+}
+
+func TestSNIRoutes(t *testing.T) {
+	withRoutes := func(routes ...SNIRoute) *Config {
+		return &Config{Host: "example.com", Domains: map[string]string{"*.youtube.com": "10.0.0.1"}, LogLevel: "info", SNIRoutes: routes}
+	}
+	for _, bad := range []SNIRoute{
+		{Backend: "127.0.0.1:443"},
+		{SNI: "*.example.com"},
+		{SNI: "*.example.com", Backend: "127.0.0.1:443", Block: true},
+		{SNI: "*.example.com", Backend: "no-port"},
+		{SNI: "*.example.com", Backends: []SNIBackend{{Address: "unix:"}}},
+		{SNI: "*.example.com", Backends: []SNIBackend{{Address: "10.0.0.1:443", Weight: -1}}},
+		{SNI: "*.example.com", Backend: "10.0.0.1:443", Policy: "fastest"},
+		{SNI: "*.example.com", Egress: []string{"socks5://proxy"}},
+		{SNI: "*.example.com", Backend: "unix:/run/edge.sock", Egress: []string{"socks5://proxy:1080"}},
+		{SNI: "*.example.com", Block: true, Egress: []string{"socks5://proxy:1080"}},
+	} {
+		if withRoutes(bad).Validate() == nil {
+			t.Errorf("route %+v accepted", bad)
+		}
+	}
+
+	r := SNIRoute{SNI: "*.example.com", ALPN: []string{"h2"}, Backend: "127.0.0.1:8443"}
+	if err := withRoutes(r).Validate(); err != nil {
+		t.Fatalf("valid route rejected: %v", err)
+	}
+	if !r.Matches("www.example.com", []string{"http/1.1", "h2"}) {
+		t.Error("h2 client not matched")
+	}
+	if r.Matches("www.example.com", []string{"http/1.1"}) || r.Matches("www.example.com", nil) {
+		t.Error("client without h2 matched")
+	}
+	if r.Matches("example.org", []string{"h2"}) {
+		t.Error("other name matched")
+	}
+	if any := (SNIRoute{SNI: "*"}); !any.Matches("anything.test", nil) {
+		t.Error(`"*" did not match`)
+	}
+
+	lb := SNIRoute{SNI: "*", Policy: SNIPolicyHash, Backend: "10.0.0.1:443", Backends: []SNIBackend{{Address: "unix:/run/edge.sock", Weight: 2}}}
+	if err := withRoutes(lb).Validate(); err != nil {
+		t.Fatalf("backend list rejected: %v", err)
+	}
+	if targets := lb.Targets(); len(targets) != 2 || targets[0].Address != "10.0.0.1:443" {
+		t.Errorf("targets = %v", targets)
+	}
+	if err := withRoutes(SNIRoute{SNI: "*.blocked.example", Egress: []string{"socks5://u:p@proxy:1080"}}).Validate(); err != nil {
+		t.Errorf("egress-only route rejected: %v", err)
+	}
+	if network, addr, _ := BackendNetwork("unix:/run/edge.sock"); network != "unix" || addr != "/run/edge.sock" {
+		t.Errorf("unix backend parsed as %s %s", network, addr)
+	}
+}
+
+func TestSourcePools(t *testing.T) {
+	base := func() *Config {
+		return &Config{Host: "example.com", Domains: map[string]string{"*.youtube.com": "10.0.0.1"}, LogLevel: "info",
+			SourcePools: map[string]AddrPool{"v6": {Addrs: []string{"2001:db8:1:2::/64", "203.0.113.4"}, Sticky: true}},
+			SNIRoutes:   []SNIRoute{{SNI: "*", Backend: "10.0.0.5:443", Source: "v6"}},
+		}
+	}
+	if err := base().Validate(); err != nil {
+		t.Fatalf("valid pools rejected: %v", err)
+	}
+
+	unknown := base()
+	unknown.SNIRoutes[0].Source = "missing"
+	empty := base()
+	empty.SourcePools["empty"] = AddrPool{}
+	bad := base()
+	bad.SourcePools["bad"] = AddrPool{Addrs: []string{"2001:db8::/129"}}
+	for name, cfg := range map[string]*Config{"unknown": unknown, "empty": empty, "bad": bad} {
+		if cfg.Validate() == nil {
+			t.Errorf("%s pool accepted", name)
+		}
+	}
+
+	if p, err := ParseSourceAddr("2001:db8:1:2:3::/64"); err != nil || p.String() != "2001:db8:1:2::/64" {
+		t.Errorf("prefix parsed as %s, %v", p, err)
+	}
+	if p, err := ParseSourceAddr("::ffff:192.0.2.1"); err != nil || p.String() != "192.0.2.1/32" {
+		t.Errorf("mapped address parsed as %s, %v", p, err)
+	}
+}
+
+func TestSNILimitsValidation(t *testing.T) {
+	for _, set := range []func(*Config){
+		func(c *Config) { c.SNIIdleTimeout = -1 },
+		func(c *Config) { c.SNIMaxLifetime = -1 },
+		func(c *Config) { c.SNIMaxConns = -1 },
+		func(c *Config) { c.SNIMaxConnsPerIP = -1 },
+		func(c *Config) { c.SNIDrainTimeout = -1 },
+	} {
+		cfg := &Config{Host: "example.com", Domains: map[string]string{"*.youtube.com": "10.0.0.1"}, LogLevel: "info"}
+		set(cfg)
+		if cfg.Validate() == nil {
+			t.Errorf("negative limit accepted: %+v", cfg)
+		}
+	}
+}
+
+func TestSNIRateLimits(t *testing.T) {
+	l := SNIRateLimit{SNI: "*.video.test", Plan: "basic", Rate: 1000}
+	if !l.Matches("a.video.test", "u1", "basic") || l.Matches("a.video.test", "u1", "") || l.Matches("other.test", "u1", "basic") {
+		t.Error("rule matching")
+	}
+	if l.BurstBytes() != 1000 {
+		t.Errorf("default burst = %d", l.BurstBytes())
+	}
+
+	cfg := &Config{Host: "example.com", Domains: map[string]string{"*.youtube.com": "10.0.0.1"}, LogLevel: "info",
+		Plans: map[string][]string{"basic": nil}, SNIRateLimits: []SNIRateLimit{l}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("valid limit rejected: %v", err)
+	}
+	for _, bad := range []SNIRateLimit{{Rate: 0}, {Rate: 10, Burst: -1}, {Plan: "gold", Rate: 10}} {
+		cfg.SNIRateLimits = []SNIRateLimit{bad}
+		if cfg.Validate() == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+}
+
+func TestECSPrefixes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	for _, tc := range []struct {
+		json   string
+		v4, v6 int
+	}{
+		{`{"host":"example.com","domains":{"x.test":"10.0.0.1"}}`, DefaultECSPrefixV4, DefaultECSPrefixV6},
+		{`{"host":"example.com","domains":{"x.test":"10.0.0.1"},"ecs_prefix_v4":0,"ecs_prefix_v6":48}`, 0, 48},
+	} {
+		if err := os.WriteFile(path, []byte(tc.json), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v4, v6 := cfg.ECSPrefixes(); v4 != tc.v4 || v6 != tc.v6 {
+			t.Errorf("%s: got /%d and /%d, want /%d and /%d", tc.json, v4, v6, tc.v4, tc.v6)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(`{"host":"example.com","domains":{"x.test":"10.0.0.1"},"ecs_prefix_v4":33}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("ecs_prefix_v4 of 33 accepted")
+	}
+}
+
+func TestECHOptionsValidation(t *testing.T) {
+	cfg := &Config{Host: "example.com", Domains: map[string]string{"*.youtube.com": "10.0.0.1"}, LogLevel: "info",
+		SNIECHPolicy: ECHPolicyBlock, DNSStripECH: ECHStripProxied}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("valid ECH options rejected: %v", err)
+	}
+	cfg.SNIECHPolicy = "inner"
+	if cfg.Validate() == nil {
+		t.Error("unknown sni_ech_policy accepted")
+	}
+	cfg.SNIECHPolicy, cfg.DNSStripECH = "", "some"
+	if cfg.Validate() == nil {
+		t.Error("unknown dns_strip_ech accepted")
+	}
+	cfg.DNSStripECH, cfg.DNSPlugins = ECHStripAll, []string{"blocklist", "cache"}
+	if cfg.Validate() == nil {
+		t.Error("dns_strip_ech accepted with a dns_plugins chain lacking ech")
+	}
+	cfg.DNSPlugins = []string{"blocklist", "ech", "cache"}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("dns_strip_ech with ech in dns_plugins rejected: %v", err)
+	}
+}
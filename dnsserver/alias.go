@@ -0,0 +1,95 @@
+package dnsserver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/miekg/dns"
+
+	"smartSNI/config"
+)
+
+// ======================== Alias Rewrites ========================
+
+// resolveUpstream looks up target through the upstream path. Local Domains
+// rules are deliberately skipped so rules cannot point at each other and
+// loop, and so the SNI proxy never dials an address we hand out ourselves.
+// With dnssec_validate on, bogus answers are refused with an error.
+func (s *Server) resolveUpstream(ctx context.Context, req *dns.Msg, target string, qtype uint16) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(target, qtype)
+	q.RecursionDesired = true
+	if opt := req.IsEdns0(); opt != nil {
+		q.SetEdns0(opt.UDPSize(), false)
+	}
+	sec := s.prepareDNSSEC(q)
+	packed, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	out, err := s.forwardQuery(ctx, packed, trimDot(target))
+	if err != nil {
+		return nil, err
+	}
+	var resp dns.Msg
+	if err := resp.Unpack(out); err != nil {
+		return nil, fmt.Errorf("invalid upstream response: %w", err)
+	}
+	if !s.finishDNSSEC(&resp, sec) {
+		return nil, fmt.Errorf("%s %s: DNSSEC validation failed", trimDot(target), dns.TypeToString[qtype])
+	}
+	return &resp, nil
+}
+
+// buildAliasResponse answers req for a Domains rule whose value is a
+// hostname, either as a CNAME chain or flattened into A/AAAA records owned
+// by the queried name.
+func (s *Server) buildAliasResponse(ctx context.Context, req *dns.Msg, target, mode string) ([]byte, error) {
+	q := req.Question[0]
+	target = dns.Fqdn(target)
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	resp.Compress = true
+
+	if mode == config.AliasModeCNAME {
+		resp.Answer = append(resp.Answer, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: defaultTTL},
+			Target: target,
+		})
+		if q.Qtype == dns.TypeCNAME {
+			return resp.Pack()
+		}
+		// The chain is still useful to the client if the target lookup fails
+		up, err := s.resolveUpstream(ctx, req, target, q.Qtype)
+		if err != nil {
+			s.logger.Warn("alias target lookup failed", "domain", q.Name, "target", target, "error", err)
+			return resp.Pack()
+		}
+		resp.Rcode = up.Rcode
+		resp.Answer = append(resp.Answer, up.Answer...)
+		return resp.Pack()
+	}
+
+	// A name with a CNAME has no other records, so flattening only makes
+	// sense for addresses; everything else is NODATA like plain IP rules
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return resp.Pack()
+	}
+	up, err := s.resolveUpstream(ctx, req, target, q.Qtype)
+	if err != nil {
+		s.metrics.IncErrors()
+		return nil, err
+	}
+	resp.Rcode = up.Rcode
+	for _, rr := range up.Answer {
+		if rr.Header().Rrtype != q.Qtype {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		resp.Answer = append(resp.Answer, rr)
+	}
+	return resp.Pack()
+}
@@ -0,0 +1,99 @@
+package dnsserver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"smartSNI/config"
+)
+
+// staticUpstream answers every query from a fixed set of records.
+type staticUpstream struct {
+	records []dns.RR
+	queries []string
+}
+
+func (u *staticUpstream) Name() string { return "static" }
+
+func (u *staticUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var req dns.Msg
+	if err := req.Unpack(query); err != nil {
+		return nil, err
+	}
+	q := req.Question[0]
+	u.queries = append(u.queries, q.Name)
+	resp := new(dns.Msg)
+	resp.SetReply(&req)
+	for _, rr := range u.records {
+		if dns.CanonicalName(rr.Header().Name) == dns.CanonicalName(q.Name) {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	return resp.Pack()
+}
+
+// useStaticUpstream makes u the only upstream of s.
+func useStaticUpstream(s *Server, records ...dns.RR) *staticUpstream {
+	u := &staticUpstream{records: records}
+	s.upstreams.Store([]Upstream{u})
+	return u
+}
+
+func aliasQuery(t *testing.T, s *Server, name string, qtype uint16, mode string) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	out, err := s.buildAliasResponse(context.Background(), req, "edge.ourcdn.net", mode)
+	if err != nil {
+		t.Fatalf("buildAliasResponse: %v", err)
+	}
+	var resp dns.Msg
+	if err := resp.Unpack(out); err != nil {
+		t.Fatal(err)
+	}
+	return &resp
+}
+
+func TestAliasFlatten(t *testing.T) {
+	s := newTestServer(t, &config.Config{})
+	up := useStaticUpstream(s,
+		mustRR(t, "edge.ourcdn.net. 60 IN A 198.51.100.7"),
+		mustRR(t, "edge.ourcdn.net. 60 IN A 198.51.100.8"),
+	)
+
+	resp := aliasQuery(t, s, "r1.googlevideo.com.", dns.TypeA, config.AliasModeFlatten)
+	if len(resp.Answer) != 2 {
+		t.Fatalf("want 2 flattened addresses, got %v", resp.Answer)
+	}
+	for _, rr := range resp.Answer {
+		if rr.Header().Name != "r1.googlevideo.com." || rr.Header().Rrtype != dns.TypeA {
+			t.Fatalf("record not flattened onto the queried name: %s", rr)
+		}
+	}
+	if len(up.queries) != 1 || up.queries[0] != "edge.ourcdn.net." {
+		t.Fatalf("upstream saw %v, want the alias target", up.queries)
+	}
+
+	if resp := aliasQuery(t, s, "r1.googlevideo.com.", dns.TypeMX, config.AliasModeFlatten); len(resp.Answer) != 0 || resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("non-address query should be NODATA, got %s", resp)
+	}
+}
+
+func TestAliasCNAMEChain(t *testing.T) {
+	s := newTestServer(t, &config.Config{})
+	useStaticUpstream(s, mustRR(t, "edge.ourcdn.net. 60 IN A 198.51.100.7"))
+
+	resp := aliasQuery(t, s, "r1.googlevideo.com.", dns.TypeA, config.AliasModeCNAME)
+	if len(resp.Answer) != 2 {
+		t.Fatalf("want CNAME plus target address, got %v", resp.Answer)
+	}
+	cname, ok := resp.Answer[0].(*dns.CNAME)
+	if !ok || cname.Hdr.Name != "r1.googlevideo.com." || cname.Target != "edge.ourcdn.net." {
+		t.Fatalf("first answer should be the alias CNAME, got %s", resp.Answer[0])
+	}
+	if resp.Answer[1].Header().Name != "edge.ourcdn.net." {
+		t.Fatalf("target record should keep its own name, got %s", resp.Answer[1])
+	}
+}
@@ -0,0 +1,133 @@
+package dnsserver
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// ======================== Standard DNS Server (Port 53) ========================
+
+// ListenAndServeDNS serves plain DNS on UDP and TCP port 53 until ctx is
+// cancelled. If the port is unavailable the server is disabled and nil is
+// returned.
+func (s *Server) ListenAndServeDNS(ctx context.Context) error {
+	udpSrv, tcpListener, err := s.listenDNS(":53")
+	if err != nil {
+		s.logger.Error("DNS: failed to listen on port 53", "error", err)
+		s.logger.Warn("DNS: standard DNS server disabled (port 53 unavailable)")
+		return nil
+	}
+
+	s.logger.Info("DNS server started", "port", 53, "protocols", "UDP/TCP",
+		"udp_sockets", len(udpSrv.conns), "udp_workers", udpSrv.workers)
+	s.serveDNS(ctx, udpSrv, tcpListener)
+	return nil
+}
+
+// listenDNS binds the UDP sockets to addr and a TCP listener to the same
+// port, so ":0" yields one ephemeral port for both.
+func (s *Server) listenDNS(addr string) (*udpServer, *net.TCPListener, error) {
+	cfg := s.config()
+
+	udpSrv, err := newUDPServer(addr, cfg.DNSUDPSockets, cfg.DNSUDPWorkers, cfg.DNSUDPQueueSize, s.handleDNSUDP)
+	if err != nil {
+		return nil, nil, fmt.Errorf("UDP: %w", err)
+	}
+	udpSrv.logger, udpSrv.metrics = s.logger, s.metrics
+
+	udpAddr := udpSrv.LocalAddr().(*net.UDPAddr)
+	tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: udpAddr.IP, Port: udpAddr.Port, Zone: udpAddr.Zone})
+	if err != nil {
+		udpSrv.close()
+		return nil, nil, fmt.Errorf("TCP: %w", err)
+	}
+	return udpSrv, tcpListener, nil
+}
+
+// serveDNS answers queries on udpSrv and tcpListener until ctx is cancelled.
+func (s *Server) serveDNS(ctx context.Context, udpSrv *udpServer, tcpListener *net.TCPListener) {
+	defer tcpListener.Close()
+
+	// Handle shutdown
+	go func() {
+		<-ctx.Done()
+		s.logger.Info("DNS server shutting down")
+		tcpListener.Close()
+	}()
+
+	// Start TCP handler in goroutine
+	go func() {
+		for {
+			conn, err := tcpListener.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				s.logger.Warn("DNS TCP accept error", "error", err)
+				continue
+			}
+			go s.handleDNSTCP(conn)
+		}
+	}()
+
+	// Handle UDP requests until shutdown
+	udpSrv.Serve(ctx)
+}
+
+func (s *Server) handleDNSUDP(conn *net.UDPConn, addr *net.UDPAddr, query []byte) {
+	clientIP, _, _ := net.SplitHostPort(addr.String())
+
+	// Check user-based authorization
+	if !s.userAuthorized(clientIP) {
+		s.logger.Warn("DNS UDP user not authorized", "client", clientIP)
+		s.metrics.IncErrors()
+		return
+	}
+
+	response, err := s.Query(context.Background(), ProtoUDP, clientIP, "", query)
+	if err != nil {
+		s.logger.Debug("DNS UDP query failed", "error", err, "client", addr.String())
+		return
+	}
+	_, _ = conn.WriteToUDP(response, addr)
+}
+
+func (s *Server) handleDNSTCP(conn net.Conn) {
+	defer conn.Close()
+
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	// Check user-based authorization
+	if !s.userAuthorized(clientIP) {
+		s.logger.Warn("DNS TCP user not authorized", "client", clientIP)
+		s.metrics.IncErrors()
+		return
+	}
+
+	// Read DNS message length (2 bytes)
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+		return
+	}
+	msgLen := binary.BigEndian.Uint16(lenBuf)
+
+	// Read DNS query
+	query := make([]byte, msgLen)
+	if _, err := io.ReadFull(conn, query); err != nil {
+		return
+	}
+
+	response, err := s.Query(context.Background(), ProtoTCP, clientIP, "", query)
+	if err != nil {
+		return
+	}
+
+	// Write response length + response
+	respLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(respLen, uint16(len(response)))
+	conn.Write(respLen)
+	conn.Write(response)
+}
@@ -0,0 +1,173 @@
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"runtime"
+	"runtime/debug"
+	"sync"
+
+	"smartSNI/metrics"
+)
+
+// ======================== UDP DNS Server ========================
+
+// udpPacketSize is large enough for EDNS0 queries; anything bigger is
+// truncated by the kernel and will fail to unpack.
+const udpPacketSize = 4096
+
+// Default pool sizes. A worker is busy for a whole upstream round trip (up
+// to dnsQueryTimeout, longer when resolving recursively), so the pool is
+// sized for blocking I/O rather than for CPUs.
+const (
+	udpMinWorkers     = 512
+	udpWorkersPerCPU  = 64
+	udpQueuePerWorker = 4
+)
+
+// udpPacketPool hands out per-packet read buffers. A buffer is owned by
+// exactly one packet from ReadFromUDP until its worker has written the reply.
+var udpPacketPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, udpPacketSize)
+		return &b
+	},
+}
+
+type udpPacket struct {
+	conn *net.UDPConn
+	addr *net.UDPAddr
+	buf  *[]byte
+	n    int
+}
+
+type udpHandlerFunc func(conn *net.UDPConn, addr *net.UDPAddr, query []byte)
+
+// udpServer reads DNS queries from one or more SO_REUSEPORT sockets and
+// hands them to a fixed pool of workers over a bounded queue. When the queue
+// is full the readers block, leaving excess load to the kernel socket buffer
+// instead of piling up goroutines.
+type udpServer struct {
+	conns   []*net.UDPConn
+	queue   chan udpPacket
+	workers int
+	handler udpHandlerFunc
+	logger  *slog.Logger
+	metrics *metrics.Metrics
+}
+
+// newUDPServer binds the given number of sockets to addr. Zero values pick
+// defaults: one socket per CPU (where SO_REUSEPORT is available), 64 workers
+// per CPU but at least 512, and a queue of 4 packets per worker.
+func newUDPServer(addr string, sockets, workers, queueSize int, handler udpHandlerFunc) (*udpServer, error) {
+	if sockets <= 0 {
+		sockets = runtime.GOMAXPROCS(0)
+	}
+	if !reusePortSupported {
+		sockets = 1
+	}
+	if workers <= 0 {
+		workers = max(udpMinWorkers, runtime.GOMAXPROCS(0)*udpWorkersPerCPU)
+	}
+	if queueSize <= 0 {
+		queueSize = workers * udpQueuePerWorker
+	}
+
+	lc := net.ListenConfig{}
+	if sockets > 1 {
+		lc.Control = reusePortControl
+	}
+
+	s := &udpServer{
+		queue:   make(chan udpPacket, queueSize),
+		workers: workers,
+		handler: handler,
+		logger:  slog.Default(),
+		metrics: metrics.New(),
+	}
+
+	for i := 0; i < sockets; i++ {
+		bindAddr := addr
+		if i > 0 {
+			// Ephemeral ports must be shared by every socket in the group
+			bindAddr = s.conns[0].LocalAddr().String()
+		}
+		pc, err := lc.ListenPacket(context.Background(), "udp", bindAddr)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		s.conns = append(s.conns, pc.(*net.UDPConn))
+	}
+
+	return s, nil
+}
+
+// LocalAddr returns the address shared by all sockets.
+func (s *udpServer) LocalAddr() net.Addr {
+	return s.conns[0].LocalAddr()
+}
+
+func (s *udpServer) close() {
+	for _, c := range s.conns {
+		_ = c.Close()
+	}
+}
+
+// Serve runs readers and workers until ctx is cancelled, then closes the
+// sockets and waits for queued packets to be answered.
+func (s *udpServer) Serve(ctx context.Context) {
+	var workers sync.WaitGroup
+	workers.Add(s.workers)
+	for i := 0; i < s.workers; i++ {
+		go func() {
+			defer workers.Done()
+			for p := range s.queue {
+				s.handle(p)
+			}
+		}()
+	}
+
+	var readers sync.WaitGroup
+	readers.Add(len(s.conns))
+	for _, c := range s.conns {
+		go func(c *net.UDPConn) {
+			defer readers.Done()
+			s.readLoop(ctx, c)
+		}(c)
+	}
+
+	<-ctx.Done()
+	s.close()
+	readers.Wait()
+	close(s.queue)
+	workers.Wait()
+}
+
+func (s *udpServer) readLoop(ctx context.Context, conn *net.UDPConn) {
+	for {
+		buf := udpPacketPool.Get().(*[]byte)
+		n, addr, err := conn.ReadFromUDP(*buf)
+		if err != nil {
+			udpPacketPool.Put(buf)
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		s.queue <- udpPacket{conn: conn, addr: addr, buf: buf, n: n}
+	}
+}
+
+func (s *udpServer) handle(p udpPacket) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Error("panic in DNS UDP handler", "error", r, "stack", string(debug.Stack()))
+			s.metrics.IncErrors()
+		}
+		udpPacketPool.Put(p.buf)
+	}()
+	s.handler(p.conn, p.addr, (*p.buf)[:p.n])
+}
@@ -0,0 +1,210 @@
+package dnsserver
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// echoQuestionHandler answers every query with an empty reply carrying the
+// same ID and question, which is enough to detect packets that were mixed up.
+func echoQuestionHandler(conn *net.UDPConn, addr *net.UDPAddr, query []byte) {
+	var req dns.Msg
+	if err := req.Unpack(query); err != nil {
+		return
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(&req)
+	out, err := resp.Pack()
+	if err != nil {
+		return
+	}
+	_, _ = conn.WriteToUDP(out, addr)
+}
+
+func startTestUDPServer(tb testing.TB, handler udpHandlerFunc) string {
+	tb.Helper()
+	srv, err := newUDPServer("127.0.0.1:0", 0, 0, 0, handler)
+	if err != nil {
+		tb.Fatalf("newUDPServer: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		srv.Serve(ctx)
+		close(done)
+	}()
+	tb.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return srv.LocalAddr().String()
+}
+
+// startLegacyUDPServer mimics the previous goroutine-per-packet loop, with
+// the copy that was missing so that it returns correct answers.
+func startLegacyUDPServer(tb testing.TB, handler udpHandlerFunc) string {
+	tb.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatalf("ListenUDP: %v", err)
+	}
+	go func() {
+		buf := make([]byte, udpPacketSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			query := append([]byte(nil), buf[:n]...)
+			go handler(conn, addr, query)
+		}
+	}()
+	tb.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String()
+}
+
+func packTestQuery(tb testing.TB, name string, id uint16) []byte {
+	tb.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	m.Id = id
+	out, err := m.Pack()
+	if err != nil {
+		tb.Fatalf("pack: %v", err)
+	}
+	return out
+}
+
+func TestUDPServerConcurrentQueriesKeepTheirOwnBuffers(t *testing.T) {
+	addr := startTestUDPServer(t, func(conn *net.UDPConn, raddr *net.UDPAddr, query []byte) {
+		// Give the reader time to receive more packets while this one is in flight
+		time.Sleep(5 * time.Millisecond)
+		echoQuestionHandler(conn, raddr, query)
+	})
+
+	const clients = 32
+	var wg sync.WaitGroup
+	errs := make(chan string, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := net.Dial("udp", addr)
+			if err != nil {
+				errs <- err.Error()
+				return
+			}
+			defer c.Close()
+			name := dns.Fqdn(string(rune('a'+i%26)) + "-client.example.com")
+			query := packTestQuery(t, name, uint16(i+1))
+			_ = c.SetDeadline(time.Now().Add(2 * time.Second))
+			if _, err := c.Write(query); err != nil {
+				errs <- err.Error()
+				return
+			}
+			buf := make([]byte, udpPacketSize)
+			n, err := c.Read(buf)
+			if err != nil {
+				errs <- err.Error()
+				return
+			}
+			var resp dns.Msg
+			if err := resp.Unpack(buf[:n]); err != nil {
+				errs <- err.Error()
+				return
+			}
+			if resp.Id != uint16(i+1) || resp.Question[0].Name != name {
+				errs <- "mismatched answer for " + name + ": got " + resp.Question[0].Name
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for e := range errs {
+		t.Error(e)
+	}
+}
+
+func TestUDPServerSlowUpstreams(t *testing.T) {
+	// Workers block for the whole upstream round trip, so the default pool
+	// must keep hundreds of slow queries in flight whatever the CPU count
+	addr := startTestUDPServer(t, func(conn *net.UDPConn, raddr *net.UDPAddr, query []byte) {
+		time.Sleep(500 * time.Millisecond)
+		echoQuestionHandler(conn, raddr, query)
+	})
+
+	const clients = 256
+	var wg sync.WaitGroup
+	var failed sync.Map
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := net.Dial("udp", addr)
+			if err != nil {
+				failed.Store(i, err)
+				return
+			}
+			defer c.Close()
+			_ = c.SetDeadline(time.Now().Add(1500 * time.Millisecond))
+			if _, err := c.Write(packTestQuery(t, "slow.example.com", uint16(i+1))); err != nil {
+				failed.Store(i, err)
+				return
+			}
+			if _, err := c.Read(make([]byte, udpPacketSize)); err != nil {
+				failed.Store(i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	failed.Range(func(k, v any) bool {
+		t.Errorf("query %v: %v", k, v)
+		return true
+	})
+}
+
+func benchmarkUDPServer(b *testing.B, addr string) {
+	query := packTestQuery(b, "bench.example.com", 1)
+	b.SetBytes(int64(len(query)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		c, err := net.Dial("udp", addr)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, udpPacketSize)
+		for pb.Next() {
+			_ = c.SetDeadline(time.Now().Add(time.Second))
+			if _, err := c.Write(query); err != nil {
+				b.Error(err)
+				return
+			}
+			n, err := c.Read(buf)
+			if err != nil {
+				// Dropped packets are part of what is being measured
+				continue
+			}
+			if n < 2 || !bytes.Equal(buf[:2], query[:2]) {
+				b.Error("response ID mismatch")
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkUDPServerGoroutinePerPacket(b *testing.B) {
+	benchmarkUDPServer(b, startLegacyUDPServer(b, echoQuestionHandler))
+}
+
+func BenchmarkUDPServerWorkerPool(b *testing.B) {
+	benchmarkUDPServer(b, startTestUDPServer(b, echoQuestionHandler))
+}
@@ -0,0 +1,946 @@
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"smartSNI/config"
+)
+
+// ======================== DNSSEC Validation ========================
+
+// defaultTrustAnchors are the IANA root KSKs (KSK-2017 and KSK-2024).
+var defaultTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// Validated keys and DS lookups are cached for at most this long
+const dnssecMaxCacheTTL = time.Hour
+
+// dnssecMaxCached bounds the key and DS caches each. DS lookups follow the
+// labels of client-chosen names, so random subdomains would otherwise grow
+// them without limit.
+const dnssecMaxCached = 10000
+
+// dnssecMaxDepth bounds the chain walk; no real chain is this deep.
+const dnssecMaxDepth = 32
+
+type dnssecStatus int
+
+const (
+	dnssecInsecure dnssecStatus = iota
+	dnssecSecure
+	dnssecBogus
+)
+
+// validationError is a bogus result together with the Extended DNS Error
+// (RFC 8914) code reported to the client.
+type validationError struct {
+	ede uint16
+	msg string
+}
+
+func (e *validationError) Error() string { return e.msg }
+
+func bogus(ede uint16, format string, args ...interface{}) error {
+	return &validationError{ede: ede, msg: fmt.Sprintf(format, args...)}
+}
+
+// errInsecure is returned while walking the chain of trust when an unsigned
+// delegation has been proven; everything below it is insecure, not bogus.
+var errInsecure = errors.New("provably insecure delegation")
+
+type dsState int
+
+const (
+	dsFound    dsState = iota // signed DS RRset exists
+	dsInsecure                // delegation proven to have no DS, or parent is insecure
+	dsNoCut                   // name is proven not to be a zone cut
+)
+
+type dsEntry struct {
+	ds      []*dns.DS
+	state   dsState
+	expires time.Time
+}
+
+type keyEntry struct {
+	keys     []*dns.DNSKEY
+	insecure bool
+	expires  time.Time
+}
+
+type dnssecValidator struct {
+	anchors  map[string][]*dns.DS // zone -> trusted DS records
+	exchange func(m *dns.Msg) (*dns.Msg, error)
+	now      func() time.Time
+
+	mu   sync.Mutex
+	keys map[string]*keyEntry // by zone
+	ds   map[string]*dsEntry  // by name
+}
+
+func (v *dnssecValidator) cachedKeys(zone string) *keyEntry {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if e := v.keys[zone]; e != nil && v.now().Before(e.expires) {
+		return e
+	}
+	return nil
+}
+
+func (v *dnssecValidator) storeKeys(zone string, e *keyEntry) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.keys == nil {
+		v.keys = make(map[string]*keyEntry)
+	}
+	if _, ok := v.keys[zone]; !ok && len(v.keys) >= dnssecMaxCached {
+		now := v.now()
+		evictCache(v.keys, dnssecMaxCached, func(e *keyEntry) bool { return !now.Before(e.expires) })
+	}
+	v.keys[zone] = e
+}
+
+func (v *dnssecValidator) cachedDS(name string) *dsEntry {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if e := v.ds[name]; e != nil && v.now().Before(e.expires) {
+		return e
+	}
+	return nil
+}
+
+func (v *dnssecValidator) storeDS(name string, ds []*dns.DS, state dsState, ttl uint32) {
+	e := &dsEntry{ds: ds, state: state, expires: v.cacheUntil(ttl)}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.ds == nil {
+		v.ds = make(map[string]*dsEntry)
+	}
+	if _, ok := v.ds[name]; !ok && len(v.ds) >= dnssecMaxCached {
+		now := v.now()
+		evictCache(v.ds, dnssecMaxCached, func(e *dsEntry) bool { return !now.Before(e.expires) })
+	}
+	v.ds[name] = e
+}
+
+func parseTrustAnchors(anchors []string) (map[string][]*dns.DS, error) {
+	if len(anchors) == 0 {
+		anchors = defaultTrustAnchors
+	}
+	out := make(map[string][]*dns.DS)
+	for _, a := range anchors {
+		rr, err := dns.NewRR(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchor %q: %w", a, err)
+		}
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			return nil, fmt.Errorf("trust anchor %q is not a DS record", a)
+		}
+		zone := dns.CanonicalName(ds.Hdr.Name)
+		out[zone] = append(out[zone], ds)
+	}
+	return out, nil
+}
+
+func newDNSSECValidator(anchors []string, exchange func(m *dns.Msg) (*dns.Msg, error)) (*dnssecValidator, error) {
+	parsed, err := parseTrustAnchors(anchors)
+	if err != nil {
+		return nil, err
+	}
+	return &dnssecValidator{anchors: parsed, exchange: exchange, now: time.Now}, nil
+}
+
+// newDNSSECValidator returns the validator for cfg, or nil when validation
+// is disabled. A fresh validator starts with no cached keys.
+func (s *Server) newDNSSECValidator(cfg *config.Config) (*dnssecValidator, error) {
+	if !cfg.DNSSECValidate {
+		return nil, nil
+	}
+	return newDNSSECValidator(cfg.DNSSECTrustAnchors, s.exchangeUpstream)
+}
+
+func (s *Server) getDNSSECValidator() *dnssecValidator {
+	v, _ := s.dnssec.Load().(*dnssecValidator)
+	return v
+}
+
+// exchangeUpstream sends m through the normal upstream path. Validation
+// lookups are shared across clients, so they are not tied to the deadline
+// of the query that triggered them.
+func (s *Server) exchangeUpstream(m *dns.Msg) (*dns.Msg, error) {
+	query, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.forwardQuery(context.Background(), query, trimDot(m.Question[0].Name))
+	if err != nil {
+		return nil, err
+	}
+	out := new(dns.Msg)
+	if err := out.Unpack(resp); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (v *dnssecValidator) query(name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(4096, true)
+	m.CheckingDisabled = true
+	resp, err := v.exchange(m)
+	if err != nil {
+		return nil, bogus(dns.ExtendedErrorCodeDNSSECIndeterminate, "fetching %s/%s: %v", name, dns.TypeToString[qtype], err)
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, bogus(dns.ExtendedErrorCodeDNSSECIndeterminate, "fetching %s/%s: rcode %s", name, dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+func (v *dnssecValidator) cacheUntil(ttl uint32) time.Time {
+	d := time.Duration(ttl) * time.Second
+	if d > dnssecMaxCacheTTL {
+		d = dnssecMaxCacheTTL
+	}
+	return v.now().Add(d)
+}
+
+// ---- RRset helpers ----
+
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+}
+
+type rrset struct {
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+// splitRRsets groups records into RRsets and attaches the RRSIGs covering
+// each one. Order of first appearance is preserved.
+func splitRRsets(rrs []dns.RR) ([]rrsetKey, map[rrsetKey]*rrset) {
+	var order []rrsetKey
+	sets := make(map[rrsetKey]*rrset)
+	get := func(k rrsetKey) *rrset {
+		s, ok := sets[k]
+		if !ok {
+			s = &rrset{}
+			sets[k] = s
+			order = append(order, k)
+		}
+		return s
+	}
+	for _, rr := range rrs {
+		h := rr.Header()
+		name := dns.CanonicalName(h.Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			s := get(rrsetKey{name, sig.TypeCovered})
+			s.sigs = append(s.sigs, sig)
+			continue
+		}
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		s := get(rrsetKey{name, h.Rrtype})
+		s.rrs = append(s.rrs, rr)
+	}
+	// Drop entries that only had signatures
+	kept := order[:0]
+	for _, k := range order {
+		if len(sets[k].rrs) > 0 {
+			kept = append(kept, k)
+		} else {
+			delete(sets, k)
+		}
+	}
+	return kept, sets
+}
+
+func minTTL(rrs []dns.RR) uint32 {
+	ttl := uint32(0)
+	for i, rr := range rrs {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
+
+func supportedDNSSECAlgorithm(alg uint8) bool {
+	switch alg {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+		dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	}
+	return false
+}
+
+// signerOf returns the signer shared by sigs that may legitimately sign
+// owner, i.e. the zone apex at or above it.
+func signerOf(owner string, sigs []*dns.RRSIG) string {
+	for _, sig := range sigs {
+		signer := dns.CanonicalName(sig.SignerName)
+		if dns.IsSubDomain(signer, owner) {
+			return signer
+		}
+	}
+	return ""
+}
+
+// verifyRRset checks that at least one signature over set made by one of
+// keys is cryptographically valid and inside its validity period.
+func (v *dnssecValidator) verifyRRset(set *rrset, keys []*dns.DNSKEY) error {
+	if len(set.sigs) == 0 {
+		return bogus(dns.ExtendedErrorCodeRRSIGsMissing, "no RRSIG for %s/%s", set.rrs[0].Header().Name, dns.TypeToString[set.rrs[0].Header().Rrtype])
+	}
+	now := v.now()
+	var lastErr error
+	for _, sig := range set.sigs {
+		for _, k := range keys {
+			if k.Algorithm != sig.Algorithm || k.KeyTag() != sig.KeyTag {
+				continue
+			}
+			if err := sig.Verify(k, set.rrs); err != nil {
+				lastErr = bogus(dns.ExtendedErrorCodeDNSBogus, "signature over %s/%s does not verify: %v", set.rrs[0].Header().Name, dns.TypeToString[sig.TypeCovered], err)
+				continue
+			}
+			if !sig.ValidityPeriod(now) {
+				if now.Before(time.Unix(int64(sig.Inception), 0)) {
+					lastErr = bogus(dns.ExtendedErrorCodeSignatureNotYetValid, "signature over %s not yet valid", set.rrs[0].Header().Name)
+				} else {
+					lastErr = bogus(dns.ExtendedErrorCodeSignatureExpired, "signature over %s expired", set.rrs[0].Header().Name)
+				}
+				continue
+			}
+			return nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = bogus(dns.ExtendedErrorCodeDNSKEYMissing, "no key matches signatures over %s", set.rrs[0].Header().Name)
+	}
+	return lastErr
+}
+
+// ---- Chain of trust ----
+
+// anchorFor returns the closest trust anchor zone at or above name.
+func (v *dnssecValidator) anchorFor(name string) (string, bool) {
+	for n := dns.CanonicalName(name); ; {
+		if _, ok := v.anchors[n]; ok {
+			return n, true
+		}
+		if n == "." {
+			return "", false
+		}
+		n = parentName(n)
+	}
+}
+
+func parentName(name string) string {
+	if name == "." {
+		return "."
+	}
+	off, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[off:]
+}
+
+// zoneKeys returns the validated DNSKEY RRset of zone, or errInsecure if the
+// zone is proven to be unsigned.
+func (v *dnssecValidator) zoneKeys(zone string, depth int) ([]*dns.DNSKEY, error) {
+	zone = dns.CanonicalName(zone)
+	if depth > dnssecMaxDepth {
+		return nil, bogus(dns.ExtendedErrorCodeDNSSECIndeterminate, "chain of trust too deep at %s", zone)
+	}
+	if e := v.cachedKeys(zone); e != nil {
+		if e.insecure {
+			return nil, errInsecure
+		}
+		return e.keys, nil
+	}
+
+	dsSet, ok := v.anchors[zone]
+	if !ok {
+		if _, covered := v.anchorFor(zone); !covered {
+			return nil, errInsecure
+		}
+		ds, state, err := v.lookupDS(zone, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		switch state {
+		case dsInsecure:
+			v.storeKeys(zone, &keyEntry{insecure: true, expires: v.cacheUntil(uint32(dnssecMaxCacheTTL.Seconds()))})
+			return nil, errInsecure
+		case dsNoCut:
+			return nil, bogus(dns.ExtendedErrorCodeDNSBogus, "%s signs records but is not a delegated zone", zone)
+		}
+		dsSet = ds
+	}
+
+	resp, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	_, sets := splitRRsets(resp.Answer)
+	keySet := sets[rrsetKey{zone, dns.TypeDNSKEY}]
+	if keySet == nil {
+		return nil, bogus(dns.ExtendedErrorCodeDNSKEYMissing, "no DNSKEY for %s", zone)
+	}
+	var keys []*dns.DNSKEY
+	for _, rr := range keySet.rrs {
+		if k, ok := rr.(*dns.DNSKEY); ok {
+			keys = append(keys, k)
+		}
+	}
+
+	// Keys authenticated by the DS set; unsupported algorithms and digests
+	// are ignored, and if nothing usable is left the zone is insecure
+	// (RFC 4035 section 5.2).
+	var trusted []*dns.DNSKEY
+	usable := false
+	for _, ds := range dsSet {
+		if !supportedDNSSECAlgorithm(ds.Algorithm) {
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() != ds.KeyTag || k.Algorithm != ds.Algorithm {
+				continue
+			}
+			digest := k.ToDS(ds.DigestType)
+			if digest == nil {
+				continue
+			}
+			usable = true
+			if strings.EqualFold(digest.Digest, ds.Digest) {
+				trusted = append(trusted, k)
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		if !usable && !anyDigestSupported(dsSet) {
+			v.storeKeys(zone, &keyEntry{insecure: true, expires: v.cacheUntil(minTTL(keySet.rrs))})
+			return nil, errInsecure
+		}
+		return nil, bogus(dns.ExtendedErrorCodeDNSKEYMissing, "no DNSKEY of %s matches its DS", zone)
+	}
+	if err := v.verifyRRset(keySet, trusted); err != nil {
+		return nil, err
+	}
+
+	v.storeKeys(zone, &keyEntry{keys: keys, expires: v.cacheUntil(minTTL(keySet.rrs))})
+	return keys, nil
+}
+
+func anyDigestSupported(dsSet []*dns.DS) bool {
+	for _, ds := range dsSet {
+		if !supportedDNSSECAlgorithm(ds.Algorithm) {
+			continue
+		}
+		switch ds.DigestType {
+		case dns.SHA1, dns.SHA256, dns.SHA384:
+			return true
+		}
+	}
+	return false
+}
+
+// lookupDS fetches and validates the DS RRset for name, or proves its
+// absence from the signed denial returned by the parent zone.
+func (v *dnssecValidator) lookupDS(name string, depth int) ([]*dns.DS, dsState, error) {
+	name = dns.CanonicalName(name)
+	if e := v.cachedDS(name); e != nil {
+		return e.ds, e.state, nil
+	}
+
+	resp, err := v.query(name, dns.TypeDS)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	_, answer := splitRRsets(resp.Answer)
+	if set := answer[rrsetKey{name, dns.TypeDS}]; set != nil {
+		signer := signerOf(name, set.sigs)
+		if signer == "" || signer == name {
+			// Unsigned DS records are only acceptable in an insecure parent
+			insecure, err := v.provablyInsecure(parentName(name))
+			if err != nil {
+				return nil, 0, err
+			}
+			if !insecure {
+				return nil, 0, bogus(dns.ExtendedErrorCodeRRSIGsMissing, "DS for %s is not signed by its parent", name)
+			}
+			v.storeDS(name, nil, dsInsecure, minTTL(set.rrs))
+			return nil, dsInsecure, nil
+		}
+		keys, err := v.zoneKeys(signer, depth)
+		if errors.Is(err, errInsecure) {
+			v.storeDS(name, nil, dsInsecure, minTTL(set.rrs))
+			return nil, dsInsecure, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := v.verifyRRset(set, keys); err != nil {
+			return nil, 0, err
+		}
+		var ds []*dns.DS
+		for _, rr := range set.rrs {
+			ds = append(ds, rr.(*dns.DS))
+		}
+		v.storeDS(name, ds, dsFound, minTTL(set.rrs))
+		return ds, dsFound, nil
+	}
+
+	// No DS: the authority section must hold a signed denial
+	signer, ttl, err := v.verifyAuthority(resp, name, depth)
+	if errors.Is(err, errInsecure) {
+		v.storeDS(name, nil, dsInsecure, ttl)
+		return nil, dsInsecure, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	state, proven := dsDenialState(resp.Ns, name, signer)
+	if !proven {
+		return nil, 0, bogus(dns.ExtendedErrorCodeNSECMissing, "no proof that %s has no DS", name)
+	}
+	v.storeDS(name, nil, state, ttl)
+	return nil, state, nil
+}
+
+// dsDenialState interprets NSEC/NSEC3 records proving a DS query for name
+// returned no data.
+func dsDenialState(ns []dns.RR, name, zone string) (dsState, bool) {
+	for _, rr := range ns {
+		switch r := rr.(type) {
+		case *dns.NSEC:
+			if dns.CanonicalName(r.Hdr.Name) == name {
+				if hasType(r.TypeBitMap, dns.TypeDS) {
+					return 0, false
+				}
+				if hasType(r.TypeBitMap, dns.TypeNS) && !hasType(r.TypeBitMap, dns.TypeSOA) {
+					return dsInsecure, true
+				}
+				return dsNoCut, true
+			}
+			if nsecCovers(r, name) {
+				return dsNoCut, true
+			}
+		case *dns.NSEC3:
+			if r.Match(name) {
+				if hasType(r.TypeBitMap, dns.TypeDS) {
+					return 0, false
+				}
+				if hasType(r.TypeBitMap, dns.TypeNS) && !hasType(r.TypeBitMap, dns.TypeSOA) {
+					return dsInsecure, true
+				}
+				return dsNoCut, true
+			}
+		}
+	}
+	// Opt-out: the next closer name is covered by an NSEC3 with the opt-out
+	// flag, so an unsigned delegation may exist there (RFC 5155 section 6)
+	if _, nextCloser, ok := nsec3ClosestEncloser(ns, name, zone); ok {
+		for _, rr := range ns {
+			if r, ok := rr.(*dns.NSEC3); ok && r.Flags&1 == 1 && r.Cover(nextCloser) {
+				return dsInsecure, true
+			}
+		}
+		return dsNoCut, true
+	}
+	return 0, false
+}
+
+// verifyAuthority validates every signed RRset in the authority section and
+// returns the zone that signed them.
+func (v *dnssecValidator) verifyAuthority(resp *dns.Msg, name string, depth int) (string, uint32, error) {
+	order, sets := splitRRsets(resp.Ns)
+	signer := ""
+	ttl := uint32(dnssecMaxCacheTTL.Seconds())
+	for _, k := range order {
+		set := sets[k]
+		if len(set.sigs) == 0 {
+			continue
+		}
+		s := signerOf(k.name, set.sigs)
+		if s == "" || !dns.IsSubDomain(s, name) {
+			return "", 0, bogus(dns.ExtendedErrorCodeDNSBogus, "authority record %s signed by unrelated zone", k.name)
+		}
+		keys, err := v.zoneKeys(s, depth)
+		if err != nil {
+			return "", 0, err
+		}
+		if err := v.verifyRRset(set, keys); err != nil {
+			return "", 0, err
+		}
+		if t := minTTL(set.rrs); t < ttl {
+			ttl = t
+		}
+		if dns.CountLabel(s) > dns.CountLabel(signer) || signer == "" {
+			signer = s
+		}
+	}
+	if signer != "" {
+		return signer, ttl, nil
+	}
+
+	// Nothing signed: acceptable only if the zone answering is insecure
+	zone := ""
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			zone = dns.CanonicalName(soa.Hdr.Name)
+		}
+	}
+	if zone == "" {
+		return "", 0, bogus(dns.ExtendedErrorCodeNSECMissing, "unsigned negative answer for %s", name)
+	}
+	if _, err := v.zoneKeys(zone, depth); err != nil {
+		return "", 0, err
+	}
+	return "", 0, bogus(dns.ExtendedErrorCodeRRSIGsMissing, "unsigned negative answer from signed zone %s", zone)
+}
+
+// provablyInsecure walks the delegations from the closest trust anchor down
+// to name and reports whether one of them is proven to be unsigned.
+func (v *dnssecValidator) provablyInsecure(name string) (bool, error) {
+	name = dns.CanonicalName(name)
+	anchor, ok := v.anchorFor(name)
+	if !ok {
+		return true, nil
+	}
+	labels := dns.SplitDomainName(name)
+	anchorLabels := dns.CountLabel(anchor)
+	for i := len(labels) - anchorLabels - 1; i >= 0; i-- {
+		cut := dns.Fqdn(strings.Join(labels[i:], "."))
+		_, state, err := v.lookupDS(cut, 0)
+		if errors.Is(err, errInsecure) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if state == dsInsecure {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ---- Denial of existence ----
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalCompare orders names as in RFC 4034 section 6.1.
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// nsecCovers reports whether name falls strictly between the owner and the
+// next name of an NSEC record.
+func nsecCovers(r *dns.NSEC, name string) bool {
+	owner, next := r.Hdr.Name, r.NextDomain
+	if canonicalCompare(owner, name) >= 0 {
+		return false
+	}
+	// Last NSEC in the zone wraps around to the apex
+	if canonicalCompare(owner, next) >= 0 {
+		return true
+	}
+	return canonicalCompare(name, next) < 0
+}
+
+// nsec3ClosestEncloser finds the closest encloser proof for name (RFC 5155
+// section 8.3): an NSEC3 matching an ancestor and one covering the next
+// closer name.
+func nsec3ClosestEncloser(ns []dns.RR, name, zone string) (string, string, bool) {
+	var nsec3 []*dns.NSEC3
+	for _, rr := range ns {
+		if r, ok := rr.(*dns.NSEC3); ok {
+			nsec3 = append(nsec3, r)
+		}
+	}
+	if len(nsec3) == 0 {
+		return "", "", false
+	}
+	for next := name; next != "." && dns.IsSubDomain(zone, parentName(next)); next = parentName(next) {
+		closest := parentName(next)
+		matched, covered := false, false
+		for _, r := range nsec3 {
+			if r.Match(closest) {
+				matched = true
+			}
+			if r.Cover(next) {
+				covered = true
+			}
+		}
+		if matched && covered {
+			return closest, next, true
+		}
+	}
+	return "", "", false
+}
+
+// denialProven checks that the authority section proves either that name
+// does not exist or that it has no record of type qtype.
+func denialProven(ns []dns.RR, name string, qtype uint16, zone string) bool {
+	for _, rr := range ns {
+		switch r := rr.(type) {
+		case *dns.NSEC:
+			if dns.CanonicalName(r.Hdr.Name) == name {
+				if !hasType(r.TypeBitMap, qtype) && !hasType(r.TypeBitMap, dns.TypeCNAME) {
+					return true
+				}
+			} else if nsecCovers(r, name) {
+				return true
+			}
+		case *dns.NSEC3:
+			if r.Match(name) && !hasType(r.TypeBitMap, qtype) && !hasType(r.TypeBitMap, dns.TypeCNAME) {
+				return true
+			}
+		}
+	}
+	_, _, ok := nsec3ClosestEncloser(ns, name, zone)
+	return ok
+}
+
+// ---- Answer validation ----
+
+// validate classifies an upstream answer as secure, insecure or bogus.
+// Bogus answers come back with a *validationError.
+func (v *dnssecValidator) validate(resp *dns.Msg) (dnssecStatus, error) {
+	if len(resp.Question) == 0 {
+		return dnssecInsecure, nil
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return dnssecInsecure, nil
+	}
+
+	q := resp.Question[0]
+	if q.Qtype == dns.TypeRRSIG {
+		// Signatures cannot be validated on their own
+		return dnssecInsecure, nil
+	}
+	status := dnssecSecure
+	wildcard := false
+	target := dns.CanonicalName(q.Name)
+	answered := false
+
+	order, sets := splitRRsets(resp.Answer)
+	for _, k := range order {
+		set := sets[k]
+		st, err := v.validateRRset(k.name, set)
+		if err != nil {
+			return dnssecBogus, err
+		}
+		if st == dnssecInsecure {
+			status = dnssecInsecure
+		}
+		for _, sig := range set.sigs {
+			if int(sig.Labels) < dns.CountLabel(k.name) {
+				wildcard = true
+			}
+		}
+		if k.name == target {
+			if k.rrtype == dns.TypeCNAME {
+				target = dns.CanonicalName(set.rrs[0].(*dns.CNAME).Target)
+			} else if k.rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+				answered = true
+			}
+		}
+	}
+
+	if answered && !wildcard {
+		return status, nil
+	}
+
+	// Negative answer (or wildcard expansion): the authority section must
+	// prove that the final name or type does not exist
+	signer, _, err := v.verifyAuthority(resp, target, 0)
+	if errors.Is(err, errInsecure) {
+		return dnssecInsecure, nil
+	}
+	if err != nil {
+		// An unsigned denial is fine below an insecure delegation
+		if insecure, ierr := v.provablyInsecure(target); ierr == nil && insecure {
+			return dnssecInsecure, nil
+		}
+		return dnssecBogus, err
+	}
+	if !denialProven(resp.Ns, target, q.Qtype, signer) {
+		return dnssecBogus, bogus(dns.ExtendedErrorCodeNSECMissing, "no denial of existence for %s", target)
+	}
+	return status, nil
+}
+
+func (v *dnssecValidator) validateRRset(owner string, set *rrset) (dnssecStatus, error) {
+	if len(set.sigs) == 0 {
+		insecure, err := v.provablyInsecure(owner)
+		if err != nil {
+			return dnssecBogus, err
+		}
+		if insecure {
+			return dnssecInsecure, nil
+		}
+		return dnssecBogus, bogus(dns.ExtendedErrorCodeRRSIGsMissing, "no RRSIG for %s/%s in signed zone", owner, dns.TypeToString[set.rrs[0].Header().Rrtype])
+	}
+
+	signer := signerOf(owner, set.sigs)
+	if signer == "" {
+		return dnssecBogus, bogus(dns.ExtendedErrorCodeDNSBogus, "RRSIG for %s has unrelated signer", owner)
+	}
+	for _, sig := range set.sigs {
+		if !supportedDNSSECAlgorithm(sig.Algorithm) {
+			return dnssecInsecure, nil
+		}
+	}
+	keys, err := v.zoneKeys(signer, 0)
+	if errors.Is(err, errInsecure) {
+		return dnssecInsecure, nil
+	}
+	if err != nil {
+		return dnssecBogus, err
+	}
+	if err := v.verifyRRset(set, keys); err != nil {
+		return dnssecBogus, err
+	}
+	return dnssecSecure, nil
+}
+
+// ---- Query/response plumbing ----
+
+// dnssecQuery records the client's DNSSEC-related flags so the reply can be
+// shaped for the client after the upstream was queried with DO and CD set.
+type dnssecQuery struct {
+	validate bool
+	clientDO bool
+	clientAD bool
+	addedOPT bool
+}
+
+// prepareDNSSEC turns req into a query suitable for validation. Queries
+// with CD set are passed through untouched since the client validates.
+func (s *Server) prepareDNSSEC(req *dns.Msg) dnssecQuery {
+	if s.getDNSSECValidator() == nil || req.CheckingDisabled {
+		return dnssecQuery{}
+	}
+	st := dnssecQuery{validate: true, clientAD: req.AuthenticatedData}
+	if opt := req.IsEdns0(); opt != nil {
+		st.clientDO = opt.Do()
+		opt.SetDo()
+	} else {
+		req.SetEdns0(ednsUDPSize, true)
+		st.addedOPT = true
+	}
+	req.CheckingDisabled = true
+	return st
+}
+
+// finishDNSSEC validates an upstream reply and rewrites it for the client:
+// AD on secure answers, SERVFAIL with an Extended DNS Error on bogus ones,
+// and DNSSEC records removed when the client did not ask for them. It
+// reports whether the result may be cached.
+func (s *Server) finishDNSSEC(m *dns.Msg, st dnssecQuery) bool {
+	v := s.getDNSSECValidator()
+	if !st.validate || v == nil {
+		return true
+	}
+
+	qName := ""
+	if len(m.Question) > 0 {
+		qName = trimDot(m.Question[0].Name)
+	}
+
+	status, err := v.validate(m)
+	cacheable := true
+	switch status {
+	case dnssecSecure:
+		s.metrics.IncDNSSECSecure()
+		m.AuthenticatedData = st.clientDO || st.clientAD
+	case dnssecInsecure:
+		m.AuthenticatedData = false
+	case dnssecBogus:
+		s.metrics.IncDNSSECBogus()
+		ede := dns.ExtendedErrorCodeDNSBogus
+		var ve *validationError
+		if errors.As(err, &ve) {
+			ede = ve.ede
+		}
+		s.logger.Warn("DNSSEC validation failed", "domain", qName, "ede", dns.ExtendedErrorCodeToString[ede], "error", err)
+
+		hdr := m.MsgHdr
+		opt := m.IsEdns0()
+		*m = dns.Msg{MsgHdr: hdr, Question: m.Question}
+		m.Rcode = dns.RcodeServerFailure
+		m.AuthenticatedData = false
+		if opt != nil {
+			// The error names upstreams and addresses; it is only logged
+			opt.Option = []dns.EDNS0{&dns.EDNS0_EDE{InfoCode: ede, ExtraText: dns.ExtendedErrorCodeToString[ede]}}
+			m.Extra = []dns.RR{opt}
+		}
+		cacheable = false
+	}
+
+	if !st.clientDO {
+		stripDNSSECRecords(m)
+		if opt := m.IsEdns0(); opt != nil {
+			opt.SetDo(false)
+		}
+	}
+	m.CheckingDisabled = false
+	if st.addedOPT {
+		removeOPT(m)
+	}
+	return cacheable
+}
+
+// stripDNSSECRecords removes records a non-DO client did not ask for.
+func stripDNSSECRecords(m *dns.Msg) {
+	qtype := uint16(0)
+	if len(m.Question) > 0 {
+		qtype = m.Question[0].Qtype
+	}
+	filter := func(rrs []dns.RR) []dns.RR {
+		kept := rrs[:0]
+		for _, rr := range rrs {
+			t := rr.Header().Rrtype
+			if t != qtype && (t == dns.TypeRRSIG || t == dns.TypeNSEC || t == dns.TypeNSEC3) {
+				continue
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+	m.Answer = filter(m.Answer)
+	m.Ns = filter(m.Ns)
+	m.Extra = filter(m.Extra)
+}
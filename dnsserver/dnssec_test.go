@@ -0,0 +1,263 @@
+package dnsserver
+
+import (
+	"crypto"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"smartSNI/config"
+)
+
+// testZoneSigner signs records for one zone with a single ECDSA key.
+type testZoneSigner struct {
+	zone string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZoneSigner(t *testing.T, zone string) *testZoneSigner {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return &testZoneSigner{zone: zone, key: key, priv: priv.(crypto.Signer)}
+}
+
+func (z *testZoneSigner) sign(t *testing.T, rrs ...dns.RR) []dns.RR {
+	t.Helper()
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrs[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrs[0].Header().Ttl},
+		Algorithm:  z.key.Algorithm,
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.zone,
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(24 * time.Hour).Unix()),
+	}
+	if err := sig.Sign(z.priv, rrs); err != nil {
+		t.Fatalf("sign %s: %v", rrs[0].Header().Name, err)
+	}
+	return append(append([]dns.RR{}, rrs...), sig)
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("NewRR(%q): %v", s, err)
+	}
+	return rr
+}
+
+// testDNSSECHierarchy is a signed root with a signed "example." child and
+// an unsigned "insecure." delegation, served from memory.
+type testDNSSECHierarchy struct {
+	root, example *testZoneSigner
+	answers       map[rrsetKey]*dns.Msg
+}
+
+func newTestDNSSECHierarchy(t *testing.T) *testDNSSECHierarchy {
+	t.Helper()
+	h := &testDNSSECHierarchy{
+		root:    newTestZoneSigner(t, "."),
+		example: newTestZoneSigner(t, "example."),
+		answers: make(map[rrsetKey]*dns.Msg),
+	}
+	rootSOA := mustRR(t, ". 3600 IN SOA a.root. admin.root. 1 3600 600 86400 300")
+
+	h.set(".", dns.TypeDNSKEY, h.root.sign(t, h.root.key), nil)
+	h.set("example.", dns.TypeDNSKEY, h.example.sign(t, h.example.key), nil)
+
+	ds := h.example.key.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+	h.set("example.", dns.TypeDS, h.root.sign(t, ds), nil)
+
+	nsec := &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "insecure.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+		NextDomain: "zz.",
+		TypeBitMap: []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC},
+	}
+	h.set("insecure.", dns.TypeDS, nil, append(h.root.sign(t, rootSOA), h.root.sign(t, nsec)...))
+	return h
+}
+
+func (h *testDNSSECHierarchy) set(name string, qtype uint16, answer, ns []dns.RR) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Response = true
+	m.Answer = answer
+	m.Ns = ns
+	h.answers[rrsetKey{name, qtype}] = m
+}
+
+func (h *testDNSSECHierarchy) exchange(m *dns.Msg) (*dns.Msg, error) {
+	q := m.Question[0]
+	if resp, ok := h.answers[rrsetKey{dns.CanonicalName(q.Name), q.Qtype}]; ok {
+		out := resp.Copy()
+		out.Id = m.Id
+		return out, nil
+	}
+	return nil, errors.New("no such record in test hierarchy")
+}
+
+func (h *testDNSSECHierarchy) validator(t *testing.T) *dnssecValidator {
+	t.Helper()
+	anchor := h.root.key.ToDS(dns.SHA256)
+	v, err := newDNSSECValidator([]string{anchor.String()}, h.exchange)
+	if err != nil {
+		t.Fatalf("newDNSSECValidator: %v", err)
+	}
+	return v
+}
+
+func answerMsg(name string, qtype uint16, rrs []dns.RR) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Response = true
+	m.Answer = rrs
+	return m
+}
+
+func TestDNSSECValidateSecureAnswer(t *testing.T) {
+	h := newTestDNSSECHierarchy(t)
+	v := h.validator(t)
+
+	a := mustRR(t, "www.example. 300 IN A 192.0.2.1")
+	status, err := v.validate(answerMsg("www.example.", dns.TypeA, h.example.sign(t, a)))
+	if err != nil || status != dnssecSecure {
+		t.Fatalf("got status %v err %v, want secure", status, err)
+	}
+}
+
+func TestDNSSECValidateTamperedAnswerIsBogus(t *testing.T) {
+	h := newTestDNSSECHierarchy(t)
+	v := h.validator(t)
+
+	signed := h.example.sign(t, mustRR(t, "www.example. 300 IN A 192.0.2.1"))
+	signed[0].(*dns.A).A = mustRR(t, "x. 300 IN A 203.0.113.66").(*dns.A).A
+
+	status, err := v.validate(answerMsg("www.example.", dns.TypeA, signed))
+	var ve *validationError
+	if status != dnssecBogus || !errors.As(err, &ve) || ve.ede != dns.ExtendedErrorCodeDNSBogus {
+		t.Fatalf("got status %v err %v, want bogus with EDE DNSSEC Bogus", status, err)
+	}
+}
+
+func TestDNSSECValidateExpiredSignature(t *testing.T) {
+	h := newTestDNSSECHierarchy(t)
+	v := h.validator(t)
+	v.now = func() time.Time { return time.Now().Add(48 * time.Hour) }
+
+	status, err := v.validate(answerMsg("www.example.", dns.TypeA, h.example.sign(t, mustRR(t, "www.example. 300 IN A 192.0.2.1"))))
+	var ve *validationError
+	if status != dnssecBogus || !errors.As(err, &ve) || ve.ede != dns.ExtendedErrorCodeSignatureExpired {
+		t.Fatalf("got status %v err %v, want bogus with EDE Signature Expired", status, err)
+	}
+}
+
+func TestDNSSECValidateUnsignedDelegationIsInsecure(t *testing.T) {
+	h := newTestDNSSECHierarchy(t)
+	v := h.validator(t)
+
+	status, err := v.validate(answerMsg("www.insecure.", dns.TypeA, []dns.RR{mustRR(t, "www.insecure. 300 IN A 192.0.2.2")}))
+	if err != nil || status != dnssecInsecure {
+		t.Fatalf("got status %v err %v, want insecure", status, err)
+	}
+}
+
+func TestDNSSECValidateStrippedSignatureIsBogus(t *testing.T) {
+	h := newTestDNSSECHierarchy(t)
+	v := h.validator(t)
+
+	status, _ := v.validate(answerMsg("www.example.", dns.TypeA, []dns.RR{mustRR(t, "www.example. 300 IN A 192.0.2.1")}))
+	if status != dnssecBogus {
+		t.Fatalf("got status %v, want bogus", status)
+	}
+}
+
+func TestDNSSECCacheBounded(t *testing.T) {
+	v, err := newDNSSECValidator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	v.now = func() time.Time { return now }
+	v.storeDS("stale.example.", nil, dsNoCut, 1)
+	v.storeKeys("stale.example.", &keyEntry{insecure: true, expires: now.Add(time.Second)})
+	now = now.Add(time.Minute)
+	for i := 0; i <= dnssecMaxCached; i++ {
+		name := "r" + strconv.Itoa(i) + ".example."
+		v.storeDS(name, nil, dsNoCut, 300)
+		v.storeKeys(name, &keyEntry{insecure: true, expires: now.Add(time.Hour)})
+	}
+	if len(v.ds) >= dnssecMaxCached || len(v.keys) >= dnssecMaxCached {
+		t.Fatalf("caches hold %d DS and %d key entries", len(v.ds), len(v.keys))
+	}
+	if v.ds["stale.example."] != nil || v.keys["stale.example."] != nil {
+		t.Error("expired entries kept")
+	}
+	last := "r" + strconv.Itoa(dnssecMaxCached) + ".example."
+	if v.cachedDS(last) == nil || v.cachedKeys(last) == nil {
+		t.Error("newest entries missing")
+	}
+}
+
+func TestFinishDNSSECShapesReply(t *testing.T) {
+	h := newTestDNSSECHierarchy(t)
+	s := newTestServer(t, &config.Config{})
+	s.dnssec.Store(h.validator(t))
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	req.AuthenticatedData = true // RFC 6840: AD in the query asks for AD in the reply
+	st := s.prepareDNSSEC(req)
+	if !req.CheckingDisabled || !req.IsEdns0().Do() {
+		t.Fatal("upstream query should have CD and DO set")
+	}
+
+	secure := answerMsg("www.example.", dns.TypeA, h.example.sign(t, mustRR(t, "www.example. 300 IN A 192.0.2.1")))
+	secure.SetEdns0(1232, true)
+	if !s.finishDNSSEC(secure, st) || !secure.AuthenticatedData {
+		t.Fatal("secure answer should be cacheable and have AD set")
+	}
+	for _, rr := range secure.Answer {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			t.Fatal("RRSIG returned to a client that did not set DO")
+		}
+	}
+
+	tampered := h.example.sign(t, mustRR(t, "www.example. 300 IN A 192.0.2.1"))
+	tampered[0].(*dns.A).A = mustRR(t, "x. 300 IN A 203.0.113.66").(*dns.A).A
+	bogusMsg := answerMsg("www.example.", dns.TypeA, tampered)
+	bogusMsg.SetEdns0(1232, true)
+	if s.finishDNSSEC(bogusMsg, st) {
+		t.Fatal("bogus answer must not be cached")
+	}
+	if bogusMsg.Rcode != dns.RcodeServerFailure || len(bogusMsg.Answer) != 0 {
+		t.Fatalf("bogus answer should be an empty SERVFAIL, got %s", bogusMsg)
+	}
+	var ede *dns.EDNS0_EDE
+	for _, o := range bogusMsg.IsEdns0().Option {
+		if e, ok := o.(*dns.EDNS0_EDE); ok {
+			ede = e
+		}
+	}
+	if ede == nil || ede.InfoCode != dns.ExtendedErrorCodeDNSBogus {
+		t.Fatalf("missing EDE DNSSEC Bogus, got %v", ede)
+	}
+	if ede.ExtraText != "DNSSEC Bogus" {
+		t.Errorf("EDE text %q exposes validation details", ede.ExtraText)
+	}
+}
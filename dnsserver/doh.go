@@ -0,0 +1,294 @@
+package dnsserver
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"smartSNI/internal/httpx"
+)
+
+// ======================== DoH Server (fasthttp) ========================
+
+// checkAuth validates the bearer token when enable_auth is set.
+func (s *Server) checkAuth(ctx *fasthttp.RequestCtx) bool {
+	cfg := s.config()
+	if !cfg.EnableAuth {
+		return true
+	}
+
+	authHeader := string(ctx.Request.Header.Peek("Authorization"))
+	if authHeader == "" {
+		return false
+	}
+
+	// Support Bearer token
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		token := strings.TrimPrefix(authHeader, "Bearer ")
+		_, exists := s.authTokens.Load(token)
+		return exists
+	}
+
+	return false
+}
+
+// HandleDoH answers one RFC 8484 request (GET or POST).
+func (s *Server) HandleDoH(ctx *fasthttp.RequestCtx) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Error("panic in DoH handler", "error", r, "stack", string(debug.Stack()))
+			s.metrics.IncErrors()
+			ctx.Error("Internal server error", fasthttp.StatusInternalServerError)
+		}
+	}()
+
+	s.metrics.IncDOHQueries()
+	clientIP := httpx.ClientIP(ctx)
+
+	s.logger.Debug("DoH request", "client", clientIP, "method", string(ctx.Method()))
+
+	// Check user-based authorization (IP or API key)
+	// Try multiple sources for API key: header, query params (key, api, apikey), or path
+	apiKey := string(ctx.Request.Header.Peek("X-API-Key"))
+	if apiKey == "" {
+		apiKey = string(ctx.QueryArgs().Peek("key"))
+	}
+	if apiKey == "" {
+		apiKey = string(ctx.QueryArgs().Peek("api"))
+	}
+	if apiKey == "" {
+		apiKey = string(ctx.QueryArgs().Peek("apikey"))
+	}
+	// Check if API key is in path (e.g., /doh/API_KEY)
+	if apiKey == "" {
+		if val := ctx.UserValue("apikey"); val != nil {
+			apiKey = val.(string)
+		}
+	}
+
+	authorized := s.userAuthorized(clientIP)
+
+	// If IP auth failed, try API key auth
+	if !authorized && apiKey != "" {
+		authorized = s.userAuthorizedByAPIKey(apiKey)
+		if authorized {
+			s.logger.Debug("DoH authorized via API key", "client", clientIP, "api_key", apiKey[:16]+"...")
+		}
+	}
+
+	if !authorized {
+		s.logger.Warn("DoH user not authorized", "client", clientIP, "has_api_key", apiKey != "")
+		s.metrics.IncErrors()
+		ctx.Error("Access denied - Please register first or provide valid API key (X-API-Key header or ?key= param)", fasthttp.StatusForbidden)
+		return
+	}
+
+	// Check old token-based authentication (only if user management is disabled)
+	cfg := s.config()
+	if !cfg.UserManagement && !s.checkAuth(ctx) {
+		s.logger.Warn("DoH authentication failed", "client", clientIP)
+		s.metrics.IncErrors()
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+
+	// Global rate limit
+	if !s.limiter.Allow() {
+		s.logger.Warn("DoH global rate limit exceeded", "client", clientIP)
+		s.metrics.IncErrors()
+		ctx.Error("Rate limit exceeded", fasthttp.StatusTooManyRequests)
+		return
+	}
+
+	// Per-IP rate limit
+	ipLimiter := s.getIPLimiter(clientIP)
+	if !ipLimiter.Allow() {
+		s.logger.Warn("DoH per-IP rate limit exceeded", "client", clientIP)
+		s.metrics.IncErrors()
+		ctx.Error("Rate limit exceeded", fasthttp.StatusTooManyRequests)
+		return
+	}
+
+	var body []byte
+	switch string(ctx.Method()) {
+	case "GET":
+		raw := ctx.QueryArgs().Peek("dns")
+		if raw == nil {
+			s.logger.Debug("DoH missing dns parameter", "client", clientIP)
+			ctx.Error("Missing 'dns' query parameter", fasthttp.StatusBadRequest)
+			return
+		}
+		decoded, err := base64.RawURLEncoding.DecodeString(string(raw))
+		if err != nil {
+			s.logger.Warn("DoH invalid dns parameter", "client", clientIP, "error", err)
+			s.metrics.IncErrors()
+			ctx.Error("Invalid 'dns' query parameter", fasthttp.StatusBadRequest)
+			return
+		}
+		body = decoded
+	case "POST":
+		body = ctx.PostBody()
+		if len(body) == 0 {
+			s.logger.Debug("DoH empty request body", "client", clientIP)
+			ctx.Error("Empty request body", fasthttp.StatusBadRequest)
+			return
+		}
+	default:
+		s.logger.Debug("DoH invalid method", "client", clientIP, "method", string(ctx.Method()))
+		ctx.Error("Only GET and POST methods are allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	// Validate DNS query size
+	if len(body) > 4096 {
+		s.logger.Warn("DoH query too large", "client", clientIP, "size", len(body))
+		s.metrics.IncErrors()
+		ctx.Error("DNS query too large", fasthttp.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// fasthttp.RequestCtx is recycled after the handler returns, so it must
+	// not become the parent of the query context
+	resp, err := s.Query(context.Background(), ProtoDoH, clientIP, apiKey, body)
+	if err != nil {
+		s.logger.Warn("DoH query processing failed", "client", clientIP, "error", err)
+		s.metrics.IncErrors()
+		ctx.Error("Failed to process DNS query", fasthttp.StatusBadRequest)
+		return
+	}
+
+	// Security headers
+	ctx.Response.Header.Set("X-Content-Type-Options", "nosniff")
+	ctx.Response.Header.Set("X-Frame-Options", "DENY")
+	ctx.Response.Header.Set("X-XSS-Protection", "1; mode=block")
+	ctx.Response.Header.Set("Referrer-Policy", "no-referrer")
+
+	ctx.SetContentType("application/dns-message")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(resp)
+
+	s.logger.Debug("DoH query completed", "client", clientIP)
+}
+
+func (s *Server) handleHealthCheck(ctx *fasthttp.RequestCtx) {
+	health := map[string]interface{}{
+		"status":  "healthy",
+		"uptime":  time.Since(s.startTime).Seconds(),
+		"version": "2.0",
+	}
+
+	data, _ := json.Marshal(health)
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(data)
+}
+
+func (s *Server) handleMetrics(ctx *fasthttp.RequestCtx) {
+	cfg := s.config()
+	if !cfg.MetricsEnabled {
+		ctx.Error("Metrics disabled", fasthttp.StatusForbidden)
+		return
+	}
+
+	stats := s.metrics.GetStats()
+	data, _ := json.Marshal(stats)
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(data)
+}
+
+func (s *Server) handlePrometheusMetrics(ctx *fasthttp.RequestCtx) {
+	cfg := s.config()
+	if !cfg.MetricsEnabled {
+		ctx.Error("Metrics disabled", fasthttp.StatusForbidden)
+		return
+	}
+
+	ctx.SetContentType("text/plain; version=0.0.4")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_ = s.metrics.WritePrometheus(ctx)
+}
+
+func (s *Server) handleConfigReload(ctx *fasthttp.RequestCtx) {
+	// Simple auth check
+	if !s.checkAuth(ctx) {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+
+	if s.reloadConfig == nil {
+		ctx.Error("Reload not supported", fasthttp.StatusNotImplemented)
+		return
+	}
+	if err := s.reloadConfig(); err != nil {
+		s.logger.Error("failed to reload config", "error", err)
+		ctx.Error(fmt.Sprintf("Failed to reload: %v", err), fasthttp.StatusInternalServerError)
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.WriteString(`{"status":"reloaded"}`)
+}
+
+// Handler routes the DoH endpoints (/dns-query, /doh/<api key>) along with
+// /health, /metrics, /metrics/prometheus and /admin/reload.
+func (s *Server) Handler() fasthttp.RequestHandler {
+	return func(c *fasthttp.RequestCtx) {
+		path := string(c.Path())
+
+		// Check for path-based API key: /doh/API_KEY
+		if strings.HasPrefix(path, "/doh/") {
+			apikey := strings.TrimPrefix(path, "/doh/")
+			if apikey != "" {
+				c.SetUserValue("apikey", apikey)
+				s.HandleDoH(c)
+				return
+			}
+		}
+
+		switch path {
+		case "/dns-query":
+			s.HandleDoH(c)
+		case "/health":
+			s.handleHealthCheck(c)
+		case "/metrics":
+			s.handleMetrics(c)
+		case "/metrics/prometheus":
+			s.handlePrometheusMetrics(c)
+		case "/admin/reload":
+			s.handleConfigReload(c)
+		default:
+			c.Error("Unsupported path", fasthttp.StatusNotFound)
+		}
+	}
+}
+
+// ListenAndServeDoH serves Handler on addr (plain HTTP behind nginx) until
+// ctx is cancelled.
+func (s *Server) ListenAndServeDoH(ctx context.Context, addr string) error {
+	server := &fasthttp.Server{
+		Handler:      s.Handler(),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		s.logger.Info("DoH server shutting down")
+		_ = server.Shutdown()
+	}()
+
+	s.logger.Info("DoH server started", "address", addr)
+	if err := server.ListenAndServe(addr); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("DoH server error: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package dnsserver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+// ======================== DoT Server ========================
+
+func (s *Server) handleDoTConnection(conn net.Conn) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Error("panic in DoT handler", "error", r, "stack", string(debug.Stack()))
+			s.metrics.IncErrors()
+		}
+		conn.Close()
+	}()
+
+	s.metrics.IncDOTQueries()
+	clientAddr := conn.RemoteAddr().String()
+	clientIP, _, _ := net.SplitHostPort(clientAddr)
+
+	s.logger.Debug("DoT connection", "client", clientAddr)
+
+	// Check user-based authorization
+	if !s.userAuthorized(clientIP) {
+		s.logger.Warn("DoT user not authorized", "client", clientIP)
+		s.metrics.IncErrors()
+		return
+	}
+
+	if !s.limiter.Allow() {
+		s.logger.Warn("DoT global rate limit exceeded", "client", clientAddr)
+		s.metrics.IncErrors()
+		return
+	}
+
+	// Set read deadline
+	if err := conn.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		s.logger.Error("DoT set read deadline failed", "error", err)
+		return
+	}
+
+	// DoT framing: 2-byte length + DNS payload (RFC 7858 uses TCP DNS framing)
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		s.logger.Debug("DoT read length failed", "error", err, "client", clientAddr)
+		s.metrics.IncErrors()
+		return
+	}
+
+	dnsLen := binary.BigEndian.Uint16(header)
+	// Basic sanity limit to avoid huge allocations
+	if dnsLen == 0 || dnsLen > 8192 {
+		s.logger.Warn("DoT invalid length", "length", dnsLen, "client", clientAddr)
+		s.metrics.IncErrors()
+		return
+	}
+
+	buf := make([]byte, int(dnsLen))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		s.logger.Debug("DoT read body failed", "error", err, "client", clientAddr)
+		s.metrics.IncErrors()
+		return
+	}
+
+	resp, err := s.Query(context.Background(), ProtoDoT, clientIP, "", buf)
+	if err != nil {
+		s.logger.Warn("DoT query processing failed", "error", err, "client", clientAddr)
+		s.metrics.IncErrors()
+		return
+	}
+
+	// Set write deadline
+	if err := conn.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		s.logger.Error("DoT set write deadline failed", "error", err)
+		return
+	}
+
+	outLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(outLen, uint16(len(resp)))
+	if _, err := conn.Write(outLen); err != nil {
+		s.logger.Debug("DoT write length failed", "error", err, "client", clientAddr)
+		s.metrics.IncErrors()
+		return
+	}
+	if _, err := conn.Write(resp); err != nil {
+		s.logger.Debug("DoT write body failed", "error", err, "client", clientAddr)
+		s.metrics.IncErrors()
+		return
+	}
+
+	s.logger.Debug("DoT query completed successfully", "client", clientAddr)
+}
+
+// ListenAndServeDoT serves DoT on port 853 with the Let's Encrypt
+// certificate for the configured host. Without a certificate DoT is
+// disabled and nil is returned.
+func (s *Server) ListenAndServeDoT(ctx context.Context) error {
+	cfg := s.config()
+	certDir := filepath.Join("/etc/letsencrypt/live", cfg.Host)
+	cer, err := tls.LoadX509KeyPair(
+		filepath.Join(certDir, "fullchain.pem"),
+		filepath.Join(certDir, "privkey.pem"),
+	)
+	if err != nil {
+		s.logger.Warn("DoT: SSL certificate not found, DoT server disabled", "error", err, "cert_dir", certDir)
+		s.logger.Warn("DoT: to enable DoT, obtain SSL certificate with: certbot --nginx -d <domain>")
+		return nil
+	}
+
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cer},
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   tls.VersionTLS13,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		},
+		PreferServerCipherSuites: true,
+	}
+
+	ln, err := tls.Listen("tcp", ":853", tlsCfg)
+	if err != nil {
+		return fmt.Errorf("DoT: listen: %w", err)
+	}
+	s.logger.Info("DoT server started", "port", 853)
+	return s.ServeDoT(ctx, ln)
+}
+
+// ServeDoT accepts DoT connections on ln, which must already terminate TLS,
+// until ctx is cancelled.
+func (s *Server) ServeDoT(ctx context.Context, ln net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		s.logger.Info("DoT server shutting down")
+		_ = ln.Close()
+	}()
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			s.logger.Warn("DoT accept error", "error", err)
+			continue
+		}
+		go s.handleDoTConnection(c)
+	}
+}
@@ -0,0 +1,309 @@
+package dnsserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/valyala/fasthttp"
+
+	"smartSNI/config"
+)
+
+// fakeDoH is an RFC 8484 upstream served by httptest that answers from a
+// fixed set of records.
+type fakeDoH struct {
+	*httptest.Server
+	records []dns.RR
+	queries atomic.Int32
+}
+
+func newFakeDoH(t *testing.T, records ...dns.RR) *fakeDoH {
+	t.Helper()
+	f := &fakeDoH{records: records}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.queries.Add(1)
+		body, err := io.ReadAll(r.Body)
+		if err != nil || r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var req dns.Msg
+		if err := req.Unpack(body); err != nil || len(req.Question) != 1 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(&req)
+		q := req.Question[0]
+		for _, rr := range f.records {
+			sig, _ := rr.(*dns.RRSIG)
+			if dns.CanonicalName(rr.Header().Name) == dns.CanonicalName(q.Name) && (rr.Header().Rrtype == q.Qtype || sig != nil && sig.TypeCovered == q.Qtype) {
+				resp.Answer = append(resp.Answer, dns.Copy(rr))
+			}
+		}
+		out, _ := resp.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(out)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// URL returns the upstream's DoH endpoint.
+func (f *fakeDoH) URL() string { return f.Server.URL + "/dns-query" }
+
+// newE2EServer builds a Server with a local domain that forwards everything
+// else to a fake upstream knowing upstream.test.
+func newE2EServer(t *testing.T) (*Server, *fakeDoH) {
+	t.Helper()
+	up := newFakeDoH(t, mustRR(t, "upstream.test. 60 IN A 198.51.100.20"))
+	s := newTestServer(t, &config.Config{
+		Domains:          map[string]string{"*.local.test": "10.0.0.1"},
+		UpstreamDOH:      []string{up.URL()},
+		CacheTTL:         60,
+		RateLimitPerIP:   1000,
+		RateLimitBurstIP: 1000,
+		DNSUDPSockets:    1,
+		DNSUDPWorkers:    2,
+	})
+	return s, up
+}
+
+func testCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.test"},
+		DNSNames:     []string{"dns.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func answerA(t *testing.T, out []byte) string {
+	t.Helper()
+	var m dns.Msg
+	if err := m.Unpack(out); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Answer) != 1 {
+		t.Fatalf("want one answer, got %s", &m)
+	}
+	a, ok := m.Answer[0].(*dns.A)
+	if !ok {
+		t.Fatalf("want an A record, got %s", m.Answer[0])
+	}
+	return a.A.String()
+}
+
+func TestDoHRoundTrip(t *testing.T) {
+	s, up := newE2EServer(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &fasthttp.Server{Handler: s.Handler()}
+	go func() { _ = srv.Serve(ln) }()
+	defer func() { _ = srv.Shutdown() }()
+	// Shutdown waits for every open connection; drop the client's spare
+	// ones first since the server has no read timeout to reap them
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.CloseIdleConnections()
+	base := "http://" + ln.Addr().String()
+
+	post := func(path string, query []byte) []byte {
+		t.Helper()
+		resp, err := client.Post(base+path, "application/dns-message", bytes.NewReader(query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/dns-message" {
+			t.Fatalf("POST %s: %s %s", path, resp.Status, body)
+		}
+		return body
+	}
+
+	if got := answerA(t, post("/dns-query", packTestQuery(t, "www.local.test.", 1))); got != "10.0.0.1" {
+		t.Fatalf("local answer %s, want 10.0.0.1", got)
+	}
+	if got := answerA(t, post("/doh/some-key", packTestQuery(t, "upstream.test.", 2))); got != "198.51.100.20" {
+		t.Fatalf("forwarded answer %s, want 198.51.100.20", got)
+	}
+
+	// GET with the query in the dns parameter is served from the cache
+	get := base + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(packTestQuery(t, "upstream.test.", 3))
+	resp, err := client.Get(get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got := answerA(t, body); got != "198.51.100.20" {
+		t.Fatalf("GET answer %s", got)
+	}
+	if n := up.queries.Load(); n != 1 {
+		t.Fatalf("upstream saw %d queries, want 1", n)
+	}
+
+	for path, want := range map[string]int{
+		"/dns-query?dns=!!":   http.StatusBadRequest,
+		"/health":             http.StatusOK,
+		"/metrics":            http.StatusForbidden,
+		"/no-such-endpoint":   http.StatusNotFound,
+		"/metrics/prometheus": http.StatusForbidden,
+	} {
+		resp, err := client.Get(base + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s: got %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestDoTRoundTrip(t *testing.T) {
+	s, _ := newE2EServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{testCert(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.ServeDoT(ctx, ln) }()
+
+	for i, name := range []string{"a.local.test.", "upstream.test."} {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		query := packTestQuery(t, name, uint16(i+1))
+		frame := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+		if _, err := conn.Write(append(frame, query...)); err != nil {
+			t.Fatal(err)
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			t.Fatal(err)
+		}
+		out := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, out); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		answerA(t, out)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("ServeDoT returned %v after shutdown", err)
+	}
+}
+
+func TestDNSRoundTrip(t *testing.T) {
+	s, _ := newE2EServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	udpSrv, tcpListener, err := s.listenDNS("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.serveDNS(ctx, udpSrv, tcpListener)
+		close(done)
+	}()
+	addr := udpSrv.LocalAddr().String()
+
+	for _, network := range []string{"udp", "tcp"} {
+		c := &dns.Client{Net: network, Timeout: 5 * time.Second}
+		for _, tc := range []struct{ name, want string }{
+			{"www.local.test.", "10.0.0.1"},
+			{"upstream.test.", "198.51.100.20"},
+		} {
+			req := new(dns.Msg)
+			req.SetQuestion(tc.name, dns.TypeA)
+			resp, _, err := c.Exchange(req, addr)
+			if err != nil {
+				t.Fatalf("%s %s: %v", network, tc.name, err)
+			}
+			out, _ := resp.Pack()
+			if got := answerA(t, out); got != tc.want {
+				t.Errorf("%s %s: got %s, want %s", network, tc.name, got, tc.want)
+			}
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("DNS server did not stop")
+	}
+}
+
+func FuzzQuery(f *testing.F) {
+	f.Add(packTestQuery(f, "www.local.test.", 1))
+	f.Add(packTestQuery(f, "upstream.test.", 2))
+	f.Add([]byte{})
+	f.Add([]byte{0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xc0, 0x0c})
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no upstream in fuzzing", http.StatusServiceUnavailable)
+	}))
+	defer up.Close()
+	s, err := New(Options{
+		Config: config.NewStore(&config.Config{
+			Domains:     map[string]string{"*.local.test": "10.0.0.1", "*.alias.test": "edge.local.test"},
+			UpstreamDOH: []string{up.URL + "/dns-query"},
+		}),
+		Logger: discardLogger(),
+	})
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Fuzz(func(t *testing.T, query []byte) {
+		out, err := s.Query(context.Background(), ProtoUDP, "192.0.2.1", "", query)
+		if err != nil {
+			return
+		}
+		var m dns.Msg
+		if err := m.Unpack(out); err != nil {
+			t.Fatalf("unparseable reply to %x: %v", query, err)
+		}
+	})
+}
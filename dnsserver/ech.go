@@ -0,0 +1,112 @@
+package dnsserver
+
+import (
+	"github.com/miekg/dns"
+
+	"smartSNI/config"
+)
+
+// ======================== ECH Stripping ========================
+
+// echStep removes the ech parameter from HTTPS and SVCB answers for the
+// names dns_strip_ech selects. Without an ECH config clients send the real
+// server name in the clear, so the SNI proxy can route by it. It runs on
+// cached answers too, so the cache holds them unchanged.
+func echStep(qc *QueryContext, next QueryHandler) ([]byte, error) {
+	resp, err := next(qc)
+	if err != nil || !stripsECH(qc) {
+		return resp, err
+	}
+	var m dns.Msg
+	if err := m.Unpack(resp); err != nil {
+		return resp, nil
+	}
+	if !stripECH(&m) {
+		return resp, nil
+	}
+	qc.Server.logger.Debug("removed ECH config from answer", "domain", qc.Name, "type", dns.TypeToString[qc.Qtype])
+	return m.Pack()
+}
+
+// stripsECH reports whether the answer to qc loses its ECH configs.
+func stripsECH(qc *QueryContext) bool {
+	switch qc.Qtype {
+	case dns.TypeHTTPS, dns.TypeSVCB, dns.TypeANY:
+	default:
+		return false
+	}
+	switch qc.Config.DNSStripECH {
+	case config.ECHStripAll:
+		return true
+	case config.ECHStripProxied:
+		if _, ok := qc.Policy.lookup(qc.Name); ok {
+			return true
+		}
+		for i := range qc.Config.SNIRoutes {
+			if r := &qc.Config.SNIRoutes[i]; r.Matches(qc.Name, nil) {
+				return !r.Block // first match wins, as in the proxy
+			}
+		}
+	}
+	return false
+}
+
+// stripECH removes the ech parameter, and its mention in mandatory, from
+// the HTTPS and SVCB records of m. Signatures over the changed records are
+// dropped with them. It reports whether m changed.
+func stripECH(m *dns.Msg) bool {
+	changed := make(map[uint16]bool)
+	strip := func(rrs []dns.RR) {
+		for _, rr := range rrs {
+			var svcb *dns.SVCB
+			switch r := rr.(type) {
+			case *dns.SVCB:
+				svcb = r
+			case *dns.HTTPS:
+				svcb = &r.SVCB
+			default:
+				continue
+			}
+			kept := svcb.Value[:0]
+			for _, kv := range svcb.Value {
+				switch v := kv.(type) {
+				case *dns.SVCBECHConfig:
+					changed[rr.Header().Rrtype] = true
+					continue
+				case *dns.SVCBMandatory:
+					codes := v.Code[:0]
+					for _, c := range v.Code {
+						if c != dns.SVCB_ECHCONFIG {
+							codes = append(codes, c)
+						}
+					}
+					if v.Code = codes; len(codes) == 0 {
+						continue
+					}
+				}
+				kept = append(kept, kv)
+			}
+			svcb.Value = kept
+		}
+	}
+	strip(m.Answer)
+	strip(m.Extra)
+	if len(changed) == 0 {
+		return false
+	}
+
+	unsigned := func(rrs []dns.RR) []dns.RR {
+		kept := rrs[:0]
+		for _, rr := range rrs {
+			if sig, ok := rr.(*dns.RRSIG); ok && changed[sig.TypeCovered] {
+				continue
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+	m.Answer = unsigned(m.Answer)
+	m.Extra = unsigned(m.Extra)
+	m.AuthenticatedData = false
+	return true
+}
@@ -0,0 +1,68 @@
+package dnsserver
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"smartSNI/config"
+)
+
+func TestECHStep(t *testing.T) {
+	// A signed HTTPS answer carrying an ECH config the client must use
+	answer := func(qc *QueryContext) ([]byte, error) {
+		name := dns.Fqdn(qc.Name)
+		resp := new(dns.Msg)
+		resp.SetReply(qc.Req)
+		resp.AuthenticatedData = true
+		resp.Answer = []dns.RR{
+			mustRR(t, name+" 300 IN HTTPS 1 . mandatory=alpn,ech alpn=h3,h2 ech=AEX+DQBBBwAgACA="),
+			mustRR(t, name+" 300 IN RRSIG HTTPS 13 2 300 20300101000000 20200101000000 12345 example. AAAA"),
+		}
+		return resp.Pack()
+	}
+	h := stepHandler(echStep, answer)
+
+	for _, tc := range []struct {
+		mode, name string
+		qtype      uint16
+		strip      bool
+	}{
+		{"", "www.youtube.com", dns.TypeHTTPS, false},
+		{config.ECHStripProxied, "www.youtube.com", dns.TypeHTTPS, true}, // domains rule
+		{config.ECHStripProxied, "api.routed.test", dns.TypeHTTPS, true}, // SNI route
+		{config.ECHStripProxied, "blocked.routed.test", dns.TypeHTTPS, false},
+		{config.ECHStripProxied, "other.test", dns.TypeHTTPS, false},
+		{config.ECHStripAll, "other.test", dns.TypeHTTPS, true},
+		{config.ECHStripAll, "other.test", dns.TypeA, false},
+	} {
+		s := newTestServer(t, &config.Config{
+			Domains:     map[string]string{"*.youtube.com": "10.0.0.1"},
+			SNIRoutes:   []config.SNIRoute{{SNI: "blocked.routed.test", Block: true}, {SNI: "*.routed.test", Backend: "10.0.0.2:443"}},
+			DNSStripECH: tc.mode,
+		})
+		m := runStep(t, h, newTestQueryContext(t, s, tc.name, tc.qtype))
+
+		https := m.Answer[0].(*dns.HTTPS)
+		hasECH := false
+		for _, kv := range https.Value {
+			switch v := kv.(type) {
+			case *dns.SVCBECHConfig:
+				hasECH = true
+			case *dns.SVCBMandatory:
+				if tc.strip && (len(v.Code) != 1 || v.Code[0] != dns.SVCB_ALPN) {
+					t.Errorf("%s %s: mandatory is %v, want alpn", tc.mode, tc.name, v.Code)
+				}
+			}
+		}
+		if hasECH == tc.strip {
+			t.Errorf("%s %s %s: ech present = %v", tc.mode, tc.name, dns.TypeToString[tc.qtype], hasECH)
+		}
+		if tc.strip && (len(m.Answer) != 1 || m.AuthenticatedData) {
+			t.Errorf("%s %s: stale signature or AD kept: %v", tc.mode, tc.name, m)
+		}
+		if !tc.strip && len(m.Answer) != 2 {
+			t.Errorf("%s %s: answer changed: %v", tc.mode, tc.name, m)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package dnsserver
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+
+	"smartSNI/config"
+)
+
+// ======================== EDNS Client Subnet (RFC 7871) ========================
+
+// ednsUDPSize is advertised when we add an OPT record the client did not send
+const ednsUDPSize = 1232
+
+// ecsState remembers what applyECS did to a query so the upstream answer
+// can be made to look like a reply to the query the client actually sent.
+type ecsState struct {
+	subnet      string            // subnet sent upstream, part of the cache key ("" = none)
+	addedOPT    bool              // client sent no OPT record; strip the whole OPT from the reply
+	stripOption bool              // client sent no ECS option we forwarded; strip ECS from the reply
+	client      *dns.EDNS0_SUBNET // client option as sent, when it was clamped; echoed in the reply
+}
+
+func (s ecsState) rewritesReply() bool {
+	return s.addedOPT || s.stripOption || s.client != nil
+}
+
+func findECS(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+func removeECS(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	kept := opt.Option[:0]
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_SUBNET); !ok {
+			kept = append(kept, o)
+		}
+	}
+	opt.Option = kept
+}
+
+func removeOPT(m *dns.Msg) {
+	kept := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			kept = append(kept, rr)
+		}
+	}
+	m.Extra = kept
+}
+
+// newECSOption builds an ECS option for ip truncated to the configured prefix.
+// It returns nil for addresses that say nothing about the client's location.
+func newECSOption(ip net.IP, cfg *config.Config) *dns.EDNS0_SUBNET {
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() {
+		return nil
+	}
+	v4, v6 := cfg.ECSPrefixes()
+	e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if ip4 := ip.To4(); ip4 != nil {
+		e.Family = 1
+		e.SourceNetmask = uint8(v4)
+		e.Address = ip4.Mask(net.CIDRMask(v4, 32))
+	} else {
+		e.Family = 2
+		e.SourceNetmask = uint8(v6)
+		e.Address = ip.Mask(net.CIDRMask(v6, 128))
+	}
+	return e
+}
+
+// clampECS reduces a client-supplied option to at most the configured prefix.
+func clampECS(e *dns.EDNS0_SUBNET, cfg *config.Config) {
+	v4, v6 := cfg.ECSPrefixes()
+	bits, limit := 32, v4
+	if e.Family == 2 {
+		bits, limit = 128, v6
+	}
+	if int(e.SourceNetmask) > limit {
+		e.SourceNetmask = uint8(limit)
+	}
+	e.SourceScope = 0
+	if e.Address != nil {
+		e.Address = e.Address.Mask(net.CIDRMask(int(e.SourceNetmask), bits))
+	}
+}
+
+func ecsSubnetString(e *dns.EDNS0_SUBNET) string {
+	if e == nil || e.Address == nil {
+		return ""
+	}
+	if e.Family == 1 {
+		// Unpacked IPv4 addresses come in 16-byte form
+		return (&net.IPNet{IP: e.Address.To4(), Mask: net.CIDRMask(int(e.SourceNetmask), 32)}).String()
+	}
+	return (&net.IPNet{IP: e.Address, Mask: net.CIDRMask(int(e.SourceNetmask), 128)}).String()
+}
+
+// applyECS rewrites the ECS option of req before it is forwarded upstream.
+// With ecs_strip_client any option sent by the client is dropped; with
+// ecs_enabled an option derived from clientIP is added when the client did
+// not provide one (or it was stripped). Client options that are kept are
+// never forwarded with a longer prefix than configured.
+func applyECS(req *dns.Msg, clientIP string, cfg *config.Config) ecsState {
+	var st ecsState
+	if !cfg.ECSEnabled && !cfg.ECSStripClient {
+		st.subnet = ecsSubnetString(findECS(req))
+		return st
+	}
+
+	clientECS := findECS(req)
+	if clientECS != nil && cfg.ECSStripClient {
+		removeECS(req)
+		clientECS = nil
+	}
+	if clientECS != nil {
+		sent := *clientECS
+		clampECS(clientECS, cfg)
+		if clientECS.SourceNetmask != sent.SourceNetmask || !clientECS.Address.Equal(sent.Address) {
+			st.client = &sent
+		}
+		st.subnet = ecsSubnetString(clientECS)
+		return st
+	}
+
+	st.stripOption = true
+	if !cfg.ECSEnabled {
+		return st
+	}
+
+	e := newECSOption(net.ParseIP(clientIP), cfg)
+	if e == nil {
+		return st
+	}
+	opt := req.IsEdns0()
+	if opt == nil {
+		req.SetEdns0(ednsUDPSize, false)
+		opt = req.IsEdns0()
+		st.addedOPT = true
+	}
+	opt.Option = append(opt.Option, e)
+	st.subnet = ecsSubnetString(e)
+	return st
+}
+
+// restoreECS removes what applyECS added from an upstream reply, and gives
+// a clamped client back its own address and source prefix (RFC 7871 7.3)
+// with the scope the upstream answered for.
+func restoreECS(m *dns.Msg, st ecsState) {
+	switch {
+	case st.addedOPT:
+		removeOPT(m)
+	case st.stripOption:
+		removeECS(m)
+	case st.client != nil:
+		if e := findECS(m); e != nil {
+			scope := e.SourceScope
+			*e = *st.client
+			e.SourceScope = scope
+		}
+	}
+}
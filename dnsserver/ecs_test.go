@@ -0,0 +1,141 @@
+package dnsserver
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"smartSNI/config"
+)
+
+// withECS adds an OPT record carrying an ECS option for prefix to m.
+func withECS(t *testing.T, m *dns.Msg, prefix string) {
+	t.Helper()
+	p := netip.MustParsePrefix(prefix)
+	e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 2, SourceNetmask: uint8(p.Bits()), Address: p.Addr().AsSlice()}
+	if p.Addr().Is4() {
+		e.Family = 1
+	}
+	m.SetEdns0(ednsUDPSize, false)
+	m.IsEdns0().Option = append(m.IsEdns0().Option, e)
+}
+
+// upstreamECSReply answers req the way an ECS-aware upstream does: the
+// query's option is echoed with a scope.
+func upstreamECSReply(req *dns.Msg, scope uint8) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(opt.UDPSize(), false)
+		if e := findECS(req); e != nil {
+			echo := *e
+			echo.SourceScope = scope
+			resp.IsEdns0().Option = append(resp.IsEdns0().Option, &echo)
+		}
+	}
+	return resp
+}
+
+func TestECS(t *testing.T) {
+	zero := 0
+	for _, tc := range []struct {
+		name      string
+		cfg       config.Config
+		clientIP  string
+		clientECS string // option sent by the client, "" = no OPT at all
+		forwarded string // subnet sent upstream, "" = none
+		reply     string // ECS in the reply to the client, "" = none
+		replyOPT  bool
+	}{
+		{"adds option", config.Config{ECSEnabled: true}, "203.0.113.77", "", "203.0.113.0/24", "", false},
+		{"adds ipv6 option", config.Config{ECSEnabled: true}, "2001:db8:1:2::1", "", "2001:db8:1::/56", "", false},
+		{"zero prefix", config.Config{ECSEnabled: true, ECSPrefixV4: &zero}, "203.0.113.77", "", "0.0.0.0/0", "", false},
+		{"private client", config.Config{ECSEnabled: true}, "192.168.1.10", "", "", "", false},
+		{"clamps client prefix", config.Config{ECSEnabled: true}, "203.0.113.77", "198.51.100.77/32", "198.51.100.0/24", "198.51.100.77/32", true},
+		{"keeps shorter client prefix", config.Config{ECSEnabled: true}, "203.0.113.77", "198.51.0.0/16", "198.51.0.0/16", "198.51.0.0/16", true},
+		{"replaces client option", config.Config{ECSEnabled: true, ECSStripClient: true}, "203.0.113.77", "198.51.100.77/32", "203.0.113.0/24", "", true},
+		{"strips client option", config.Config{ECSStripClient: true}, "203.0.113.77", "198.51.100.77/32", "", "", true},
+		{"disabled", config.Config{}, "203.0.113.77", "198.51.100.77/32", "198.51.100.77/32", "198.51.100.77/32", true},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		if tc.clientECS != "" {
+			withECS(t, req, tc.clientECS)
+		}
+
+		st := applyECS(req, tc.clientIP, &tc.cfg)
+		if got := ecsSubnetString(findECS(req)); got != tc.forwarded || st.subnet != tc.forwarded {
+			t.Errorf("%s: forwarded %q (state %q), want %q", tc.name, got, st.subnet, tc.forwarded)
+		}
+		if e := findECS(req); e != nil && e.SourceScope != 0 {
+			t.Errorf("%s: forwarded scope %d", tc.name, e.SourceScope)
+		}
+
+		resp := upstreamECSReply(req, 20)
+		restoreECS(resp, st)
+		if (resp.IsEdns0() != nil) != tc.replyOPT {
+			t.Errorf("%s: reply OPT present = %v, want %v", tc.name, resp.IsEdns0() != nil, tc.replyOPT)
+		}
+		e := findECS(resp)
+		if got := ecsSubnetString(e); got != tc.reply {
+			t.Errorf("%s: reply ECS %q, want %q", tc.name, got, tc.reply)
+		}
+		if e != nil && e.SourceScope != 20 {
+			t.Errorf("%s: reply scope %d, want the upstream's 20", tc.name, e.SourceScope)
+		}
+	}
+}
+
+func TestECSCacheKey(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	a := getCacheKey(req, "203.0.113.0/24", "")
+	if a != getCacheKey(req, "203.0.113.0/24", "") {
+		t.Error("cache key not stable")
+	}
+	for _, other := range []string{"198.51.100.0/24", "203.0.113.0/25", ""} {
+		if getCacheKey(req, other, "") == a {
+			t.Errorf("subnet %q shares the cache key of 203.0.113.0/24", other)
+		}
+	}
+}
+
+func TestECSStepSharesCache(t *testing.T) {
+	s := newTestServer(t, &config.Config{ECSEnabled: true, CacheTTL: 60})
+	upstream := 0
+	answer := func(qc *QueryContext) ([]byte, error) {
+		upstream++
+		resp := upstreamECSReply(qc.Req, 24)
+		resp.Answer = []dns.RR{mustRR(t, "www.example.com. 60 IN A 192.0.2.10")}
+		return resp.Pack()
+	}
+	h := stepHandler(ecsStep, stepHandler(cacheStep, answer))
+
+	// Clients of the same /24 share one upstream answer, each seeing
+	// its own request mirrored
+	for _, tc := range []struct{ clientIP, clientECS, reply string }{
+		{"203.0.113.77", "", ""},
+		{"203.0.113.78", "203.0.113.78/32", "203.0.113.78/32"},
+		{"198.51.100.1", "203.0.113.0/24", "203.0.113.0/24"},
+	} {
+		qc := newTestQueryContext(t, s, "www.example.com", dns.TypeA)
+		qc.ClientIP = tc.clientIP
+		if tc.clientECS != "" {
+			withECS(t, qc.Req, tc.clientECS)
+		}
+		m := runStep(t, h, qc)
+		if len(m.Answer) != 1 {
+			t.Fatalf("%s: answer %v", tc.clientIP, m)
+		}
+		if tc.clientECS == "" && m.IsEdns0() != nil {
+			t.Errorf("%s: OPT returned to a client that sent none", tc.clientIP)
+		}
+		if got := ecsSubnetString(findECS(m)); got != tc.reply {
+			t.Errorf("%s: reply ECS %q, want %q", tc.clientIP, got, tc.reply)
+		}
+	}
+	if upstream != 1 {
+		t.Errorf("%d upstream queries, want 1", upstream)
+	}
+}
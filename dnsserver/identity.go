@@ -0,0 +1,83 @@
+package dnsserver
+
+import (
+	"strings"
+
+	"smartSNI/config"
+	"smartSNI/users"
+)
+
+// ======================== Client Identity & Domain Policy ========================
+
+// identifyUser finds the user behind a query, preferring the API key when
+// one was presented. It returns nil when user management is off or the
+// client is unknown.
+func (s *Server) identifyUser(clientIP, apiKey string) *users.User {
+	if !s.config().UserManagement {
+		return nil
+	}
+	if apiKey != "" {
+		if u := s.users.ByAPIKey(apiKey); u != nil {
+			return u
+		}
+	}
+	return s.users.ByIP(clientIP)
+}
+
+// domainPolicy is the effective set of rules for one client.
+type domainPolicy struct {
+	scope   string // cache key component; "" for the global rules
+	domains []map[string]string
+	blocked [][]string
+}
+
+// policyFor returns the rules for user. Users without domain sets (directly
+// or via their plan) get Config.Domains; users with sets get only their
+// sets' domains. Config.BlockedDomains always applies.
+func policyFor(cfg *config.Config, user *users.User) domainPolicy {
+	p := domainPolicy{blocked: [][]string{cfg.BlockedDomains}}
+
+	var names []string
+	if user != nil {
+		names = append(names, user.DomainSets...)
+		names = append(names, cfg.Plans[user.Plan]...)
+	}
+	var used []string
+	for _, name := range names {
+		set, ok := cfg.DomainSets[name]
+		if !ok {
+			continue
+		}
+		used = append(used, name)
+		p.domains = append(p.domains, set.Domains)
+		p.blocked = append(p.blocked, set.Blocked)
+	}
+
+	if len(used) == 0 {
+		p.domains = []map[string]string{cfg.Domains}
+		return p
+	}
+	p.scope = strings.Join(used, ",")
+	return p
+}
+
+func (p domainPolicy) isBlocked(host string) bool {
+	for _, list := range p.blocked {
+		for _, pattern := range list {
+			if config.Matches(host, pattern) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lookup returns the target for host from the first set with a match.
+func (p domainPolicy) lookup(host string) (string, bool) {
+	for _, m := range p.domains {
+		if v, ok := config.FindValueByPattern(m, host); ok {
+			return v, true
+		}
+	}
+	return "", false
+}
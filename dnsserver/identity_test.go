@@ -0,0 +1,84 @@
+package dnsserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"smartSNI/config"
+	"smartSNI/users"
+)
+
+func addTestUser(s *Server, u *users.User) {
+	u.IsActive = true
+	u.ExpiresAt = time.Now().Add(time.Hour)
+	s.users.Put(u)
+}
+
+func newIdentityTestConfig() *config.Config {
+	return &config.Config{
+		UserManagement: true,
+		Domains:        map[string]string{"*.youtube.com": "10.0.0.1", "*.netflix.com": "10.0.0.1"},
+		BlockedDomains: []string{"malware.test"},
+		DomainSets: map[string]config.DomainSet{
+			"youtube": {Domains: map[string]string{"*.youtube.com": "10.0.0.2"}},
+			"full":    {Domains: map[string]string{"*.youtube.com": "10.0.0.3", "*.netflix.com": "10.0.0.3"}},
+			"adblock": {Blocked: []string{"*.ads.test"}},
+		},
+		Plans: map[string][]string{"premium": {"full", "adblock"}},
+	}
+}
+
+func queryAs(t *testing.T, s *Server, clientIP, name string) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	packed, _ := req.Pack()
+	out, err := s.Query(context.Background(), ProtoUDP, clientIP, "", packed)
+	if err != nil {
+		t.Fatalf("Query(%s): %v", name, err)
+	}
+	var resp dns.Msg
+	if err := resp.Unpack(out); err != nil {
+		t.Fatal(err)
+	}
+	return &resp
+}
+
+func TestDomainSetsPerUser(t *testing.T) {
+	s := newTestServer(t, newIdentityTestConfig())
+	useStaticUpstream(s, mustRR(t, "www.netflix.com. 60 IN A 198.51.100.1"))
+	addTestUser(s, &users.User{ID: "u-basic", IPs: []string{"192.0.2.10"}, DomainSets: []string{"youtube"}})
+	addTestUser(s, &users.User{ID: "u-premium", IPs: []string{"192.0.2.20"}, Plan: "premium"})
+
+	basic, premium, anon := "192.0.2.10", "192.0.2.20", "192.0.2.30"
+
+	addr := func(m *dns.Msg) string {
+		if len(m.Answer) == 0 {
+			return ""
+		}
+		return m.Answer[0].(*dns.A).A.String()
+	}
+
+	if got := addr(queryAs(t, s, basic, "www.youtube.com.")); got != "10.0.0.2" {
+		t.Errorf("basic user youtube: got %q, want 10.0.0.2", got)
+	}
+	if got := addr(queryAs(t, s, basic, "www.netflix.com.")); got != "198.51.100.1" {
+		t.Errorf("basic user netflix should go upstream, got %q", got)
+	}
+	if got := addr(queryAs(t, s, premium, "www.netflix.com.")); got != "10.0.0.3" {
+		t.Errorf("premium user netflix: got %q, want 10.0.0.3", got)
+	}
+	if got := addr(queryAs(t, s, anon, "www.youtube.com.")); got != "10.0.0.1" {
+		t.Errorf("user without sets should get global domains, got %q", got)
+	}
+
+	if rc := queryAs(t, s, premium, "x.ads.test.").Rcode; rc != dns.RcodeRefused {
+		t.Errorf("premium user ad domain: got %s, want REFUSED", dns.RcodeToString[rc])
+	}
+	if rc := queryAs(t, s, basic, "malware.test.").Rcode; rc != dns.RcodeRefused {
+		t.Errorf("global blocklist must apply to every user, got %s", dns.RcodeToString[rc])
+	}
+}
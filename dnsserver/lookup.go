@@ -0,0 +1,71 @@
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ======================== Backend Lookups ========================
+
+// LookupUpstream resolves host to its IPv4 and IPv6 addresses through the
+// upstream servers only: Domains, domain sets and hosted zones are skipped.
+// It also returns the smallest TTL of the answers.
+func (s *Server) LookupUpstream(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+	defer cancel()
+
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+	qtypes := []uint16{dns.TypeAAAA, dns.TypeA}
+	results := make([]chan result, len(qtypes))
+	for i, qtype := range qtypes {
+		results[i] = make(chan result, 1)
+		go func(qtype uint16, out chan<- result) {
+			req := new(dns.Msg)
+			req.SetEdns0(dns.DefaultMsgSize, false)
+			resp, err := s.resolveUpstream(ctx, req, dns.Fqdn(host), qtype)
+			out <- result{resp, err}
+		}(qtype, results[i])
+	}
+
+	var addrs []netip.Addr
+	var errs []error
+	ttl := time.Duration(defaultTTL) * time.Second
+	for i, ch := range results {
+		r := <-ch
+		if r.err == nil && r.resp.Rcode != dns.RcodeSuccess {
+			r.err = fmt.Errorf("%s %s: %s", host, dns.TypeToString[qtypes[i]], dns.RcodeToString[r.resp.Rcode])
+		}
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+		for _, rr := range r.resp.Answer {
+			var ip netip.Addr
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip, _ = netip.AddrFromSlice(rr.A.To4())
+			case *dns.AAAA:
+				ip, _ = netip.AddrFromSlice(rr.AAAA)
+			default:
+				continue
+			}
+			addrs = append(addrs, ip)
+			ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+		}
+	}
+	if len(addrs) == 0 {
+		if len(errs) == 0 {
+			errs = append(errs, fmt.Errorf("no addresses for %s", host))
+		}
+		return nil, 0, errors.Join(errs...)
+	}
+	return addrs, ttl, nil
+}
@@ -0,0 +1,60 @@
+package dnsserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"smartSNI/config"
+)
+
+func TestLookupUpstreamSkipsLocalDomains(t *testing.T) {
+	up := newFakeDoH(t,
+		mustRR(t, "www.example.com. 300 IN A 93.184.215.14"),
+		mustRR(t, "www.example.com. 120 IN AAAA 2606:2800:21f:cb07:6820:80da:af6b:8b2c"),
+	)
+	s := newTestServer(t, &config.Config{
+		Domains:     map[string]string{"*.example.com": "10.0.0.1"},
+		UpstreamDOH: []string{up.URL()},
+	})
+
+	addrs, ttl, err := s.LookupUpstream(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 || addrs[0].String() != "2606:2800:21f:cb07:6820:80da:af6b:8b2c" || addrs[1].String() != "93.184.215.14" {
+		t.Fatalf("addrs = %v, want the upstream's, not the local override", addrs)
+	}
+	if ttl != 120*time.Second {
+		t.Fatalf("ttl = %v, want the smallest", ttl)
+	}
+
+	if _, _, err := s.LookupUpstream(context.Background(), "missing.example.com"); err == nil {
+		t.Fatal("name without addresses resolved")
+	}
+}
+
+func TestLookupUpstreamRefusesBogusAnswers(t *testing.T) {
+	h := newTestDNSSECHierarchy(t)
+	forged := h.example.sign(t, mustRR(t, "evil.example. 300 IN A 192.0.2.1"))
+	forged[0].(*dns.A).A = mustRR(t, "x. 300 IN A 203.0.113.66").(*dns.A).A
+	up := newFakeDoH(t, append(h.example.sign(t, mustRR(t, "www.example. 300 IN A 192.0.2.1")), forged...)...)
+	s := newTestServer(t, &config.Config{UpstreamDOH: []string{up.URL()}, DNSSECValidate: true})
+	s.dnssec.Store(h.validator(t))
+
+	addrs, _, err := s.LookupUpstream(context.Background(), "www.example")
+	if len(addrs) != 1 || addrs[0].String() != "192.0.2.1" {
+		t.Fatalf("signed backend: %v, %v", addrs, err)
+	}
+	if addrs, _, err := s.LookupUpstream(context.Background(), "evil.example"); err == nil || len(addrs) != 0 {
+		t.Fatalf("forged backend address accepted: %v", addrs)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("alias.test.", dns.TypeA)
+	if _, err := s.buildAliasResponse(context.Background(), req, "evil.example", config.AliasModeFlatten); err == nil {
+		t.Fatal("forged alias target flattened")
+	}
+}
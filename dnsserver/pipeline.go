@@ -0,0 +1,198 @@
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"smartSNI/config"
+	"smartSNI/users"
+)
+
+// ======================== DNS Query Pipeline ========================
+
+// Protocols a query can arrive over
+const (
+	ProtoDoH = "doh"
+	ProtoDoT = "dot"
+	ProtoUDP = "udp"
+	ProtoTCP = "tcp"
+)
+
+// dnsQueryTimeout bounds the time spent answering one query, upstream
+// lookups included.
+const dnsQueryTimeout = 8 * time.Second
+
+// QueryContext carries everything known about a query while it moves
+// through the pipeline.
+type QueryContext struct {
+	Ctx      context.Context // deadline and cancellation for upstream work
+	Server   *Server
+	ClientIP string
+	User     *users.User // nil when user management is off or the client is unknown
+	Protocol string
+
+	Req     *dns.Msg
+	Name    string // query name without the trailing dot
+	Qtype   uint16
+	HasEDNS bool
+	UDPSize uint16
+	DO      bool
+
+	Config *config.Config
+	Policy domainPolicy
+
+	// Set by the steps
+	ECS      ecsState
+	CacheKey string
+	NoCache  bool // the answer must not be cached (e.g. DNSSEC bogus)
+}
+
+// newQueryContext identifies the client and returns a context with the
+// default query deadline. The caller must call the returned cancel func.
+func (s *Server) newQueryContext(parent context.Context, protocol, clientIP, apiKey string) (*QueryContext, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(parent, dnsQueryTimeout)
+	return &QueryContext{
+		Ctx:      ctx,
+		Server:   s,
+		ClientIP: clientIP,
+		User:     s.identifyUser(clientIP, apiKey),
+		Protocol: protocol,
+	}, cancel
+}
+
+// processDNSQuery parses query and runs it through the pipeline.
+func (s *Server) processDNSQuery(qc *QueryContext, query []byte) ([]byte, error) {
+	var req dns.Msg
+	if err := req.Unpack(query); err != nil {
+		s.logger.Warn("failed to unpack DNS query", "error", err)
+		return nil, err
+	}
+	if len(req.Question) == 0 {
+		return nil, errors.New("no DNS question")
+	}
+
+	qc.Req = &req
+	qc.Name = trimDot(req.Question[0].Name)
+	qc.Qtype = req.Question[0].Qtype
+	if opt := req.IsEdns0(); opt != nil {
+		qc.HasEDNS, qc.UDPSize, qc.DO = true, opt.UDPSize(), opt.Do()
+	}
+	if qc.Config == nil {
+		qc.Config = s.config()
+	}
+	qc.Policy = policyFor(qc.Config, qc.User)
+
+	s.logger.Debug("processing DNS query", "domain", qc.Name, "type", dns.TypeToString[qc.Qtype], "proto", qc.Protocol, "client", qc.ClientIP)
+	return s.pipeline.Load().(QueryHandler)(qc)
+}
+
+// blocklistStep refuses names blocked for this client.
+func blocklistStep(qc *QueryContext, next QueryHandler) ([]byte, error) {
+	if qc.Policy.isBlocked(qc.Name) {
+		qc.Server.logger.Info("blocked domain query", "domain", qc.Name, "client", qc.ClientIP)
+		qc.Server.metrics.IncErrors()
+		return buildBlockedResponse(qc.Req)
+	}
+	return next(qc)
+}
+
+// zoneStep answers from hosted zones. It runs before the cache so a zone
+// reload takes effect immediately.
+func zoneStep(qc *QueryContext, next QueryHandler) ([]byte, error) {
+	if resp, ok, err := qc.Server.buildZoneResponse(qc.Req); ok {
+		qc.Server.logger.Debug("authoritative zone answer", "domain", qc.Name)
+		return resp, err
+	}
+	return next(qc)
+}
+
+// ecsStep applies the EDNS Client Subnet policy; it runs before the cache
+// so the subnet becomes part of the key, and restores the answer for the
+// client afterwards, so cached answers are shared between clients of the
+// same subnet.
+func ecsStep(qc *QueryContext, next QueryHandler) ([]byte, error) {
+	qc.ECS = applyECS(qc.Req, qc.ClientIP, qc.Config)
+	resp, err := next(qc)
+	if err != nil || !qc.ECS.rewritesReply() {
+		return resp, err
+	}
+	var m dns.Msg
+	if err := m.Unpack(resp); err != nil {
+		qc.Server.metrics.IncErrors()
+		return nil, fmt.Errorf("invalid upstream response: %w", err)
+	}
+	restoreECS(&m, qc.ECS)
+	return m.Pack()
+}
+
+// cacheStep serves cached answers and stores what the rest of the chain
+// produces unless a step marked it NoCache.
+func cacheStep(qc *QueryContext, next QueryHandler) ([]byte, error) {
+	qc.CacheKey = getCacheKey(qc.Req, qc.ECS.subnet, qc.Policy.scope)
+	if cached, found := qc.Server.getCachedResponse(qc.CacheKey, qc.Req.Id); found {
+		qc.Server.logger.Debug("returning cached response", "domain", qc.Name)
+		return cached, nil
+	}
+	resp, err := next(qc)
+	if err == nil && !qc.NoCache {
+		qc.Server.setCachedResponse(qc.CacheKey, resp)
+	}
+	return resp, err
+}
+
+// localStep answers names redirected to an IP address.
+func localStep(qc *QueryContext, next QueryHandler) ([]byte, error) {
+	target, ok := qc.Policy.lookup(qc.Name)
+	if !ok || net.ParseIP(target) == nil {
+		return next(qc)
+	}
+	qc.Server.logger.Debug("local domain match", "domain", qc.Name, "ip", target)
+	return buildLocalDNSResponse(qc.Req, target)
+}
+
+// rewriteStep answers names aliased to another hostname.
+func rewriteStep(qc *QueryContext, next QueryHandler) ([]byte, error) {
+	target, ok := qc.Policy.lookup(qc.Name)
+	if !ok || net.ParseIP(target) != nil {
+		return next(qc)
+	}
+	qc.Server.logger.Debug("alias domain match", "domain", qc.Name, "target", target, "mode", qc.Config.DomainAliasMode)
+	return qc.Server.buildAliasResponse(qc.Ctx, qc.Req, target, qc.Config.DomainAliasMode)
+}
+
+// forwardStep sends the query upstream, validating the reply as needed.
+func forwardStep(qc *QueryContext) ([]byte, error) {
+	s := qc.Server
+	if qc.ECS.subnet != "" {
+		s.logger.Debug("forwarding with client subnet", "domain", qc.Name, "subnet", qc.ECS.subnet)
+	}
+	sec := s.prepareDNSSEC(qc.Req)
+	upstreamQuery, err := qc.Req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.forwardQuery(qc.Ctx, upstreamQuery, qc.Name)
+	if err != nil {
+		s.metrics.IncErrors()
+		return nil, err
+	}
+
+	if sec.validate {
+		var m dns.Msg
+		if err := m.Unpack(resp); err != nil {
+			s.metrics.IncErrors()
+			return nil, fmt.Errorf("invalid upstream response: %w", err)
+		}
+		qc.NoCache = !s.finishDNSSEC(&m, sec)
+		if resp, err = m.Pack(); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
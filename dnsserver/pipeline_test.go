@@ -0,0 +1,168 @@
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"smartSNI/config"
+)
+
+var errNextCalled = errors.New("next called")
+
+func nextStub(qc *QueryContext) ([]byte, error) { return nil, errNextCalled }
+
+// stepHandler binds a plugin function to next so it can be run on its own.
+func stepHandler(step func(*QueryContext, QueryHandler) ([]byte, error), next QueryHandler) QueryHandler {
+	return func(qc *QueryContext) ([]byte, error) { return step(qc, next) }
+}
+
+// newTestQueryContext builds a parsed QueryContext for name on s without
+// running the pipeline.
+func newTestQueryContext(t *testing.T, s *Server, name string, qtype uint16) *QueryContext {
+	t.Helper()
+	cfg := s.config()
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	return &QueryContext{
+		Ctx:      context.Background(),
+		Server:   s,
+		ClientIP: "192.0.2.1",
+		Protocol: ProtoUDP,
+		Req:      req,
+		Name:     trimDot(dns.Fqdn(name)),
+		Qtype:    qtype,
+		Config:   cfg,
+		Policy:   policyFor(cfg, nil),
+	}
+}
+
+func runStep(t *testing.T, h QueryHandler, qc *QueryContext) *dns.Msg {
+	t.Helper()
+	out, err := h(qc)
+	if err != nil {
+		t.Fatalf("step returned %v", err)
+	}
+	var m dns.Msg
+	if err := m.Unpack(out); err != nil {
+		t.Fatal(err)
+	}
+	return &m
+}
+
+func TestBlocklistStep(t *testing.T) {
+	s := newTestServer(t, &config.Config{BlockedDomains: []string{"*.ads.test"}})
+	h := stepHandler(blocklistStep, nextStub)
+
+	m := runStep(t, h, newTestQueryContext(t, s, "x.ads.test", dns.TypeA))
+	if m.Rcode != dns.RcodeRefused {
+		t.Fatalf("got %s, want REFUSED", dns.RcodeToString[m.Rcode])
+	}
+	if _, err := h(newTestQueryContext(t, s, "example.com", dns.TypeA)); err != errNextCalled {
+		t.Fatal("unblocked name should continue down the chain")
+	}
+}
+
+func TestLocalStep(t *testing.T) {
+	s := newTestServer(t, &config.Config{Domains: map[string]string{"*.youtube.com": "10.0.0.1", "*.cdn.test": "edge.example.net"}})
+	h := stepHandler(localStep, nextStub)
+
+	m := runStep(t, h, newTestQueryContext(t, s, "www.youtube.com", dns.TypeA))
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Fatalf("unexpected local answer %v", m.Answer)
+	}
+	if _, err := h(newTestQueryContext(t, s, "a.cdn.test", dns.TypeA)); err != errNextCalled {
+		t.Fatal("hostname targets belong to the rewrite step")
+	}
+}
+
+func TestRewriteStep(t *testing.T) {
+	s := newTestServer(t, &config.Config{Domains: map[string]string{"*.cdn.test": "edge.example.net"}, DomainAliasMode: config.AliasModeFlatten})
+	useStaticUpstream(s, mustRR(t, "edge.example.net. 60 IN A 198.51.100.9"))
+	h := stepHandler(rewriteStep, nextStub)
+
+	m := runStep(t, h, newTestQueryContext(t, s, "a.cdn.test", dns.TypeA))
+	if len(m.Answer) != 1 || m.Answer[0].Header().Name != "a.cdn.test." {
+		t.Fatalf("unexpected rewrite answer %v", m.Answer)
+	}
+	if _, err := h(newTestQueryContext(t, s, "other.test", dns.TypeA)); err != errNextCalled {
+		t.Fatal("unmatched name should continue down the chain")
+	}
+}
+
+func TestCacheStep(t *testing.T) {
+	s := newTestServer(t, &config.Config{CacheTTL: 60})
+	calls := 0
+	h := stepHandler(cacheStep, func(qc *QueryContext) ([]byte, error) {
+		calls++
+		resp := new(dns.Msg)
+		resp.SetReply(qc.Req)
+		return resp.Pack()
+	})
+
+	first := newTestQueryContext(t, s, "cache-step.test", dns.TypeA)
+	runStep(t, h, first)
+	second := newTestQueryContext(t, s, "cache-step.test", dns.TypeA)
+	second.Req.Id = first.Req.Id + 1
+	m := runStep(t, h, second)
+	if calls != 1 {
+		t.Fatalf("next called %d times, want 1", calls)
+	}
+	if m.Id != second.Req.Id {
+		t.Fatalf("cached answer has ID %d, want %d", m.Id, second.Req.Id)
+	}
+
+	// Answers marked NoCache are not stored
+	h = stepHandler(cacheStep, func(qc *QueryContext) ([]byte, error) {
+		calls++
+		qc.NoCache = true
+		resp := new(dns.Msg)
+		resp.SetReply(qc.Req)
+		return resp.Pack()
+	})
+	calls = 0
+	runStep(t, h, newTestQueryContext(t, s, "nocache-step.test", dns.TypeA))
+	runStep(t, h, newTestQueryContext(t, s, "nocache-step.test", dns.TypeA))
+	if calls != 2 {
+		t.Fatalf("NoCache answer was served from cache")
+	}
+}
+
+func TestForwardStepHonoursDeadline(t *testing.T) {
+	s := newTestServer(t, &config.Config{UpstreamDOH: []string{"https://192.0.2.1/dns-query"}})
+
+	qc := newTestQueryContext(t, s, "example.com", dns.TypeA)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	qc.Ctx = ctx
+	if _, err := forwardStep(qc); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestProcessDNSQueryFillsContext(t *testing.T) {
+	s := newTestServer(t, &config.Config{Domains: map[string]string{"local.test": "10.0.0.1"}})
+	req := new(dns.Msg)
+	req.SetQuestion("local.test.", dns.TypeA)
+	req.SetEdns0(1400, true)
+	packed, _ := req.Pack()
+
+	qc, cancel := s.newQueryContext(context.Background(), ProtoDoT, "192.0.2.7", "")
+	defer cancel()
+	out, err := s.processDNSQuery(qc, packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m dns.Msg
+	if err := m.Unpack(out); err != nil || len(m.Answer) != 1 {
+		t.Fatalf("want a local answer, got %s", &m)
+	}
+	if qc.Name != "local.test" || !qc.HasEDNS || qc.UDPSize != 1400 || !qc.DO {
+		t.Fatalf("query context not filled in: %+v", qc)
+	}
+	if _, ok := qc.Ctx.Deadline(); !ok {
+		t.Fatal("query context has no deadline")
+	}
+}
@@ -0,0 +1,162 @@
+package dnsserver
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"smartSNI/config"
+)
+
+// ======================== DNS Plugins ========================
+
+// QueryHandler produces the packed answer for a query.
+type QueryHandler func(qc *QueryContext) ([]byte, error)
+
+// DNSPlugin is one link of the query chain. It either answers the query
+// itself or passes it on by calling next, optionally looking at or changing
+// the result on the way back.
+type DNSPlugin interface {
+	Name() string
+	ServeDNS(qc *QueryContext, next QueryHandler) ([]byte, error)
+}
+
+// pluginFunc adapts a plain function to DNSPlugin.
+type pluginFunc struct {
+	name string
+	fn   func(qc *QueryContext, next QueryHandler) ([]byte, error)
+}
+
+func (p pluginFunc) Name() string { return p.name }
+
+func (p pluginFunc) ServeDNS(qc *QueryContext, next QueryHandler) ([]byte, error) {
+	return p.fn(qc, next)
+}
+
+// PluginFactory creates a plugin for the given configuration. It is called
+// again on every config reload.
+type PluginFactory func(cfg *config.Config) (DNSPlugin, error)
+
+var (
+	pluginMu       sync.RWMutex
+	pluginRegistry = make(map[string]PluginFactory)
+)
+
+// defaultDNSPlugins is the chain used when dns_plugins is not set. Queries
+// that no plugin answers are always forwarded upstream.
+var defaultDNSPlugins = []string{"blocklist", "zones", "ecs", "ech", "cache", "local", "rewrite"}
+
+// RegisterDNSPlugin makes a plugin available to dns_plugins. It is meant to
+// be called from init functions and panics if name is taken.
+func RegisterDNSPlugin(name string, factory PluginFactory) {
+	pluginMu.Lock()
+	defer pluginMu.Unlock()
+	if _, dup := pluginRegistry[name]; dup {
+		panic("dns plugin registered twice: " + name)
+	}
+	pluginRegistry[name] = factory
+}
+
+func registerStep(name string, fn func(qc *QueryContext, next QueryHandler) ([]byte, error)) {
+	RegisterDNSPlugin(name, func(*config.Config) (DNSPlugin, error) {
+		return pluginFunc{name: name, fn: fn}, nil
+	})
+}
+
+func init() {
+	registerStep("blocklist", blocklistStep)
+	registerStep("zones", zoneStep)
+	registerStep("ecs", ecsStep)
+	registerStep("ech", echStep)
+	registerStep("cache", cacheStep)
+	registerStep("local", localStep)
+	registerStep("rewrite", rewriteStep)
+	registerStep("log", logStep)
+}
+
+func registeredDNSPlugins() []string {
+	pluginMu.RLock()
+	defer pluginMu.RUnlock()
+	names := make([]string, 0, len(pluginRegistry))
+	for name := range pluginRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupDNSPlugin(name string) (PluginFactory, bool) {
+	pluginMu.RLock()
+	defer pluginMu.RUnlock()
+	factory, ok := pluginRegistry[name]
+	return factory, ok
+}
+
+// validateDNSPlugins checks that every name is registered and used once.
+func validateDNSPlugins(names []string) error {
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if _, ok := lookupDNSPlugin(name); !ok {
+			return fmt.Errorf("unknown dns plugin %q (available: %v)", name, registeredDNSPlugins())
+		}
+		if seen[name] {
+			return fmt.Errorf("dns plugin %q listed twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// chainPlugins builds a handler running plugins in order before final.
+func chainPlugins(final QueryHandler, plugins ...DNSPlugin) QueryHandler {
+	h := final
+	for i := len(plugins) - 1; i >= 0; i-- {
+		p, next := plugins[i], h
+		h = func(qc *QueryContext) ([]byte, error) {
+			return p.ServeDNS(qc, next)
+		}
+	}
+	return h
+}
+
+// buildDNSPipeline instantiates the named plugins, ending in forwardStep.
+func buildDNSPipeline(cfg *config.Config, names []string) (QueryHandler, error) {
+	if len(names) == 0 {
+		names = defaultDNSPlugins
+	}
+	plugins := make([]DNSPlugin, 0, len(names))
+	for _, name := range names {
+		factory, ok := lookupDNSPlugin(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown dns plugin %q", name)
+		}
+		p, err := factory(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("dns plugin %s: %w", name, err)
+		}
+		plugins = append(plugins, p)
+	}
+	return chainPlugins(forwardStep, plugins...), nil
+}
+
+// logStep logs every query with its outcome and duration.
+func logStep(qc *QueryContext, next QueryHandler) ([]byte, error) {
+	start := time.Now()
+	resp, err := next(qc)
+	rcode := "error"
+	if err == nil && len(resp) >= 4 {
+		rcode = dns.RcodeToString[int(resp[3]&0x0f)]
+	}
+	qc.Server.logger.Info("dns query",
+		"client", qc.ClientIP,
+		"proto", qc.Protocol,
+		"domain", qc.Name,
+		"type", dns.TypeToString[qc.Qtype],
+		"rcode", rcode,
+		"duration", time.Since(start),
+	)
+	return resp, err
+}
@@ -0,0 +1,87 @@
+package dnsserver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"smartSNI/config"
+)
+
+// recordingPlugin notes that it ran and passes the query on.
+type recordingPlugin struct {
+	name  string
+	trace *[]string
+}
+
+func (p recordingPlugin) Name() string { return p.name }
+
+func (p recordingPlugin) ServeDNS(qc *QueryContext, next QueryHandler) ([]byte, error) {
+	*p.trace = append(*p.trace, p.name)
+	return next(qc)
+}
+
+func TestChainPluginsRunsInOrder(t *testing.T) {
+	var trace []string
+	h := chainPlugins(func(qc *QueryContext) ([]byte, error) {
+		trace = append(trace, "final")
+		return nil, nil
+	}, recordingPlugin{"a", &trace}, recordingPlugin{"b", &trace}, recordingPlugin{"c", &trace})
+
+	if _, err := h(&QueryContext{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(trace, ","); got != "a,b,c,final" {
+		t.Fatalf("plugins ran as %s", got)
+	}
+}
+
+func TestCustomPluginFromConfig(t *testing.T) {
+	RegisterDNSPlugin("test-teapot", func(*config.Config) (DNSPlugin, error) {
+		return pluginFunc{name: "test-teapot", fn: func(qc *QueryContext, next QueryHandler) ([]byte, error) {
+			if qc.Name != "teapot.test" {
+				return next(qc)
+			}
+			resp := new(dns.Msg)
+			resp.SetRcode(qc.Req, dns.RcodeNotImplemented)
+			return resp.Pack()
+		}}, nil
+	})
+	defer func() {
+		pluginMu.Lock()
+		delete(pluginRegistry, "test-teapot")
+		pluginMu.Unlock()
+	}()
+
+	// The custom plugin runs before the local domains would answer
+	s := newTestServer(t, &config.Config{
+		Domains:    map[string]string{"teapot.test": "10.0.0.1"},
+		DNSPlugins: []string{"test-teapot", "local"},
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("teapot.test.", dns.TypeA)
+	packed, _ := req.Pack()
+	out, err := s.Query(context.Background(), ProtoUDP, "192.0.2.1", "", packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m dns.Msg
+	if err := m.Unpack(out); err != nil || m.Rcode != dns.RcodeNotImplemented {
+		t.Fatalf("custom plugin did not answer: %v %s", err, &m)
+	}
+}
+
+func TestValidateDNSPlugins(t *testing.T) {
+	if err := validateDNSPlugins(defaultDNSPlugins); err != nil {
+		t.Fatalf("default chain rejected: %v", err)
+	}
+	if validateDNSPlugins([]string{"cache", "nope"}) == nil {
+		t.Fatal("unknown plugin accepted")
+	}
+	if validateDNSPlugins([]string{"cache", "cache"}) == nil {
+		t.Fatal("duplicate plugin accepted")
+	}
+}
@@ -0,0 +1,568 @@
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"smartSNI/config"
+	"smartSNI/internal/egress"
+)
+
+// ======================== Recursive Resolver ========================
+
+// defaultRootHints are the IPv4 addresses of a.root-servers.net through
+// m.root-servers.net.
+var defaultRootHints = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13",
+	"192.203.230.10", "192.5.5.241", "192.112.36.4", "198.97.190.53",
+	"192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42",
+	"202.12.27.33",
+}
+
+const (
+	resolverAttemptTimeout = 1500 * time.Millisecond
+	resolverRetries        = 2
+	resolverMaxReferrals   = 24 // delegations followed for a single name
+	resolverMaxDepth       = 6  // nested lookups for glueless NS names
+	resolverMaxCNAMEs      = 8
+	resolverMaxInfraTTL    = 24 * time.Hour
+	resolverServerBackoff  = 30 * time.Second
+	resolverMaxInfra       = 10000 // delegations, and nameservers, kept
+)
+
+var errResolverLoop = errors.New("resolution depth exceeded")
+
+// delegation is a zone cut together with the addresses of its nameservers.
+type delegation struct {
+	zone    string
+	servers []string
+	expires time.Time
+}
+
+// serverStats tracks how a nameserver has been responding so faster
+// servers are tried first and unresponsive ones are skipped for a while.
+type serverStats struct {
+	rtt         time.Duration
+	failedUntil time.Time
+	seen        time.Time
+}
+
+// infraCache holds delegations and nameserver health, separate from the
+// answer cache used by processDNSQuery. Each map holds at most
+// resolverMaxInfra entries: when one is full, expired entries are dropped
+// and then random ones, so lookups of random names cannot grow it forever.
+type infraCache struct {
+	mu      sync.RWMutex
+	zones   map[string]*delegation
+	servers map[string]*serverStats
+}
+
+func newInfraCache() *infraCache {
+	return &infraCache{
+		zones:   make(map[string]*delegation),
+		servers: make(map[string]*serverStats),
+	}
+}
+
+// closest returns the deepest cached delegation enclosing name.
+func (c *infraCache) closest(name string, now time.Time) *delegation {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for n := name; ; n = parentName(n) {
+		if d, ok := c.zones[n]; ok && now.Before(d.expires) {
+			return d
+		}
+		if n == "." {
+			return nil
+		}
+	}
+}
+
+func (c *infraCache) store(d *delegation, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.zones[d.zone]; !ok && len(c.zones) >= resolverMaxInfra {
+		evictCache(c.zones, resolverMaxInfra, func(d *delegation) bool { return now.After(d.expires) })
+	}
+	c.zones[d.zone] = d
+}
+
+// evictCache makes room in a cache map that reached limit entries, removing
+// expired entries and then, if that was not enough, random ones down to
+// three quarters of limit. It backs the infrastructure and DNSSEC caches.
+func evictCache[V any](m map[string]V, limit int, expired func(V) bool) {
+	for k, v := range m {
+		if expired(v) {
+			delete(m, k)
+		}
+	}
+	for k := range m {
+		if len(m) < limit*3/4 {
+			return
+		}
+		delete(m, k)
+	}
+}
+
+// order sorts servers by observed RTT, moving recently failed ones last.
+func (c *infraCache) order(servers []string, now time.Time) []string {
+	out := append([]string(nil), servers...)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	rank := func(s string) (bool, time.Duration) {
+		st, ok := c.servers[s]
+		if !ok {
+			return false, 0
+		}
+		return now.Before(st.failedUntil), st.rtt
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		fi, ri := rank(out[i])
+		fj, rj := rank(out[j])
+		if fi != fj {
+			return !fi
+		}
+		return ri < rj
+	})
+	return out
+}
+
+func (c *infraCache) observe(server string, rtt time.Duration, failed bool, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st, ok := c.servers[server]
+	if !ok {
+		if len(c.servers) >= resolverMaxInfra {
+			evictCache(c.servers, resolverMaxInfra, func(st *serverStats) bool { return now.Sub(st.seen) > resolverMaxInfraTTL })
+		}
+		st = &serverStats{rtt: rtt}
+		c.servers[server] = st
+	}
+	st.seen = now
+	if failed {
+		st.failedUntil = now.Add(resolverServerBackoff)
+		return
+	}
+	st.failedUntil = time.Time{}
+	st.rtt = (st.rtt*7 + rtt) / 8
+}
+
+// iterativeResolver resolves names itself, starting from the root hints
+// and following referrals, instead of relying on a third-party upstream.
+type iterativeResolver struct {
+	rootHints     []string
+	port          string
+	timeout       time.Duration
+	retries       int
+	minimizeQNAME atomic.Bool // updated on reload while queries run
+	infra         *infraCache
+	logger        *slog.Logger
+
+	// exchange sends one query to one server; replaceable in tests
+	exchange func(ctx context.Context, m *dns.Msg, server string, timeout time.Duration) (*dns.Msg, time.Duration, error)
+}
+
+func newIterativeResolver(rootHints []string, minimizeQNAME bool) *iterativeResolver {
+	if len(rootHints) == 0 {
+		rootHints = defaultRootHints
+	}
+	r := &iterativeResolver{
+		rootHints: rootHints,
+		port:      "53",
+		timeout:   resolverAttemptTimeout,
+		retries:   resolverRetries,
+		infra:     newInfraCache(),
+		logger:    slog.Default(),
+		exchange:  exchangeUDPWithTCPFallback,
+	}
+	r.minimizeQNAME.Store(minimizeQNAME)
+	return r
+}
+
+func exchangeUDPWithTCPFallback(ctx context.Context, m *dns.Msg, server string, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	c := &dns.Client{Net: "udp", Timeout: timeout}
+	resp, rtt, err := c.ExchangeContext(ctx, m, server)
+	if err == nil && resp.Truncated {
+		c.Net = "tcp"
+		resp, rtt, err = c.ExchangeContext(ctx, m, server)
+	}
+	return resp, rtt, err
+}
+
+// Name implements Upstream.
+func (r *iterativeResolver) Name() string { return config.RecursiveUpstream }
+
+// Exchange implements Upstream: it answers a packed query by iterating from
+// the root.
+func (r *iterativeResolver) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var req dns.Msg
+	if err := req.Unpack(query); err != nil {
+		return nil, err
+	}
+	if len(req.Question) == 0 {
+		return nil, errors.New("no DNS question")
+	}
+	q := req.Question[0]
+	do := false
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+
+	result, err := r.resolve(ctx, dns.CanonicalName(q.Name), q.Qtype, do, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(&req)
+	resp.RecursionAvailable = true
+	resp.Rcode = result.Rcode
+	resp.Answer = result.Answer
+	resp.Ns = result.Ns
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(opt.UDPSize(), do)
+	}
+	return resp.Pack()
+}
+
+// resolve follows CNAMEs across zones and returns the combined answer.
+func (r *iterativeResolver) resolve(ctx context.Context, name string, qtype uint16, do bool, depth int) (*dns.Msg, error) {
+	if depth > resolverMaxDepth {
+		return nil, errResolverLoop
+	}
+	out := new(dns.Msg)
+	seen := make(map[string]bool)
+	for i := 0; i <= resolverMaxCNAMEs; i++ {
+		resp, err := r.lookup(ctx, name, qtype, do, depth)
+		if err != nil {
+			return nil, err
+		}
+		answer := answerChain(resp.Answer, name)
+		out.Rcode = resp.Rcode
+		out.Answer = append(out.Answer, answer...)
+		out.Ns = resp.Ns
+
+		target := cnameTarget(answer, name, qtype)
+		if target == "" || seen[target] {
+			return out, nil
+		}
+		seen[name] = true
+		name = target
+	}
+	return out, nil
+}
+
+// answerChain returns the records of answer owned by name or by the CNAME
+// targets it leads to. Anything else a server adds is not what was asked
+// and would poison the reply.
+func answerChain(answer []dns.RR, name string) []dns.RR {
+	owners := make(map[string]bool)
+	for n := name; n != "" && !owners[n]; {
+		owners[n] = true
+		next := ""
+		for _, rr := range answer {
+			if c, ok := rr.(*dns.CNAME); ok && dns.CanonicalName(c.Hdr.Name) == n {
+				next = dns.CanonicalName(c.Target)
+			}
+		}
+		n = next
+	}
+	var out []dns.RR
+	for _, rr := range answer {
+		if owners[dns.CanonicalName(rr.Header().Name)] {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// cnameTarget returns where a CNAME answer for name points, unless the
+// answer already contains the requested type for the target.
+func cnameTarget(answer []dns.RR, name string, qtype uint16) string {
+	if qtype == dns.TypeCNAME || qtype == dns.TypeANY {
+		return ""
+	}
+	target := ""
+	for _, rr := range answer {
+		if c, ok := rr.(*dns.CNAME); ok && dns.CanonicalName(c.Hdr.Name) == name {
+			target = dns.CanonicalName(c.Target)
+		}
+	}
+	if target == "" {
+		return ""
+	}
+	for _, rr := range answer {
+		if rr.Header().Rrtype == qtype && dns.CanonicalName(rr.Header().Name) == target {
+			return ""
+		}
+	}
+	return target
+}
+
+// lookup walks referrals from the closest known delegation down to the
+// servers authoritative for name. With QNAME minimisation (RFC 9156) each
+// zone only sees one more label than it needs to.
+func (r *iterativeResolver) lookup(ctx context.Context, name string, qtype uint16, do bool, depth int) (*dns.Msg, error) {
+	now := time.Now()
+	zone, servers := ".", r.rootHints
+	if d := r.infra.closest(name, now); d != nil {
+		zone, servers = d.zone, d.servers
+	}
+	known := zone
+
+	for i := 0; i < resolverMaxReferrals; i++ {
+		qname, qt := name, qtype
+		if r.minimizeQNAME.Load() && known != name {
+			qname, qt = childOf(known, name), dns.TypeA
+		}
+
+		resp, err := r.queryServers(ctx, servers, qname, qt, do)
+		if err != nil {
+			return nil, fmt.Errorf("resolving %s in %s: %w", qname, zone, err)
+		}
+
+		if cut, ns := referral(resp, zone, qname); cut != "" {
+			addrs, ttl := r.nameserverAddrs(ctx, resp, ns, zone, do, depth)
+			if len(addrs) == 0 {
+				return nil, fmt.Errorf("no usable nameserver addresses for %s", cut)
+			}
+			if ttl > resolverMaxInfraTTL {
+				ttl = resolverMaxInfraTTL
+			}
+			now := time.Now()
+			r.infra.store(&delegation{zone: cut, servers: addrs, expires: now.Add(ttl)}, now)
+			zone, servers, known = cut, addrs, cut
+			continue
+		}
+
+		if qname != name {
+			// Nothing exists below a name that does not exist (RFC 8020)
+			if resp.Rcode == dns.RcodeNameError {
+				resp.Question = []dns.Question{{Name: name, Qtype: qtype, Qclass: dns.ClassINET}}
+				resp.Answer = nil
+				return resp, nil
+			}
+			known = qname
+			continue
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("too many referrals resolving %s", name)
+}
+
+// childOf returns the name one label below ancestor on the way to name.
+func childOf(ancestor, name string) string {
+	labels := dns.SplitDomainName(name)
+	n := len(labels) - dns.CountLabel(ancestor) - 1
+	if n < 0 {
+		return name
+	}
+	return dns.Fqdn(strings.Join(labels[n:], "."))
+}
+
+// referral reports the zone cut a non-authoritative answer delegates to.
+// Only cuts strictly below the current zone and above qname are accepted,
+// which keeps servers from redirecting queries outside their bailiwick.
+func referral(resp *dns.Msg, zone, qname string) (string, []*dns.NS) {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 || resp.Authoritative {
+		return "", nil
+	}
+	var cut string
+	var ns []*dns.NS
+	for _, rr := range resp.Ns {
+		n, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := dns.CanonicalName(n.Hdr.Name)
+		if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, qname) {
+			continue
+		}
+		if cut != "" && owner != cut {
+			continue
+		}
+		cut = owner
+		ns = append(ns, n)
+	}
+	return cut, ns
+}
+
+// nameserverAddrs collects addresses for a delegation from in-bailiwick glue
+// and, when that is missing, by resolving the nameserver names.
+func (r *iterativeResolver) nameserverAddrs(ctx context.Context, resp *dns.Msg, ns []*dns.NS, zone string, do bool, depth int) ([]string, time.Duration) {
+	ttl := resolverMaxInfraTTL
+	glue := make(map[string][]string)
+	for _, rr := range resp.Extra {
+		owner := dns.CanonicalName(rr.Header().Name)
+		if !dns.IsSubDomain(zone, owner) {
+			continue
+		}
+		switch a := rr.(type) {
+		case *dns.A:
+			glue[owner] = append(glue[owner], a.A.String())
+		case *dns.AAAA:
+			glue[owner] = append(glue[owner], a.AAAA.String())
+		}
+	}
+
+	var addrs []string
+	for _, n := range ns {
+		if d := time.Duration(n.Hdr.Ttl) * time.Second; d < ttl {
+			ttl = d
+		}
+		host := dns.CanonicalName(n.Ns)
+		if g, ok := glue[host]; ok {
+			addrs = append(addrs, g...)
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, ttl
+	}
+
+	for _, n := range ns {
+		res, err := r.resolve(ctx, dns.CanonicalName(n.Ns), dns.TypeA, do, depth+1)
+		if err != nil {
+			r.logger.Debug("resolver: nameserver lookup failed", "ns", n.Ns, "error", err)
+			continue
+		}
+		for _, rr := range res.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				addrs = append(addrs, a.A.String())
+			}
+		}
+		if len(addrs) > 0 {
+			break
+		}
+	}
+	return addrs, ttl
+}
+
+// queryServers asks the servers of one zone in turn, retrying the whole
+// set before giving up.
+func (r *iterativeResolver) queryServers(ctx context.Context, servers []string, name string, qtype uint16, do bool) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.RecursionDesired = false
+	m.SetEdns0(ednsUDPSize, do)
+
+	var lastErr error
+	for attempt := 0; attempt <= r.retries; attempt++ {
+		for _, server := range r.infra.order(servers, time.Now()) {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			m.Id = dns.Id()
+			resp, rtt, err := r.exchange(ctx, m, net.JoinHostPort(server, r.port), r.timeout)
+			if err == nil && resp.Rcode != dns.RcodeServerFailure && resp.Rcode != dns.RcodeRefused {
+				r.infra.observe(server, rtt, false, time.Now())
+				return resp, nil
+			}
+			if err == nil {
+				err = fmt.Errorf("%s answered %s", server, dns.RcodeToString[resp.Rcode])
+			}
+			r.infra.observe(server, 0, true, time.Now())
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+// ======================== Upstreams ========================
+
+// Upstream answers queries that are not handled locally.
+type Upstream interface {
+	Name() string
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// dohUpstreamServer forwards queries to a DNS-over-HTTPS endpoint.
+type dohUpstreamServer struct {
+	url    string
+	client *http.Client
+}
+
+func (u *dohUpstreamServer) Name() string { return u.url }
+
+func (u *dohUpstreamServer) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	return queryUpstreamDoH(ctx, u.client, u.url, query)
+}
+
+// getRecursiveResolver returns the server's iterative resolver, keeping its
+// infrastructure cache across reloads unless the root hints changed.
+func (s *Server) getRecursiveResolver(cfg *config.Config) *iterativeResolver {
+	s.recursiveMu.Lock()
+	defer s.recursiveMu.Unlock()
+	hints := strings.Join(cfg.RecursiveRootHints, ",")
+	if s.recursive == nil || hints != s.recursiveHints {
+		s.recursive = newIterativeResolver(cfg.RecursiveRootHints, !cfg.RecursiveNoQNAMEMin)
+		s.recursive.logger = s.logger
+		s.recursiveHints = hints
+	}
+	s.recursive.minimizeQNAME.Store(!cfg.RecursiveNoQNAMEMin)
+	return s.recursive
+}
+
+// newDoHClient returns the HTTP client for DoH upstreams, connecting with
+// dial when it is not nil. A custom dialer disables HTTP/2 unless it is
+// forced, which would cost DoH its multiplexing.
+func newDoHClient(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Client {
+	return &http.Client{
+		Timeout: 4 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dial,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     30 * time.Second,
+			DisableCompression:  false,
+			TLSHandshakeTimeout: 3 * time.Second,
+		},
+	}
+}
+
+// upstreamClient returns the DoH client for cfg: the shared one, or one
+// tunnelling through upstream_doh_egress, kept across reloads while the
+// chain is unchanged.
+func (s *Server) upstreamClient(cfg *config.Config) (*http.Client, error) {
+	if len(cfg.UpstreamDoHEgress) == 0 {
+		return s.dohClient, nil
+	}
+	s.egressMu.Lock()
+	defer s.egressMu.Unlock()
+	key := strings.Join(cfg.UpstreamDoHEgress, " ")
+	if s.egressDoH == nil || key != s.egressKey {
+		d, err := egress.New(cfg.UpstreamDoHEgress, &net.Dialer{Timeout: 3 * time.Second})
+		if err != nil {
+			return nil, fmt.Errorf("upstream_doh_egress: %w", err)
+		}
+		if s.egressDoH != nil {
+			s.egressDoH.CloseIdleConnections()
+		}
+		s.egressDoH = newDoHClient(d.DialContext)
+		s.egressKey = key
+	}
+	return s.egressDoH, nil
+}
+
+// buildUpstreams turns the upstream_doh list into Upstreams, in order.
+func (s *Server) buildUpstreams(cfg *config.Config, client *http.Client) []Upstream {
+	var out []Upstream
+	for _, u := range cfg.UpstreamDOH {
+		if u == config.RecursiveUpstream {
+			out = append(out, s.getRecursiveResolver(cfg))
+			continue
+		}
+		out = append(out, &dohUpstreamServer{url: u, client: client})
+	}
+	return out
+}
@@ -0,0 +1,364 @@
+package dnsserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"smartSNI/config"
+)
+
+// fakeAuthority serves one zone from memory and records the names it was
+// asked about.
+type fakeAuthority struct {
+	zone    string
+	records []dns.RR
+	cuts    map[string][]dns.RR // delegated zone -> NS and glue records
+
+	mu   sync.Mutex
+	seen []string
+	junk []dns.RR // added to every answer, as a poisoning server would
+}
+
+func (f *fakeAuthority) queries() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.seen...)
+}
+
+func (f *fakeAuthority) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	name := dns.CanonicalName(q.Name)
+	f.mu.Lock()
+	f.seen = append(f.seen, name)
+	junk := f.junk
+	f.mu.Unlock()
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+
+	for cut, rrs := range f.cuts {
+		if !dns.IsSubDomain(cut, name) {
+			continue
+		}
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeNS {
+				resp.Ns = append(resp.Ns, rr)
+			} else {
+				resp.Extra = append(resp.Extra, rr)
+			}
+		}
+		_ = w.WriteMsg(resp)
+		return
+	}
+
+	resp.Authoritative = true
+	exists := false
+	for _, rr := range f.records {
+		owner := dns.CanonicalName(rr.Header().Name)
+		if dns.IsSubDomain(name, owner) {
+			exists = true
+		}
+		if owner != name {
+			continue
+		}
+		if rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	if len(resp.Answer) > 0 {
+		resp.Answer = append(resp.Answer, junk...)
+	}
+	if !exists {
+		resp.Rcode = dns.RcodeNameError
+	}
+	if len(resp.Answer) == 0 {
+		resp.Ns = []dns.RR{&dns.SOA{
+			Hdr: dns.RR_Header{Name: f.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+			Ns:  "ns." + f.zone, Mbox: "admin." + f.zone, Serial: 1, Minttl: 60,
+		}}
+	}
+	_ = w.WriteMsg(resp)
+}
+
+// startFakeAuthorities serves each authority on its own loopback address,
+// all on the same UDP port, since glue records carry no port.
+func startFakeAuthorities(t *testing.T, servers map[string]*fakeAuthority) string {
+	t.Helper()
+	for attempt := 0; attempt < 10; attempt++ {
+		probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		port := strconv.Itoa(probe.LocalAddr().(*net.UDPAddr).Port)
+		probe.Close()
+
+		var started []*dns.Server
+		ok := true
+		for ip, auth := range servers {
+			pc, err := net.ListenPacket("udp", net.JoinHostPort(ip, port))
+			if err != nil {
+				ok = false
+				break
+			}
+			srv := &dns.Server{PacketConn: pc, Handler: auth}
+			go func() { _ = srv.ActivateAndServe() }()
+			started = append(started, srv)
+		}
+		if ok {
+			t.Cleanup(func() {
+				for _, srv := range started {
+					_ = srv.Shutdown()
+				}
+			})
+			return port
+		}
+		for _, srv := range started {
+			_ = srv.Shutdown()
+		}
+	}
+	t.Fatal("could not find a free port on all loopback addresses")
+	return ""
+}
+
+type testHierarchy struct {
+	root, com, example *fakeAuthority
+	resolver           *iterativeResolver
+}
+
+func newTestHierarchy(t *testing.T, rootHints ...string) *testHierarchy {
+	t.Helper()
+	h := &testHierarchy{
+		root: &fakeAuthority{zone: ".", cuts: map[string][]dns.RR{
+			"com.": {
+				mustRR(t, "com. 3600 IN NS ns1.com."),
+				mustRR(t, "ns1.com. 3600 IN A 127.0.0.2"),
+			},
+		}},
+		com: &fakeAuthority{zone: "com.", cuts: map[string][]dns.RR{
+			"example.com.": {
+				mustRR(t, "example.com. 3600 IN NS ns.example.com."),
+				mustRR(t, "ns.example.com. 3600 IN A 127.0.0.3"),
+				// out-of-bailiwick glue must be ignored
+				mustRR(t, "www.victim.com. 3600 IN A 203.0.113.66"),
+			},
+			"glueless.com.": {
+				mustRR(t, "glueless.com. 3600 IN NS ns.example.com."),
+			},
+		}},
+		example: &fakeAuthority{zone: "example.com.", records: []dns.RR{
+			mustRR(t, "ns.example.com. 300 IN A 127.0.0.3"),
+			mustRR(t, "www.example.com. 300 IN A 192.0.2.10"),
+			mustRR(t, "alias.example.com. 300 IN CNAME www.example.com."),
+			mustRR(t, "far.example.com. 300 IN CNAME www.glueless.com."),
+			mustRR(t, "www.glueless.com. 300 IN A 192.0.2.20"),
+		}},
+	}
+	port := startFakeAuthorities(t, map[string]*fakeAuthority{
+		"127.0.0.1": h.root,
+		"127.0.0.2": h.com,
+		"127.0.0.3": h.example,
+	})
+	if len(rootHints) == 0 {
+		rootHints = []string{"127.0.0.1"}
+	}
+	h.resolver = newIterativeResolver(rootHints, true)
+	h.resolver.port = port
+	h.resolver.timeout = 300 * time.Millisecond
+	return h
+}
+
+func (h *testHierarchy) query(t *testing.T, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	packed, err := req.Pack()
+	if err != nil {
+		t.Fatalf("pack: %v", err)
+	}
+	out, err := h.resolver.Exchange(context.Background(), packed)
+	if err != nil {
+		t.Fatalf("resolve %s: %v", name, err)
+	}
+	var resp dns.Msg
+	if err := resp.Unpack(out); err != nil {
+		t.Fatalf("unpack: %v", err)
+	}
+	if resp.Id != req.Id || !resp.RecursionAvailable {
+		t.Fatalf("reply does not match query: %s", &resp)
+	}
+	return &resp
+}
+
+func answerAddrs(m *dns.Msg) []string {
+	var out []string
+	for _, rr := range m.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			out = append(out, a.A.String())
+		}
+	}
+	return out
+}
+
+func TestRecursiveResolvesThroughReferrals(t *testing.T) {
+	h := newTestHierarchy(t)
+	resp := h.query(t, "www.example.com.", dns.TypeA)
+	if got := answerAddrs(resp); len(got) != 1 || got[0] != "192.0.2.10" {
+		t.Fatalf("got %v, want [192.0.2.10]", got)
+	}
+}
+
+func TestRecursiveQNAMEMinimization(t *testing.T) {
+	h := newTestHierarchy(t)
+	h.query(t, "www.example.com.", dns.TypeA)
+	for _, q := range h.root.queries() {
+		if q != "com." {
+			t.Errorf("root saw %q, want only com.", q)
+		}
+	}
+	for _, q := range h.com.queries() {
+		if q != "example.com." {
+			t.Errorf("com saw %q, want only example.com.", q)
+		}
+	}
+}
+
+func TestRecursiveNXDOMAIN(t *testing.T) {
+	h := newTestHierarchy(t)
+	resp := h.query(t, "missing.example.com.", dns.TypeA)
+	if resp.Rcode != dns.RcodeNameError || len(resp.Answer) != 0 {
+		t.Fatalf("got %s, want empty NXDOMAIN", resp)
+	}
+
+	// A missing intermediate label ends resolution early (RFC 8020)
+	resp = h.query(t, "a.b.nothere.com.", dns.TypeA)
+	if resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("got rcode %s, want NXDOMAIN", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestRecursiveFollowsCNAMEs(t *testing.T) {
+	h := newTestHierarchy(t)
+	resp := h.query(t, "alias.example.com.", dns.TypeA)
+	if len(resp.Answer) != 2 || resp.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Fatalf("want CNAME followed by A, got %v", resp.Answer)
+	}
+
+	// The target lives in a zone whose nameserver has no glue
+	resp = h.query(t, "far.example.com.", dns.TypeA)
+	if got := answerAddrs(resp); len(got) != 1 || got[0] != "192.0.2.20" {
+		t.Fatalf("got %v, want [192.0.2.20]", got)
+	}
+}
+
+func TestRecursiveDropsUnrelatedAnswers(t *testing.T) {
+	h := newTestHierarchy(t)
+	h.example.mu.Lock()
+	h.example.junk = []dns.RR{
+		mustRR(t, "www.victim.com. 300 IN A 203.0.113.66"),
+		mustRR(t, "other.example.com. 300 IN A 203.0.113.67"),
+	}
+	h.example.mu.Unlock()
+	for _, name := range []string{"www.example.com.", "alias.example.com."} {
+		resp := h.query(t, name, dns.TypeA)
+		for _, rr := range resp.Answer {
+			if owner := rr.Header().Name; owner != name && owner != "www.example.com." {
+				t.Errorf("%s: unrelated record %v in the answer", name, rr)
+			}
+		}
+		if got := answerAddrs(resp); len(got) != 1 || got[0] != "192.0.2.10" {
+			t.Errorf("%s: got %v, want [192.0.2.10]", name, got)
+		}
+	}
+}
+
+func TestRecursiveIgnoresOutOfBailiwickGlue(t *testing.T) {
+	h := newTestHierarchy(t)
+	h.query(t, "www.example.com.", dns.TypeA)
+	if d := h.resolver.infra.closest("www.victim.com.", time.Now()); d != nil && d.zone != "com." {
+		t.Fatalf("out-of-bailiwick glue created delegation %q", d.zone)
+	}
+}
+
+func TestRecursiveReusesInfraCache(t *testing.T) {
+	h := newTestHierarchy(t)
+	h.query(t, "www.example.com.", dns.TypeA)
+	rootQueries := len(h.root.queries())
+
+	h.query(t, "alias.example.com.", dns.TypeA)
+	if got := len(h.root.queries()); got != rootQueries {
+		t.Fatalf("root queried again (%d -> %d) despite cached delegation", rootQueries, got)
+	}
+}
+
+func TestInfraCacheBounded(t *testing.T) {
+	c := newInfraCache()
+	now := time.Now()
+	c.store(&delegation{zone: "stale.", expires: now.Add(-time.Second)}, now)
+	c.store(&delegation{zone: "com.", expires: now.Add(time.Hour)}, now)
+	for i := 0; len(c.zones) < resolverMaxInfra; i++ {
+		c.store(&delegation{zone: "n" + strconv.Itoa(i) + ".com.", expires: now.Add(time.Hour)}, now)
+	}
+	c.store(&delegation{zone: "new.com.", expires: now.Add(time.Hour)}, now)
+	if n := len(c.zones); n >= resolverMaxInfra || n < resolverMaxInfra/2 {
+		t.Fatalf("%d delegations after eviction", n)
+	}
+	if _, ok := c.zones["stale."]; ok {
+		t.Fatal("expired delegation kept")
+	}
+	if d := c.closest("www.new.com.", now); d == nil || d.zone != "new.com." {
+		t.Fatalf("stored delegation missing: %+v", d)
+	}
+
+	for i := 0; i <= resolverMaxInfra; i++ {
+		c.observe("192.0.2.1:"+strconv.Itoa(i), time.Millisecond, false, now)
+	}
+	if n := len(c.servers); n >= resolverMaxInfra {
+		t.Fatalf("%d nameservers tracked", n)
+	}
+}
+
+func TestRecursiveSkipsDeadRootHint(t *testing.T) {
+	h := newTestHierarchy(t, "127.0.0.9", "127.0.0.1")
+	resp := h.query(t, "www.example.com.", dns.TypeA)
+	if got := answerAddrs(resp); len(got) != 1 {
+		t.Fatalf("got %v, want one address", got)
+	}
+}
+
+func TestBuildUpstreams(t *testing.T) {
+	cfg := &config.Config{UpstreamDOH: []string{"https://1.1.1.1/dns-query", config.RecursiveUpstream}}
+	s := newTestServer(t, cfg)
+	ups := s.buildUpstreams(cfg, s.dohClient)
+	if len(ups) != 2 || ups[0].Name() != "https://1.1.1.1/dns-query" || ups[1].Name() != config.RecursiveUpstream {
+		t.Fatalf("unexpected upstreams %v", ups)
+	}
+	if s.buildUpstreams(cfg, s.dohClient)[1] != ups[1] {
+		t.Fatal("recursive resolver should be reused across reloads")
+	}
+}
+
+func TestDoHClientUsesHTTP2WithCustomDialer(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := newDoHClient((&net.Dialer{}).DialContext)
+	client.Transport.(*http.Transport).TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("DoH client spoke %s", resp.Proto)
+	}
+}
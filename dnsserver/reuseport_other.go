@@ -0,0 +1,11 @@
+//go:build !linux
+
+package dnsserver
+
+import "syscall"
+
+const reusePortSupported = false
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
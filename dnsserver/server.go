@@ -0,0 +1,403 @@
+// Package dnsserver answers DNS queries over DoH, DoT and plain UDP/TCP,
+// applying the local domain rules, hosted zones and blocklists before
+// forwarding everything else upstream.
+package dnsserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+
+	"smartSNI/config"
+	"smartSNI/metrics"
+	"smartSNI/users"
+)
+
+var defaultTTL uint32 = 3600
+
+// Options configures a Server. Config is required; the rest default to
+// fresh instances.
+type Options struct {
+	Config  *config.Store
+	Users   *users.Store
+	Metrics *metrics.Metrics
+	Logger  *slog.Logger
+
+	// ReloadConfig is called by the /admin/reload endpoint of the DoH server.
+	ReloadConfig func() error
+}
+
+// Server answers DNS queries. Create it with New.
+type Server struct {
+	cfg          *config.Store
+	users        *users.Store
+	metrics      *metrics.Metrics
+	logger       *slog.Logger
+	reloadConfig func() error
+
+	limiter    *rate.Limiter
+	ipLimiters sync.Map // map[string]*rate.Limiter - per-IP rate limiting
+	authTokens sync.Map // map[string]bool - valid auth tokens
+	cache      sync.Map // map[string]*CacheEntry
+
+	dohClient *http.Client
+	egressMu  sync.Mutex
+	egressDoH *http.Client // dohClient going through egressKey's proxy chain
+	egressKey string
+	upstreams atomic.Value // []Upstream - multiple upstream servers
+	zones     atomic.Value // *zoneSet
+	pipeline  atomic.Value // queryHandler
+	dnssec    atomic.Value // *dnssecValidator, nil when validation is disabled
+
+	recursiveMu    sync.Mutex
+	recursive      *iterativeResolver
+	recursiveHints string
+
+	startTime time.Time
+}
+
+// CacheEntry represents a cached DNS response
+type CacheEntry struct {
+	Response  []byte
+	ExpiresAt time.Time
+	mu        sync.RWMutex
+}
+
+// New creates a Server for the configuration in opts.Config.
+func New(opts Options) (*Server, error) {
+	s := &Server{
+		cfg:          opts.Config,
+		users:        opts.Users,
+		metrics:      opts.Metrics,
+		logger:       opts.Logger,
+		reloadConfig: opts.ReloadConfig,
+		// Shared rate limiter for DoH/DoT (50 req/s, burst 100)
+		limiter:   rate.NewLimiter(rate.Limit(50), 100),
+		dohClient: newDoHClient(nil),
+		startTime: time.Now(),
+	}
+	if s.users == nil {
+		s.users = users.NewStore(opts.Logger)
+	}
+	if s.metrics == nil {
+		s.metrics = metrics.New()
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+	if err := s.Reload(s.cfg.Get()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload applies cfg. Zones, the plugin chain and the DNSSEC settings are
+// all prepared first, so a broken config leaves the running one untouched.
+func (s *Server) Reload(cfg *config.Config) error {
+	if err := validateDNSPlugins(cfg.DNSPlugins); err != nil {
+		return err
+	}
+	zones, err := loadZones(cfg)
+	if err != nil {
+		return err
+	}
+	pipeline, err := buildDNSPipeline(cfg, cfg.DNSPlugins)
+	if err != nil {
+		return err
+	}
+	validator, err := s.newDNSSECValidator(cfg)
+	if err != nil {
+		return err
+	}
+	client, err := s.upstreamClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	s.cfg.Set(cfg)
+	s.zones.Store(zones)
+	s.pipeline.Store(pipeline)
+	s.upstreams.Store(s.buildUpstreams(cfg, client))
+	s.dnssec.Store(validator)
+
+	// Update auth tokens
+	s.authTokens.Range(func(key, value interface{}) bool {
+		s.authTokens.Delete(key)
+		return true
+	})
+	for _, token := range cfg.AuthTokens {
+		s.authTokens.Store(token, true)
+	}
+
+	if len(zones.zones) > 0 {
+		s.logger.Info("authoritative zones loaded", "zones", len(zones.zones))
+	}
+	return nil
+}
+
+func (s *Server) config() *config.Config {
+	return s.cfg.Get()
+}
+
+// Query answers a packed DNS query as if it had arrived over protocol from
+// clientIP, running it through the full plugin chain.
+func (s *Server) Query(ctx context.Context, protocol, clientIP, apiKey string, query []byte) ([]byte, error) {
+	qc, cancel := s.newQueryContext(ctx, protocol, clientIP, apiKey)
+	defer cancel()
+	return s.processDNSQuery(qc, query)
+}
+
+// ======================== Utilities ========================
+
+func trimDot(s string) string { return strings.TrimSuffix(s, ".") }
+
+// userAuthorized checks IP-based access when user management is enabled.
+func (s *Server) userAuthorized(ip string) bool {
+	if !s.config().UserManagement {
+		return true // User management disabled, allow all
+	}
+	return s.users.AuthorizeIP(ip)
+}
+
+// userAuthorizedByAPIKey checks API key access (for dynamic IPs).
+func (s *Server) userAuthorizedByAPIKey(apiKey string) bool {
+	if !s.config().UserManagement {
+		return true // User management disabled, allow all
+	}
+	return s.users.AuthorizeAPIKey(apiKey)
+}
+
+func (s *Server) getIPLimiter(ip string) *rate.Limiter {
+	cfg := s.config()
+	val, exists := s.ipLimiters.Load(ip)
+	if !exists {
+		limiter := rate.NewLimiter(rate.Limit(cfg.RateLimitPerIP), cfg.RateLimitBurstIP)
+		s.ipLimiters.Store(ip, limiter)
+		return limiter
+	}
+	return val.(*rate.Limiter)
+}
+
+// ======================== DNS Cache ========================
+
+// getCacheKey identifies an answer by its question, the DO and CD bits,
+// the client subnet sent upstream and the domain policy scope, so that
+// answers tailored to different subnets, users (or carrying DNSSEC records)
+// are cached separately. The message ID is deliberately not part of the key.
+func getCacheKey(req *dns.Msg, subnet, scope string) string {
+	q := req.Question[0]
+	do := false
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	return fmt.Sprintf("%s|%d|%d|%t|%t|%s|%s", strings.ToLower(q.Name), q.Qtype, q.Qclass, do, req.CheckingDisabled, subnet, scope)
+}
+
+func (s *Server) getCachedResponse(key string, id uint16) ([]byte, bool) {
+	val, exists := s.cache.Load(key)
+	if !exists {
+		s.metrics.IncCacheMisses()
+		return nil, false
+	}
+
+	entry := val.(*CacheEntry)
+	entry.mu.RLock()
+	defer entry.mu.RUnlock()
+
+	if time.Now().After(entry.ExpiresAt) {
+		s.cache.Delete(key)
+		s.metrics.IncCacheMisses()
+		return nil, false
+	}
+
+	s.metrics.IncCacheHits()
+	s.logger.Debug("cache hit", "key", key)
+
+	// Answer with the ID of the query being served
+	resp := make([]byte, len(entry.Response))
+	copy(resp, entry.Response)
+	if len(resp) >= 2 {
+		binary.BigEndian.PutUint16(resp, id)
+	}
+	return resp, true
+}
+
+func (s *Server) setCachedResponse(key string, response []byte) {
+	cfg := s.config()
+	if cfg.CacheTTL <= 0 {
+		return
+	}
+
+	entry := &CacheEntry{
+		Response:  response,
+		ExpiresAt: time.Now().Add(time.Duration(cfg.CacheTTL) * time.Second),
+	}
+
+	s.cache.Store(key, entry)
+	s.logger.Debug("cached response", "key", key, "ttl", cfg.CacheTTL)
+}
+
+// CleanExpiredCache drops expired cache entries every minute until ctx ends.
+func (s *Server) CleanExpiredCache(ctx context.Context) {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		s.cache.Range(func(key, value interface{}) bool {
+			entry := value.(*CacheEntry)
+			entry.mu.RLock()
+			expired := now.After(entry.ExpiresAt)
+			entry.mu.RUnlock()
+
+			if expired {
+				s.cache.Delete(key)
+				s.logger.Debug("removed expired cache entry", "key", key)
+			}
+			return true
+		})
+	}
+}
+
+// ======================== DNS Handling ========================
+
+func buildLocalDNSResponse(req *dns.Msg, ipStr string) ([]byte, error) {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", ipStr)
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	resp.Compress = true
+
+	q := req.Question[0]
+	name := q.Name
+
+	// Answer only if the type matches the IP version.
+	switch q.Qtype {
+	case dns.TypeA:
+		if ip4 := ip.To4(); ip4 != nil {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    defaultTTL,
+				},
+				A: ip4,
+			})
+		}
+	case dns.TypeAAAA:
+		if ip16 := ip.To16(); ip16 != nil && ip.To4() == nil {
+			resp.Answer = append(resp.Answer, &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:   name,
+					Rrtype: dns.TypeAAAA,
+					Class:  dns.ClassINET,
+					Ttl:    defaultTTL,
+				},
+				AAAA: ip16,
+			})
+		}
+	case dns.TypeANY:
+		// Return whichever record matches the IP family
+		if ip4 := ip.To4(); ip4 != nil {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    defaultTTL,
+				},
+				A: ip4,
+			})
+		} else if ip16 := ip.To16(); ip16 != nil {
+			resp.Answer = append(resp.Answer, &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:   name,
+					Rrtype: dns.TypeAAAA,
+					Class:  dns.ClassINET,
+					Ttl:    defaultTTL,
+				},
+				AAAA: ip16,
+			})
+		}
+	default:
+		// NOERROR / NODATA for other types
+	}
+
+	return resp.Pack()
+}
+
+// forwardQuery sends query to the configured upstreams with failover and
+// returns the first successful answer.
+func (s *Server) forwardQuery(ctx context.Context, query []byte, qName string) ([]byte, error) {
+	upstreams := s.upstreams.Load().([]Upstream)
+	var lastErr error
+
+	for _, upstream := range upstreams {
+		resp, err := upstream.Exchange(ctx, query)
+		if err == nil {
+			s.logger.Debug("upstream query success", "domain", qName, "upstream", upstream.Name())
+			return resp, nil
+		}
+		s.logger.Warn("upstream query failed", "domain", qName, "upstream", upstream.Name(), "error", err)
+		lastErr = err
+	}
+
+	return nil, fmt.Errorf("all upstream servers failed, last error: %w", lastErr)
+}
+
+func queryUpstreamDoH(ctx context.Context, client *http.Client, upstream string, query []byte) ([]byte, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", upstream, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/dns-message")
+	httpReq.Header.Set("Accept", "application/dns-message")
+	httpReq.Header.Set("User-Agent", "smartSNI/2.0")
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		slurp, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("upstream status %d: %s", resp.StatusCode, string(slurp))
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func buildBlockedResponse(req *dns.Msg) ([]byte, error) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	resp.Rcode = dns.RcodeRefused
+	return resp.Pack()
+}
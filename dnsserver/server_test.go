@@ -0,0 +1,70 @@
+package dnsserver
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+
+	"smartSNI/config"
+)
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// newTestServer builds a Server for cfg that logs nowhere.
+func newTestServer(t *testing.T, cfg *config.Config) *Server {
+	t.Helper()
+	s, err := New(Options{
+		Config: config.NewStore(cfg),
+		Logger: discardLogger(),
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return s
+}
+
+func TestReloadKeepsRunningConfigOnError(t *testing.T) {
+	s := newTestServer(t, &config.Config{Domains: map[string]string{"local.test": "10.0.0.1"}})
+
+	if err := s.Reload(&config.Config{DNSPlugins: []string{"nope"}}); err == nil {
+		t.Fatal("unknown plugin accepted")
+	}
+	if err := s.Reload(&config.Config{Zones: map[string]string{"example.org": "/nonexistent.zone"}}); err == nil {
+		t.Fatal("missing zone file accepted")
+	}
+	if got := s.config().Domains["local.test"]; got != "10.0.0.1" {
+		t.Fatalf("running config replaced by a rejected one: %v", s.config().Domains)
+	}
+
+	if err := s.Reload(&config.Config{Domains: map[string]string{"local.test": "10.0.0.2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.config().Domains["local.test"]; got != "10.0.0.2" {
+		t.Fatalf("reload not applied, got %q", got)
+	}
+}
+
+func TestUpstreamClientEgress(t *testing.T) {
+	s := newTestServer(t, &config.Config{})
+	if c, _ := s.upstreamClient(&config.Config{}); c != s.dohClient {
+		t.Fatal("client without egress is not the shared one")
+	}
+
+	viaSocks := &config.Config{UpstreamDoHEgress: []string{"socks5://127.0.0.1:1080"}}
+	c1, err := s.upstreamClient(viaSocks)
+	if err != nil || c1 == s.dohClient {
+		t.Fatalf("egress client: %v", err)
+	}
+	if c2, _ := s.upstreamClient(viaSocks); c2 != c1 {
+		t.Fatal("egress client rebuilt for the same chain")
+	}
+	if c3, _ := s.upstreamClient(&config.Config{UpstreamDoHEgress: []string{"http://127.0.0.1:3128"}}); c3 == c1 {
+		t.Fatal("egress client kept after the chain changed")
+	}
+
+	if err := s.Reload(&config.Config{UpstreamDoHEgress: []string{"ftp://proxy:21"}}); err == nil {
+		t.Fatal("bad egress URL accepted")
+	}
+}
@@ -0,0 +1,243 @@
+package dnsserver
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/miekg/dns"
+
+	"smartSNI/config"
+)
+
+// ======================== Authoritative Zones ========================
+
+// authZone is one zone loaded from an RFC 1035 master file.
+type authZone struct {
+	origin string
+	soa    *dns.SOA
+	names  map[string][]dns.RR // canonical owner name -> records
+}
+
+// zoneSet holds every hosted zone, keyed by canonical origin.
+type zoneSet struct {
+	zones map[string]*authZone
+}
+
+// parseZone reads a zone file for origin and checks it has exactly one SOA
+// at the apex and only records that belong to the zone.
+func parseZone(origin, filename string) (*authZone, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	z := &authZone{origin: dns.CanonicalName(origin), names: make(map[string][]dns.RR)}
+	zp := dns.NewZoneParser(f, z.origin, filename)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		owner := dns.CanonicalName(rr.Header().Name)
+		if !dns.IsSubDomain(z.origin, owner) {
+			return nil, fmt.Errorf("%s: record %s is outside zone %s", filename, owner, z.origin)
+		}
+		rr.Header().Name = owner
+		if soa, ok := rr.(*dns.SOA); ok {
+			if owner != z.origin || z.soa != nil {
+				return nil, fmt.Errorf("%s: unexpected SOA at %s", filename, owner)
+			}
+			z.soa = soa
+		}
+		z.names[owner] = append(z.names[owner], rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if z.soa == nil {
+		return nil, fmt.Errorf("%s: zone %s has no SOA record", filename, z.origin)
+	}
+	return z, nil
+}
+
+// loadZones parses every configured zone. The caller swaps the set in only
+// if all zones load, so a bad edit keeps the previous zones online.
+func loadZones(cfg *config.Config) (*zoneSet, error) {
+	set := &zoneSet{zones: make(map[string]*authZone, len(cfg.Zones))}
+	for origin, filename := range cfg.Zones {
+		z, err := parseZone(origin, filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load zone %s: %w", origin, err)
+		}
+		set.zones[z.origin] = z
+	}
+	return set, nil
+}
+
+// findZone returns the most specific hosted zone containing name.
+func (s *Server) findZone(name string) *authZone {
+	set, _ := s.zones.Load().(*zoneSet)
+	if set == nil || len(set.zones) == 0 {
+		return nil
+	}
+	for n := dns.CanonicalName(name); ; n = parentName(n) {
+		if z, ok := set.zones[n]; ok {
+			return z
+		}
+		if n == "." {
+			return nil
+		}
+	}
+}
+
+func (z *authZone) rrset(name string, qtype uint16) []dns.RR {
+	var out []dns.RR
+	for _, rr := range z.names[name] {
+		if qtype == dns.TypeANY || rr.Header().Rrtype == qtype {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// exists reports whether name owns records or is an empty non-terminal.
+func (z *authZone) exists(name string) bool {
+	if _, ok := z.names[name]; ok {
+		return true
+	}
+	for owner := range z.names {
+		if dns.IsSubDomain(name, owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// delegation returns the NS records of a zone cut between the apex and
+// name, if any.
+func (z *authZone) delegation(name string) []dns.RR {
+	var cut []dns.RR
+	for n := name; n != z.origin && dns.IsSubDomain(z.origin, n); n = parentName(n) {
+		if ns := z.rrset(n, dns.TypeNS); len(ns) > 0 {
+			cut = ns
+		}
+	}
+	return cut
+}
+
+// lookup returns the records for name, expanding a wildcard (RFC 4592) when
+// the name does not exist.
+func (z *authZone) lookup(name string, qtype uint16) (rrs []dns.RR, found bool) {
+	if z.exists(name) {
+		return z.rrset(name, qtype), true
+	}
+	encloser := parentName(name)
+	for !z.exists(encloser) && encloser != z.origin {
+		encloser = parentName(encloser)
+	}
+	wild := "*." + encloser
+	if _, ok := z.names[wild]; !ok {
+		return nil, false
+	}
+	for _, rr := range z.rrset(wild, qtype) {
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		rrs = append(rrs, rr)
+	}
+	return rrs, true
+}
+
+func (z *authZone) negativeSOA() dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+// additional adds in-zone addresses for the targets of NS, MX and SRV records.
+func (z *authZone) additional(resp *dns.Msg, rrs []dns.RR) {
+	for _, rr := range rrs {
+		var target string
+		switch v := rr.(type) {
+		case *dns.NS:
+			target = v.Ns
+		case *dns.MX:
+			target = v.Mx
+		case *dns.SRV:
+			target = v.Target
+		default:
+			continue
+		}
+		target = dns.CanonicalName(target)
+		if !dns.IsSubDomain(z.origin, target) {
+			continue
+		}
+		resp.Extra = append(resp.Extra, z.rrset(target, dns.TypeA)...)
+		resp.Extra = append(resp.Extra, z.rrset(target, dns.TypeAAAA)...)
+	}
+}
+
+// answer builds an authoritative reply for req from the zone: referrals for
+// delegated names, CNAME chains within the zone, NODATA with the SOA for
+// existing names without the type, and NXDOMAIN otherwise.
+func (z *authZone) answer(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Compress = true
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(ednsUDPSize, false)
+	}
+
+	q := req.Question[0]
+	name := dns.CanonicalName(q.Name)
+	if q.Qclass != dns.ClassINET && q.Qclass != dns.ClassANY {
+		resp.Rcode = dns.RcodeRefused
+		return resp
+	}
+
+	seen := make(map[string]bool)
+	for {
+		if ns := z.delegation(name); len(ns) > 0 {
+			if len(resp.Answer) == 0 {
+				resp.Ns = ns
+				z.additional(resp, ns)
+			}
+			return resp
+		}
+		resp.Authoritative = true
+
+		rrs, found := z.lookup(name, q.Qtype)
+		if !found {
+			// The rcode describes the last name in the chain (RFC 6604)
+			resp.Rcode = dns.RcodeNameError
+			resp.Ns = []dns.RR{z.negativeSOA()}
+			return resp
+		}
+		if len(rrs) > 0 {
+			resp.Answer = append(resp.Answer, rrs...)
+			z.additional(resp, rrs)
+			return resp
+		}
+
+		cname, _ := z.lookup(name, dns.TypeCNAME)
+		if len(cname) == 0 || q.Qtype == dns.TypeCNAME {
+			resp.Ns = []dns.RR{z.negativeSOA()}
+			return resp
+		}
+		resp.Answer = append(resp.Answer, cname[0])
+		seen[name] = true
+		name = dns.CanonicalName(cname[0].(*dns.CNAME).Target)
+		if seen[name] || !dns.IsSubDomain(z.origin, name) {
+			// Out-of-zone targets are left to the client's resolver
+			return resp
+		}
+	}
+}
+
+// buildZoneResponse answers req if it falls inside a hosted zone.
+func (s *Server) buildZoneResponse(req *dns.Msg) ([]byte, bool, error) {
+	z := s.findZone(req.Question[0].Name)
+	if z == nil {
+		return nil, false, nil
+	}
+	out, err := z.answer(req).Pack()
+	return out, true, err
+}
@@ -0,0 +1,155 @@
+package dnsserver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"smartSNI/config"
+)
+
+const testZoneFile = `$ORIGIN example.org.
+$TTL 3600
+@        IN SOA  ns1 hostmaster 2024010101 7200 900 1209600 300
+@        IN NS   ns1
+@        IN MX   10 mail
+@        IN TXT  "v=spf1 mx -all"
+@        IN CAA  0 issue "letsencrypt.org"
+ns1      IN A    192.0.2.1
+mail     IN A    192.0.2.2
+www      IN CNAME web
+web      IN A    192.0.2.3
+web      IN AAAA 2001:db8::3
+_sip._tcp IN SRV 10 5 5060 web
+*.apps   IN A    192.0.2.4
+a.b.deep IN A    192.0.2.5
+sub      IN NS   ns.sub
+ns.sub   IN A    192.0.2.6
+`
+
+func writeTestZone(t *testing.T, content string) map[string]string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "example.org.zone")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return map[string]string{"example.org": path}
+}
+
+func loadTestZones(t *testing.T, zones map[string]string) *Server {
+	t.Helper()
+	return newTestServer(t, &config.Config{Zones: zones})
+}
+
+func zoneQuery(t *testing.T, s *Server, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	out, ok, err := s.buildZoneResponse(req)
+	if !ok || err != nil {
+		t.Fatalf("%s not answered from zone (ok=%v err=%v)", name, ok, err)
+	}
+	var resp dns.Msg
+	if err := resp.Unpack(out); err != nil {
+		t.Fatal(err)
+	}
+	return &resp
+}
+
+func TestZoneAnswers(t *testing.T) {
+	s := loadTestZones(t, writeTestZone(t, testZoneFile))
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+		extra   int
+	}{
+		{"example.org.", dns.TypeSOA, dns.RcodeSuccess, 1, 0},
+		{"example.org.", dns.TypeNS, dns.RcodeSuccess, 1, 1},
+		{"example.org.", dns.TypeMX, dns.RcodeSuccess, 1, 1},
+		{"example.org.", dns.TypeTXT, dns.RcodeSuccess, 1, 0},
+		{"example.org.", dns.TypeCAA, dns.RcodeSuccess, 1, 0},
+		{"_sip._tcp.example.org.", dns.TypeSRV, dns.RcodeSuccess, 1, 2},
+		{"WWW.Example.Org.", dns.TypeA, dns.RcodeSuccess, 2, 0},
+		{"www.example.org.", dns.TypeCNAME, dns.RcodeSuccess, 1, 0},
+		{"x.apps.example.org.", dns.TypeA, dns.RcodeSuccess, 1, 0},
+		{"web.example.org.", dns.TypeMX, dns.RcodeSuccess, 0, 0},       // NODATA
+		{"deep.example.org.", dns.TypeA, dns.RcodeSuccess, 0, 0},       // empty non-terminal
+		{"missing.example.org.", dns.TypeA, dns.RcodeNameError, 0, 0},  // NXDOMAIN
+		{"x.y.deep.example.org.", dns.TypeA, dns.RcodeNameError, 0, 0}, // no wildcard here
+	}
+	for _, tt := range tests {
+		resp := zoneQuery(t, s, tt.name, tt.qtype)
+		if resp.Rcode != tt.rcode || len(resp.Answer) != tt.answers || len(resp.Extra) != tt.extra {
+			t.Errorf("%s %s: got rcode %s, %d answers, %d extra; want %s, %d, %d",
+				tt.name, dns.TypeToString[tt.qtype], dns.RcodeToString[resp.Rcode], len(resp.Answer), len(resp.Extra),
+				dns.RcodeToString[tt.rcode], tt.answers, tt.extra)
+		}
+		if !resp.Authoritative {
+			t.Errorf("%s: AA not set", tt.name)
+		}
+		if len(resp.Answer) == 0 {
+			if len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA || resp.Ns[0].Header().Ttl != 300 {
+				t.Errorf("%s: negative answer needs SOA with the minimum TTL, got %v", tt.name, resp.Ns)
+			}
+		}
+	}
+}
+
+func TestZoneDelegation(t *testing.T) {
+	s := loadTestZones(t, writeTestZone(t, testZoneFile))
+
+	resp := zoneQuery(t, s, "host.sub.example.org.", dns.TypeA)
+	if resp.Authoritative || len(resp.Answer) != 0 || len(resp.Ns) != 1 || len(resp.Extra) != 1 {
+		t.Fatalf("want non-authoritative referral with glue, got %s", resp)
+	}
+}
+
+func TestZoneOutsideHostedZones(t *testing.T) {
+	s := loadTestZones(t, writeTestZone(t, testZoneFile))
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, ok, _ := s.buildZoneResponse(req); ok {
+		t.Fatal("name outside hosted zones should not be answered")
+	}
+}
+
+func TestZoneReload(t *testing.T) {
+	zones := writeTestZone(t, testZoneFile)
+	s := loadTestZones(t, zones)
+	cfg := s.config()
+
+	updated := testZoneFile + "new IN A 192.0.2.9\n"
+	if err := os.WriteFile(zones["example.org"], []byte(updated), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if resp := zoneQuery(t, s, "new.example.org.", dns.TypeA); len(resp.Answer) != 1 {
+		t.Fatalf("reloaded record missing: %s", resp)
+	}
+
+	// A broken zone is rejected and the loaded one keeps serving
+	if err := os.WriteFile(zones["example.org"], []byte("www IN A not-an-ip\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(cfg); err == nil {
+		t.Fatal("broken zone file accepted")
+	}
+	if resp := zoneQuery(t, s, "new.example.org.", dns.TypeA); len(resp.Answer) != 1 {
+		t.Fatal("previous zone data lost after a failed reload")
+	}
+}
+
+func TestParseZoneRejectsMissingSOA(t *testing.T) {
+	zones := writeTestZone(t, "$ORIGIN example.org.\nwww 300 IN A 192.0.2.1\n")
+	if _, err := parseZone("example.org", zones["example.org"]); err == nil {
+		t.Fatal("zone without SOA accepted")
+	}
+}
@@ -5,6 +5,7 @@ go 1.21.1
 require (
 	github.com/miekg/dns v1.1.57
 	github.com/valyala/fasthttp v1.51.0
+	golang.org/x/sys v0.13.0
 	golang.org/x/time v0.4.0
 )
 
@@ -14,6 +15,5 @@ require (
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	golang.org/x/mod v0.12.0 // indirect
 	golang.org/x/net v0.17.0 // indirect
-	golang.org/x/sys v0.13.0 // indirect
 	golang.org/x/tools v0.13.0 // indirect
 )
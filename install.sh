@@ -243,7 +243,7 @@ EOF
         echo -e "${yellow}********************${rest}"
         echo -e "${cyan}Building smartSNI v$VERSION...${rest}"
         cd /root/smartSNI
-        /usr/local/go/bin/go build -o smartsni main.go
+        /usr/local/go/bin/go build -o smartsni ./cmd/smartsni
 
         if [ $? -ne 0 ]; then
             echo -e "${red}Build failed! Please check the errors above.${rest}"
@@ -0,0 +1,292 @@
+// Package egress dials TCP connections through a chain of SOCKS5 and HTTP
+// CONNECT proxies, so SNI and DNS traffic can leave through another network.
+package egress
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ContextDialer is the subset of net.Dialer used to reach the first proxy.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// handshakeTimeout bounds each proxy handshake when ctx has no deadline.
+const handshakeTimeout = 10 * time.Second
+
+// ParseChain parses proxy URLs of the form socks5://[user:pass@]host:port or
+// http://[user:pass@]host:port, in the order traffic passes through them.
+// Host names are always passed to the proxy to resolve, so socks5h:// is
+// accepted as a synonym of socks5://.
+func ParseChain(raw []string) ([]*url.URL, error) {
+	chain := make([]*url.URL, 0, len(raw))
+	for _, r := range raw {
+		u, err := url.Parse(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %w", r, err)
+		}
+		switch u.Scheme {
+		case "socks5", "socks5h", "http":
+		default:
+			return nil, fmt.Errorf("proxy %q: unsupported scheme %q (want socks5 or http)", u.Redacted(), u.Scheme)
+		}
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return nil, fmt.Errorf("proxy %q: %w", u.Redacted(), err)
+		}
+		chain = append(chain, u)
+	}
+	return chain, nil
+}
+
+// Dialer connects through Chain, reaching the first proxy with Forward.
+// An empty chain dials directly.
+type Dialer struct {
+	Chain   []*url.URL
+	Forward ContextDialer
+}
+
+// New parses raw with ParseChain and returns a Dialer using forward.
+func New(raw []string, forward ContextDialer) (*Dialer, error) {
+	chain, err := ParseChain(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &Dialer{Chain: chain, Forward: forward}, nil
+}
+
+// Dial is DialContext with a background context.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through every proxy of the chain in turn.
+// Only TCP can be tunnelled.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if len(d.Chain) == 0 {
+		return d.Forward.DialContext(ctx, network, addr)
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("egress: cannot tunnel %s", network)
+	}
+
+	conn, err := d.Forward.DialContext(ctx, "tcp", d.Chain[0].Host)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(handshakeTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	for i, proxy := range d.Chain {
+		next := addr
+		if i+1 < len(d.Chain) {
+			next = d.Chain[i+1].Host
+		}
+		if conn, err = connect(conn, proxy, next); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("egress via %s: %w", proxy.Redacted(), err)
+		}
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func connect(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	if proxy.Scheme == "http" {
+		return connectHTTP(conn, proxy, addr)
+	}
+	return conn, connectSOCKS5(conn, proxy, addr)
+}
+
+// ======================== HTTP CONNECT ========================
+
+// bufferedConn returns bytes the proxy sent after its response before
+// reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// CloseWrite keeps half-close working for the relay.
+func (c *bufferedConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+func connectHTTP(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxy.User; u != nil {
+		pass, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pass)))
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// ======================== SOCKS5 ========================
+
+// SOCKS5 constants (RFC 1928, RFC 1929)
+const (
+	socksVersion        = 5
+	socksAuthNone       = 0
+	socksAuthPassword   = 2
+	socksAuthNoMethod   = 0xff
+	socksCmdConnect     = 1
+	socksAddrIPv4       = 1
+	socksAddrDomain     = 3
+	socksAddrIPv6       = 4
+	socksPasswordVer    = 1
+	socksReplySucceeded = 0
+)
+
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func connectSOCKS5(conn net.Conn, proxy *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	methods := []byte{socksAuthNone}
+	if proxy.User != nil {
+		methods = []byte{socksAuthPassword}
+	}
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("not a SOCKS5 proxy (version %d)", reply[0])
+	}
+	switch reply[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if proxy.User == nil {
+			return errors.New("proxy requires a username and password")
+		}
+		user := proxy.User.Username()
+		pass, _ := proxy.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("username or password longer than 255 bytes")
+		}
+		msg := []byte{socksPasswordVer, byte(len(user))}
+		msg = append(msg, user...)
+		msg = append(msg, byte(len(pass)))
+		msg = append(msg, pass...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("proxy rejected the username or password")
+		}
+	case socksAuthNoMethod:
+		return errors.New("proxy accepted none of the offered authentication methods")
+	default:
+		return fmt.Errorf("proxy chose unsupported authentication method %d", reply[1])
+	}
+
+	req := []byte{socksVersion, socksCmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("host name longer than 255 bytes")
+		}
+		req = append(req, socksAddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socksAddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socksAddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// VER REP RSV ATYP, then the bound address, which we skip
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != socksReplySucceeded {
+		msg, ok := socksReplies[head[1]]
+		if !ok {
+			msg = fmt.Sprintf("reply %d", head[1])
+		}
+		return fmt.Errorf("CONNECT %s: %s", addr, msg)
+	}
+	var skip int
+	switch head[3] {
+	case socksAddrIPv4:
+		skip = net.IPv4len
+	case socksAddrIPv6:
+		skip = net.IPv6len
+	case socksAddrDomain:
+		if _, err := io.ReadFull(conn, head[:1]); err != nil {
+			return err
+		}
+		skip = int(head[0])
+	default:
+		return fmt.Errorf("unknown bound address type %d", head[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
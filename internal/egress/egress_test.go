@@ -0,0 +1,206 @@
+package egress
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serve runs handle for every connection accepted on a local listener.
+func serve(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+				handle(c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// relay connects c to addr and copies both ways.
+func relay(c net.Conn, r io.Reader, addr string) {
+	up, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer up.Close()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(up, r)
+	}()
+	_, _ = io.Copy(c, up)
+	c.Close()
+	wg.Wait()
+}
+
+// socksProxy is a minimal SOCKS5 server requiring user:pass when user is set.
+func socksProxy(t *testing.T, user, pass string) string {
+	return serve(t, func(c net.Conn) {
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(c, head); err != nil {
+			return
+		}
+		methods := make([]byte, head[1])
+		_, _ = io.ReadFull(c, methods)
+		if user == "" {
+			_, _ = c.Write([]byte{5, socksAuthNone})
+		} else {
+			_, _ = c.Write([]byte{5, socksAuthPassword})
+			b := make([]byte, 2)
+			_, _ = io.ReadFull(c, b)
+			u := make([]byte, b[1])
+			_, _ = io.ReadFull(c, u)
+			_, _ = io.ReadFull(c, b[:1])
+			p := make([]byte, b[0])
+			_, _ = io.ReadFull(c, p)
+			if string(u) != user || string(p) != pass {
+				_, _ = c.Write([]byte{1, 1})
+				return
+			}
+			_, _ = c.Write([]byte{1, 0})
+		}
+
+		req := make([]byte, 4)
+		if _, err := io.ReadFull(c, req); err != nil {
+			return
+		}
+		var host string
+		switch req[3] {
+		case socksAddrIPv4:
+			ip := make([]byte, 4)
+			_, _ = io.ReadFull(c, ip)
+			host = net.IP(ip).String()
+		case socksAddrDomain:
+			n := make([]byte, 1)
+			_, _ = io.ReadFull(c, n)
+			name := make([]byte, n[0])
+			_, _ = io.ReadFull(c, name)
+			host = string(name)
+		default:
+			return
+		}
+		port := make([]byte, 2)
+		_, _ = io.ReadFull(c, port)
+		_, _ = c.Write([]byte{5, 0, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+		relay(c, c, net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	})
+}
+
+// connectProxy is a minimal HTTP CONNECT proxy requiring auth when set.
+func connectProxy(t *testing.T, auth string) string {
+	return serve(t, func(c net.Conn) {
+		br := bufio.NewReader(c)
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		if auth != "" && req.Header.Get("Proxy-Authorization") != auth {
+			_, _ = io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return
+		}
+		_, _ = io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		relay(c, br, req.Host)
+	})
+}
+
+func echo(t *testing.T) string {
+	return serve(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+}
+
+func roundTrip(t *testing.T, d *Dialer, addr string) error {
+	t.Helper()
+	conn, err := d.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = io.WriteString(conn, "ping")
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return err
+	}
+	if string(got) != "ping" {
+		t.Fatalf("echo returned %q", got)
+	}
+	return nil
+}
+
+func TestDialChain(t *testing.T) {
+	target := echo(t)
+	socks := socksProxy(t, "alice", "s3cret")
+	connect := connectProxy(t, "Basic Ym9iOmh1bnRlcjI=") // bob:hunter2
+
+	for name, chain := range map[string][]string{
+		"direct":         nil,
+		"socks5":         {"socks5://alice:s3cret@" + socks},
+		"http":           {"http://bob:hunter2@" + connect},
+		"http to socks5": {"http://bob:hunter2@" + connect, "socks5://alice:s3cret@" + socks},
+		"socks5 to http": {"socks5://alice:s3cret@" + socks, "http://bob:hunter2@" + connect},
+	} {
+		d, err := New(chain, &net.Dialer{})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := roundTrip(t, d, target); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	// Host names are resolved by the proxy
+	_, port, _ := net.SplitHostPort(target)
+	d, _ := New([]string{"socks5://alice:s3cret@" + socks}, &net.Dialer{})
+	if err := roundTrip(t, d, net.JoinHostPort("localhost", port)); err != nil {
+		t.Errorf("socks5 by name: %v", err)
+	}
+}
+
+func TestDialRejectedCredentials(t *testing.T) {
+	target := echo(t)
+	for _, proxy := range []string{
+		"socks5://alice:wrong@" + socksProxy(t, "alice", "s3cret"),
+		"socks5://" + socksProxy(t, "alice", "s3cret"),
+		"http://bob:wrong@" + connectProxy(t, "Basic Ym9iOmh1bnRlcjI="),
+	} {
+		d, _ := New([]string{proxy}, &net.Dialer{})
+		if err := roundTrip(t, d, target); err == nil {
+			t.Errorf("%s: dial succeeded", proxy)
+		} else if strings.Contains(err.Error(), "wrong") {
+			t.Errorf("error leaks the password: %v", err)
+		}
+	}
+}
+
+func TestParseChain(t *testing.T) {
+	for _, bad := range []string{"https://proxy:443", "socks5://proxy", "proxy:1080", "socks4://proxy:1080"} {
+		if _, err := ParseChain([]string{bad}); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+	if _, err := ParseChain([]string{"socks5://u:p@[2001:db8::1]:1080", "socks5h://proxy.example:1080", "http://proxy.example:3128"}); err != nil {
+		t.Error(err)
+	}
+}
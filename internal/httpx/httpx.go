@@ -0,0 +1,25 @@
+// Package httpx holds small helpers shared by the fasthttp servers.
+package httpx
+
+import (
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// ClientIP returns the client address, preferring the headers set by the
+// reverse proxy in front of us.
+func ClientIP(ctx *fasthttp.RequestCtx) string {
+	// Check X-Forwarded-For header
+	xff := string(ctx.Request.Header.Peek("X-Forwarded-For"))
+	if xff != "" {
+		ips := strings.Split(xff, ",")
+		return strings.TrimSpace(ips[0])
+	}
+	// Check X-Real-IP header
+	xri := string(ctx.Request.Header.Peek("X-Real-IP"))
+	if xri != "" {
+		return xri
+	}
+	return ctx.RemoteIP().String()
+}
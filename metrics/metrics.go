@@ -0,0 +1,164 @@
+// Package metrics counts events across the smartSNI servers.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics holds runtime statistics. The zero value is ready to use.
+type Metrics struct {
+	dohQueries     uint64
+	dotQueries     uint64
+	sniConnections uint64
+	sniBlocked     uint64
+	sniSelfLoops   uint64
+	sniRejected    uint64
+	sniECH         uint64
+	httpProxied    uint64
+	quicSessions   uint64
+	sniBytesIn     uint64
+	sniBytesOut    uint64
+	cacheHits      uint64
+	cacheMisses    uint64
+	errors         uint64
+	dnssecSecure   uint64
+	dnssecBogus    uint64
+
+	trafficMu sync.Mutex
+	bySNI     map[string]*Traffic
+	byUser    map[string]*Traffic
+}
+
+// New returns an empty set of counters.
+func New() *Metrics {
+	return &Metrics{}
+}
+
+func (m *Metrics) IncDOHQueries() {
+	atomic.AddUint64(&m.dohQueries, 1)
+}
+
+func (m *Metrics) IncDOTQueries() {
+	atomic.AddUint64(&m.dotQueries, 1)
+}
+
+func (m *Metrics) IncSNIConnections() {
+	atomic.AddUint64(&m.sniConnections, 1)
+}
+
+func (m *Metrics) IncSNIBlocked() {
+	atomic.AddUint64(&m.sniBlocked, 1)
+}
+
+func (m *Metrics) IncSNISelfLoops() {
+	atomic.AddUint64(&m.sniSelfLoops, 1)
+}
+
+func (m *Metrics) IncSNIRejected() {
+	atomic.AddUint64(&m.sniRejected, 1)
+}
+
+// IncSNIECH counts ClientHellos offering Encrypted Client Hello.
+func (m *Metrics) IncSNIECH() {
+	atomic.AddUint64(&m.sniECH, 1)
+}
+
+func (m *Metrics) IncHTTPProxied() {
+	atomic.AddUint64(&m.httpProxied, 1)
+}
+
+func (m *Metrics) IncQUICSessions() {
+	atomic.AddUint64(&m.quicSessions, 1)
+}
+
+// AddSNIBytesIn counts bytes relayed from SNI clients to backends.
+func (m *Metrics) AddSNIBytesIn(n uint64) {
+	atomic.AddUint64(&m.sniBytesIn, n)
+}
+
+// AddSNIBytesOut counts bytes relayed from backends to SNI clients.
+func (m *Metrics) AddSNIBytesOut(n uint64) {
+	atomic.AddUint64(&m.sniBytesOut, n)
+}
+
+func (m *Metrics) IncCacheHits() {
+	atomic.AddUint64(&m.cacheHits, 1)
+}
+
+func (m *Metrics) IncCacheMisses() {
+	atomic.AddUint64(&m.cacheMisses, 1)
+}
+
+func (m *Metrics) IncErrors() {
+	atomic.AddUint64(&m.errors, 1)
+}
+
+func (m *Metrics) IncDNSSECSecure() {
+	atomic.AddUint64(&m.dnssecSecure, 1)
+}
+
+func (m *Metrics) IncDNSSECBogus() {
+	atomic.AddUint64(&m.dnssecBogus, 1)
+}
+
+// GetStats returns a snapshot of every counter.
+func (m *Metrics) GetStats() map[string]uint64 {
+	return map[string]uint64{
+		"doh_queries":     atomic.LoadUint64(&m.dohQueries),
+		"dot_queries":     atomic.LoadUint64(&m.dotQueries),
+		"sni_connections": atomic.LoadUint64(&m.sniConnections),
+		"sni_blocked":     atomic.LoadUint64(&m.sniBlocked),
+		"sni_self_loops":  atomic.LoadUint64(&m.sniSelfLoops),
+		"sni_rejected":    atomic.LoadUint64(&m.sniRejected),
+		"sni_ech":         atomic.LoadUint64(&m.sniECH),
+		"http_proxied":    atomic.LoadUint64(&m.httpProxied),
+		"quic_sessions":   atomic.LoadUint64(&m.quicSessions),
+		"sni_bytes_in":    atomic.LoadUint64(&m.sniBytesIn),
+		"sni_bytes_out":   atomic.LoadUint64(&m.sniBytesOut),
+		"cache_hits":      atomic.LoadUint64(&m.cacheHits),
+		"cache_misses":    atomic.LoadUint64(&m.cacheMisses),
+		"errors":          atomic.LoadUint64(&m.errors),
+		"dnssec_secure":   atomic.LoadUint64(&m.dnssecSecure),
+		"dnssec_bogus":    atomic.LoadUint64(&m.dnssecBogus),
+	}
+}
+
+// prometheusCounters lists the exported counters in output order.
+var prometheusCounters = []struct {
+	key, name, help string
+}{
+	{"doh_queries", "smartsni_doh_queries_total", "Total number of DoH queries"},
+	{"dot_queries", "smartsni_dot_queries_total", "Total number of DoT queries"},
+	{"sni_connections", "smartsni_sni_connections_total", "Total number of SNI connections"},
+	{"sni_blocked", "smartsni_sni_blocked_total", "Total number of SNI connections dropped by routes or fingerprints"},
+	{"sni_self_loops", "smartsni_sni_self_loops_total", "Total number of SNI connections refused because the backend was the proxy itself"},
+	{"sni_rejected", "smartsni_sni_rejected_total", "Total number of SNI connections refused by connection limits"},
+	{"sni_ech", "smartsni_sni_ech_total", "Total number of SNI connections offering Encrypted Client Hello"},
+	{"http_proxied", "smartsni_http_proxied_total", "Total number of plain HTTP connections accepted by the Host proxy"},
+	{"quic_sessions", "smartsni_quic_sessions_total", "Total number of QUIC flows relayed by the QUIC proxy"},
+	{"sni_bytes_in", "smartsni_sni_bytes_in_total", "Total bytes relayed from SNI clients to backends"},
+	{"sni_bytes_out", "smartsni_sni_bytes_out_total", "Total bytes relayed from backends to SNI clients"},
+	{"cache_hits", "smartsni_cache_hits_total", "Total number of cache hits"},
+	{"cache_misses", "smartsni_cache_misses_total", "Total number of cache misses"},
+	{"errors", "smartsni_errors_total", "Total number of errors"},
+	{"dnssec_secure", "smartsni_dnssec_secure_total", "Total number of answers validated as secure"},
+	{"dnssec_bogus", "smartsni_dnssec_bogus_total", "Total number of answers that failed DNSSEC validation"},
+}
+
+// WritePrometheus writes the counters in the Prometheus text format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	stats := m.GetStats()
+	for _, c := range prometheusCounters {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, stats[c.key]); err != nil {
+			return err
+		}
+	}
+	bySNI, byUser := m.SNITraffic()
+	if err := writeTraffic(w, "domain", "sni", bySNI); err != nil {
+		return err
+	}
+	return writeTraffic(w, "user", "user", byUser)
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	m := New()
+	m.IncDOHQueries()
+	m.IncDOHQueries()
+	m.IncErrors()
+
+	var b strings.Builder
+	if err := m.WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		"# TYPE smartsni_doh_queries_total counter\nsmartsni_doh_queries_total 2\n",
+		"smartsni_errors_total 1\n",
+		"smartsni_sni_connections_total 0\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	if n := strings.Count(out, "# TYPE "); n != len(prometheusCounters)+2*len(trafficFamilies) {
+		t.Errorf("%d counters written, want %d", n, len(prometheusCounters)+2*len(trafficFamilies))
+	}
+}
+
+func TestSNITraffic(t *testing.T) {
+	m := New()
+	m.SNIConnStart("a.test", "u1")
+	m.AddSNITraffic("a.test", "u1", 100, 2000)
+	m.SNIConnEnd("a.test", "u1", 3*time.Second)
+	m.SNIConnStart("b.test", "")
+	m.AddSNITraffic("b.test", "", 10, 20)
+
+	bySNI, byUser := m.SNITraffic()
+	if got := bySNI["a.test"]; got != (Traffic{Connections: 1, BytesIn: 100, BytesOut: 2000, Seconds: 3}) {
+		t.Errorf("a.test = %+v", got)
+	}
+	if len(byUser) != 1 || byUser["u1"].BytesOut != 2000 {
+		t.Errorf("by user = %+v", byUser)
+	}
+	if s := m.GetStats(); s["sni_bytes_in"] != 110 || s["sni_bytes_out"] != 2020 {
+		t.Errorf("totals = %d/%d", s["sni_bytes_in"], s["sni_bytes_out"])
+	}
+
+	var b strings.Builder
+	_ = m.WritePrometheus(&b)
+	for _, want := range []string{
+		`smartsni_sni_domain_bytes_out_total{sni="a.test"} 2000` + "\n",
+		`smartsni_sni_user_duration_seconds_total{user="u1"} 3` + "\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("output lacks %q", want)
+		}
+	}
+
+	// Unbounded SNI names collapse into one bucket
+	for i := 0; i < maxTrafficKeys+10; i++ {
+		m.SNIConnStart(fmt.Sprintf("%d.test", i), "")
+	}
+	bySNI, _ = m.SNITraffic()
+	if len(bySNI) != maxTrafficKeys+1 || bySNI[otherTraffic].Connections == 0 {
+		t.Errorf("%d domains tracked, other = %+v", len(bySNI), bySNI[otherTraffic])
+	}
+}
@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ======================== SNI Traffic ========================
+
+// maxTrafficKeys bounds the SNI names and users tracked separately;
+// further ones are added up under otherTraffic.
+const (
+	maxTrafficKeys = 1000
+	otherTraffic   = "other"
+)
+
+// Traffic is the SNI proxy traffic of one domain or user.
+type Traffic struct {
+	Connections uint64  `json:"connections"`
+	BytesIn     uint64  `json:"bytes_in"`  // from clients
+	BytesOut    uint64  `json:"bytes_out"` // to clients
+	Seconds     float64 `json:"duration_seconds"`
+	Throttled   float64 `json:"throttled_seconds"` // time relays waited for sni_rate_limits tokens
+}
+
+// trafficEntry returns the bucket for key in table, creating it if room
+// is left. Callers hold trafficMu.
+func trafficEntry(table *map[string]*Traffic, key string) *Traffic {
+	if *table == nil {
+		*table = make(map[string]*Traffic)
+	}
+	t, ok := (*table)[key]
+	if !ok {
+		if len(*table) >= maxTrafficKeys {
+			key = otherTraffic
+			if t, ok = (*table)[key]; ok {
+				return t
+			}
+		}
+		t = &Traffic{}
+		(*table)[key] = t
+	}
+	return t
+}
+
+// each runs fn on the SNI bucket and, for identified users, the user's.
+func (m *Metrics) each(sni, user string, fn func(*Traffic)) {
+	m.trafficMu.Lock()
+	defer m.trafficMu.Unlock()
+	fn(trafficEntry(&m.bySNI, sni))
+	if user != "" {
+		fn(trafficEntry(&m.byUser, user))
+	}
+}
+
+// SNIConnStart counts a relayed connection to sni, made by user ("" when
+// the client is not a registered user).
+func (m *Metrics) SNIConnStart(sni, user string) {
+	m.each(sni, user, func(t *Traffic) { t.Connections++ })
+}
+
+// AddSNITraffic counts bytes relayed for sni and user, in from the client
+// and out to it.
+func (m *Metrics) AddSNITraffic(sni, user string, in, out uint64) {
+	m.AddSNIBytesIn(in)
+	m.AddSNIBytesOut(out)
+	m.each(sni, user, func(t *Traffic) {
+		t.BytesIn += in
+		t.BytesOut += out
+	})
+}
+
+// SNIConnEnd records how long a connection started with SNIConnStart lasted.
+func (m *Metrics) SNIConnEnd(sni, user string, d time.Duration) {
+	m.each(sni, user, func(t *Traffic) { t.Seconds += d.Seconds() })
+}
+
+// AddSNIThrottled records time a relay for sni and user was held back by
+// bandwidth shaping.
+func (m *Metrics) AddSNIThrottled(sni, user string, d time.Duration) {
+	m.each(sni, user, func(t *Traffic) { t.Throttled += d.Seconds() })
+}
+
+// SNITraffic returns a snapshot of the traffic per SNI domain and per user
+// ID.
+func (m *Metrics) SNITraffic() (bySNI, byUser map[string]Traffic) {
+	m.trafficMu.Lock()
+	defer m.trafficMu.Unlock()
+	bySNI = make(map[string]Traffic, len(m.bySNI))
+	for k, t := range m.bySNI {
+		bySNI[k] = *t
+	}
+	byUser = make(map[string]Traffic, len(m.byUser))
+	for k, t := range m.byUser {
+		byUser[k] = *t
+	}
+	return bySNI, byUser
+}
+
+// trafficFamilies lists the labelled Prometheus counters derived from
+// Traffic, written once per domain and once per user.
+var trafficFamilies = []struct {
+	suffix, help string
+	value        func(Traffic) string
+}{
+	{"connections_total", "SNI connections", func(t Traffic) string { return fmt.Sprint(t.Connections) }},
+	{"bytes_in_total", "Bytes relayed from SNI clients", func(t Traffic) string { return fmt.Sprint(t.BytesIn) }},
+	{"bytes_out_total", "Bytes relayed to SNI clients", func(t Traffic) string { return fmt.Sprint(t.BytesOut) }},
+	{"duration_seconds_total", "Time spent in closed SNI connections", func(t Traffic) string { return fmt.Sprint(t.Seconds) }},
+	{"throttled_seconds_total", "Time SNI relays waited for bandwidth shaping", func(t Traffic) string { return fmt.Sprint(t.Throttled) }},
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeTraffic writes table as smartsni_sni_<kind>_* counters labelled
+// with label.
+func writeTraffic(w io.Writer, kind, label string, table map[string]Traffic) error {
+	keys := make([]string, 0, len(table))
+	for k := range table {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, f := range trafficFamilies {
+		name := "smartsni_sni_" + kind + "_" + f.suffix
+		if _, err := fmt.Fprintf(w, "# HELP %s %s per %s\n# TYPE %s counter\n", name, f.help, kind, name); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if _, err := fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", name, label, labelEscaper.Replace(k), f.value(table[k])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,463 @@
+package panel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"smartSNI/config"
+	"smartSNI/users"
+)
+
+// ======================== Backup & Restore Functions ========================
+
+// BackupData represents the complete backup structure
+type BackupData struct {
+	Version   string            `json:"version"`
+	Timestamp time.Time         `json:"timestamp"`
+	Config    *config.Config    `json:"config"`
+	Users     []users.User      `json:"users"`
+	IPToUser  map[string]string `json:"ip_to_user"` // IP -> UserID mapping
+}
+
+// Create a backup of all users and config
+func (s *Server) createBackup() (*BackupData, error) {
+	cfg := s.config()
+
+	backup := &BackupData{
+		Version:   "2.0",
+		Timestamp: time.Now(),
+		Config:    cfg,
+		Users:     s.users.List(),
+		IPToUser:  s.users.IPMappings(),
+	}
+
+	return backup, nil
+}
+
+// Save backup to file
+func (s *Server) saveBackupToFile(backup *BackupData, filename string) error {
+	data, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal backup: %w", err)
+	}
+
+	// Create backups directory if it doesn't exist
+	if err := os.MkdirAll(s.backupDir, 0755); err != nil {
+		return fmt.Errorf("failed to create backups directory: %w", err)
+	}
+
+	filepath := filepath.Join(s.backupDir, filename)
+	if err := os.WriteFile(filepath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write backup file: %w", err)
+	}
+
+	s.logger.Info("backup saved", "file", filepath, "users", len(backup.Users), "size", len(data))
+	return nil
+}
+
+// Load backup from file
+func (s *Server) loadBackupFromFile(filename string) (*BackupData, error) {
+	filepath := filepath.Join(s.backupDir, filename)
+	data, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup file: %w", err)
+	}
+
+	var backup BackupData
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal backup: %w", err)
+	}
+
+	return &backup, nil
+}
+
+// Restore from backup
+func (s *Server) restoreBackup(backup *BackupData, restoreConfig bool) error {
+	s.users.Replace(backup.Users, backup.IPToUser)
+
+	// Restore config if requested
+	if restoreConfig && backup.Config != nil {
+		if err := s.applyConfig(backup.Config); err != nil {
+			return fmt.Errorf("failed to restore config: %w", err)
+		}
+
+		// Save config to file
+		if err := config.Save(s.configPath, backup.Config); err != nil {
+			return fmt.Errorf("failed to save restored config: %w", err)
+		}
+	}
+
+	s.logger.Info("backup restored", "users", len(backup.Users), "config_restored", restoreConfig, "timestamp", backup.Timestamp)
+	return nil
+}
+
+// List all available backups
+func (s *Server) listBackups() ([]map[string]interface{}, error) {
+	files, err := os.ReadDir(s.backupDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []map[string]interface{}{}, nil
+		}
+		return nil, err
+	}
+
+	var backups []map[string]interface{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+
+		// Try to read backup metadata
+		backup, err := s.loadBackupFromFile(file.Name())
+		var userCount int
+		var timestamp time.Time
+		if err == nil {
+			userCount = len(backup.Users)
+			timestamp = backup.Timestamp
+		} else {
+			timestamp = info.ModTime()
+		}
+
+		backups = append(backups, map[string]interface{}{
+			"filename":  file.Name(),
+			"size":      info.Size(),
+			"timestamp": timestamp,
+			"users":     userCount,
+		})
+	}
+
+	return backups, nil
+}
+
+// RunAutoBackup creates a backup shortly after startup and then daily,
+// keeping the last 7 automatic ones, until ctx is cancelled.
+func (s *Server) RunAutoBackup(ctx context.Context) {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+
+	// Create initial backup on startup
+	go func() {
+		time.Sleep(5 * time.Second) // Wait for system to fully start
+		filename := fmt.Sprintf("auto_backup_%s.json", time.Now().Format("2006-01-02_15-04-05"))
+		backup, err := s.createBackup()
+		if err != nil {
+			s.logger.Error("auto-backup creation failed", "error", err)
+			return
+		}
+		if err := s.saveBackupToFile(backup, filename); err != nil {
+			s.logger.Error("auto-backup save failed", "error", err)
+			return
+		}
+		s.logger.Info("auto-backup created on startup", "file", filename)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			filename := fmt.Sprintf("auto_backup_%s.json", time.Now().Format("2006-01-02_15-04-05"))
+			backup, err := s.createBackup()
+			if err != nil {
+				s.logger.Error("auto-backup creation failed", "error", err)
+				continue
+			}
+			if err := s.saveBackupToFile(backup, filename); err != nil {
+				s.logger.Error("auto-backup save failed", "error", err)
+				continue
+			}
+			s.logger.Info("auto-backup created", "file", filename)
+
+			// Clean old backups (keep last 7 auto-backups)
+			s.cleanOldBackups()
+		}
+	}
+}
+
+// Clean old auto-backups (keep last 7)
+func (s *Server) cleanOldBackups() {
+	files, err := os.ReadDir(s.backupDir)
+	if err != nil {
+		return
+	}
+
+	var autoBackups []os.DirEntry
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), "auto_backup_") && strings.HasSuffix(file.Name(), ".json") {
+			autoBackups = append(autoBackups, file)
+		}
+	}
+
+	// If more than 7 auto-backups, delete oldest
+	if len(autoBackups) > 7 {
+		// Sort by name (which includes timestamp)
+		for i := 0; i < len(autoBackups)-7; i++ {
+			filepath := filepath.Join(s.backupDir, autoBackups[i].Name())
+			if err := os.Remove(filepath); err != nil {
+				s.logger.Warn("failed to delete old backup", "file", autoBackups[i].Name(), "error", err)
+			} else {
+				s.logger.Info("deleted old backup", "file", autoBackups[i].Name())
+			}
+		}
+	}
+}
+
+// ======================== Backup & Restore API Handlers ========================
+
+func (s *Server) handlePanelBackupCreate(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	// Create backup
+	backup, err := s.createBackup()
+	if err != nil {
+		s.logger.Error("failed to create backup", "error", err)
+		ctx.Error(`{"error":"Failed to create backup"}`, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	// Generate filename with timestamp
+	filename := fmt.Sprintf("manual_backup_%s.json", time.Now().Format("2006-01-02_15-04-05"))
+
+	// Save to file
+	if err := s.saveBackupToFile(backup, filename); err != nil {
+		s.logger.Error("failed to save backup", "error", err)
+		ctx.Error(`{"error":"Failed to save backup"}`, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Info("manual backup created via web panel", "file", filename, "users", len(backup.Users))
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	json.NewEncoder(ctx).Encode(map[string]interface{}{
+		"success":  true,
+		"filename": filename,
+		"users":    len(backup.Users),
+		"size":     0, // Will be calculated in list
+	})
+}
+
+func (s *Server) handlePanelBackupList(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	backups, err := s.listBackups()
+	if err != nil {
+		s.logger.Error("failed to list backups", "error", err)
+		ctx.Error(`{"error":"Failed to list backups"}`, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	json.NewEncoder(ctx).Encode(map[string]interface{}{
+		"backups": backups,
+		"count":   len(backups),
+	})
+}
+
+func (s *Server) handlePanelBackupDownload(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	filename := string(ctx.QueryArgs().Peek("filename"))
+	if filename == "" {
+		ctx.Error(`{"error":"Missing filename parameter"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	// Security: only allow .json files and prevent directory traversal
+	if !strings.HasSuffix(filename, ".json") || strings.Contains(filename, "..") || strings.Contains(filename, "/") {
+		ctx.Error(`{"error":"Invalid filename"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	filepath := filepath.Join(s.backupDir, filename)
+	data, err := os.ReadFile(filepath)
+	if err != nil {
+		s.logger.Warn("backup file not found", "file", filename, "error", err)
+		ctx.Error(`{"error":"Backup file not found"}`, fasthttp.StatusNotFound)
+		return
+	}
+
+	s.logger.Info("backup downloaded via web panel", "file", filename)
+
+	ctx.SetContentType("application/json")
+	ctx.Response.Header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(data)
+}
+
+func (s *Server) handlePanelBackupRestore(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	var req struct {
+		Filename      string `json:"filename"`
+		RestoreConfig bool   `json:"restore_config"`
+	}
+
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		ctx.Error(`{"error":"Invalid JSON"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	if req.Filename == "" {
+		ctx.Error(`{"error":"Missing filename"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	// Security check
+	if strings.Contains(req.Filename, "..") || strings.Contains(req.Filename, "/") {
+		ctx.Error(`{"error":"Invalid filename"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	// Load backup
+	backup, err := s.loadBackupFromFile(req.Filename)
+	if err != nil {
+		s.logger.Error("failed to load backup", "file", req.Filename, "error", err)
+		ctx.Error(`{"error":"Failed to load backup file"}`, fasthttp.StatusNotFound)
+		return
+	}
+
+	// Restore backup
+	if err := s.restoreBackup(backup, req.RestoreConfig); err != nil {
+		s.logger.Error("failed to restore backup", "file", req.Filename, "error", err)
+		ctx.Error(`{"error":"Failed to restore backup"}`, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Info("backup restored via web panel", "file", req.Filename, "users", len(backup.Users), "config_restored", req.RestoreConfig)
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	json.NewEncoder(ctx).Encode(map[string]interface{}{
+		"success":         true,
+		"users_restored":  len(backup.Users),
+		"config_restored": req.RestoreConfig,
+	})
+}
+
+func (s *Server) handlePanelBackupUpload(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	// Get uploaded file
+	fileHeader, err := ctx.FormFile("backup")
+	if err != nil {
+		ctx.Error(`{"error":"No file uploaded"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	// Security: check file extension
+	if !strings.HasSuffix(fileHeader.Filename, ".json") {
+		ctx.Error(`{"error":"Only JSON files are allowed"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	// Read file content
+	file, err := fileHeader.Open()
+	if err != nil {
+		ctx.Error(`{"error":"Failed to open uploaded file"}`, fasthttp.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		ctx.Error(`{"error":"Failed to read uploaded file"}`, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	// Validate JSON structure
+	var backup BackupData
+	if err := json.Unmarshal(data, &backup); err != nil {
+		ctx.Error(`{"error":"Invalid backup file format"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	// Create backups directory if needed
+	if err := os.MkdirAll(s.backupDir, 0755); err != nil {
+		ctx.Error(`{"error":"Failed to create backups directory"}`, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	// Save with timestamp prefix
+	newFilename := fmt.Sprintf("uploaded_%s_%s", time.Now().Format("2006-01-02_15-04-05"), fileHeader.Filename)
+	filepath := filepath.Join(s.backupDir, newFilename)
+
+	if err := os.WriteFile(filepath, data, 0644); err != nil {
+		s.logger.Error("failed to save uploaded backup", "error", err)
+		ctx.Error(`{"error":"Failed to save backup file"}`, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Info("backup uploaded via web panel", "file", newFilename, "users", len(backup.Users))
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	json.NewEncoder(ctx).Encode(map[string]interface{}{
+		"success":  true,
+		"filename": newFilename,
+		"users":    len(backup.Users),
+	})
+}
+
+func (s *Server) handlePanelBackupDelete(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	var req struct {
+		Filename string `json:"filename"`
+	}
+
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		ctx.Error(`{"error":"Invalid JSON"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	if req.Filename == "" {
+		ctx.Error(`{"error":"Missing filename"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	// Security check
+	if strings.Contains(req.Filename, "..") || strings.Contains(req.Filename, "/") {
+		ctx.Error(`{"error":"Invalid filename"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	filepath := filepath.Join(s.backupDir, req.Filename)
+	if err := os.Remove(filepath); err != nil {
+		s.logger.Warn("failed to delete backup", "file", req.Filename, "error", err)
+		ctx.Error(`{"error":"Failed to delete backup file"}`, fasthttp.StatusNotFound)
+		return
+	}
+
+	s.logger.Info("backup deleted via web panel", "file", req.Filename)
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.WriteString(`{"success":true}`)
+}
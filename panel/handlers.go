@@ -0,0 +1,652 @@
+package panel
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"smartSNI/config"
+	"smartSNI/sniproxy"
+)
+
+// ======================== Web Panel Handlers ========================
+
+func (s *Server) serveWebPanel(ctx *fasthttp.RequestCtx) {
+	htmlContent, err := os.ReadFile(filepath.Join(s.staticDir, "webpanel.html"))
+	if err != nil {
+		ctx.Error("Web panel not found", fasthttp.StatusNotFound)
+		return
+	}
+
+	ctx.SetContentType("text/html; charset=utf-8")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(htmlContent)
+}
+
+func (s *Server) serveStaticFile(ctx *fasthttp.RequestCtx, filename string, contentType string) {
+	content, err := os.ReadFile(filepath.Join(s.staticDir, filename))
+	if err != nil {
+		ctx.Error("File not found", fasthttp.StatusNotFound)
+		return
+	}
+
+	ctx.SetContentType(contentType)
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(content)
+}
+
+func (s *Server) handlePanelLogin(ctx *fasthttp.RequestCtx) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		ctx.Error(`{"error":"Invalid request"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	if !s.checkWebPanelAuth(req.Username, req.Password) {
+		s.logger.Warn("web panel login failed", "username", req.Username, "ip", ctx.RemoteIP().String())
+		ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+		_, _ = ctx.WriteString(`{"error":"Invalid credentials"}`)
+		return
+	}
+
+	sessionID, err := s.createSession(req.Username)
+	if err != nil {
+		ctx.Error(`{"error":"Failed to create session"}`, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Info("web panel login successful", "username", req.Username)
+
+	resp, _ := json.Marshal(map[string]string{
+		"session_id": sessionID,
+		"username":   req.Username,
+	})
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(resp)
+}
+
+func (s *Server) handlePanelLogout(ctx *fasthttp.RequestCtx) {
+	sessionID := string(ctx.Request.Header.Peek("X-Session-ID"))
+	if sessionID != "" {
+		s.deleteSession(sessionID)
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.WriteString(`{"status":"logged_out"}`)
+}
+
+func (s *Server) handlePanelValidate(ctx *fasthttp.RequestCtx) {
+	sessionID := string(ctx.Request.Header.Peek("X-Session-ID"))
+	session, valid := s.validateSession(sessionID)
+
+	if !valid {
+		ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+		_, _ = ctx.WriteString(`{"error":"Invalid session"}`)
+		return
+	}
+
+	resp, _ := json.Marshal(map[string]string{
+		"username": session.Username,
+	})
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(resp)
+}
+
+func (s *Server) requirePanelAuth(ctx *fasthttp.RequestCtx) bool {
+	sessionID := string(ctx.Request.Header.Peek("X-Session-ID"))
+	_, valid := s.validateSession(sessionID)
+
+	if !valid {
+		ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+		_, _ = ctx.WriteString(`{"error":"Unauthorized"}`)
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) handlePanelMetrics(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	stats := s.metrics.GetStats()
+	data, _ := json.Marshal(stats)
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(data)
+}
+
+func (s *Server) handlePanelHealth(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	health := map[string]interface{}{
+		"status":  "healthy",
+		"uptime":  time.Since(s.startTime).Seconds(),
+		"version": "2.0",
+	}
+
+	data, _ := json.Marshal(health)
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(data)
+}
+
+func (s *Server) handlePanelDomains(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	cfg := s.config()
+	resp, _ := json.Marshal(map[string]interface{}{
+		"domains": cfg.Domains,
+		"host":    cfg.Host,
+	})
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.Write(resp)
+}
+
+func (s *Server) handlePanelAddDomain(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	var req struct {
+		Domain string `json:"domain"`
+	}
+
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		ctx.Error(`{"error":"Invalid request"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	// Read current config
+	cfg, err := config.Load(s.configPath)
+	if err != nil {
+		s.logger.Error("failed to load config for add domain", "error", err)
+		ctx.Error(fmt.Sprintf(`{"error":"Failed to load config: %s"}`, err.Error()), fasthttp.StatusInternalServerError)
+		return
+	}
+
+	// Get server IP from existing domains or use first domain's IP
+	var serverIP string
+	for _, ip := range cfg.Domains {
+		if net.ParseIP(ip) != nil {
+			serverIP = ip
+			break
+		}
+	}
+
+	if serverIP == "" {
+		ctx.Error(`{"error":"No server IP found in config. Please add at least one domain first via install.sh"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	// Clean domain
+	domain := strings.TrimSpace(req.Domain)
+	domain = strings.TrimPrefix(domain, "http://")
+	domain = strings.TrimPrefix(domain, "https://")
+	domain = strings.TrimSuffix(domain, "/")
+
+	if domain == "" {
+		ctx.Error(`{"error":"Domain cannot be empty"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	// Add both exact and wildcard patterns
+	if strings.HasPrefix(domain, "*.") || strings.Contains(domain, "*") {
+		// Already has wildcard, add as-is
+		cfg.Domains[domain] = serverIP
+	} else {
+		// Add both exact and wildcard
+		cfg.Domains[domain] = serverIP
+		cfg.Domains["*."+domain] = serverIP
+	}
+
+	// Save config
+	data, _ := json.MarshalIndent(cfg, "", "  ")
+	if err := os.WriteFile(s.configPath, data, 0644); err != nil {
+		ctx.Error(`{"error":"Failed to save config"}`, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	// Reload config
+	if err := s.reload(); err != nil {
+		s.logger.Error("failed to reload after adding domain", "error", err)
+	}
+
+	s.logger.Info("domain added via web panel", "domain", domain, "wildcard", "*."+domain, "ip", serverIP)
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.WriteString(`{"status":"added"}`)
+}
+
+func (s *Server) handlePanelRemoveDomain(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	var req struct {
+		Domain string `json:"domain"`
+	}
+
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		ctx.Error(`{"error":"Invalid request"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	// Read current config
+	cfg, err := config.Load(s.configPath)
+	if err != nil {
+		ctx.Error(`{"error":"Failed to load config"}`, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	// Remove domain
+	delete(cfg.Domains, req.Domain)
+
+	// Save config
+	data, _ := json.MarshalIndent(cfg, "", "  ")
+	if err := os.WriteFile(s.configPath, data, 0644); err != nil {
+		ctx.Error(`{"error":"Failed to save config"}`, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	// Reload config
+	if err := s.reload(); err != nil {
+		s.logger.Error("failed to reload after removing domain", "error", err)
+	}
+
+	s.logger.Info("domain removed via web panel", "domain", req.Domain)
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.WriteString(`{"status":"removed"}`)
+}
+
+func (s *Server) handlePanelReload(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	if err := s.reload(); err != nil {
+		s.logger.Error("failed to reload config via panel", "error", err)
+		ctx.Error(`{"error":"Failed to reload"}`, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Info("config reloaded via web panel")
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.WriteString(`{"status":"reloaded"}`)
+}
+
+// ======================== SNI Connections API Handlers ========================
+
+func (s *Server) handlePanelConnections(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	active := []sniproxy.ConnInfo{}
+	if s.connections != nil {
+		active = s.connections.Connections()
+	}
+	bySNI, byUser := s.metrics.SNITraffic()
+
+	// Names for the user IDs shown
+	names := make(map[string]string)
+	addName := func(id string) {
+		if _, ok := names[id]; ok || id == "" {
+			return
+		}
+		if u := s.users.ByID(id); u != nil {
+			names[id] = u.Name
+		}
+	}
+	for _, c := range active {
+		addName(c.User)
+	}
+	for id := range byUser {
+		addName(id)
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	json.NewEncoder(ctx).Encode(map[string]interface{}{
+		"active":     active,
+		"count":      len(active),
+		"by_sni":     bySNI,
+		"by_user":    byUser,
+		"user_names": names,
+	})
+}
+
+func (s *Server) handlePanelKillConnection(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	var req struct {
+		ID uint64 `json:"id"`
+	}
+
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		ctx.Error(`{"error":"Invalid JSON"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	if s.connections == nil || !s.connections.KillConnection(req.ID) {
+		ctx.Error(`{"error":"Connection not found"}`, fasthttp.StatusNotFound)
+		return
+	}
+	s.logger.Info("SNI connection killed from the panel", "id", req.ID)
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.WriteString(`{"success":true}`)
+}
+
+// ======================== User Management API Handlers ========================
+
+func (s *Server) handlePanelUsers(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	userList := s.users.List()
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	json.NewEncoder(ctx).Encode(map[string]interface{}{
+		"users": userList,
+		"count": len(userList),
+	})
+}
+
+func (s *Server) handlePanelCreateUser(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	var req struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		MaxIPs      int    `json:"max_ips"`
+		ValidDays   int    `json:"valid_days"`
+	}
+
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		ctx.Error(`{"error":"Invalid JSON"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" || req.MaxIPs <= 0 || req.ValidDays <= 0 {
+		ctx.Error(`{"error":"Missing required fields"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	user, err := s.users.Create(req.Name, req.Description, req.MaxIPs, req.ValidDays)
+	if err != nil {
+		s.logger.Error("failed to create user", "error", err)
+		ctx.Error(`{"error":"Failed to create user"}`, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	cfg := s.config()
+	registerURL := fmt.Sprintf("http://%s:%d/register?token=%s", cfg.Host, cfg.WebPanelPort, user.ID)
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	json.NewEncoder(ctx).Encode(map[string]interface{}{
+		"success":      true,
+		"user":         user,
+		"register_url": registerURL,
+	})
+}
+
+func (s *Server) handlePanelExtendUser(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	var req struct {
+		UserID string `json:"user_id"`
+		Days   int    `json:"days"`
+	}
+
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		ctx.Error(`{"error":"Invalid JSON"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	if err := s.users.Extend(req.UserID, req.Days); err != nil {
+		ctx.Error(fmt.Sprintf(`{"error":"%s"}`, err.Error()), fasthttp.StatusNotFound)
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.WriteString(`{"success":true}`)
+}
+
+func (s *Server) handlePanelUserDomainSets(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	var req struct {
+		UserID     string   `json:"user_id"`
+		Plan       string   `json:"plan"`
+		DomainSets []string `json:"domain_sets"`
+	}
+
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		ctx.Error(`{"error":"Invalid JSON"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	if err := s.setUserDomainSets(req.UserID, req.Plan, req.DomainSets); err != nil {
+		ctx.Error(fmt.Sprintf(`{"error":"%s"}`, err.Error()), fasthttp.StatusBadRequest)
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.WriteString(`{"success":true}`)
+}
+
+func (s *Server) handlePanelUserSourcePool(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	var req struct {
+		UserID     string `json:"user_id"`
+		SourcePool string `json:"source_pool"`
+	}
+
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		ctx.Error(`{"error":"Invalid JSON"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	if err := s.setUserSourcePool(req.UserID, req.SourcePool); err != nil {
+		ctx.Error(fmt.Sprintf(`{"error":"%s"}`, err.Error()), fasthttp.StatusBadRequest)
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.WriteString(`{"success":true}`)
+}
+
+func (s *Server) handlePanelDeactivateUser(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	var req struct {
+		UserID string `json:"user_id"`
+	}
+
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		ctx.Error(`{"error":"Invalid JSON"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	if err := s.users.Deactivate(req.UserID); err != nil {
+		ctx.Error(fmt.Sprintf(`{"error":"%s"}`, err.Error()), fasthttp.StatusNotFound)
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.WriteString(`{"success":true}`)
+}
+
+func (s *Server) handlePanelDeleteUser(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	var req struct {
+		UserID string `json:"user_id"`
+	}
+
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		ctx.Error(`{"error":"Invalid JSON"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	if err := s.users.Delete(req.UserID); err != nil {
+		ctx.Error(fmt.Sprintf(`{"error":"%s"}`, err.Error()), fasthttp.StatusNotFound)
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.WriteString(`{"success":true}`)
+}
+
+func (s *Server) handlePanelChangePassword(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		ctx.Error(`{"error":"Invalid JSON"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		ctx.Error(`{"error":"Current password and new password are required"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	cfg := s.config()
+
+	// Verify current password
+	currentHash := fmt.Sprintf("%x", sha256.Sum256([]byte(req.CurrentPassword)))
+	if currentHash != cfg.WebPanelPassword {
+		ctx.Error(`{"error":"Current password is incorrect"}`, fasthttp.StatusUnauthorized)
+		return
+	}
+
+	// Hash new password
+	newHash := fmt.Sprintf("%x", sha256.Sum256([]byte(req.NewPassword)))
+
+	// Update config
+	cfg.WebPanelPassword = newHash
+	s.cfg.Set(cfg)
+
+	// Save to file
+	if err := config.Save(s.configPath, cfg); err != nil {
+		s.logger.Error("failed to save config after password change", "error", err)
+		ctx.Error(`{"error":"Failed to save new password"}`, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Info("web panel password changed", "username", cfg.WebPanelUsername)
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.WriteString(`{"success":true,"message":"Password changed successfully"}`)
+}
+
+func (s *Server) handlePanelChangeUsername(ctx *fasthttp.RequestCtx) {
+	if !s.requirePanelAuth(ctx) {
+		return
+	}
+
+	var req struct {
+		Password    string `json:"password"`
+		NewUsername string `json:"new_username"`
+	}
+
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		ctx.Error(`{"error":"Invalid JSON"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	if req.Password == "" || req.NewUsername == "" {
+		ctx.Error(`{"error":"Password and new username are required"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	cfg := s.config()
+
+	// Verify password
+	passwordHash := fmt.Sprintf("%x", sha256.Sum256([]byte(req.Password)))
+	if passwordHash != cfg.WebPanelPassword {
+		ctx.Error(`{"error":"Password is incorrect"}`, fasthttp.StatusUnauthorized)
+		return
+	}
+
+	oldUsername := cfg.WebPanelUsername
+
+	// Update config
+	cfg.WebPanelUsername = req.NewUsername
+	s.cfg.Set(cfg)
+
+	// Save to file
+	if err := config.Save(s.configPath, cfg); err != nil {
+		s.logger.Error("failed to save config after username change", "error", err)
+		ctx.Error(`{"error":"Failed to save new username"}`, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Info("web panel username changed", "old_username", oldUsername, "new_username", req.NewUsername)
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.WriteString(`{"success":true,"message":"Username changed successfully"}`)
+}
@@ -0,0 +1,375 @@
+// Package panel serves the web admin panel, the self-service registration
+// page and the backup API.
+package panel
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"smartSNI/config"
+	"smartSNI/metrics"
+	"smartSNI/sniproxy"
+	"smartSNI/users"
+)
+
+// Connections lists and closes live SNI proxy connections. sniproxy.Server
+// implements it.
+type Connections interface {
+	Connections() []sniproxy.ConnInfo
+	KillConnection(id uint64) bool
+}
+
+// Options configures a Server. Config and Users are required.
+type Options struct {
+	Config     *config.Store
+	ConfigPath string // file edits are saved to (default "config.json")
+	Users      *users.Store
+	Metrics    *metrics.Metrics
+	Logger     *slog.Logger
+
+	// BackupDir holds backup archives (default "backups").
+	BackupDir string
+	// StaticDir holds webpanel.html and its assets (default ".").
+	StaticDir string
+
+	// Connections backs the active connections view (none when nil).
+	Connections Connections
+
+	// ApplyConfig activates a configuration changed through the panel,
+	// typically the DNS server's Reload. When nil the config store is
+	// updated directly.
+	ApplyConfig func(*config.Config) error
+}
+
+// Server is the web panel. Create it with New.
+type Server struct {
+	cfg         *config.Store
+	configPath  string
+	users       *users.Store
+	metrics     *metrics.Metrics
+	logger      *slog.Logger
+	backupDir   string
+	staticDir   string
+	applyConfig func(*config.Config) error
+	connections Connections
+
+	sessions  sync.Map // map[string]*Session - session_id -> Session
+	startTime time.Time
+}
+
+// New creates a Server from opts.
+func New(opts Options) *Server {
+	s := &Server{
+		cfg:         opts.Config,
+		configPath:  opts.ConfigPath,
+		users:       opts.Users,
+		metrics:     opts.Metrics,
+		logger:      opts.Logger,
+		backupDir:   opts.BackupDir,
+		staticDir:   opts.StaticDir,
+		applyConfig: opts.ApplyConfig,
+		connections: opts.Connections,
+		startTime:   time.Now(),
+	}
+	if s.configPath == "" {
+		s.configPath = "config.json"
+	}
+	if s.metrics == nil {
+		s.metrics = metrics.New()
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+	if s.backupDir == "" {
+		s.backupDir = "backups"
+	}
+	if s.staticDir == "" {
+		s.staticDir = "."
+	}
+	if s.applyConfig == nil {
+		s.applyConfig = func(c *config.Config) error {
+			s.cfg.Set(c)
+			return nil
+		}
+	}
+	return s
+}
+
+func (s *Server) config() *config.Config {
+	return s.cfg.Get()
+}
+
+// reload re-reads the config file and applies it.
+func (s *Server) reload() error {
+	cfg, err := config.Load(s.configPath)
+	if err != nil {
+		return err
+	}
+	if err := s.applyConfig(cfg); err != nil {
+		return err
+	}
+	s.logger.Info("configuration reloaded successfully")
+	return nil
+}
+
+// setUserDomainSets assigns a plan and domain sets after checking that they
+// exist in the current configuration.
+func (s *Server) setUserDomainSets(userID, plan string, sets []string) error {
+	if s.users.ByID(userID) == nil {
+		return fmt.Errorf("user not found")
+	}
+	if err := s.config().ValidateUserSets(plan, sets); err != nil {
+		return err
+	}
+	return s.users.SetDomainSets(userID, plan, sets)
+}
+
+func (s *Server) setUserSourcePool(userID, pool string) error {
+	if s.users.ByID(userID) == nil {
+		return fmt.Errorf("user not found")
+	}
+	if err := s.config().ValidateSourcePool(pool); err != nil {
+		return err
+	}
+	return s.users.SetSourcePool(userID, pool)
+}
+
+// ======================== Web Panel Sessions ========================
+
+type Session struct {
+	Username  string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	mu        sync.RWMutex
+}
+
+func hashPassword(password string) string {
+	hash := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(hash[:])
+}
+
+func generateSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *Server) createSession(username string) (string, error) {
+	sessionID, err := generateSessionID()
+	if err != nil {
+		return "", err
+	}
+
+	session := &Session{
+		Username:  username,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(24 * time.Hour),
+	}
+
+	s.sessions.Store(sessionID, session)
+	s.logger.Info("session created", "username", username, "session_id", sessionID[:16]+"...")
+
+	return sessionID, nil
+}
+
+func (s *Server) validateSession(sessionID string) (*Session, bool) {
+	val, exists := s.sessions.Load(sessionID)
+	if !exists {
+		return nil, false
+	}
+
+	session := val.(*Session)
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+
+	if time.Now().After(session.ExpiresAt) {
+		s.sessions.Delete(sessionID)
+		return nil, false
+	}
+
+	return session, true
+}
+
+func (s *Server) deleteSession(sessionID string) {
+	s.sessions.Delete(sessionID)
+	s.logger.Info("session deleted", "session_id", sessionID[:16]+"...")
+}
+
+// CleanExpiredSessions drops expired sessions every 10 minutes until ctx
+// is cancelled.
+func (s *Server) CleanExpiredSessions(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		s.sessions.Range(func(key, value interface{}) bool {
+			session := value.(*Session)
+			session.mu.RLock()
+			expired := now.After(session.ExpiresAt)
+			session.mu.RUnlock()
+
+			if expired {
+				s.sessions.Delete(key)
+				s.logger.Debug("removed expired session", "session_id", key.(string)[:16]+"...")
+			}
+			return true
+		})
+	}
+}
+
+func (s *Server) checkWebPanelAuth(username, password string) bool {
+	cfg := s.config()
+
+	if !cfg.WebPanelEnabled {
+		return false
+	}
+
+	if cfg.WebPanelUsername == "" || cfg.WebPanelPassword == "" {
+		return false
+	}
+
+	hashedPassword := hashPassword(password)
+	return username == cfg.WebPanelUsername && hashedPassword == cfg.WebPanelPassword
+}
+
+// ======================== Web Panel Server ========================
+
+// Handler routes the panel, registration and backup endpoints.
+func (s *Server) Handler() fasthttp.RequestHandler {
+	return func(c *fasthttp.RequestCtx) {
+		path := string(c.Path())
+
+		// CORS headers
+		c.Response.Header.Set("Access-Control-Allow-Origin", "*")
+		c.Response.Header.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		c.Response.Header.Set("Access-Control-Allow-Headers", "Content-Type, X-Session-ID")
+
+		if string(c.Method()) == "OPTIONS" {
+			c.SetStatusCode(fasthttp.StatusOK)
+			return
+		}
+
+		switch path {
+		case "/panel", "/panel/":
+			s.serveWebPanel(c)
+		case "/webpanel-main.js":
+			s.serveStaticFile(c, "webpanel-main.js", "application/javascript")
+		case "/webpanel-enhancements.js":
+			s.serveStaticFile(c, "webpanel-enhancements.js", "application/javascript")
+		case "/webpanel-style.css":
+			s.serveStaticFile(c, "webpanel-style.css", "text/css")
+		case "/panel/api/login":
+			s.handlePanelLogin(c)
+		case "/panel/api/logout":
+			s.handlePanelLogout(c)
+		case "/panel/api/validate":
+			s.handlePanelValidate(c)
+		case "/panel/api/metrics":
+			s.handlePanelMetrics(c)
+		case "/panel/api/health":
+			s.handlePanelHealth(c)
+		case "/panel/api/domains":
+			s.handlePanelDomains(c)
+		case "/panel/api/domains/add":
+			s.handlePanelAddDomain(c)
+		case "/panel/api/domains/remove":
+			s.handlePanelRemoveDomain(c)
+		case "/panel/api/reload":
+			s.handlePanelReload(c)
+		case "/panel/api/connections":
+			s.handlePanelConnections(c)
+		case "/panel/api/connections/kill":
+			s.handlePanelKillConnection(c)
+		case "/panel/api/users":
+			s.handlePanelUsers(c)
+		case "/panel/api/users/create":
+			s.handlePanelCreateUser(c)
+		case "/panel/api/users/extend":
+			s.handlePanelExtendUser(c)
+		case "/panel/api/users/deactivate":
+			s.handlePanelDeactivateUser(c)
+		case "/panel/api/users/domain-sets":
+			s.handlePanelUserDomainSets(c)
+		case "/panel/api/users/source-pool":
+			s.handlePanelUserSourcePool(c)
+		case "/panel/api/users/delete":
+			s.handlePanelDeleteUser(c)
+		case "/panel/api/settings/change-password":
+			s.handlePanelChangePassword(c)
+		case "/panel/api/settings/change-username":
+			s.handlePanelChangeUsername(c)
+		case "/panel/api/backup/create":
+			s.handlePanelBackupCreate(c)
+		case "/panel/api/backup/list":
+			s.handlePanelBackupList(c)
+		case "/panel/api/backup/download":
+			s.handlePanelBackupDownload(c)
+		case "/panel/api/backup/restore":
+			s.handlePanelBackupRestore(c)
+		case "/panel/api/backup/upload":
+			s.handlePanelBackupUpload(c)
+		case "/panel/api/backup/delete":
+			s.handlePanelBackupDelete(c)
+		case "/register":
+			s.serveRegisterPage(c)
+		case "/register/submit":
+			s.handleRegisterSubmit(c)
+		case "/api/update-ip":
+			s.handleUpdateIP(c)
+		default:
+			c.Error("Not found", fasthttp.StatusNotFound)
+		}
+	}
+}
+
+// ListenAndServe serves Handler on web_panel_port until ctx is cancelled.
+// It returns nil without listening when the panel is disabled or has no
+// credentials.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	cfg := s.config()
+	if !cfg.WebPanelEnabled {
+		s.logger.Info("web panel is disabled")
+		return nil
+	}
+
+	if cfg.WebPanelUsername == "" || cfg.WebPanelPassword == "" {
+		s.logger.Warn("web panel enabled but no credentials configured")
+		return nil
+	}
+
+	server := &fasthttp.Server{
+		Handler:      s.Handler(),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		s.logger.Info("web panel shutting down")
+		_ = server.Shutdown()
+	}()
+
+	addr := fmt.Sprintf("0.0.0.0:%d", cfg.WebPanelPort)
+	s.logger.Info("web panel started", "port", cfg.WebPanelPort, "url", fmt.Sprintf("http://0.0.0.0:%d/panel", cfg.WebPanelPort))
+
+	if err := server.ListenAndServe(addr); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("web panel server error: %w", err)
+	}
+	return nil
+}
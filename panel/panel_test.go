@@ -0,0 +1,161 @@
+package panel
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+
+	"smartSNI/config"
+	"smartSNI/metrics"
+	"smartSNI/sniproxy"
+	"smartSNI/users"
+)
+
+func newTestPanel(t *testing.T) *Server {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return New(Options{
+		Config: config.NewStore(&config.Config{
+			Host:             "panel.test",
+			WebPanelEnabled:  true,
+			WebPanelUsername: "admin",
+			WebPanelPassword: hashPassword("secret"),
+			DomainSets:       map[string]config.DomainSet{"youtube": {Domains: map[string]string{"*.youtube.com": "10.0.0.2"}}},
+			SourcePools:      map[string]config.AddrPool{"v6": {Addrs: []string{"2001:db8::/64"}}},
+		}),
+		ConfigPath: t.TempDir() + "/config.json",
+		Users:      users.NewStore(logger),
+		Logger:     logger,
+		BackupDir:  t.TempDir(),
+	})
+}
+
+// call runs one request through the panel handler.
+func call(s *Server, path, session, body string) (int, []byte) {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI(path)
+	ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+	if session != "" {
+		ctx.Request.Header.Set("X-Session-ID", session)
+	}
+	ctx.Request.SetBodyString(body)
+	s.Handler()(&ctx)
+	return ctx.Response.StatusCode(), ctx.Response.Body()
+}
+
+func TestPanelLoginAndSession(t *testing.T) {
+	s := newTestPanel(t)
+
+	if code, _ := call(s, "/panel/api/login", "", `{"username":"admin","password":"wrong"}`); code != fasthttp.StatusUnauthorized {
+		t.Fatalf("bad password: got %d", code)
+	}
+	if code, _ := call(s, "/panel/api/metrics", "", ""); code != fasthttp.StatusUnauthorized {
+		t.Fatalf("API without session: got %d", code)
+	}
+
+	code, body := call(s, "/panel/api/login", "", `{"username":"admin","password":"secret"}`)
+	var login struct {
+		SessionID string `json:"session_id"`
+	}
+	if code != fasthttp.StatusOK || json.Unmarshal(body, &login) != nil || login.SessionID == "" {
+		t.Fatalf("login: %d %s", code, body)
+	}
+	if code, _ := call(s, "/panel/api/validate", login.SessionID, ""); code != fasthttp.StatusOK {
+		t.Fatalf("validate: got %d", code)
+	}
+
+	call(s, "/panel/api/logout", login.SessionID, "")
+	if code, _ := call(s, "/panel/api/validate", login.SessionID, ""); code != fasthttp.StatusUnauthorized {
+		t.Fatalf("session still valid after logout: %d", code)
+	}
+}
+
+func TestPanelUserDomainSets(t *testing.T) {
+	s := newTestPanel(t)
+	session, err := s.createSession("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := call(s, "/panel/api/users/create", session, `{"name":"alice","max_ips":2,"valid_days":30}`)
+	var created struct {
+		User users.User `json:"user"`
+	}
+	if code != fasthttp.StatusOK || json.Unmarshal(body, &created) != nil {
+		t.Fatalf("create user: %d %s", code, body)
+	}
+	id := created.User.ID
+
+	if code, _ := call(s, "/panel/api/users/domain-sets", session, `{"user_id":"`+id+`","domain_sets":["missing"]}`); code != fasthttp.StatusBadRequest {
+		t.Fatalf("unknown set: got %d", code)
+	}
+	if code, _ := call(s, "/panel/api/users/domain-sets", session, `{"user_id":"`+id+`","domain_sets":["youtube"]}`); code != fasthttp.StatusOK {
+		t.Fatalf("known set: got %d", code)
+	}
+	if sets := s.users.ByID(id).DomainSets; len(sets) != 1 || sets[0] != "youtube" {
+		t.Fatalf("domain sets not stored: %v", sets)
+	}
+
+	if code, _ := call(s, "/panel/api/users/source-pool", session, `{"user_id":"`+id+`","source_pool":"missing"}`); code != fasthttp.StatusBadRequest {
+		t.Fatalf("unknown pool: got %d", code)
+	}
+	if code, _ := call(s, "/panel/api/users/source-pool", session, `{"user_id":"`+id+`","source_pool":"v6"}`); code != fasthttp.StatusOK {
+		t.Fatalf("known pool: got %d", code)
+	}
+	if pool := s.users.ByID(id).SourcePool; pool != "v6" {
+		t.Fatalf("source pool not stored: %q", pool)
+	}
+}
+
+// fakeConnections is a fixed set of live connections.
+type fakeConnections struct {
+	live   []sniproxy.ConnInfo
+	killed []uint64
+}
+
+func (f *fakeConnections) Connections() []sniproxy.ConnInfo { return f.live }
+
+func (f *fakeConnections) KillConnection(id uint64) bool {
+	for _, c := range f.live {
+		if c.ID == id {
+			f.killed = append(f.killed, id)
+			return true
+		}
+	}
+	return false
+}
+
+func TestPanelConnections(t *testing.T) {
+	s := newTestPanel(t)
+	conns := &fakeConnections{live: []sniproxy.ConnInfo{{ID: 7, Client: "198.51.100.9:4000", SNI: "video.test", User: "u1", BytesIn: 10}}}
+	s.connections = conns
+	s.users.Put(&users.User{ID: "u1", Name: "alice"})
+	s.metrics.SNIConnStart("video.test", "u1")
+	session, err := s.createSession("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := call(s, "/panel/api/connections", session, "")
+	var resp struct {
+		Active    []sniproxy.ConnInfo        `json:"active"`
+		BySNI     map[string]metrics.Traffic `json:"by_sni"`
+		UserNames map[string]string          `json:"user_names"`
+	}
+	if code != fasthttp.StatusOK || json.Unmarshal(body, &resp) != nil {
+		t.Fatalf("connections: %d %s", code, body)
+	}
+	if len(resp.Active) != 1 || resp.BySNI["video.test"].Connections != 1 || resp.UserNames["u1"] != "alice" {
+		t.Fatalf("connections: %s", body)
+	}
+
+	if code, _ := call(s, "/panel/api/connections/kill", session, `{"id":8}`); code != fasthttp.StatusNotFound {
+		t.Fatalf("unknown connection: got %d", code)
+	}
+	if code, _ := call(s, "/panel/api/connections/kill", session, `{"id":7}`); code != fasthttp.StatusOK || len(conns.killed) != 1 {
+		t.Fatalf("kill: got %d, killed %v", code, conns.killed)
+	}
+}
@@ -0,0 +1,480 @@
+package panel
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/valyala/fasthttp"
+
+	"smartSNI/internal/httpx"
+)
+
+// ======================== Registration Handlers ========================
+
+func (s *Server) serveRegisterPage(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.QueryArgs().Peek("token"))
+	if token == "" {
+		ctx.Error("Missing token", fasthttp.StatusBadRequest)
+		return
+	}
+
+	// Validate user exists and is valid
+	user := s.users.ByID(token)
+	if user == nil {
+		ctx.Error("Invalid token", fasthttp.StatusNotFound)
+		return
+	}
+
+	if !user.IsActive || time.Now().After(user.ExpiresAt) {
+		ctx.Error("User expired or inactive", fasthttp.StatusForbidden)
+		return
+	}
+
+	// Get client IP
+	clientIP := httpx.ClientIP(ctx)
+
+	html := fmt.Sprintf(`
+<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Register for DNS Access</title>
+    <style>
+        * { margin: 0; padding: 0; box-sizing: border-box; }
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Oxygen, Ubuntu, Cantarell, sans-serif;
+            background: linear-gradient(135deg, #667eea 0%%, #764ba2 100%%);
+            min-height: 100vh;
+            display: flex;
+            justify-content: center;
+            align-items: center;
+            padding: 20px;
+        }
+        .container {
+            background: white;
+            border-radius: 20px;
+            padding: 40px;
+            max-width: 800px;
+            width: 100%%;
+            box-shadow: 0 20px 60px rgba(0,0,0,0.3);
+        }
+        h1 {
+            color: #667eea;
+            margin-bottom: 10px;
+            font-size: 28px;
+        }
+        .subtitle {
+            color: #666;
+            margin-bottom: 30px;
+            font-size: 14px;
+        }
+        .form-group {
+            margin-bottom: 20px;
+        }
+        label {
+            display: block;
+            margin-bottom: 8px;
+            color: #333;
+            font-weight: 500;
+        }
+        input, textarea {
+            width: 100%%;
+            padding: 12px;
+            border: 2px solid #e0e0e0;
+            border-radius: 8px;
+            font-size: 14px;
+            transition: border-color 0.3s;
+        }
+        input:focus, textarea:focus {
+            outline: none;
+            border-color: #667eea;
+        }
+        textarea {
+            resize: vertical;
+            min-height: 80px;
+        }
+        .info-box {
+            background: #f0f7ff;
+            border-left: 4px solid #667eea;
+            padding: 15px;
+            margin-bottom: 20px;
+            border-radius: 4px;
+        }
+        .info-box p {
+            color: #333;
+            font-size: 14px;
+            margin-bottom: 5px;
+        }
+        .info-box strong {
+            color: #667eea;
+        }
+        button {
+            width: 100%%;
+            padding: 14px;
+            background: linear-gradient(135deg, #667eea 0%%, #764ba2 100%%);
+            color: white;
+            border: none;
+            border-radius: 8px;
+            font-size: 16px;
+            font-weight: 600;
+            cursor: pointer;
+            transition: transform 0.2s;
+        }
+        button:hover {
+            transform: translateY(-2px);
+        }
+        button:disabled {
+            opacity: 0.6;
+            cursor: not-allowed;
+        }
+        .message {
+            margin-top: 20px;
+            padding: 15px;
+            border-radius: 8px;
+            display: none;
+        }
+        .message.success {
+            background: #d4edda;
+            color: #155724;
+            border: 1px solid #c3e6cb;
+        }
+        .message.error {
+            background: #f8d7da;
+            color: #721c24;
+            border: 1px solid #f5c6cb;
+        }
+        .dns-info {
+            margin-top: 20px;
+            padding: 15px;
+            background: #fff3cd;
+            border-radius: 8px;
+            display: none;
+        }
+        .dns-info h3 {
+            color: #856404;
+            margin-bottom: 10px;
+            font-size: 16px;
+        }
+        .dns-info code {
+            background: #ffeaa7;
+            padding: 2px 6px;
+            border-radius: 4px;
+            font-family: 'Courier New', monospace;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>🌐 DNS Access Registration</h1>
+        <p class="subtitle">Register your IP address to access our DNS services</p>
+
+        <div class="info-box">
+            <p><strong>Your IP:</strong> <span id="userIP">%s</span></p>
+            <p><strong>User:</strong> %s</p>
+            <p><strong>Max IPs:</strong> %d</p>
+            <p><strong>Current IPs:</strong> %d / %d</p>
+            <p><strong>Expires:</strong> %s</p>
+        </div>
+
+        <form id="registerForm">
+            <input type="hidden" name="token" value="%s">
+
+            <button type="submit" id="submitBtn">Register This IP</button>
+        </form>
+
+        <div class="message" id="message"></div>
+
+        <div class="dns-info" id="dnsInfo">
+            <h3>✅ Registration Successful!</h3>
+            <p>Configure your device to use our DNS:</p>
+            <p><strong>DoH:</strong> <code id="dohURL"></code></p>
+            <p><strong>DoT:</strong> <code id="dotServer"></code></p>
+        </div>
+    </div>
+
+    <script>
+        function createGuide(result) {
+            const hostname = window.location.hostname;
+            const apiKey = result.user.api_key;
+            const dohWithKey = 'https://' + hostname + '/dns-query?key=' + apiKey;
+            const dohShortURL = 'https://' + hostname + '/doh/' + apiKey;
+            const updateURL = 'https://' + hostname + '/api/update-ip?key=' + apiKey;
+
+            return '<div style="margin-top: 20px;">' +
+                '<div style="background: #d4edda; padding: 20px; border-radius: 10px; margin-bottom: 20px;">' +
+                    '<h3 style="color: #155724; margin-bottom: 15px;">📋 Your Information</h3>' +
+                    '<p style="margin: 5px 0;"><strong>IP:</strong> ' + result.user.ips.join(', ') + '</p>' +
+                    '<p style="margin: 5px 0;"><strong>User:</strong> ' + result.user.name + '</p>' +
+                    '<p style="margin: 5px 0;"><strong>Expires:</strong> ' + new Date(result.expires_at).toLocaleDateString() + '</p>' +
+                '</div>' +
+
+                '<div style="background: #fff3cd; padding: 20px; border-radius: 10px; margin-bottom: 20px;">' +
+                    '<h3 style="color: #856404; margin-bottom: 15px;">🌐 DoH URLs (For Dynamic IPs)</h3>' +
+                    '<p style="font-size: 13px; color: #666; margin-bottom: 15px;">Choose the URL format that works with your app:</p>' +
+
+                    '<label style="font-weight: 600; color: #856404; display: block; margin-bottom: 5px;">📱 For Intra / Short URL (Recommended):</label>' +
+                    '<div style="background: white; padding: 10px; border-radius: 5px; margin-bottom: 15px; word-break: break-all;">' +
+                        '<code style="font-size: 12px;">' + dohShortURL + '</code>' +
+                        '<button onclick="copyText(\'' + dohShortURL + '\')" style="width: auto; padding: 5px 10px; margin-left: 10px; font-size: 12px;">Copy</button>' +
+                    '</div>' +
+
+                    '<label style="font-weight: 600; color: #856404; display: block; margin-bottom: 5px;">🌐 For Browsers (Firefox, Chrome):</label>' +
+                    '<div style="background: white; padding: 10px; border-radius: 5px; margin-bottom: 10px; word-break: break-all;">' +
+                        '<code style="font-size: 11px;">' + dohWithKey + '</code>' +
+                        '<button onclick="copyText(\'' + dohWithKey + '\')" style="width: auto; padding: 5px 10px; margin-left: 10px; font-size: 12px;">Copy</button>' +
+                    '</div>' +
+                '</div>' +
+
+                '<div style="background: #d1ecf1; padding: 20px; border-radius: 10px; margin-bottom: 20px;">' +
+                    '<h3 style="color: #0c5460; margin-bottom: 15px;">📖 Setup Guides</h3>' +
+
+                    '<details style="margin-bottom: 10px;">' +
+                        '<summary style="cursor: pointer; font-weight: 600; padding: 10px; background: white; border-radius: 5px;">🦊 Firefox</summary>' +
+                        '<div style="padding: 15px; background: white; margin-top: 5px; border-radius: 5px;">' +
+                            '<ol style="margin: 10px 0 10px 20px; line-height: 1.8;">' +
+                                '<li>Open Settings → Privacy & Security</li>' +
+                                '<li>Scroll to "DNS over HTTPS"</li>' +
+                                '<li>Select "Max Protection"</li>' +
+                                '<li>Choose "Custom" and paste:<br><code style="background: #f0f0f0; padding: 5px; display: block; margin: 5px 0; word-break: break-all;">' + dohWithKey + '</code></li>' +
+                            '</ol>' +
+                        '</div>' +
+                    '</details>' +
+
+                    '<details style="margin-bottom: 10px;">' +
+                        '<summary style="cursor: pointer; font-weight: 600; padding: 10px; background: white; border-radius: 5px;">🌐 Chrome/Edge</summary>' +
+                        '<div style="padding: 15px; background: white; margin-top: 5px; border-radius: 5px;">' +
+                            '<ol style="margin: 10px 0 10px 20px; line-height: 1.8;">' +
+                                '<li>Settings → Privacy and security → Security</li>' +
+                                '<li>Enable "Use secure DNS"</li>' +
+                                '<li>Select "With Custom" and paste the URL above</li>' +
+                            '</ol>' +
+                        '</div>' +
+                    '</details>' +
+
+                    '<details style="margin-bottom: 10px;">' +
+                        '<summary style="cursor: pointer; font-weight: 600; padding: 10px; background: white; border-radius: 5px;">🍎 macOS</summary>' +
+                        '<div style="padding: 15px; background: white; margin-top: 5px; border-radius: 5px;">' +
+                            '<p>Install a DoH client like <strong>DNSCrypt</strong> or use browser settings above.</p>' +
+                        '</div>' +
+                    '</details>' +
+
+                    '<details style="margin-bottom: 10px;">' +
+                        '<summary style="cursor: pointer; font-weight: 600; padding: 10px; background: white; border-radius: 5px;">🤖 Android / Intra App</summary>' +
+                        '<div style="padding: 15px; background: white; margin-top: 5px; border-radius: 5px;">' +
+                            '<p><strong>Option 1: Intra App (Recommended)</strong></p>' +
+                            '<ol style="margin: 10px 0 10px 20px; line-height: 1.8;">' +
+                                '<li>Install "Intra" from Google Play Store</li>' +
+                                '<li>Open Intra → Settings → Select DNS over HTTPS Server</li>' +
+                                '<li>Choose "Custom server URL"</li>' +
+                                '<li>Paste the short URL:<br><code style="background: #f0f0f0; padding: 5px; display: block; margin: 5px 0; word-break: break-all; font-size: 11px;">' + dohShortURL + '</code></li>' +
+                                '<li>Enable Intra protection</li>' +
+                            '</ol>' +
+                            '<p><strong>Option 2: Browser-based</strong></p>' +
+                            '<ul style="margin: 10px 0 10px 20px;">' +
+                                '<li>Use Firefox or Chrome browser settings (see above)</li>' +
+                            '</ul>' +
+                        '</div>' +
+                    '</details>' +
+
+                    '<details style="margin-bottom: 10px;">' +
+                        '<summary style="cursor: pointer; font-weight: 600; padding: 10px; background: white; border-radius: 5px;">📱 iOS</summary>' +
+                        '<div style="padding: 15px; background: white; margin-top: 5px; border-radius: 5px;">' +
+                            '<p>Install "DNSCloak" or "DNSecure" from App Store and add custom DoH URL.</p>' +
+                        '</div>' +
+                    '</details>' +
+                '</div>' +
+
+                '<div style="background: #f8d7da; padding: 20px; border-radius: 10px; margin-bottom: 20px;">' +
+                    '<h3 style="color: #721c24; margin-bottom: 15px;">🔄 Dynamic IP? Auto-Update Script</h3>' +
+                    '<p style="font-size: 13px; color: #666; margin-bottom: 10px;">If your IP changes frequently, run this script every 10 minutes:</p>' +
+                    '<textarea readonly style="width: 100%%; height: 150px; font-family: monospace; font-size: 11px; padding: 10px; background: white;">' +
+'#!/bin/bash\n' +
+'# Auto IP Update - Run via cron every 10 minutes\n' +
+'# */10 * * * * /path/to/this/script.sh\n\n' +
+'curl -s "' + updateURL + '" | jq .\n' +
+'echo "IP updated at $(date)"' +
+                    '</textarea>' +
+                    '<button onclick="copyText(this.previousElementSibling.value)" style="width: auto; padding: 8px 15px; margin-top: 10px; font-size: 13px;">Copy Script</button>' +
+                '</div>' +
+
+                '<div style="text-align: center; margin-top: 30px; padding: 20px; background: #e7f3ff; border-radius: 10px;">' +
+                    '<p style="font-size: 14px; color: #333; margin-bottom: 10px;">✨ <strong>All Done!</strong> Your DNS service is ready to use.</p>' +
+                    '<p style="font-size: 12px; color: #666;">Need help? Contact your administrator.</p>' +
+                '</div>' +
+            '</div>';
+        }
+
+        function copyText(text) {
+            navigator.clipboard.writeText(text).then(() => {
+                alert('✅ Copied to clipboard!');
+            });
+        }
+
+        document.getElementById('registerForm').addEventListener('submit', async (e) => {
+            e.preventDefault();
+
+            const submitBtn = document.getElementById('submitBtn');
+            const message = document.getElementById('message');
+            const dnsInfo = document.getElementById('dnsInfo');
+
+            submitBtn.disabled = true;
+            submitBtn.textContent = 'Registering...';
+            message.style.display = 'none';
+            dnsInfo.style.display = 'none';
+
+            const formData = {
+                token: document.querySelector('[name="token"]').value
+            };
+
+            try {
+                const response = await fetch('/register/submit', {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify(formData)
+                });
+
+                const result = await response.json();
+
+                if (response.ok && result.success) {
+                    // Hide form and show success page with full guide
+                    document.getElementById('registerForm').style.display = 'none';
+                    document.querySelector('.info-box').style.display = 'none';
+                    document.querySelector('h1').textContent = '✅ Registration Successful!';
+                    document.querySelector('.subtitle').textContent = 'Your IP has been registered. Choose your setup method below:';
+
+                    // Show comprehensive guide
+                    const guide = createGuide(result);
+                    document.querySelector('.container').innerHTML += guide;
+                } else {
+                    throw new Error(result.error || 'Registration failed');
+                }
+            } catch (error) {
+                message.className = 'message error';
+                message.textContent = error.message;
+                message.style.display = 'block';
+                submitBtn.disabled = false;
+                submitBtn.textContent = 'Register';
+            }
+        });
+    </script>
+</body>
+</html>
+`, clientIP, user.Name, user.MaxIPs, len(user.IPs), user.MaxIPs, user.ExpiresAt.Format("2006-01-02 15:04"), token)
+
+	ctx.SetContentType("text/html; charset=utf-8")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	_, _ = ctx.WriteString(html)
+}
+
+func (s *Server) handleRegisterSubmit(ctx *fasthttp.RequestCtx) {
+	var req struct {
+		Token string `json:"token"` // User ID used as token
+	}
+
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		ctx.Error(`{"error":"Invalid JSON"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	if req.Token == "" {
+		ctx.Error(`{"error":"Missing token"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	// Get client IP
+	clientIP := httpx.ClientIP(ctx)
+
+	// Debug log to see what IP we're getting
+	xffHeader := string(ctx.Request.Header.Peek("X-Forwarded-For"))
+	xriHeader := string(ctx.Request.Header.Peek("X-Real-IP"))
+	s.logger.Info("register IP detection", "clientIP", clientIP, "X-Forwarded-For", xffHeader, "X-Real-IP", xriHeader, "RemoteAddr", ctx.RemoteAddr().String())
+
+	// Add IP to user (with FIFO logic)
+	err := s.users.AddIP(req.Token, clientIP)
+	if err != nil {
+		ctx.Error(fmt.Sprintf(`{"error":"%s"}`, err.Error()), fasthttp.StatusForbidden)
+		return
+	}
+
+	// Get user info
+	user := s.users.ByID(req.Token)
+	if user == nil {
+		ctx.Error(`{"error":"User not found"}`, fasthttp.StatusNotFound)
+		return
+	}
+
+	cfg := s.config()
+	dohURL := fmt.Sprintf("https://%s/dns-query", cfg.Host)
+	dotServer := fmt.Sprintf("%s:853", cfg.Host)
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	json.NewEncoder(ctx).Encode(map[string]interface{}{
+		"success":    true,
+		"user":       user,
+		"doh_url":    dohURL,
+		"dot_server": dotServer,
+		"expires_at": user.ExpiresAt,
+	})
+}
+
+// Handle auto IP update via API key
+func (s *Server) handleUpdateIP(ctx *fasthttp.RequestCtx) {
+	// Get API key from query parameter or header
+	apiKey := string(ctx.QueryArgs().Peek("key"))
+	if apiKey == "" {
+		apiKey = string(ctx.Request.Header.Peek("X-API-Key"))
+	}
+
+	if apiKey == "" {
+		ctx.Error(`{"error":"Missing API key. Use ?key=YOUR_API_KEY or X-API-Key header"}`, fasthttp.StatusBadRequest)
+		return
+	}
+
+	// Find user by API key
+	user := s.users.ByAPIKey(apiKey)
+	if user == nil {
+		ctx.Error(`{"error":"Invalid API key"}`, fasthttp.StatusForbidden)
+		return
+	}
+
+	// Check if user is active
+	if !user.IsActive {
+		ctx.Error(`{"error":"User is inactive"}`, fasthttp.StatusForbidden)
+		return
+	}
+
+	// Check if user is expired
+	if time.Now().After(user.ExpiresAt) {
+		ctx.Error(`{"error":"User has expired"}`, fasthttp.StatusForbidden)
+		return
+	}
+
+	// Get client IP
+	clientIP := httpx.ClientIP(ctx)
+
+	// Add IP to user (with FIFO logic)
+	err := s.users.AddIP(user.ID, clientIP)
+	if err != nil {
+		ctx.Error(fmt.Sprintf(`{"error":"%s"}`, err.Error()), fasthttp.StatusInternalServerError)
+		return
+	}
+
+	// Refresh user data
+	user = s.users.ByID(user.ID)
+
+	ctx.SetContentType("application/json")
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	json.NewEncoder(ctx).Encode(map[string]interface{}{
+		"success":    true,
+		"message":    "IP updated successfully",
+		"ip":         clientIP,
+		"user":       user.Name,
+		"all_ips":    user.IPs,
+		"expires_at": user.ExpiresAt,
+	})
+
+	s.logger.Info("IP auto-updated", "user", user.Name, "ip", clientIP, "total_ips", len(user.IPs))
+}
@@ -0,0 +1,171 @@
+package sniproxy
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"smartSNI/config"
+	"smartSNI/internal/egress"
+)
+
+// ======================== Backend Selection ========================
+
+// backendRetryAfter is how long a backend that refused a dial is passed
+// over while other backends of its route are available.
+const backendRetryAfter = 10 * time.Second
+
+// backendState is shared by every route using the same backend address.
+type backendState struct {
+	active    atomic.Int64
+	downUntil atomic.Int64 // unix nanoseconds
+}
+
+func (b *backendState) down(now time.Time) bool {
+	return now.UnixNano() < b.downUntil.Load()
+}
+
+// balancer keeps the load-balancing state of the routing table. State is
+// keyed by route pattern and backend address so it survives config
+// reloads.
+type balancer struct {
+	mu       sync.Mutex
+	counters map[string]*atomic.Uint64
+	backends map[string]*backendState
+}
+
+func newBalancer() *balancer {
+	return &balancer{
+		counters: make(map[string]*atomic.Uint64),
+		backends: make(map[string]*backendState),
+	}
+}
+
+func routeKey(r *config.SNIRoute) string {
+	return "route " + r.SNI + "|" + strings.Join(r.ALPN, ",")
+}
+
+func (lb *balancer) counter(key string) *atomic.Uint64 {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	c, ok := lb.counters[key]
+	if !ok {
+		c = new(atomic.Uint64)
+		lb.counters[key] = c
+	}
+	return c
+}
+
+func (lb *balancer) backend(address string) *backendState {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	b, ok := lb.backends[address]
+	if !ok {
+		b = new(backendState)
+		lb.backends[address] = b
+	}
+	return b
+}
+
+func weight(b config.SNIBackend) int {
+	if b.Weight == 0 {
+		return 1
+	}
+	return b.Weight
+}
+
+// weighted returns the backend index n falls on when each backend owns a
+// slice of [0, total weight) proportional to its weight.
+func weighted(backends []config.SNIBackend, n uint64) int {
+	total := 0
+	for _, b := range backends {
+		total += weight(b)
+	}
+	pos := int(n % uint64(total))
+	for i, b := range backends {
+		if pos < weight(b) {
+			return i
+		}
+		pos -= weight(b)
+	}
+	return 0
+}
+
+// order returns the route's backends in the order to try them for a client:
+// the one chosen by the route's policy first, then the others, with
+// backends that recently failed moved to the end.
+func (lb *balancer) order(r *config.SNIRoute, clientIP string) []config.SNIBackend {
+	backends := r.Targets()
+	if len(backends) < 2 {
+		return backends
+	}
+
+	first := 0
+	switch r.Policy {
+	case config.SNIPolicyFailover:
+	case config.SNIPolicyRandom:
+		first = weighted(backends, rand.Uint64())
+	case config.SNIPolicyHash:
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(clientIP))
+		first = weighted(backends, h.Sum64())
+	case config.SNIPolicyLeastConn:
+		best := -1.0
+		for i, b := range backends {
+			load := float64(lb.backend(b.Address).active.Load()) / float64(weight(b))
+			if best < 0 || load < best {
+				first, best = i, load
+			}
+		}
+	default:
+		first = weighted(backends, lb.counter(routeKey(r)).Add(1)-1)
+	}
+
+	now := time.Now()
+	ordered := make([]config.SNIBackend, 0, len(backends))
+	var failed []config.SNIBackend
+	for i := range backends {
+		b := backends[(first+i)%len(backends)]
+		if lb.backend(b.Address).down(now) {
+			failed = append(failed, b)
+		} else {
+			ordered = append(ordered, b)
+		}
+	}
+	return append(ordered, failed...)
+}
+
+// dialRoute connects to one of the route's backends with d. The returned
+// release function must be called when the connection ends.
+func (s *Server) dialRoute(ctx context.Context, d egress.ContextDialer, r *config.SNIRoute, clientIP string) (net.Conn, string, func(), error) {
+	var errs []error
+	for _, b := range s.lb.order(r, clientIP) {
+		network, addr, err := config.BackendNetwork(b.Address)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		state := s.lb.backend(b.Address)
+		dialer := d
+		if network == "unix" {
+			dialer = s.dialer // source pools only apply to TCP
+		}
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			state.downUntil.Store(time.Now().Add(backendRetryAfter).UnixNano())
+			s.logger.Warn("SNI backend dial failed", "backend", b.Address, "route", r.SNI, "error", err)
+			errs = append(errs, err)
+			continue
+		}
+		state.downUntil.Store(0)
+		state.active.Add(1)
+		return conn, b.Address, func() { state.active.Add(-1) }, nil
+	}
+	return nil, "", nil, errors.Join(errs...)
+}
@@ -0,0 +1,102 @@
+package sniproxy
+
+import (
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"smartSNI/config"
+)
+
+func TestBalancerPolicies(t *testing.T) {
+	backends := []config.SNIBackend{{Address: "a:443", Weight: 3}, {Address: "b:443"}}
+
+	lb := newBalancer()
+	rr := &config.SNIRoute{SNI: "*", Backends: backends}
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		counts[lb.order(rr, "192.0.2.1")[0].Address]++
+	}
+	if counts["a:443"] != 6 || counts["b:443"] != 2 {
+		t.Errorf("weighted round robin: %v", counts)
+	}
+
+	hash := &config.SNIRoute{SNI: "*", Backends: backends, Policy: config.SNIPolicyHash}
+	first := lb.order(hash, "198.51.100.7")[0]
+	for i := 0; i < 5; i++ {
+		if got := lb.order(hash, "198.51.100.7")[0]; got != first {
+			t.Fatalf("hash: client moved from %s to %s", first.Address, got.Address)
+		}
+	}
+
+	least := &config.SNIRoute{SNI: "*", Backends: []config.SNIBackend{{Address: "a:443"}, {Address: "b:443"}}, Policy: config.SNIPolicyLeastConn}
+	lb.backend("a:443").active.Add(2)
+	if got := lb.order(least, "")[0].Address; got != "b:443" {
+		t.Errorf("least_conn picked %s", got)
+	}
+
+	failover := &config.SNIRoute{SNI: "*", Backends: backends, Policy: config.SNIPolicyFailover}
+	lb.backend("a:443").downUntil.Store(time.Now().Add(time.Minute).UnixNano())
+	if got := lb.order(failover, ""); got[0].Address != "b:443" || got[1].Address != "a:443" {
+		t.Errorf("failover with a down: %v", got)
+	}
+}
+
+// unixBackend accepts one connection on a unix socket and reports the first
+// bytes it reads.
+func unixBackend(t *testing.T) (string, <-chan []byte) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "backend.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	return "unix:" + path, firstBytes(t, ln)
+}
+
+func TestProxyRouteFailsOverToUnixSocket(t *testing.T) {
+	sock, got := unixBackend(t)
+	proxy, _ := startTestProxyConfig(t, &config.Config{
+		SNIRoutes: []config.SNIRoute{{
+			SNI:      "*.example.com",
+			Backends: []config.SNIBackend{{Address: "127.0.0.1:1"}, {Address: sock}},
+			Policy:   config.SNIPolicyFailover,
+		}},
+	}, "127.0.0.1:1")
+
+	sendHello(t, proxy, &tls.Config{ServerName: "www.example.com"})
+	select {
+	case b := <-got:
+		if len(b) == 0 || b[0] != recordTypeHandshake {
+			t.Fatalf("unix backend got %x", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("unix backend got no connection")
+	}
+}
+
+func TestDialFallsBackToDefault(t *testing.T) {
+	local, got := echoServer(t)
+	s := New(Options{Config: config.NewStore(&config.Config{}), Logger: slog.New(slog.NewTextHandler(io.Discard, nil)), LocalTarget: local})
+	cfg := &config.Config{Host: "panel.test"}
+	r := &config.SNIRoute{SNI: "panel.test", Backend: "127.0.0.1:1"}
+
+	if _, _, _, err := s.dial(cfg, r, s.defaultTarget(cfg, "panel.test"), ""); err == nil {
+		t.Fatal("dial to a closed port succeeded")
+	}
+	r.Fallback = true
+	conn, target, release, err := s.dial(cfg, r, s.defaultTarget(cfg, "panel.test"), "")
+	if err != nil || target != local {
+		t.Fatalf("fallback: %s, %v", target, err)
+	}
+	release()
+	_, _ = conn.Write([]byte{recordTypeHandshake, 3, 1, 0, 1})
+	conn.Close()
+	if b := <-got; len(b) != 5 {
+		t.Fatalf("local target got %x", b)
+	}
+}
@@ -0,0 +1,288 @@
+package sniproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ======================== TLS SNI Peek ========================
+
+const (
+	recordTypeHandshake    = 0x16
+	handshakeClientHello   = 0x01
+	extensionServerName    = 0x0000
+	recordHeaderLen        = 5
+	handshakeHeaderLen     = 4
+	maxPlaintextRecordLen  = 1 << 14 // RFC 8446 5.1
+	maxClientHelloLen      = 1 << 16 // generous for post-quantum key shares
+	serverNameTypeHostName = 0
+)
+
+var errShortHello = errors.New("ClientHello truncated")
+
+// readClientHello reads TLS records from r until they hold a complete
+// ClientHello handshake message, which may be split across several records.
+// It returns the raw records, to be replayed to the backend unchanged, and
+// the reassembled handshake message. Nothing past the last record needed is
+// consumed.
+func readClientHello(r io.Reader) (raw, msg []byte, err error) {
+	header := make([]byte, recordHeaderLen)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF && len(raw) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return raw, nil, err
+		}
+		if header[0] != recordTypeHandshake {
+			return raw, nil, errors.New("not a TLS handshake")
+		}
+		if header[1] != 3 {
+			return raw, nil, fmt.Errorf("unsupported record version %d.%d", header[1], header[2])
+		}
+		recordLen := int(header[3])<<8 | int(header[4])
+		if recordLen == 0 || recordLen > maxPlaintextRecordLen {
+			return raw, nil, fmt.Errorf("invalid TLS record length %d", recordLen)
+		}
+
+		start := len(raw)
+		raw = append(raw, header...)
+		raw = append(raw, make([]byte, recordLen)...)
+		if _, err := io.ReadFull(r, raw[start+recordHeaderLen:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return raw[:start], nil, err
+		}
+		msg = append(msg, raw[start+recordHeaderLen:]...)
+
+		if len(msg) < handshakeHeaderLen {
+			continue
+		}
+		if msg[0] != handshakeClientHello {
+			return raw, nil, fmt.Errorf("handshake message type %d is not ClientHello", msg[0])
+		}
+		helloLen := handshakeHeaderLen + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+		if helloLen > maxClientHelloLen {
+			return raw, nil, fmt.Errorf("ClientHello of %d bytes exceeds the %d byte limit", helloLen, maxClientHelloLen)
+		}
+		if len(msg) >= helloLen {
+			return raw, msg[:helloLen], nil
+		}
+	}
+}
+
+// helloReader walks a handshake message. Every read is bounds-checked; once
+// one fails the reader stays failed and returns zero values.
+type helloReader struct {
+	b   []byte
+	bad bool
+}
+
+func (r *helloReader) bytes(n int) []byte {
+	if r.bad || n < 0 || n > len(r.b) {
+		r.bad = true
+		return nil
+	}
+	out := r.b[:n]
+	r.b = r.b[n:]
+	return out
+}
+
+func (r *helloReader) u8() int {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (r *helloReader) u16() int {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])<<8 | int(b[1])
+}
+
+func (r *helloReader) u24() int {
+	b := r.bytes(3)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+}
+
+// vec8 and vec16 return a length-prefixed vector as its own reader.
+func (r *helloReader) vec8() *helloReader {
+	b := r.bytes(r.u8())
+	return &helloReader{b: b, bad: r.bad}
+}
+
+func (r *helloReader) vec16() *helloReader {
+	b := r.bytes(r.u16())
+	return &helloReader{b: b, bad: r.bad}
+}
+
+// ClientHelloInfo is the metadata of a ClientHello that can be read
+// without terminating TLS. Lists keep the client's order and include GREASE
+// values (RFC 8701); the fingerprints skip them.
+type ClientHelloInfo struct {
+	ServerName          string
+	ECH                 bool // offers Encrypted Client Hello (or GREASE for it); ServerName is then the outer name
+	ALPN                []string
+	LegacyVersion       uint16
+	SupportedVersions   []uint16
+	CipherSuites        []uint16
+	Extensions          []uint16
+	SupportedGroups     []uint16
+	ECPointFormats      []uint8
+	SignatureAlgorithms []uint16
+
+	JA3 string // MD5 of the JA3 string, hex
+	JA4 string // JA4 fingerprint, e.g. t13d1516h2_8daaf6152771_e5627efa2ab1
+}
+
+// Extensions carrying metadata
+const (
+	extensionSupportedGroups     = 0x000a
+	extensionECPointFormats      = 0x000b
+	extensionSignatureAlgorithms = 0x000d
+	extensionALPN                = 0x0010
+	extensionSupportedVersions   = 0x002b
+	extensionECH                 = 0xfe0d // encrypted_client_hello
+)
+
+// echClientHelloOuter is the ECHClientHelloType of the extension in the
+// unencrypted ClientHello (draft-ietf-tls-esni 5).
+const echClientHelloOuter = 0
+
+func u16List(r *helloReader) []uint16 {
+	var out []uint16
+	for len(r.b) >= 2 {
+		out = append(out, uint16(r.u16()))
+	}
+	return out
+}
+
+// parseClientHello reads the metadata of a complete ClientHello handshake
+// message.
+func parseClientHello(msg []byte) (*ClientHelloInfo, error) {
+	r := &helloReader{b: msg}
+	if r.u8() != handshakeClientHello {
+		return nil, errors.New("not a ClientHello")
+	}
+	body := &helloReader{b: r.bytes(r.u24())}
+	if r.bad {
+		return nil, errShortHello
+	}
+
+	info := &ClientHelloInfo{}
+	info.LegacyVersion = uint16(body.u16())
+	body.bytes(32) // random
+	body.vec8()    // legacy_session_id
+	info.CipherSuites = u16List(body.vec16())
+	body.vec8() // legacy_compression_methods
+	if body.bad {
+		return nil, errShortHello
+	}
+	if len(body.b) == 0 {
+		info.fingerprint()
+		return info, nil // No extensions
+	}
+
+	exts := body.vec16()
+	if exts.bad {
+		return nil, errors.New("invalid extensions")
+	}
+	for len(exts.b) > 0 {
+		extType := uint16(exts.u16())
+		ext := exts.vec16()
+		if exts.bad {
+			return nil, errors.New("invalid extensions")
+		}
+		info.Extensions = append(info.Extensions, extType)
+
+		switch extType {
+		case extensionServerName:
+			list := ext.vec16()
+			for len(list.b) > 0 {
+				nameType := list.u8()
+				name := list.vec16()
+				if name.bad {
+					return nil, errors.New("invalid server_name extension")
+				}
+				if nameType == serverNameTypeHostName && info.ServerName == "" {
+					info.ServerName = string(name.b)
+				}
+			}
+			if list.bad {
+				return nil, errors.New("invalid server_name extension")
+			}
+		case extensionALPN:
+			list := ext.vec16()
+			for len(list.b) > 0 {
+				proto := list.vec8()
+				if proto.bad {
+					return nil, errors.New("invalid ALPN extension")
+				}
+				info.ALPN = append(info.ALPN, string(proto.b))
+			}
+		case extensionSupportedVersions:
+			info.SupportedVersions = u16List(ext.vec8())
+		case extensionSupportedGroups:
+			info.SupportedGroups = u16List(ext.vec16())
+		case extensionECPointFormats:
+			info.ECPointFormats = append([]uint8(nil), ext.vec8().b...)
+		case extensionSignatureAlgorithms:
+			info.SignatureAlgorithms = u16List(ext.vec16())
+		case extensionECH:
+			info.ECH = len(ext.b) > 0 && ext.b[0] == echClientHelloOuter
+		}
+	}
+
+	info.fingerprint()
+	return info, nil
+}
+
+// ParseClientHello parses TLS records holding a ClientHello, which may be
+// fragmented across several records.
+func ParseClientHello(data []byte) (*ClientHelloInfo, error) {
+	_, msg, err := readClientHello(bytes.NewReader(data))
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errShortHello
+		}
+		return nil, err
+	}
+	return parseClientHello(msg)
+}
+
+// ParseSNIFromClientHello extracts the server name from TLS records holding
+// a ClientHello, which may be fragmented across several records. It needs
+// no certificate and returns "" when the hello carries no server_name
+// extension.
+func ParseSNIFromClientHello(data []byte) (string, error) {
+	info, err := ParseClientHello(data)
+	if err != nil {
+		return "", err
+	}
+	return info.ServerName, nil
+}
+
+// peekClientHello reads the ClientHello from conn and returns its metadata
+// together with the raw records read, which the caller replays to the
+// backend.
+func peekClientHello(conn io.Reader) (*ClientHelloInfo, []byte, error) {
+	raw, msg, err := readClientHello(conn)
+	if err != nil {
+		return nil, raw, err
+	}
+	info, err := parseClientHello(msg)
+	if err != nil {
+		return nil, raw, err
+	}
+	return info, raw, nil
+}
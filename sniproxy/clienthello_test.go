@@ -0,0 +1,211 @@
+package sniproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientHello returns the first TLS record a crypto/tls client sends when
+// connecting with cfg.
+func clientHello(t testing.TB, cfg *tls.Config) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	go func() {
+		_ = tls.Client(client, cfg).Handshake()
+		client.Close()
+	}()
+	defer server.Close()
+
+	_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, body...)
+}
+
+func helloFor(t testing.TB, serverName string) []byte {
+	return clientHello(t, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+}
+
+func TestParseSNIFromClientHello(t *testing.T) {
+	for _, name := range []string{"example.com", "www.youtube.com", "a.very.long.sub.domain.example.org"} {
+		got, err := ParseSNIFromClientHello(helloFor(t, name))
+		if err != nil || got != name {
+			t.Errorf("got %q, %v; want %q", got, err, name)
+		}
+	}
+
+	// crypto/tls leaves server_name out for IP addresses
+	if got, err := ParseSNIFromClientHello(helloFor(t, "192.0.2.1")); err != nil || got != "" {
+		t.Errorf("IP target: got %q, %v; want no name", got, err)
+	}
+
+	// TLS 1.2-only hello with ALPN
+	hello := clientHello(t, &tls.Config{ServerName: "h2.example", MaxVersion: tls.VersionTLS12, NextProtos: []string{"h2", "http/1.1"}, InsecureSkipVerify: true})
+	if got, err := ParseSNIFromClientHello(hello); err != nil || got != "h2.example" {
+		t.Errorf("TLS 1.2 hello: got %q, %v", got, err)
+	}
+}
+
+// fragment re-splits the handshake data in the TLS records of hello into
+// records of at most size bytes.
+func fragment(hello []byte, size int) []byte {
+	var msg []byte
+	for rest := hello; len(rest) >= recordHeaderLen; {
+		n := int(rest[3])<<8 | int(rest[4])
+		msg = append(msg, rest[recordHeaderLen:recordHeaderLen+n]...)
+		rest = rest[recordHeaderLen+n:]
+	}
+	var out []byte
+	for len(msg) > 0 {
+		n := min(size, len(msg))
+		out = append(out, recordTypeHandshake, hello[1], hello[2], byte(n>>8), byte(n))
+		out = append(out, msg[:n]...)
+		msg = msg[n:]
+	}
+	return out
+}
+
+// bigHello returns a ClientHello well over one TCP segment, like those
+// carrying post-quantum key shares.
+func bigHello(t testing.TB, serverName string) []byte {
+	protos := make([]string, 200)
+	for i := range protos {
+		protos[i] = strings.Repeat(string(rune('a'+i%26)), 40)
+	}
+	return clientHello(t, &tls.Config{ServerName: serverName, NextProtos: protos, InsecureSkipVerify: true})
+}
+
+// withExtension appends an extension to the single-record ClientHello
+// hello and fixes up the lengths.
+func withExtension(hello []byte, typ uint16, data []byte) []byte {
+	out := append([]byte(nil), hello...)
+	off := recordHeaderLen + handshakeHeaderLen + 2 + 32
+	off += 1 + int(out[off])                        // legacy_session_id
+	off += 2 + (int(out[off])<<8 | int(out[off+1])) // cipher_suites
+	off += 1 + int(out[off])                        // legacy_compression_methods
+	ext := append([]byte{byte(typ >> 8), byte(typ), byte(len(data) >> 8), byte(len(data))}, data...)
+	out = append(out, ext...)
+
+	grow := func(at, size int) {
+		n := 0
+		for i := 0; i < size; i++ {
+			n = n<<8 | int(out[at+i])
+		}
+		n += len(ext)
+		for i := size - 1; i >= 0; i-- {
+			out[at+i] = byte(n)
+			n >>= 8
+		}
+	}
+	grow(off, 2)               // extensions
+	grow(recordHeaderLen+1, 3) // handshake message
+	grow(3, 2)                 // record
+	return out
+}
+
+func TestParseECH(t *testing.T) {
+	// An outer encrypted_client_hello: type, HKDF-SHA256 + AES-128-GCM,
+	// config_id, enc and payload
+	outer := []byte{echClientHelloOuter, 0, 1, 0, 1, 7, 0, 2, 0xaa, 0xbb, 0, 3, 1, 2, 3}
+	info, err := ParseClientHello(withExtension(helloFor(t, "public.example"), extensionECH, outer))
+	if err != nil || !info.ECH || info.ServerName != "public.example" {
+		t.Fatalf("ECH hello: got %+v, %v", info, err)
+	}
+
+	// The inner hello only marks itself
+	info, err = ParseClientHello(withExtension(helloFor(t, "hidden.example"), extensionECH, []byte{1}))
+	if err != nil || info.ECH {
+		t.Errorf("inner hello: got ECH %v, %v", info != nil && info.ECH, err)
+	}
+	if info, err := ParseClientHello(helloFor(t, "plain.example")); err != nil || info.ECH {
+		t.Errorf("plain hello: got ECH %v, %v", info != nil && info.ECH, err)
+	}
+}
+
+func TestParseSNIFragmented(t *testing.T) {
+	hello := bigHello(t, "pq.example.com")
+	if len(hello) < 8000 {
+		t.Fatalf("hello only %d bytes", len(hello))
+	}
+	for _, size := range []int{1, 3, 100, 1400} {
+		records := fragment(hello, size)
+		got, err := ParseSNIFromClientHello(records)
+		if err != nil || got != "pq.example.com" {
+			t.Errorf("%d-byte records: got %q, %v", size, got, err)
+		}
+
+		// The records read are exactly the ones holding the hello
+		raw, _, err := readClientHello(bytes.NewReader(append(records, 0x17, 3, 3, 0, 1, 0)))
+		if err != nil || !bytes.Equal(raw, records) {
+			t.Errorf("%d-byte records: read %d bytes of %d, %v", size, len(raw), len(records), err)
+		}
+	}
+}
+
+func TestReadClientHelloLimits(t *testing.T) {
+	hello := helloFor(t, "example.com")
+
+	// Handshake length beyond the limit is rejected before it is buffered
+	huge := append([]byte(nil), hello...)
+	huge[recordHeaderLen+1] = 0x10
+	if _, _, err := readClientHello(bytes.NewReader(huge)); err == nil {
+		t.Error("oversized ClientHello accepted")
+	}
+
+	// An alert between fragments is not a ClientHello
+	records := fragment(hello, 50)
+	mixed := append(append([]byte(nil), records[:55]...), 0x15, 3, 3, 0, 2, 2, 40)
+	if _, _, err := readClientHello(bytes.NewReader(mixed)); err == nil {
+		t.Error("alert record accepted as handshake data")
+	}
+
+	// Oversized and empty records
+	for _, header := range [][]byte{{0x16, 3, 1, 0x40, 0x01}, {0x16, 3, 1, 0, 0}} {
+		if _, _, err := readClientHello(bytes.NewReader(header)); err == nil {
+			t.Errorf("record header %x accepted", header)
+		}
+	}
+}
+
+func TestParseSNIRejectsNonTLS(t *testing.T) {
+	for _, in := range [][]byte{
+		nil,
+		[]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		bytes.Repeat([]byte{0x17}, 64),
+	} {
+		if _, err := ParseSNIFromClientHello(in); err == nil {
+			t.Errorf("%q accepted", in)
+		}
+	}
+}
+
+func TestParseSNITruncated(t *testing.T) {
+	hello := helloFor(t, "example.com")
+	for n := 0; n < len(hello); n++ {
+		// Must not panic; a name, if any, must be the real one
+		if got, _ := ParseSNIFromClientHello(hello[:n]); got != "" && got != "example.com" {
+			t.Fatalf("prefix %d parsed as %q", n, got)
+		}
+	}
+}
+
+func FuzzParseSNIFromClientHello(f *testing.F) {
+	f.Add(helloFor(f, "example.com"))
+	f.Add(helloFor(f, "192.0.2.1"))
+	f.Add([]byte{0x16, 3, 1, 0, 0})
+	f.Add(fragment(helloFor(f, "example.com"), 7))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = ParseSNIFromClientHello(data)
+	})
+}
@@ -0,0 +1,157 @@
+package sniproxy
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ======================== TLS Fingerprints ========================
+
+// isGREASE reports whether v is one of the RFC 8701 reserved values
+// (0x0a0a, 0x1a1a, ... 0xfafa) clients add to keep servers tolerant.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(vs []uint16) []uint16 {
+	out := make([]uint16, 0, len(vs))
+	for _, v := range vs {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func joinDecimal(vs []uint16) string {
+	parts := make([]string, len(vs))
+	for i, v := range vs {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(vs []uint16) string {
+	parts := make([]string, len(vs))
+	for i, v := range vs {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// truncatedSHA256 is the 12 hex digit hash used by JA4, or zeros for an
+// empty list.
+func truncatedSHA256(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// fingerprint fills in JA3 and JA4.
+func (h *ClientHelloInfo) fingerprint() {
+	h.JA3 = h.ja3()
+	h.JA4 = h.ja4()
+}
+
+// ja3 hashes "version,ciphers,extensions,groups,point formats" with GREASE
+// values removed.
+func (h *ClientHelloInfo) ja3() string {
+	formats := make([]uint16, len(h.ECPointFormats))
+	for i, f := range h.ECPointFormats {
+		formats[i] = uint16(f)
+	}
+	s := strings.Join([]string{
+		strconv.Itoa(int(h.LegacyVersion)),
+		joinDecimal(withoutGREASE(h.CipherSuites)),
+		joinDecimal(withoutGREASE(h.Extensions)),
+		joinDecimal(withoutGREASE(h.SupportedGroups)),
+		joinDecimal(formats),
+	}, ",")
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+var ja4Versions = map[uint16]string{
+	0x0304: "13",
+	0x0303: "12",
+	0x0302: "11",
+	0x0301: "10",
+	0x0300: "s3",
+	0x0002: "s2",
+	0xfeff: "d1",
+	0xfefd: "d2",
+	0xfefc: "d3",
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// ja4 builds the JA4 fingerprint for a TCP ClientHello:
+// protocol, version, SNI, counts and ALPN, then truncated hashes of the
+// sorted ciphers and of the sorted extensions plus signature algorithms.
+func (h *ClientHelloInfo) ja4() string {
+	// The highest supported_versions entry wins over the legacy field
+	version := h.LegacyVersion
+	if vs := withoutGREASE(h.SupportedVersions); len(vs) > 0 {
+		version = vs[0]
+		for _, v := range vs {
+			version = max(version, v)
+		}
+	}
+	ver, ok := ja4Versions[version]
+	if !ok {
+		ver = "00"
+	}
+
+	sni := "i"
+	if h.ServerName != "" {
+		sni = "d"
+	}
+
+	ciphers := withoutGREASE(h.CipherSuites)
+	exts := withoutGREASE(h.Extensions)
+
+	alpn := "00"
+	if len(h.ALPN) > 0 && h.ALPN[0] != "" {
+		first := h.ALPN[0]
+		if isAlnum(first[0]) && isAlnum(first[len(first)-1]) {
+			alpn = string(first[0]) + string(first[len(first)-1])
+		} else {
+			x := hex.EncodeToString([]byte(first))
+			alpn = string(x[0]) + string(x[len(x)-1])
+		}
+	}
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s", ver, sni, min(len(ciphers), 99), min(len(exts), 99), alpn)
+
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+	b := truncatedSHA256(joinHex(ciphers))
+
+	var hashed []uint16
+	for _, e := range exts {
+		if e != extensionServerName && e != extensionALPN {
+			hashed = append(hashed, e)
+		}
+	}
+	sort.Slice(hashed, func(i, j int) bool { return hashed[i] < hashed[j] })
+	c := joinHex(hashed)
+	if sigs := withoutGREASE(h.SignatureAlgorithms); len(sigs) > 0 && c != "" {
+		c += "_" + joinHex(sigs)
+	}
+
+	return a + "_" + b + "_" + truncatedSHA256(c)
+}
+
+// MatchesFingerprint reports whether fp equals the client's JA3 hash or JA4
+// fingerprint (case-insensitive).
+func (h *ClientHelloInfo) MatchesFingerprint(fp string) bool {
+	return strings.EqualFold(fp, h.JA3) || strings.EqualFold(fp, h.JA4)
+}
@@ -0,0 +1,61 @@
+package sniproxy
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"testing"
+)
+
+// chromeHello is the ClientHello used in the JA4 documentation: Chrome with
+// GREASE, TLS 1.3, ALPN h2 and 15 ciphers, 16 extensions.
+func chromeHello() *ClientHelloInfo {
+	return &ClientHelloInfo{
+		ServerName:        "example.com",
+		ALPN:              []string{"h2", "http/1.1"},
+		LegacyVersion:     0x0303,
+		SupportedVersions: []uint16{0x3a3a, 0x0304, 0x0303},
+		CipherSuites: []uint16{0x2a2a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+			0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		Extensions: []uint16{0x4a4a, 0x0000, 0x0017, 0xff01, 0x000a, 0x000b, 0x0023, 0x0010, 0x0005,
+			0x000d, 0x0012, 0x0033, 0x002d, 0x002b, 0x001b, 0x4469, 0x0015, 0x5a5a},
+		SupportedGroups:     []uint16{0x6a6a, 0x001d, 0x0017, 0x0018},
+		ECPointFormats:      []uint8{0},
+		SignatureAlgorithms: []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601},
+	}
+}
+
+func TestJA4(t *testing.T) {
+	h := chromeHello()
+	if got, want := h.ja4(), "t13d1516h2_8daaf6152771_e5627efa2ab1"; got != want {
+		t.Fatalf("ja4 = %s, want %s", got, want)
+	}
+
+	// No SNI, no ALPN, TLS 1.2
+	h.ServerName, h.ALPN, h.SupportedVersions = "", nil, nil
+	if got := h.ja4()[:10]; got != "t12i151600" {
+		t.Fatalf("ja4 prefix = %s", got)
+	}
+}
+
+func TestJA3(t *testing.T) {
+	h := chromeHello()
+	s := "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53," +
+		"0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0"
+	sum := md5.Sum([]byte(s))
+	if got, want := h.ja3(), hex.EncodeToString(sum[:]); got != want {
+		t.Fatalf("ja3 = %s, want %s", got, want)
+	}
+}
+
+func TestParsedHelloFingerprints(t *testing.T) {
+	info, err := ParseClientHello(helloFor(t, "example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.JA3 == "" || len(info.JA4) != 36 || info.JA4[:4] != "t13d" {
+		t.Fatalf("fingerprints: ja3 %q ja4 %q", info.JA3, info.JA4)
+	}
+	if !info.MatchesFingerprint(info.JA4) || info.MatchesFingerprint("t13d0000") {
+		t.Fatal("MatchesFingerprint")
+	}
+}
@@ -0,0 +1,24 @@
+package sniproxy
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// freebindControl lets a socket bind a source address that is not
+// configured on any interface, such as one picked from a routed IPv6 /64.
+func freebindControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if network == "tcp6" || network == "udp6" {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_FREEBIND, 1)
+		} else {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_FREEBIND, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
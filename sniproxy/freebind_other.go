@@ -0,0 +1,9 @@
+//go:build !linux
+
+package sniproxy
+
+import "syscall"
+
+func freebindControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,261 @@
+package sniproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"smartSNI/config"
+)
+
+// ======================== HTTP Proxy (Host) ========================
+
+// maxHTTPHead bounds the request line and headers read to find the Host.
+const maxHTTPHead = 16 * 1024
+
+var errHTTPHeadTooLarge = errors.New("request head too large")
+
+// httpRequestHead is what the Host proxy needs from a client's first
+// request.
+type httpRequestHead struct {
+	host string // lowercased, without port
+	port string // explicit port of the host, if any
+	path string // origin-form request target, for redirects
+}
+
+// peekHTTPHead reads conn up to the end of the first request's headers.
+// It returns every byte read, including any body bytes after the headers,
+// so they can be replayed to the backend.
+func peekHTTPHead(conn net.Conn) (httpRequestHead, []byte, error) {
+	buf := make([]byte, 0, 4096)
+	tmp := make([]byte, 4096)
+	for {
+		if i := bytes.Index(buf, []byte("\r\n\r\n")); i >= 0 {
+			head, err := parseHTTPHead(buf[:i])
+			return head, buf, err
+		}
+		if len(buf) >= maxHTTPHead {
+			return httpRequestHead{}, buf, errHTTPHeadTooLarge
+		}
+		n, err := conn.Read(tmp[:min(len(tmp), maxHTTPHead-len(buf))])
+		buf = append(buf, tmp[:n]...)
+		if err != nil {
+			return httpRequestHead{}, buf, err
+		}
+	}
+}
+
+// parseHTTPHead parses an HTTP/1.x request line and headers. The host
+// comes from an absolute-form target or else the Host header.
+func parseHTTPHead(b []byte) (httpRequestHead, error) {
+	lines := strings.Split(string(b), "\r\n")
+	parts := strings.Fields(lines[0])
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "HTTP/1.") {
+		return httpRequestHead{}, fmt.Errorf("not an HTTP/1.x request line: %.64q", lines[0])
+	}
+	var head httpRequestHead
+	head.path = parts[1]
+	if u, err := url.Parse(parts[1]); err == nil && u.IsAbs() {
+		head.host = u.Host
+		head.path = u.RequestURI()
+	} else {
+		for _, line := range lines[1:] {
+			name, value, ok := strings.Cut(line, ":")
+			if ok && strings.EqualFold(strings.TrimSpace(name), "host") {
+				head.host = strings.TrimSpace(value)
+				break
+			}
+		}
+	}
+	if !strings.HasPrefix(head.path, "/") {
+		head.path = "/"
+	}
+
+	host := head.host
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		host, head.port = h, port
+	}
+	host = strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+	if host == "" || strings.ContainsAny(host, " /\\@?#") {
+		return httpRequestHead{}, fmt.Errorf("invalid host %q", head.host)
+	}
+	head.host = host
+	return head, nil
+}
+
+// httpError answers a plain HTTP client and ends the exchange.
+func httpError(conn net.Conn, code int, status, body string) {
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Connection: close\r\n"+
+		"Content-Length: %d\r\n\r\n%s", code, status, len(body), body)
+}
+
+// httpsRedirect sends the client to the HTTPS version of the request.
+func httpsRedirect(conn net.Conn, cfg *config.Config, head httpRequestHead) {
+	host := head.host
+	if cfg.SNIPort != 0 && cfg.SNIPort != 443 {
+		host = net.JoinHostPort(host, fmt.Sprint(cfg.SNIPort))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 301 Moved Permanently\r\n"+
+		"Location: https://%s%s\r\n"+
+		"Connection: close\r\n"+
+		"Content-Length: 0\r\n\r\n", host, head.path)
+}
+
+// httpAllowed reports whether the proxy serves host to clientIP: it must
+// match Domains, one of the client's domain sets or an sni_routes pattern.
+func (s *Server) httpAllowed(cfg *config.Config, host, clientIP string) bool {
+	if _, ok := config.FindValueByPattern(cfg.Domains, host); ok {
+		return true
+	}
+	if matchRoute(cfg, host, nil) != nil {
+		return true
+	}
+	if s.users == nil {
+		return false
+	}
+	u := s.users.ByIP(clientIP)
+	if u == nil {
+		return false
+	}
+	sets := append([]string(nil), u.DomainSets...)
+	for _, name := range append(sets, cfg.Plans[u.Plan]...) {
+		if _, ok := config.FindValueByPattern(cfg.DomainSets[name].Domains, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isPublicAddr reports whether a is a global unicast address outside the
+// private ranges.
+func isPublicAddr(a netip.Addr) bool {
+	a = a.Unmap()
+	return a.IsGlobalUnicast() && !a.IsPrivate()
+}
+
+// handleHTTP routes a plain HTTP connection by the Host of its first
+// request and relays the whole connection, so keep-alive requests and
+// WebSocket upgrades pass through untouched. Only hosts the proxy serves,
+// on the backend port and resolving to public addresses, are relayed.
+func (s *Server) handleHTTP(clientConn net.Conn) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Error("panic in HTTP proxy handler", "error", r, "stack", string(debug.Stack()))
+			s.metrics.IncErrors()
+		}
+		clientConn.Close()
+	}()
+
+	s.metrics.IncHTTPProxied()
+	clientAddr := clientConn.RemoteAddr().String()
+
+	_ = clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	head, first, err := peekHTTPHead(clientConn)
+	if err != nil {
+		s.logger.Debug("HTTP request head unreadable", "error", err, "client", clientAddr)
+		s.metrics.IncErrors()
+		if len(first) > 0 {
+			httpError(clientConn, 400, "Bad Request", "Host required")
+		}
+		return
+	}
+	_ = clientConn.SetReadDeadline(time.Time{})
+
+	cfg := s.cfg.Get()
+	if head.host == strings.ToLower(cfg.Host) {
+		httpsRedirect(clientConn, cfg, head)
+		return
+	}
+
+	clientIP, _, _ := net.SplitHostPort(clientAddr)
+	if _, err := netip.ParseAddr(head.host); err == nil || head.port != "" && head.port != s.httpPort || !s.httpAllowed(cfg, head.host, clientIP) {
+		s.logger.Debug("HTTP connection for a host not proxied", "host", head.host, "port", head.port, "client", clientAddr)
+		s.metrics.IncSNIBlocked()
+		httpError(clientConn, 403, "Forbidden", "Host not proxied")
+		return
+	}
+
+	route := matchRoute(cfg, head.host, nil)
+	if route != nil && route.Block {
+		s.logger.Info("HTTP connection blocked by route", "host", head.host, "client", clientAddr)
+		s.metrics.IncSNIBlocked()
+		httpError(clientConn, 403, "Forbidden", "Blocked")
+		return
+	}
+
+	// Never relay to the proxy's own networks
+	ctx, cancel := context.WithTimeout(context.Background(), s.dialer.Timeout)
+	addrs, err := s.lookup(ctx, head.host)
+	cancel()
+	if err != nil {
+		s.logger.Warn("HTTP backend lookup failed", "host", head.host, "error", err, "client", clientAddr)
+		s.metrics.IncErrors()
+		httpError(clientConn, 502, "Bad Gateway", "Backend unavailable")
+		return
+	}
+	for _, a := range addrs {
+		if !isPublicAddr(a) && !s.httpPrivateOK {
+			s.logger.Warn("HTTP host resolves to a non-public address", "host", head.host, "addr", a, "client", clientAddr)
+			s.metrics.IncSNIBlocked()
+			httpError(clientConn, 403, "Forbidden", "Host not proxied")
+			return
+		}
+	}
+	// Route backends speak TLS; plain HTTP goes to the host itself, through
+	// the route's egress and source pool
+	if route != nil {
+		r := *route
+		r.Backend, r.Backends, r.Fallback = "", nil, false
+		route = &r
+	}
+
+	backendConn, target, release, err := s.dial(cfg, route, net.JoinHostPort(head.host, s.httpPort), clientIP)
+	if errors.Is(err, errSelfLoop) {
+		s.logger.Warn("HTTP backend is this proxy, refusing to loop", "host", head.host, "target", target, "client", clientAddr)
+		s.metrics.IncSNISelfLoops()
+		httpError(clientConn, 508, "Loop Detected", "Loop detected")
+		return
+	}
+	if err != nil {
+		s.logger.Warn("HTTP backend dial failed", "target", target, "error", err, "client", clientAddr)
+		s.metrics.IncErrors()
+		httpError(clientConn, 502, "Bad Gateway", "Backend unavailable")
+		return
+	}
+	defer release()
+	s.pipe(cfg, clientConn, backendConn, ConnInfo{Proto: "http", SNI: head.host, Backend: target}, first)
+}
+
+// ListenAndServeHTTP listens on the configured http_port and proxies plain
+// HTTP by Host until ctx is cancelled. It returns nil at once when
+// http_port is unset.
+func (s *Server) ListenAndServeHTTP(ctx context.Context) error {
+	port := s.cfg.Get().HTTPPort
+	if port == 0 {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return fmt.Errorf("HTTP proxy: failed to listen: %w", err)
+	}
+	s.logger.Info("HTTP proxy started", "port", port)
+	return s.ServeHTTPProxy(ctx, ln)
+}
+
+// ServeHTTPProxy is Serve for plain HTTP connections routed by Host. Both
+// share the connection limits, routes and accounting.
+func (s *Server) ServeHTTPProxy(ctx context.Context, ln net.Listener) error {
+	return s.serve(ctx, ln, s.handleHTTP)
+}
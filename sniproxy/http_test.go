@@ -0,0 +1,230 @@
+package sniproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"smartSNI/config"
+	"smartSNI/metrics"
+	"smartSNI/users"
+)
+
+func TestParseHTTPHead(t *testing.T) {
+	for raw, want := range map[string]httpRequestHead{
+		"GET /a?b HTTP/1.1\r\nHost: WWW.Example.com:8080":         {host: "www.example.com", port: "8080", path: "/a?b"},
+		"GET /x HTTP/1.1\r\nUser-Agent: t\r\nhost:  example.com.": {host: "example.com", path: "/x"},
+		"GET http://proxy.test/p HTTP/1.1\r\nHost: other.test":    {host: "proxy.test", path: "/p"},
+		"GET / HTTP/1.0\r\nHost: [2001:db8::1]:80":                {host: "2001:db8::1", port: "80", path: "/"},
+		"OPTIONS * HTTP/1.1\r\nHost: example.com":                 {host: "example.com", path: "/"},
+	} {
+		got, err := parseHTTPHead([]byte(raw))
+		if err != nil || got != want {
+			t.Errorf("%q: got %+v, %v", raw, got, err)
+		}
+	}
+	for _, bad := range []string{
+		"GET / HTTP/1.1\r\nUser-Agent: t",
+		"GET / HTTP/1.1\r\nHost: a b",
+		"PRI * HTTP/2.0",
+		"\x16\x03\x01\x02\x00",
+	} {
+		if _, err := parseHTTPHead([]byte(bad)); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+// startHTTPProxy serves the Host proxy on a local port, sending requests
+// to port backendPort of the requested host ("self" for its own port).
+// Every host resolves to 127.0.0.1, which private lets it reach.
+func startHTTPProxy(t *testing.T, cfg *config.Config, backendPort string, private bool) (string, *Server) {
+	t.Helper()
+	s := New(Options{
+		Config:   config.NewStore(cfg),
+		Metrics:  metrics.New(),
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Resolver: &fakeResolver{addrs: []netip.Addr{netip.MustParseAddr("127.0.0.1")}},
+	})
+	s.httpPrivateOK = private
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.httpPort = backendPort
+	if backendPort == "self" {
+		_, s.httpPort, _ = net.SplitHostPort(ln.Addr().String())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = s.ServeHTTPProxy(ctx, ln)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return ln.Addr().String(), s
+}
+
+// roundTrip sends req on conn and reads the response.
+func roundTrip(t *testing.T, conn net.Conn, br *bufio.Reader, req string) *http.Response {
+	t.Helper()
+	if _, err := io.WriteString(conn, req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestHTTPProxyKeepAliveAndWebSocket(t *testing.T) {
+	var conns atomic.Int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			_, _ = io.WriteString(w, "hello "+r.Host+r.URL.Path)
+			return
+		}
+		c, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		_ = rw.Flush()
+		_, _ = io.Copy(c, rw) // echo frames
+	}))
+	backend.Config.ConnState = func(_ net.Conn, st http.ConnState) {
+		if st == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+
+	proxy, s := startHTTPProxy(t, &config.Config{Host: "panel.test", Domains: map[string]string{"*.example.test": "203.0.113.1"}}, port, true)
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+
+	for _, path := range []string{"/one", "/two"} {
+		resp := roundTrip(t, conn, br, "GET "+path+" HTTP/1.1\r\nHost: www.example.test\r\n\r\n")
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "hello www.example.test"+path {
+			t.Fatalf("%s: got %q", path, body)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("keep-alive requests used %d backend connections", n)
+	}
+	if live := s.Connections(); len(live) != 1 || live[0].Proto != "http" || live[0].SNI != "www.example.test" {
+		t.Errorf("live connections = %+v", live)
+	}
+
+	ws, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	_ = ws.SetDeadline(time.Now().Add(5 * time.Second))
+	wbr := bufio.NewReader(ws)
+	resp := roundTrip(t, ws, wbr, "GET /ws HTTP/1.1\r\nHost: www.example.test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade: %s", resp.Status)
+	}
+	_, _ = io.WriteString(ws, "frame")
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(wbr, got); err != nil || string(got) != "frame" {
+		t.Fatalf("websocket echo: %q, %v", got, err)
+	}
+}
+
+func TestHTTPProxyResponses(t *testing.T) {
+	cfg := &config.Config{
+		Host:      "panel.test",
+		Domains:   map[string]string{"example.test": "203.0.113.1"},
+		SNIRoutes: []config.SNIRoute{{SNI: "*.blocked.test", Block: true}},
+	}
+	proxy, _ := startHTTPProxy(t, cfg, "1", false)
+	open, _ := startHTTPProxy(t, cfg, "1", true)
+	loop, _ := startHTTPProxy(t, cfg, "self", true)
+
+	for _, tc := range []struct {
+		proxy, req string
+		code       int
+		header     string
+	}{
+		{proxy, "GET /login?x=1 HTTP/1.1\r\nHost: Panel.test\r\n\r\n", http.StatusMovedPermanently, "https://panel.test/login?x=1"},
+		{proxy, "GET / HTTP/1.1\r\nHost: www.blocked.test\r\n\r\n", http.StatusForbidden, ""},
+		{proxy, "GET / HTTP/1.1\r\nAccept: */*\r\n\r\n", http.StatusBadRequest, ""},
+		{proxy, "GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n", http.StatusForbidden, ""},
+		{proxy, "GET http://[::1]/ HTTP/1.1\r\nHost: example.test\r\n\r\n", http.StatusForbidden, ""},
+		{proxy, "GET / HTTP/1.1\r\nHost: other.test\r\n\r\n", http.StatusForbidden, ""},
+		{proxy, "GET / HTTP/1.1\r\nHost: example.test\r\n\r\n", http.StatusForbidden, ""}, // resolves to 127.0.0.1
+		{open, "GET / HTTP/1.1\r\nHost: example.test:22\r\n\r\n", http.StatusForbidden, ""},
+		{open, "GET / HTTP/1.1\r\nHost: example.test:1\r\n\r\n", http.StatusBadGateway, ""},
+		{open, "GET / HTTP/1.1\r\nHost: example.test\r\n\r\n", http.StatusBadGateway, ""},
+		{loop, "GET / HTTP/1.1\r\nHost: example.test\r\n\r\n", http.StatusLoopDetected, ""},
+	} {
+		conn, err := net.Dial("tcp", tc.proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		resp := roundTrip(t, conn, bufio.NewReader(conn), tc.req)
+		conn.Close()
+		if resp.StatusCode != tc.code || resp.Header.Get("Location") != tc.header {
+			t.Errorf("%q: got %s, Location %q", strings.SplitN(tc.req, "\r\n", 3)[:2], resp.Status, resp.Header.Get("Location"))
+		}
+	}
+}
+
+func TestHTTPAllowed(t *testing.T) {
+	store := users.NewStore(nil)
+	store.Put(&users.User{ID: "u1", IPs: []string{"192.0.2.1"}, IsActive: true, Plan: "basic", DomainSets: []string{"extra"}, ExpiresAt: time.Now().Add(time.Hour)})
+	s := New(Options{Config: config.NewStore(&config.Config{}), Users: store})
+	cfg := &config.Config{
+		Domains: map[string]string{"*.example.test": "203.0.113.1"},
+		DomainSets: map[string]config.DomainSet{
+			"extra": {Domains: map[string]string{"extra.test": "203.0.113.1"}},
+			"plan":  {Domains: map[string]string{"plan.test": "203.0.113.1"}},
+			"other": {Domains: map[string]string{"other.test": "203.0.113.1"}},
+		},
+		Plans:     map[string][]string{"basic": {"plan"}},
+		SNIRoutes: []config.SNIRoute{{SNI: "routed.test", Egress: []string{"socks5://127.0.0.1:1080"}}},
+	}
+
+	for _, tc := range []struct {
+		host, clientIP string
+		want           bool
+	}{
+		{"www.example.test", "198.51.100.1", true},
+		{"routed.test", "198.51.100.1", true},
+		{"extra.test", "192.0.2.1", true},
+		{"plan.test", "192.0.2.1", true},
+		{"extra.test", "198.51.100.1", false},
+		{"other.test", "192.0.2.1", false},
+		{"example.org", "192.0.2.1", false},
+	} {
+		if got := s.httpAllowed(cfg, tc.host, tc.clientIP); got != tc.want {
+			t.Errorf("httpAllowed(%s, %s) = %v, want %v", tc.host, tc.clientIP, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package sniproxy
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ======================== Connection Limits ========================
+
+// defaultDrainTimeout applies when sni_drain_timeout is unset.
+const defaultDrainTimeout = 30 * time.Second
+
+// ConnInfo describes a live SNI proxy connection.
+type ConnInfo struct {
+	ID       uint64    `json:"id"`
+	Proto    string    `json:"proto,omitempty"` // "tls", "quic", or "http" for the Host proxy
+	Client   string    `json:"client"`
+	SNI      string    `json:"sni,omitempty"`     // server name or Host; empty until read
+	Backend  string    `json:"backend,omitempty"` // empty until the backend answers
+	User     string    `json:"user,omitempty"`    // ID of the registered user, if any
+	Started  time.Time `json:"started"`
+	BytesIn  int64     `json:"bytes_in"`  // from the client
+	BytesOut int64     `json:"bytes_out"` // to the client
+
+	RateLimit int64 `json:"rate_limit,omitempty"` // lowest sni_rate_limits rate applied, bytes/s
+}
+
+// trackedConn is a live connection and every socket of its relay.
+type trackedConn struct {
+	info    ConnInfo // BytesIn and BytesOut are kept in in and out
+	in, out atomic.Int64
+	conns   []net.Conn
+}
+
+// connTracker counts live client connections, globally and per client IP,
+// and remembers every socket of a relay so draining can close them. The
+// TLS, HTTP and QUIC listeners share one tracker.
+type connTracker struct {
+	mu       sync.Mutex
+	conns    map[net.Conn]*trackedConn // by client connection
+	perIP    map[string]int
+	wg       sync.WaitGroup
+	nextID   uint64
+	draining int // drains in progress; no connection is admitted meanwhile
+}
+
+// acquire registers client unless a limit (0 = unlimited) is reached or a
+// listener is draining. A successful acquire must be paired with release.
+func (t *connTracker) acquire(client net.Conn, ip string, maxConns, maxPerIP int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining > 0 {
+		// One listener may still accept while another drains; refusing
+		// here keeps every wg.Add ahead of the drain's wg.Wait
+		return false
+	}
+	if maxConns > 0 && len(t.conns) >= maxConns {
+		return false
+	}
+	if maxPerIP > 0 && t.perIP[ip] >= maxPerIP {
+		return false
+	}
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]*trackedConn)
+		t.perIP = make(map[string]int)
+	}
+	t.nextID++
+	t.conns[client] = &trackedConn{
+		info:  ConnInfo{ID: t.nextID, Client: client.RemoteAddr().String(), Started: time.Now()},
+		conns: []net.Conn{client},
+	}
+	t.perIP[ip]++
+	t.wg.Add(1)
+	return true
+}
+
+// attach adds the backend connection of client's relay and what it is
+// relayed for, taken from the Proto, SNI, Backend, User and RateLimit of
+// info, and its Client when set. The returned entry counts the relay's
+// bytes; it is nil if client is not tracked.
+func (t *connTracker) attach(client, backend net.Conn, info ConnInfo) *trackedConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tc, ok := t.conns[client]
+	if !ok {
+		return nil
+	}
+	tc.conns = append(tc.conns, backend)
+	if info.Client == "" {
+		info.Client = tc.info.Client
+	}
+	info.ID, info.Started = tc.info.ID, tc.info.Started
+	tc.info = info
+	return tc
+}
+
+func (t *connTracker) release(client net.Conn, ip string) {
+	t.mu.Lock()
+	delete(t.conns, client)
+	if t.perIP[ip]--; t.perIP[ip] <= 0 {
+		delete(t.perIP, ip)
+	}
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+func (t *connTracker) active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// list returns the tracked connections in the order they were accepted.
+func (t *connTracker) list() []ConnInfo {
+	t.mu.Lock()
+	out := make([]ConnInfo, 0, len(t.conns))
+	for _, tc := range t.conns {
+		info := tc.info
+		info.BytesIn, info.BytesOut = tc.in.Load(), tc.out.Load()
+		out = append(out, info)
+	}
+	t.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// kill closes the sockets of connection id. It reports whether id was
+// live.
+func (t *connTracker) kill(id uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tc := range t.conns {
+		if tc.info.ID == id {
+			for _, c := range tc.conns {
+				_ = c.Close()
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// closeAll closes every tracked socket, ending their relays.
+func (t *connTracker) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tc := range t.conns {
+		for _, c := range tc.conns {
+			_ = c.Close()
+		}
+	}
+}
+
+// drain waits up to timeout for the tracked relays to finish, then closes
+// the remaining ones. It reports whether every relay finished in time.
+func (t *connTracker) drain(timeout time.Duration) bool {
+	t.mu.Lock()
+	t.draining++
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.draining--
+		t.mu.Unlock()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		t.closeAll()
+		<-done
+		return false
+	}
+}
+
+// Connections lists the live SNI proxy connections.
+func (s *Server) Connections() []ConnInfo {
+	return s.conns.list()
+}
+
+// KillConnection closes the live connection with the given ID. It reports
+// whether there was one.
+func (s *Server) KillConnection(id uint64) bool {
+	return s.conns.kill(id)
+}
@@ -0,0 +1,284 @@
+package sniproxy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"smartSNI/config"
+	"smartSNI/metrics"
+	"smartSNI/users"
+)
+
+// holdingBackend accepts connections and runs serve on each.
+func holdingBackend(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				serve(c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// openRelay connects through proxy to serverName and returns the raw
+// client connection once the ClientHello is sent.
+func openRelay(t *testing.T, proxy, serverName string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := conn.Write(helloFor(t, serverName)); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestConnectionLimits(t *testing.T) {
+	backend := holdingBackend(t, func(c net.Conn) { _, _ = io.Copy(io.Discard, c) })
+	proxy, m := startTestProxyConfig(t, &config.Config{
+		SNIMaxConnsPerIP: 2,
+		SNIRoutes:        []config.SNIRoute{{SNI: "*", Backend: backend}},
+	}, "127.0.0.1:1")
+
+	openRelay(t, proxy, "a.test")
+	openRelay(t, proxy, "b.test")
+	third := openRelay(t, proxy, "c.test")
+	_ = third.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := third.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("third connection: %v, want closed", err)
+	}
+	if got := m.GetStats()["sni_rejected"]; got != 1 {
+		t.Fatalf("sni_rejected = %d, want 1", got)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	// Streams to the client for 1.5s, then falls silent
+	backend := holdingBackend(t, func(c net.Conn) {
+		for i := 0; i < 5; i++ {
+			time.Sleep(300 * time.Millisecond)
+			if _, err := c.Write([]byte{byte(i)}); err != nil {
+				return
+			}
+		}
+		_, _ = io.Copy(io.Discard, c)
+	})
+	proxy, _ := startTestProxyConfig(t, &config.Config{
+		SNIIdleTimeout: 1,
+		SNIRoutes:      []config.SNIRoute{{SNI: "*", Backend: backend}},
+	}, "127.0.0.1:1")
+
+	conn := openRelay(t, proxy, "idle.test")
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The quiet client direction must not cut the stream short
+	if len(got) != 5 {
+		t.Fatalf("got %d bytes before the relay closed, want 5", len(got))
+	}
+	if elapsed := time.Since(start); elapsed < 2*time.Second || elapsed > 5*time.Second {
+		t.Fatalf("relay closed after %v, want about 1.5s + 1-2s idle", elapsed)
+	}
+}
+
+func TestMaxLifetime(t *testing.T) {
+	backend := holdingBackend(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+	proxy, _ := startTestProxyConfig(t, &config.Config{
+		SNIMaxLifetime: 1,
+		SNIRoutes:      []config.SNIRoute{{SNI: "*", Backend: backend}},
+	}, "127.0.0.1:1")
+
+	conn := openRelay(t, proxy, "busy.test")
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	buf := make([]byte, 64*1024)
+	for {
+		if _, err := conn.Write([]byte("x")); err != nil {
+			break
+		}
+		if _, err := conn.Read(buf); err != nil {
+			break
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("busy relay lasted %v past a 1s lifetime", elapsed)
+	}
+}
+
+func TestGracefulDrain(t *testing.T) {
+	backend := holdingBackend(t, func(c net.Conn) { _, _ = io.Copy(io.Discard, c) })
+	s := New(Options{
+		Config: config.NewStore(&config.Config{
+			SNIDrainTimeout: 1,
+			SNIRoutes:       []config.SNIRoute{{SNI: "*", Backend: backend}},
+		}),
+		Metrics: metrics.New(),
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve(ctx, ln)
+		close(done)
+	}()
+
+	// One relay finishes during the drain, one outlives it
+	quick := openRelay(t, ln.Addr().String(), "quick.test")
+	stuck := openRelay(t, ln.Addr().String(), "stuck.test")
+	for s.conns.active() < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Error("listener still accepting while draining")
+	}
+	select {
+	case <-done:
+		t.Fatal("Serve returned before relays finished")
+	default:
+	}
+	quick.Close()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Serve did not return after the drain deadline")
+	}
+	_ = stuck.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := stuck.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("relay left open after the drain: %v", err)
+	}
+}
+
+func TestDrainRefusesNewConnections(t *testing.T) {
+	var tr connTracker
+	a, _ := net.Pipe()
+	if !tr.acquire(a, "192.0.2.1", 0, 0) {
+		t.Fatal("acquire refused")
+	}
+	done := make(chan bool)
+	go func() { done <- tr.drain(5 * time.Second) }()
+	for {
+		tr.mu.Lock()
+		draining := tr.draining > 0
+		tr.mu.Unlock()
+		if draining {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Another listener accepting during the drain is turned away
+	b, _ := net.Pipe()
+	if tr.acquire(b, "192.0.2.2", 0, 0) {
+		t.Fatal("connection admitted while draining")
+	}
+	tr.release(a, "192.0.2.1")
+	if !<-done {
+		t.Fatal("drain timed out")
+	}
+	if !tr.acquire(b, "192.0.2.2", 0, 0) {
+		t.Fatal("acquire refused after the drain")
+	}
+	tr.release(b, "192.0.2.2")
+}
+
+func TestConnectionAccounting(t *testing.T) {
+	backend := holdingBackend(t, func(c net.Conn) { _, _ = io.Copy(c, c) })
+	store := users.NewStore(nil)
+	store.Put(&users.User{ID: "u1", Name: "alice", IPs: []string{"127.0.0.1"}, IsActive: true, ExpiresAt: time.Now().Add(time.Hour)})
+	m := metrics.New()
+	s := New(Options{
+		Config:  config.NewStore(&config.Config{SNIRoutes: []config.SNIRoute{{SNI: "*", Backend: backend}}}),
+		Users:   store,
+		Metrics: m,
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = s.Serve(ctx, ln) }()
+
+	hello := helloFor(t, "video.test")
+	conn := openRelay(t, ln.Addr().String(), "video.test")
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	// The echo returns the ClientHello, then ping
+	if _, err := io.ReadFull(conn, make([]byte, len(hello)+4)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Spliced bytes are counted within relayTick
+	want := int64(len(hello) + 4)
+	var c ConnInfo
+	for deadline := time.Now().Add(3 * relayTick); ; time.Sleep(50 * time.Millisecond) {
+		live := s.Connections()
+		if len(live) != 1 {
+			t.Fatalf("%d live connections, want 1", len(live))
+		}
+		c = live[0]
+		if c.BytesIn == want && c.BytesOut == want || time.Now().After(deadline) {
+			break
+		}
+	}
+	if c.SNI != "video.test" || c.Backend != backend || c.User != "u1" {
+		t.Errorf("connection = %+v", c)
+	}
+	if c.BytesIn != want || c.BytesOut != want {
+		t.Errorf("bytes in/out = %d/%d, want %d", c.BytesIn, c.BytesOut, want)
+	}
+
+	if s.KillConnection(c.ID + 1) {
+		t.Error("killed an unknown connection")
+	}
+	if !s.KillConnection(c.ID) {
+		t.Fatal("KillConnection failed")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("killed connection still open")
+	}
+	for s.conns.active() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	bySNI, byUser := m.SNITraffic()
+	for name, tr := range map[string]metrics.Traffic{"sni": bySNI["video.test"], "user": byUser["u1"]} {
+		if tr.Connections != 1 || tr.BytesIn != uint64(want) || tr.BytesOut != uint64(want) || tr.Seconds <= 0 {
+			t.Errorf("%s traffic = %+v", name, tr)
+		}
+	}
+	if got := m.GetStats()["sni_bytes_in"]; got != uint64(want) {
+		t.Errorf("sni_bytes_in = %d, want %d", got, want)
+	}
+}
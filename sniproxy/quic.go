@@ -0,0 +1,300 @@
+package sniproxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ======================== QUIC Initial Packets ========================
+
+// QUIC versions whose Initial packets we can open (RFC 9000, RFC 9369).
+const (
+	quicVersion1 = 0x00000001
+	quicVersion2 = 0x6b3343cf
+)
+
+// quicInitialSalts derive the Initial secrets of each version from the
+// client's Destination Connection ID (RFC 9001 5.2, RFC 9369 3.3.1).
+var quicInitialSalts = map[uint32][]byte{
+	quicVersion1: {0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a},
+	quicVersion2: {0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9},
+}
+
+const (
+	maxConnIDLen     = 20
+	quicSampleLen    = 16
+	frameTypePadding = 0x00
+	frameTypePing    = 0x01
+	frameTypeAck     = 0x02
+	frameTypeAckECN  = 0x03
+	frameTypeCrypto  = 0x06
+	frameTypeClose   = 0x1c
+)
+
+var errShortQUIC = errors.New("QUIC packet truncated")
+
+// varint reads a QUIC variable-length integer (RFC 9000 16).
+func (r *helloReader) varint() uint64 {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, c := range r.bytes(1<<(b[0]>>6) - 1) {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func hkdfExtract(salt, secret []byte) []byte {
+	h := hmac.New(sha256.New, salt)
+	h.Write(secret)
+	return h.Sum(nil)
+}
+
+// hkdfExpandLabel is the TLS 1.3 HKDF-Expand-Label (RFC 8446 7.1) with
+// SHA-256 and an empty context.
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := []byte{byte(length >> 8), byte(length), byte(len(label))}
+	info = append(info, label...)
+	info = append(info, 0)
+	var out, t []byte
+	for i := byte(1); len(out) < length; i++ {
+		h := hmac.New(sha256.New, secret)
+		h.Write(t)
+		h.Write(info)
+		h.Write([]byte{i})
+		t = h.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:length]
+}
+
+// quicKeys protect the packets of one direction.
+type quicKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block // header protection
+}
+
+// clientInitialKeys derives the keys of the client's Initial packets. They
+// depend only on the version and the Destination Connection ID the client
+// chose, so anyone on the path can read the ClientHello.
+func clientInitialKeys(version uint32, dcid []byte) (*quicKeys, error) {
+	salt, ok := quicInitialSalts[version]
+	if !ok {
+		return nil, fmt.Errorf("unsupported QUIC version %#x", version)
+	}
+	prefix := "quic "
+	if version == quicVersion2 {
+		prefix = "quicv2 "
+	}
+	secret := hkdfExpandLabel(hkdfExtract(salt, dcid), "client in", sha256.Size)
+	block, err := aes.NewCipher(hkdfExpandLabel(secret, prefix+"key", 16))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hkdfExpandLabel(secret, prefix+"hp", 16))
+	if err != nil {
+		return nil, err
+	}
+	return &quicKeys{aead: aead, iv: hkdfExpandLabel(secret, prefix+"iv", 12), hp: hp}, nil
+}
+
+// isInitial reports whether the first byte of a long header packet marks
+// an Initial packet; version 2 renumbered the packet types.
+func isInitial(first byte, version uint32) bool {
+	typ := first >> 4 & 0x03
+	if version == quicVersion2 {
+		return typ == 0x01
+	}
+	return typ == 0x00
+}
+
+// openInitials decrypts the client Initial packets coalesced in datagram
+// and returns their payloads. Other long header packets are skipped and a
+// short header packet ends the datagram. datagram is not modified.
+func openInitials(datagram []byte) ([][]byte, error) {
+	var payloads [][]byte
+	for len(datagram) > 0 && datagram[0]&0x80 != 0 {
+		r := &helloReader{b: datagram}
+		first := byte(r.u8())
+		v := r.bytes(4)
+		if r.bad {
+			return payloads, errShortQUIC
+		}
+		version := binary.BigEndian.Uint32(v)
+		if _, ok := quicInitialSalts[version]; !ok {
+			return payloads, fmt.Errorf("unsupported QUIC version %#x", version)
+		}
+		dcid := r.vec8()
+		r.vec8() // source connection ID
+		initial := isInitial(first, version)
+		if initial {
+			r.bytes(int(r.varint())) // token
+		}
+		length := int(r.varint())
+		if r.bad || len(dcid.b) > maxConnIDLen || length < 0 || length > len(r.b) {
+			return payloads, errShortQUIC
+		}
+		pnOffset := len(datagram) - len(r.b)
+		packet := datagram[:pnOffset+length]
+		datagram = datagram[pnOffset+length:]
+		if !initial {
+			continue
+		}
+		payload, err := openInitial(packet, pnOffset, version, dcid.b)
+		if err != nil {
+			return payloads, err
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads, nil
+}
+
+// openInitial removes the header protection of an Initial packet whose
+// packet number starts at pnOffset and decrypts its payload (RFC 9001 5.3,
+// 5.4).
+func openInitial(packet []byte, pnOffset int, version uint32, dcid []byte) ([]byte, error) {
+	if len(packet) < pnOffset+4+quicSampleLen {
+		return nil, errShortQUIC
+	}
+	keys, err := clientInitialKeys(version, dcid)
+	if err != nil {
+		return nil, err
+	}
+	p := append([]byte(nil), packet...)
+	mask := make([]byte, aes.BlockSize)
+	keys.hp.Encrypt(mask, p[pnOffset+4:pnOffset+4+quicSampleLen])
+	p[0] ^= mask[0] & 0x0f
+	pnLen := int(p[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		p[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(p[pnOffset+i])
+	}
+	// The first packets of a connection are numbered from 0, so the
+	// truncated number is the full one
+	nonce := append([]byte(nil), keys.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	payload, err := keys.aead.Open(nil, nonce, p[pnOffset+pnLen:], p[:pnOffset+pnLen])
+	if err != nil {
+		return nil, fmt.Errorf("QUIC Initial packet: %w", err)
+	}
+	return payload, nil
+}
+
+// cryptoStream reassembles the CRYPTO frames of a client's Initial
+// packets, which may be split across datagrams, reordered and repeated.
+type cryptoStream struct {
+	frags map[uint64][]byte // by offset
+	size  int
+}
+
+func (cs *cryptoStream) add(off uint64, data []byte) error {
+	cs.size += len(data)
+	if off+uint64(len(data)) > maxClientHelloLen || cs.size > 2*maxClientHelloLen {
+		return fmt.Errorf("ClientHello exceeds the %d byte limit", maxClientHelloLen)
+	}
+	if cs.frags == nil {
+		cs.frags = make(map[uint64][]byte)
+	}
+	if len(data) > len(cs.frags[off]) {
+		cs.frags[off] = append([]byte(nil), data...)
+	}
+	return nil
+}
+
+// addFrames adds the CRYPTO frames of a decrypted Initial payload. Clients
+// send only PADDING, PING, ACK, CRYPTO and CONNECTION_CLOSE frames there
+// (RFC 9000 12.4).
+func (cs *cryptoStream) addFrames(payload []byte) error {
+	r := &helloReader{b: payload}
+	for len(r.b) > 0 && !r.bad {
+		switch typ := r.varint(); typ {
+		case frameTypePadding, frameTypePing:
+		case frameTypeAck, frameTypeAckECN:
+			r.varint() // largest acknowledged
+			r.varint() // delay
+			ranges := r.varint()
+			r.varint() // first range
+			for i := uint64(0); i < ranges && !r.bad; i++ {
+				r.varint() // gap
+				r.varint() // range length
+			}
+			if typ == frameTypeAckECN {
+				r.varint()
+				r.varint()
+				r.varint()
+			}
+		case frameTypeCrypto:
+			off := r.varint()
+			data := r.bytes(int(r.varint()))
+			if r.bad {
+				return errShortQUIC
+			}
+			if err := cs.add(off, data); err != nil {
+				return err
+			}
+		case frameTypeClose:
+			return errors.New("QUIC connection closed by the client")
+		default:
+			return fmt.Errorf("unexpected frame type %#x in QUIC Initial", typ)
+		}
+	}
+	if r.bad {
+		return errShortQUIC
+	}
+	return nil
+}
+
+// hello returns the ClientHello once the stream holds all of it, or nil.
+func (cs *cryptoStream) hello() (*ClientHelloInfo, error) {
+	offs := make([]uint64, 0, len(cs.frags))
+	for off := range cs.frags {
+		offs = append(offs, off)
+	}
+	sort.Slice(offs, func(i, j int) bool { return offs[i] < offs[j] })
+
+	var msg []byte
+	for _, off := range offs {
+		if off > uint64(len(msg)) {
+			break
+		}
+		if data := cs.frags[off]; off+uint64(len(data)) > uint64(len(msg)) {
+			msg = append(msg, data[uint64(len(msg))-off:]...)
+		}
+	}
+	if len(msg) < handshakeHeaderLen {
+		return nil, nil
+	}
+	if msg[0] != handshakeClientHello {
+		return nil, fmt.Errorf("handshake message type %d is not ClientHello", msg[0])
+	}
+	helloLen := handshakeHeaderLen + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+	if helloLen > maxClientHelloLen {
+		return nil, fmt.Errorf("ClientHello of %d bytes exceeds the %d byte limit", helloLen, maxClientHelloLen)
+	}
+	if len(msg) < helloLen {
+		return nil, nil
+	}
+	info, err := parseClientHello(msg[:helloLen])
+	if err != nil {
+		return nil, err
+	}
+	info.JA4 = "q" + info.JA4[1:] // JA4 marks hellos sent over QUIC
+	return info, nil
+}
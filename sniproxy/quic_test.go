@@ -0,0 +1,167 @@
+package sniproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// quicClientHello returns the ClientHello a crypto/tls QUIC client sends.
+func quicClientHello(t testing.TB, serverName string) []byte {
+	t.Helper()
+	conn := tls.QUICClient(&tls.QUICConfig{TLSConfig: &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         []string{"h3"},
+		MinVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: true,
+	}})
+	conn.SetTransportParameters([]byte{0x04, 0x04, 0x80, 0x10, 0x00, 0x00}) // initial_max_data
+	if err := conn.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for {
+		switch e := conn.NextEvent(); e.Kind {
+		case tls.QUICNoEvent:
+			t.Fatal("QUIC client sent no ClientHello")
+		case tls.QUICWriteData:
+			if e.Level == tls.QUICEncryptionLevelInitial {
+				return append([]byte(nil), e.Data...)
+			}
+		}
+	}
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return binary.BigEndian.AppendUint16(b, uint16(v)|0x4000)
+	default:
+		return binary.BigEndian.AppendUint32(b, uint32(v)|0x80000000)
+	}
+}
+
+func cryptoFrame(off int, data []byte) []byte {
+	b := appendVarint([]byte{frameTypeCrypto}, uint64(off))
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// sealInitial builds a client Initial packet carrying frames, padded so
+// the packet is at least minQUICInitial bytes.
+func sealInitial(t testing.TB, version uint32, dcid []byte, pn uint16, frames []byte) []byte {
+	t.Helper()
+	keys, err := clientInitialKeys(version, dcid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	typ := byte(0x00)
+	if version == quicVersion2 {
+		typ = 0x01
+	}
+	header := []byte{0xc0 | typ<<4 | 0x01} // 2 byte packet number
+	header = binary.BigEndian.AppendUint32(header, version)
+	header = append(append(header, byte(len(dcid))), dcid...)
+	header = append(header, 4, 0xa, 0xb, 0xc, 0xd) // source connection ID
+	header = append(header, 0)                     // token
+	overhead := len(header) + 2 + 2 + keys.aead.Overhead()
+	payload := append([]byte(nil), frames...)
+	if pad := minQUICInitial - overhead - len(payload); pad > 0 {
+		payload = append(payload, make([]byte, pad)...)
+	}
+	header = binary.BigEndian.AppendUint16(header, uint16(2+len(payload)+keys.aead.Overhead())|0x4000)
+	pnOffset := len(header)
+	header = binary.BigEndian.AppendUint16(header, pn)
+
+	nonce := append([]byte(nil), keys.iv...)
+	nonce[len(nonce)-2] ^= byte(pn >> 8)
+	nonce[len(nonce)-1] ^= byte(pn)
+	packet := keys.aead.Seal(header, nonce, payload, header)
+
+	mask := make([]byte, aes.BlockSize)
+	keys.hp.Encrypt(mask, packet[pnOffset+4:pnOffset+4+quicSampleLen])
+	packet[0] ^= mask[0] & 0x0f
+	packet[pnOffset] ^= mask[1]
+	packet[pnOffset+1] ^= mask[2]
+	return packet
+}
+
+func TestClientInitialKeys(t *testing.T) {
+	dcid, _ := hex.DecodeString("8394c8f03e515708") // RFC 9001 A.1, RFC 9369 A.1
+	for _, tc := range []struct {
+		version     uint32
+		key, iv, hp string
+	}{
+		{quicVersion1, "1f369613dd76d5467730efcbe3b1a22d", "fa044b2f42a3fd3b46fb255c", "9f50449e04a0e810283a1e9933adedd2"},
+		{quicVersion2, "8b1a0bc121284290a29e0971b5cd045d", "91f73e2351d8fa91660e909f", "45b95e15235d6f45a6b19cbcb0294ba9"},
+	} {
+		prefix := "quic "
+		if tc.version == quicVersion2 {
+			prefix = "quicv2 "
+		}
+		secret := hkdfExpandLabel(hkdfExtract(quicInitialSalts[tc.version], dcid), "client in", 32)
+		for label, want := range map[string]string{"key": tc.key, "iv": tc.iv, "hp": tc.hp} {
+			if got := hex.EncodeToString(hkdfExpandLabel(secret, prefix+label, len(want)/2)); got != want {
+				t.Errorf("version %#x %s: got %s, want %s", tc.version, label, got, want)
+			}
+		}
+	}
+	if _, err := clientInitialKeys(0xff00001d, dcid); err == nil {
+		t.Error("draft version accepted")
+	}
+}
+
+func TestOpenInitials(t *testing.T) {
+	hello := quicClientHello(t, "quic.example")
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	half := len(hello) / 2
+
+	for _, version := range []uint32{quicVersion1, quicVersion2} {
+		// The second half first, in a datagram that also carries a
+		// Handshake packet, then the first half with an ACK and a PING
+		second := sealInitial(t, version, dcid, 0, cryptoFrame(half, hello[half:]))
+		handshake := []byte{0xe0, 0, 0, 0, 1, 8, 1, 2, 3, 4, 5, 6, 7, 8, 0, 0x04, 9, 9, 9, 9}
+		binary.BigEndian.PutUint32(handshake[1:], version)
+		if version == quicVersion2 {
+			handshake[0] = 0xf0
+		}
+		first := sealInitial(t, version, dcid, 1, append([]byte{frameTypeAck, 0, 0, 0, 0, frameTypePing}, cryptoFrame(0, hello[:half])...))
+		orig := append([]byte(nil), first...)
+
+		var cs cryptoStream
+		for i, datagram := range [][]byte{append(second, handshake...), first} {
+			payloads, err := openInitials(datagram)
+			if err != nil || len(payloads) != 1 {
+				t.Fatalf("version %#x datagram %d: %d payloads, %v", version, i, len(payloads), err)
+			}
+			if err := cs.addFrames(payloads[0]); err != nil {
+				t.Fatalf("version %#x datagram %d: %v", version, i, err)
+			}
+			info, err := cs.hello()
+			if i == 0 && (info != nil || err != nil) {
+				t.Fatalf("half a ClientHello parsed: %v, %v", info, err)
+			}
+			if i == 1 && (err != nil || info == nil || info.ServerName != "quic.example" || info.JA4[0] != 'q') {
+				t.Fatalf("version %#x: got %+v, %v", version, info, err)
+			}
+		}
+		if !bytes.Equal(first, orig) {
+			t.Error("openInitials modified the datagram")
+		}
+
+		tampered := append([]byte(nil), first...)
+		tampered[len(tampered)-1] ^= 1
+		if _, err := openInitials(tampered); err == nil {
+			t.Error("tampered packet opened")
+		}
+		if _, err := openInitials(first[:40]); err == nil {
+			t.Error("truncated packet opened")
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package sniproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"smartSNI/config"
+)
+
+// ======================== UDP Proxy (QUIC) ========================
+
+const (
+	minQUICInitial   = 1200 // RFC 9000 14.1: clients pad Initial datagrams to this
+	maxQUICDatagram  = 65535
+	maxQUICPending   = 1024 // flows still reading their ClientHello
+	maxQUICQueued    = 32   // datagrams held per flow until its backend is dialled
+	quicHelloTimeout = 5 * time.Second
+	quicIdleTimeout  = 2 * time.Minute // when sni_idle_timeout is unset
+)
+
+// quicFlow is the UDP flow of one client address. Until the backend is
+// dialled its datagrams are queued while the ClientHello is read from
+// them; then they are relayed through a socket connected to the backend.
+type quicFlow struct {
+	client   netip.AddrPort
+	started  time.Time
+	crypto   cryptoStream
+	queued   [][]byte
+	dialling bool
+
+	// Set once relaying
+	backend    *net.UDPConn
+	tc         *trackedConn
+	name, user string
+	last       atomic.Int64 // UnixNano of the last datagram either way
+}
+
+// quicProxy relays the flows of one UDP listener.
+type quicProxy struct {
+	s       *Server
+	pc      *net.UDPConn
+	mu      sync.Mutex
+	flows   map[netip.AddrPort]*quicFlow
+	pending int // flows without a backend
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// forward sends a client datagram to the backend.
+func (q *quicProxy) forward(f *quicFlow, datagram []byte) {
+	if _, err := f.backend.Write(datagram); err != nil {
+		return
+	}
+	f.last.Store(time.Now().UnixNano())
+	f.tc.in.Add(int64(len(datagram)))
+	q.s.metrics.AddSNITraffic(f.name, f.user, uint64(len(datagram)), 0)
+}
+
+// handle routes one datagram from a client.
+func (q *quicProxy) handle(datagram []byte, from netip.AddrPort) {
+	q.mu.Lock()
+	f := q.flows[from]
+	if f != nil && f.backend != nil {
+		q.mu.Unlock()
+		q.forward(f, datagram)
+		return
+	}
+	defer q.mu.Unlock()
+
+	if f == nil {
+		// Only a padded Initial opens a flow, so spoofed sources cannot use
+		// us to amplify
+		if len(datagram) < minQUICInitial || q.pending >= maxQUICPending || q.closed {
+			return
+		}
+		f = &quicFlow{client: from, started: time.Now()}
+	}
+	if len(f.queued) >= maxQUICQueued {
+		return
+	}
+	if !f.dialling {
+		payloads, err := openInitials(datagram)
+		if len(payloads) == 0 && err == nil && q.flows[from] == nil {
+			return // not a QUIC Initial
+		}
+		for _, p := range payloads {
+			if err == nil {
+				err = f.crypto.addFrames(p)
+			}
+		}
+		var hello *ClientHelloInfo
+		if err == nil {
+			hello, err = f.crypto.hello()
+		}
+		if err != nil {
+			q.s.logger.Debug("QUIC Initial unreadable", "error", err, "client", from)
+			q.s.metrics.IncErrors()
+			if q.flows[from] != nil {
+				delete(q.flows, from)
+				q.pending--
+			}
+			return
+		}
+		if hello != nil {
+			f.dialling = true
+			go q.open(f, hello)
+		}
+	}
+	if q.flows[from] == nil {
+		q.flows[from] = f
+		q.pending++
+	}
+	f.queued = append(f.queued, append([]byte(nil), datagram...))
+}
+
+// open dials the backend of a flow whose ClientHello is complete and
+// starts relaying, or drops the flow.
+func (q *quicProxy) open(f *quicFlow, hello *ClientHelloInfo) {
+	s := q.s
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Error("panic in QUIC handler", "error", r, "stack", string(debug.Stack()))
+			s.metrics.IncErrors()
+		}
+	}()
+
+	cfg := s.cfg.Get()
+	clientIP := f.client.Addr().Unmap().String()
+	backend, info, release := q.connect(cfg, f, hello)
+	if backend != nil {
+		if !s.conns.acquire(backend, clientIP, cfg.SNIMaxConns, cfg.SNIMaxConnsPerIP) {
+			s.logger.Debug("SNI connection limit reached", "client", clientIP)
+			s.metrics.IncSNIRejected()
+			backend.Close()
+			release()
+			backend = nil
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending--
+	if backend == nil || q.closed {
+		delete(q.flows, f.client)
+		if backend != nil {
+			backend.Close()
+			s.conns.release(backend, clientIP)
+			release()
+		}
+		return
+	}
+
+	s.metrics.IncQUICSessions()
+	f.user, _ = s.clientUser(clientIP)
+	f.name, info.User = info.SNI, f.user
+	f.tc = s.conns.attach(backend, backend, info)
+	f.backend = backend
+	f.last.Store(time.Now().UnixNano())
+	s.metrics.SNIConnStart(f.name, f.user)
+	for _, d := range f.queued {
+		q.forward(f, d)
+	}
+	f.queued = nil
+
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		defer release()
+		defer s.conns.release(backend, clientIP)
+		q.relay(cfg, f)
+	}()
+}
+
+// connect routes a flow by its ClientHello the way handleConnection routes
+// TLS, and connects a UDP socket to the backend. It returns a nil socket
+// when the flow is dropped; release must be called otherwise.
+func (q *quicProxy) connect(cfg *config.Config, f *quicFlow, hello *ClientHelloInfo) (*net.UDPConn, ConnInfo, func()) {
+	s := q.s
+	clientAddr := f.client.String()
+	clientIP := f.client.Addr().Unmap().String()
+
+	sni := strings.TrimSpace(strings.ToLower(hello.ServerName))
+	if sni == "" {
+		s.logger.Warn("SNI missing from QUIC ClientHello", "client", clientAddr, "ja4", hello.JA4)
+		s.metrics.IncErrors()
+		return nil, ConnInfo{}, nil
+	}
+	if cfg.SNILogClientHello {
+		s.logger.Info("client hello", "proto", "quic", "sni", sni, "client", clientAddr,
+			"alpn", hello.ALPN, "versions", hello.SupportedVersions, "ech", hello.ECH,
+			"ciphers", len(hello.CipherSuites), "ja3", hello.JA3, "ja4", hello.JA4)
+	} else {
+		s.logger.Debug("SNI detected", "proto", "quic", "sni", sni, "client", clientAddr, "alpn", hello.ALPN, "ja4", hello.JA4)
+	}
+
+	for _, fp := range cfg.SNIBlockedFP {
+		if hello.MatchesFingerprint(fp) {
+			s.logger.Warn("SNI connection blocked by fingerprint", "proto", "quic", "sni", sni, "client", clientAddr, "fingerprint", fp)
+			s.metrics.IncSNIBlocked()
+			return nil, ConnInfo{}, nil
+		}
+	}
+	if !s.echAllowed(cfg, hello, "quic", sni, clientAddr) {
+		return nil, ConnInfo{}, nil
+	}
+
+	route := matchRoute(cfg, sni, hello.ALPN)
+	if route != nil && route.Block {
+		s.logger.Info("SNI connection blocked by route", "proto", "quic", "sni", sni, "client", clientAddr, "alpn", hello.ALPN)
+		s.metrics.IncSNIBlocked()
+		return nil, ConnInfo{}, nil
+	}
+
+	// What QUIC cannot honour is left to TLS over TCP: the local HTTPS
+	// server, egress proxies and bandwidth shaping
+	user, plan := s.clientUser(clientIP)
+	reason := ""
+	switch {
+	case sni == strings.ToLower(cfg.Host):
+		reason = "configured host"
+	case route != nil && len(route.Egress) > 0:
+		reason = "route egress"
+	default:
+		for i := range cfg.SNIRateLimits {
+			if cfg.SNIRateLimits[i].Matches(sni, user, plan) {
+				reason = "rate limited"
+				break
+			}
+		}
+	}
+	if reason != "" {
+		s.logger.Debug("QUIC flow dropped, client falls back to TCP", "sni", sni, "reason", reason, "client", clientAddr)
+		return nil, ConnInfo{}, nil
+	}
+
+	backend, target, release, err := s.dialUDP(cfg, route, net.JoinHostPort(sni, "443"), clientIP)
+	if errors.Is(err, errSelfLoop) {
+		s.logger.Warn("SNI backend is this proxy, refusing to loop", "proto", "quic", "sni", sni, "target", target, "client", clientAddr)
+		s.metrics.IncSNISelfLoops()
+		return nil, ConnInfo{}, nil
+	}
+	if err != nil {
+		s.logger.Warn("backend dial failed", "proto", "quic", "target", target, "error", err, "client", clientAddr)
+		s.metrics.IncErrors()
+		return nil, ConnInfo{}, nil
+	}
+	return backend, ConnInfo{Proto: "quic", Client: clientAddr, SNI: sni, Backend: target}, release
+}
+
+// relay copies backend datagrams to the client until the flow idles out,
+// reaches its lifetime or its socket is closed.
+func (q *quicProxy) relay(cfg *config.Config, f *quicFlow) {
+	s := q.s
+	idle := quicIdleTimeout
+	if cfg.SNIIdleTimeout > 0 {
+		idle = time.Duration(cfg.SNIIdleTimeout) * time.Second
+	}
+	if cfg.SNIMaxLifetime > 0 {
+		t := time.AfterFunc(time.Duration(cfg.SNIMaxLifetime)*time.Second, func() {
+			s.logger.Debug("connection reached its maximum lifetime", "proto", "quic", "sni", f.name, "client", f.client)
+			_ = f.backend.Close()
+		})
+		defer t.Stop()
+	}
+
+	start := time.Now()
+	s.logger.Debug("proxying connection", "proto", "quic", "sni", f.name, "target", f.tc.info.Backend, "client", f.client)
+	buf := make([]byte, maxQUICDatagram)
+	for {
+		_ = f.backend.SetReadDeadline(time.Now().Add(min(idle, relayTick)))
+		n, err := f.backend.Read(buf)
+		if n > 0 {
+			if _, err := q.pc.WriteToUDPAddrPort(buf[:n], f.client); err == nil {
+				f.last.Store(time.Now().UnixNano())
+				f.tc.out.Add(int64(n))
+				s.metrics.AddSNITraffic(f.name, f.user, 0, uint64(n))
+			}
+		}
+		var ne net.Error
+		if err == nil || errors.As(err, &ne) && ne.Timeout() && time.Since(time.Unix(0, f.last.Load())) < idle {
+			continue
+		}
+		break
+	}
+
+	q.mu.Lock()
+	delete(q.flows, f.client)
+	q.mu.Unlock()
+	_ = f.backend.Close()
+	s.metrics.SNIConnEnd(f.name, f.user, time.Since(start))
+	s.logger.Debug("connection closed", "proto", "quic", "sni", f.name, "client", f.client,
+		"bytes_in", f.tc.in.Load(), "bytes_out", f.tc.out.Load(), "duration", time.Since(start))
+}
+
+// expire drops flows that did not complete their ClientHello in time.
+func (q *quicProxy) expire(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for addr, f := range q.flows {
+		if f.backend == nil && !f.dialling && now.Sub(f.started) > quicHelloTimeout {
+			delete(q.flows, addr)
+			q.pending--
+		}
+	}
+}
+
+// close ends every flow and waits for their relays.
+func (q *quicProxy) close() {
+	q.mu.Lock()
+	q.closed = true
+	for _, f := range q.flows {
+		if f.backend != nil {
+			_ = f.backend.Close()
+		}
+	}
+	q.mu.Unlock()
+	q.wg.Wait()
+}
+
+// udpDialer is sourceDialer for UDP sockets.
+func (s *Server) udpDialer(cfg *config.Config, r *config.SNIRoute, clientIP string) *net.Dialer {
+	d := *s.sourceDialer(cfg, r, clientIP)
+	if local, ok := d.LocalAddr.(*net.TCPAddr); ok {
+		d.LocalAddr = &net.UDPAddr{IP: local.IP}
+	}
+	return &d
+}
+
+// dialUDP connects a UDP socket to the backend of a QUIC flow: one of the
+// route's TCP backends, on the same port, or target when there is no
+// route, it has no such backends, or it falls back after all of them
+// failed. The returned release function must be called when the flow ends.
+func (s *Server) dialUDP(cfg *config.Config, r *config.SNIRoute, target, clientIP string) (*net.UDPConn, string, func(), error) {
+	ctx := context.Background()
+	d := s.udpDialer(cfg, r, clientIP)
+	if r != nil {
+		var errs []error
+		for _, b := range s.lb.order(r, clientIP) {
+			network, addr, err := config.BackendNetwork(b.Address)
+			if err != nil || network == "unix" {
+				continue // Unix sockets only carry TCP
+			}
+			state := s.lb.backend(b.Address)
+			conn, err := s.dialUDPAddr(ctx, d, addr)
+			if err != nil {
+				state.downUntil.Store(time.Now().Add(backendRetryAfter).UnixNano())
+				s.logger.Warn("SNI backend dial failed", "proto", "quic", "backend", b.Address, "route", r.SNI, "error", err)
+				errs = append(errs, err)
+				continue
+			}
+			state.downUntil.Store(0)
+			state.active.Add(1)
+			return conn, b.Address, func() { state.active.Add(-1) }, nil
+		}
+		if len(r.Targets()) > 0 && !r.Fallback {
+			return nil, target, nil, fmt.Errorf("no UDP backend for route %s: %w", r.SNI, errors.Join(errs...))
+		}
+	}
+	conn, err := s.dialUDPAddr(ctx, d, target)
+	return conn, target, func() {}, err
+}
+
+// dialUDPAddr connects to host:port, trying the resolved addresses of a
+// host name in Happy Eyeballs order until one is reachable.
+func (s *Server) dialUDPAddr(ctx context.Context, d *net.Dialer, address string) (*net.UDPConn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []netip.Addr{}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		addrs = append(addrs, ip)
+	} else if addrs, err = s.lookup(ctx, host); err != nil {
+		return nil, err
+	}
+	addrs = sourceFamily(addrs, d.LocalAddr)
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses for " + host + " in the source address family")
+	}
+	var errs []error
+	for _, a := range interleave(addrs) {
+		conn, err := d.DialContext(ctx, "udp", net.JoinHostPort(a.String(), port))
+		if err == nil {
+			return conn.(*net.UDPConn), nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// ListenAndServeQUIC listens on the configured quic_port and proxies QUIC
+// by the server name of its Initial packets until ctx is cancelled. It
+// returns nil at once when quic_port is unset.
+func (s *Server) ListenAndServeQUIC(ctx context.Context) error {
+	port := s.cfg.Get().QUICPort
+	if port == 0 {
+		return nil
+	}
+
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return fmt.Errorf("QUIC proxy: failed to listen: %w", err)
+	}
+	s.logger.Info("QUIC proxy started", "port", port)
+	return s.ServeQUIC(ctx, pc)
+}
+
+// ServeQUIC relays the QUIC flows arriving on pc until ctx is cancelled,
+// then closes them. Flows share the routes, connection limits and
+// accounting of Serve.
+func (s *Server) ServeQUIC(ctx context.Context, pc *net.UDPConn) error {
+	s.udpSelf.add(pc.LocalAddr())
+	q := &quicProxy{s: s, pc: pc, flows: make(map[netip.AddrPort]*quicFlow)}
+	go func() {
+		ticker := time.NewTicker(relayTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				s.logger.Info("QUIC proxy shutting down")
+				_ = pc.Close()
+				return
+			case now := <-ticker.C:
+				q.expire(now)
+			}
+		}
+	}()
+
+	buf := make([]byte, maxQUICDatagram)
+	for {
+		n, from, err := pc.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				q.close()
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				q.close()
+				return err
+			}
+			continue
+		}
+		q.handle(buf[:n], from)
+	}
+}
@@ -0,0 +1,172 @@
+package sniproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"smartSNI/config"
+	"smartSNI/metrics"
+)
+
+// udpEcho serves a UDP echo backend on a local port.
+func udpEcho(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, maxQUICDatagram)
+		for {
+			n, from, err := pc.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteToUDPAddrPort(buf[:n], from)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// quicDatagrams returns the two Initial datagrams of a client connecting
+// to serverName, which split its ClientHello.
+func quicDatagrams(t *testing.T, serverName string) [][]byte {
+	hello := quicClientHello(t, serverName)
+	dcid := []byte{8, 7, 6, 5, 4, 3, 2, 1}
+	half := len(hello) / 2
+	return [][]byte{
+		sealInitial(t, quicVersion1, dcid, 0, cryptoFrame(0, hello[:half])),
+		sealInitial(t, quicVersion1, dcid, 1, cryptoFrame(half, hello[half:])),
+	}
+}
+
+// sendQUIC sends datagrams from a new client socket and returns the
+// datagrams received back within wait.
+func sendQUIC(t *testing.T, proxy string, datagrams [][]byte, want int, wait time.Duration) [][]byte {
+	t.Helper()
+	conn, err := net.Dial("udp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, d := range datagrams {
+		if _, err := conn.Write(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got [][]byte
+	buf := make([]byte, maxQUICDatagram)
+	_ = conn.SetReadDeadline(time.Now().Add(wait))
+	for len(got) < want {
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		got = append(got, append([]byte(nil), buf[:n]...))
+	}
+	return got
+}
+
+func TestQUICProxy(t *testing.T) {
+	backend := udpEcho(t)
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := metrics.New()
+	s := New(Options{
+		Config: config.NewStore(&config.Config{SNIRoutes: []config.SNIRoute{
+			{SNI: "quic.test", Backend: backend},
+			{SNI: "blocked.test", Block: true},
+			{SNI: "loop.test", Backend: pc.LocalAddr().String()},
+		}}),
+		Metrics: m,
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.ServeQUIC(ctx, pc) }()
+	proxy := pc.LocalAddr().String()
+
+	// Both Initials and a short header packet sent before the backend is
+	// dialled come back in order
+	sent := append(quicDatagrams(t, "quic.test"), []byte{0x40, 1, 2, 3})
+	got := sendQUIC(t, proxy, sent, len(sent), 5*time.Second)
+	if len(got) != len(sent) {
+		t.Fatalf("got %d datagrams back, want %d", len(got), len(sent))
+	}
+	for i := range sent {
+		if !bytes.Equal(got[i], sent[i]) {
+			t.Errorf("datagram %d changed", i)
+		}
+	}
+	conns := s.Connections()
+	if len(conns) != 1 || conns[0].Proto != "quic" || conns[0].SNI != "quic.test" || conns[0].Backend != backend {
+		t.Fatalf("connections: %+v", conns)
+	}
+	if conns[0].BytesIn != int64(len(sent[0])+len(sent[1])+len(sent[2])) {
+		t.Errorf("bytes in: %d", conns[0].BytesIn)
+	}
+
+	if got := sendQUIC(t, proxy, quicDatagrams(t, "blocked.test"), 1, 300*time.Millisecond); len(got) != 0 {
+		t.Error("blocked flow relayed")
+	}
+	if got := sendQUIC(t, proxy, quicDatagrams(t, "loop.test"), 1, 300*time.Millisecond); len(got) != 0 {
+		t.Error("looping flow relayed")
+	}
+	if got := sendQUIC(t, proxy, [][]byte{make([]byte, minQUICInitial)}, 1, 100*time.Millisecond); len(got) != 0 {
+		t.Error("garbage relayed")
+	}
+	stats := m.GetStats()
+	if stats["quic_sessions"] != 1 || stats["sni_blocked"] != 1 || stats["sni_self_loops"] != 1 {
+		t.Errorf("stats: %v", stats)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeQUIC did not return")
+	}
+	if n := len(s.Connections()); n != 0 {
+		t.Errorf("%d flows left after shutdown", n)
+	}
+}
+
+func TestQUICIdleTimeout(t *testing.T) {
+	backend := udpEcho(t)
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(Options{
+		Config: config.NewStore(&config.Config{
+			SNIIdleTimeout: 1,
+			SNIRoutes:      []config.SNIRoute{{SNI: "quic.test", Backend: backend}},
+		}),
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = s.ServeQUIC(ctx, pc) }()
+
+	if got := sendQUIC(t, pc.LocalAddr().String(), quicDatagrams(t, "quic.test"), 2, 5*time.Second); len(got) != 2 {
+		t.Fatalf("got %d datagrams back", len(got))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.Connections()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle flow not expired")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,143 @@
+package sniproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ======================== Relay ========================
+
+// 16KB tends to work well for TLS/DNS framing
+const relayBufferSize = 16 * 1024
+
+// Reusable buffer for relays that cannot splice
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, relayBufferSize)
+	},
+}
+
+// A spliced copy reports its bytes when it has moved relayChunk or has
+// waited relayTick, so byte counters stay current whatever the traffic.
+const (
+	relayChunk = 1 << 20
+	relayTick  = time.Second
+)
+
+// closeWrite half-closes TCP and unix socket connections.
+func closeWrite(c net.Conn) {
+	if hc, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = hc.CloseWrite()
+	}
+}
+
+// spliceable reports whether dst.ReadFrom(src) moves data with splice(2)
+// on Linux, without copying it through userspace.
+func spliceable(dst, src net.Conn) bool {
+	if _, ok := dst.(*net.TCPConn); !ok {
+		return false
+	}
+	switch src.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+// copyChunk copies up to relayChunk bytes from src to dst, with splice when
+// buf is nil and through buf otherwise, pacing writes with th when set. It
+// returns io.EOF once src is done.
+func copyChunk(dst, src net.Conn, buf []byte, th *throttle) (int64, error) {
+	if buf == nil {
+		lr := &io.LimitedReader{R: src, N: relayChunk}
+		n, err := dst.(*net.TCPConn).ReadFrom(lr)
+		if err == nil && lr.N > 0 {
+			err = io.EOF
+		}
+		return n, err
+	}
+	n, err := src.Read(buf)
+	if n > 0 {
+		if th != nil {
+			th.wait(n)
+		}
+		if _, werr := dst.Write(buf[:n]); werr != nil {
+			return int64(n), werr
+		}
+	}
+	return int64(n), err
+}
+
+// direction configures one way of a relay: count sees every chunk and
+// throttle, when set, paces it.
+type direction struct {
+	count    func(int64)
+	throttle *throttle
+}
+
+// copyConn copies src to dst, then half-closes dst. With an idle timeout,
+// the relay ends once neither direction has moved data for about idle,
+// tracked in last. Throttled copies go through a buffer, never splice.
+func copyConn(dst, src net.Conn, idle time.Duration, last *atomic.Int64, dir direction) {
+	var buf []byte
+	wait := idle
+	if dir.throttle != nil || !spliceable(dst, src) {
+		buf = bufferPool.Get().([]byte)
+		defer bufferPool.Put(buf)
+		if dir.throttle != nil {
+			buf = buf[:min(len(buf), dir.throttle.chunk)]
+		}
+	} else if wait <= 0 || wait > relayTick {
+		wait = relayTick
+	}
+
+	for {
+		if wait > 0 {
+			_ = src.SetReadDeadline(time.Now().Add(wait))
+		}
+		n, err := copyChunk(dst, src, buf, dir.throttle)
+		if n > 0 {
+			last.Store(time.Now().UnixNano())
+			dir.count(n)
+		}
+		if err == nil {
+			continue
+		}
+		var ne net.Error
+		if wait <= 0 || !errors.As(err, &ne) || !ne.Timeout() {
+			break
+		}
+		// A spliced copy reports its bytes up to min(idle, relayTick) late
+		if idle <= 0 || time.Since(time.Unix(0, last.Load())) < idle+min(idle, relayTick) {
+			continue // a tick, or still busy in one direction
+		}
+		// Idle in both directions
+		_ = src.Close()
+		_ = dst.Close()
+		return
+	}
+	closeWrite(dst)
+}
+
+// relay copies between client and backend in both directions until both
+// are done; in carries the client's bytes and out the backend's.
+func relay(client, backend net.Conn, idle time.Duration, in, out direction) {
+	var last atomic.Int64
+	last.Store(time.Now().UnixNano())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		copyConn(client, backend, idle, &last, out) // backend -> client
+	}()
+	go func() {
+		defer wg.Done()
+		copyConn(backend, client, idle, &last, in) // client -> backend
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,121 @@
+package sniproxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+	if b == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() { a.Close(); b.Close() })
+	return a, b
+}
+
+// opaqueConn hides the concrete type of a connection, disabling splice.
+type opaqueConn struct{ net.Conn }
+
+func TestSpliceable(t *testing.T) {
+	a, b := tcpPair(t)
+	if !spliceable(a, b) {
+		t.Error("TCP to TCP not spliceable")
+	}
+	if spliceable(opaqueConn{a}, b) || spliceable(a, opaqueConn{b}) {
+		t.Error("wrapped connection spliceable")
+	}
+}
+
+func TestCopyConnCounts(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 3*relayChunk/16+1000)
+	for name, wrap := range map[string]func(net.Conn) net.Conn{
+		"splice": func(c net.Conn) net.Conn { return c },
+		"buffer": func(c net.Conn) net.Conn { return opaqueConn{c} },
+	} {
+		in, src := tcpPair(t)
+		dst, out := tcpPair(t)
+		go func() {
+			_, _ = in.Write(payload)
+			in.Close()
+		}()
+
+		var last atomic.Int64
+		var counted, calls int64
+		done := make(chan struct{})
+		go func() {
+			copyConn(dst, wrap(src), 0, &last, direction{count: func(n int64) { counted += n; calls++ }})
+			close(done)
+		}()
+		got, err := io.ReadAll(out)
+		<-done
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Errorf("%s: received %d bytes, want %d", name, len(got), len(payload))
+		}
+		if counted != int64(len(payload)) {
+			t.Errorf("%s: counted %d bytes, want %d", name, counted, len(payload))
+		}
+		if calls < 4 {
+			t.Errorf("%s: %d count updates for %d bytes", name, calls, len(payload))
+		}
+	}
+}
+
+// benchmarkRelay pushes b.N chunks of 64KB through copyConn between two
+// loopback connections.
+func benchmarkRelay(b *testing.B, wrap func(net.Conn) net.Conn) {
+	in, src := tcpPair(b)
+	dst, out := tcpPair(b)
+	chunk := make([]byte, 64*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+
+	var last atomic.Int64
+	go copyConn(dst, wrap(src), time.Minute, &last, direction{count: func(int64) {}})
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, out)
+		close(done)
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := in.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	in.Close()
+	<-done
+}
+
+func BenchmarkRelay(b *testing.B) {
+	b.Run("splice", func(b *testing.B) {
+		benchmarkRelay(b, func(c net.Conn) net.Conn { return c })
+	})
+	b.Run("buffer", func(b *testing.B) {
+		benchmarkRelay(b, func(c net.Conn) net.Conn { return opaqueConn{c} })
+	})
+}
@@ -0,0 +1,215 @@
+package sniproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// ======================== Backend Resolution ========================
+
+// Resolver resolves backend host names. dnsserver.Server implements it
+// with its upstream path, bypassing our own Domains answers.
+type Resolver interface {
+	LookupUpstream(ctx context.Context, host string) ([]netip.Addr, time.Duration, error)
+}
+
+// systemResolver is used when Options.Resolver is nil.
+type systemResolver struct{}
+
+func (systemResolver) LookupUpstream(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	return addrs, time.Minute, err
+}
+
+// Resolved addresses are kept between these bounds whatever their TTL, and
+// the cache is emptied when it grows past maxCachedHosts.
+const (
+	minAddrTTL     = 5 * time.Second
+	maxAddrTTL     = 5 * time.Minute
+	maxCachedHosts = 10000
+)
+
+type cachedAddrs struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// addrCache remembers backend addresses by host name.
+type addrCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedAddrs
+}
+
+func (c *addrCache) get(host string, now time.Time) ([]netip.Addr, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[host]
+	if !ok || now.After(e.expires) {
+		return nil, false
+	}
+	return e.addrs, true
+}
+
+func (c *addrCache) put(host string, addrs []netip.Addr, ttl time.Duration, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil || len(c.entries) >= maxCachedHosts {
+		c.entries = make(map[string]cachedAddrs)
+	}
+	c.entries[host] = cachedAddrs{addrs: addrs, expires: now.Add(min(max(ttl, minAddrTTL), maxAddrTTL))}
+}
+
+// lookup returns the addresses of host, from the cache when possible.
+func (s *Server) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	now := time.Now()
+	if addrs, ok := s.addrs.get(host, now); ok {
+		return addrs, nil
+	}
+	addrs, ttl, err := s.resolver.LookupUpstream(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	s.addrs.put(host, addrs, ttl, now)
+	s.logger.Debug("SNI backend resolved", "host", host, "addrs", addrs, "ttl", ttl)
+	return addrs, nil
+}
+
+// happyEyeballsDelay is the RFC 8305 Connection Attempt Delay.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// interleave orders addrs for Happy Eyeballs: alternating families,
+// starting with IPv6 (RFC 8305 section 4).
+func interleave(addrs []netip.Addr) []netip.Addr {
+	var v6, v4 []netip.Addr
+	for _, a := range addrs {
+		if a.Is4() || a.Is4In6() {
+			v4 = append(v4, a.Unmap())
+		} else {
+			v6 = append(v6, a)
+		}
+	}
+	out := make([]netip.Addr, 0, len(addrs))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			out = append(out, v6[i])
+		}
+		if i < len(v4) {
+			out = append(out, v4[i])
+		}
+	}
+	return out
+}
+
+// happyEyeballs connects to port on the first of addrs to answer, starting
+// a new attempt whenever the previous one fails or has been pending for
+// happyEyeballsDelay.
+func happyEyeballs(ctx context.Context, d *net.Dialer, addrs []netip.Addr, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(addrs[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			results <- result{conn, err}
+		}()
+	}
+
+	var errs []error
+	start()
+	for pending > 0 {
+		var delay <-chan time.Time
+		if next < len(addrs) {
+			delay = time.After(happyEyeballsDelay)
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close connections that lose the race
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			errs = append(errs, r.err)
+			if next < len(addrs) {
+				start()
+			}
+		case <-delay:
+			start()
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// resolvingDialer dials TCP host names with addresses from the proxy's
+// resolver and Happy Eyeballs; IP literals and other networks go straight
+// to the underlying dialer.
+type resolvingDialer struct {
+	s *Server
+	d *net.Dialer
+}
+
+func (r *resolvingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || network != "tcp" {
+		return r.d.DialContext(ctx, network, addr)
+	}
+	if _, err := netip.ParseAddr(host); err == nil || host == "localhost" {
+		return r.d.DialContext(ctx, network, addr)
+	}
+
+	addrs, err := r.s.lookup(ctx, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	addrs = sourceFamily(addrs, r.d.LocalAddr)
+	if len(addrs) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("no addresses for " + host + " in the source address family")}
+	}
+	return happyEyeballs(ctx, r.d, interleave(addrs), port)
+}
+
+// sourceFamily returns the addresses a dialer bound to local can reach:
+// all of them when it is unbound, else those of its family.
+func sourceFamily(addrs []netip.Addr, local net.Addr) []netip.Addr {
+	var ip net.IP
+	switch a := local.(type) {
+	case *net.TCPAddr:
+		if a != nil {
+			ip = a.IP
+		}
+	case *net.UDPAddr:
+		if a != nil {
+			ip = a.IP
+		}
+	}
+	if ip == nil {
+		return addrs
+	}
+	want4 := ip.To4() != nil
+	filtered := addrs[:0:0]
+	for _, a := range addrs {
+		if a.Unmap().Is4() == want4 {
+			filtered = append(filtered, a)
+		}
+	}
+	return filtered
+}
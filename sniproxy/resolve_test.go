@@ -0,0 +1,122 @@
+package sniproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"smartSNI/config"
+)
+
+// fakeResolver answers every name with addrs and counts lookups.
+type fakeResolver struct {
+	addrs   []netip.Addr
+	lookups atomic.Int32
+}
+
+func (f *fakeResolver) LookupUpstream(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	f.lookups.Add(1)
+	if host == "nxdomain.test" {
+		return nil, 0, errors.New("NXDOMAIN")
+	}
+	return f.addrs, time.Minute, nil
+}
+
+func TestInterleave(t *testing.T) {
+	var addrs []netip.Addr
+	for _, a := range []string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "::ffff:192.0.2.3", "2001:db8::2", "2001:db8::3"} {
+		addrs = append(addrs, netip.MustParseAddr(a))
+	}
+	want := "[2001:db8::1 192.0.2.1 2001:db8::2 192.0.2.2 2001:db8::3 192.0.2.3]"
+	if got := fmt.Sprint(interleave(addrs)); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestHappyEyeballsRacesPastSlowAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// The first address hangs like a black-holed IPv6 route
+	d := &net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		if network == "tcp6" {
+			time.Sleep(2 * time.Second)
+			return errors.New("unreachable")
+		}
+		return nil
+	}}
+	start := time.Now()
+	conn, err := happyEyeballs(context.Background(), d, []netip.Addr{netip.MustParseAddr("::1"), netip.MustParseAddr("127.0.0.1")}, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > time.Second || elapsed < happyEyeballsDelay {
+		t.Fatalf("connected after %v, want just past the attempt delay", elapsed)
+	}
+
+	// Refused attempts move on at once
+	ln.Close()
+	if _, err := happyEyeballs(context.Background(), &net.Dialer{}, []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("127.0.0.2")}, port); err == nil {
+		t.Fatal("dial to closed port succeeded")
+	}
+}
+
+func TestResolvingDialerCachesLookups(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	res := &fakeResolver{addrs: []netip.Addr{netip.MustParseAddr("127.0.0.1")}}
+	s := New(Options{Config: config.NewStore(&config.Config{}), Logger: slog.New(slog.NewTextHandler(io.Discard, nil)), Resolver: res})
+	d := &resolvingDialer{s: s, d: s.dialer}
+	for i := 0; i < 3; i++ {
+		conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("backend.test", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if n := res.lookups.Load(); n != 1 {
+		t.Fatalf("%d lookups, want 1", n)
+	}
+
+	// IP literals skip the resolver; failures are not cached
+	conn, err := d.DialContext(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := d.DialContext(context.Background(), "tcp", "nxdomain.test:443"); err == nil {
+			t.Fatal("unresolvable name dialled")
+		}
+	}
+	if n := res.lookups.Load(); n != 3 {
+		t.Fatalf("%d lookups, want 3", n)
+	}
+}
@@ -0,0 +1,156 @@
+package sniproxy
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+
+	"smartSNI/config"
+)
+
+// ======================== Self-Loop Guard ========================
+
+// errSelfLoop is returned for dials to one of the proxy's own listeners.
+var errSelfLoop = errors.New("backend is this proxy")
+
+// interfaceRefresh is how often wildcard listeners re-read the host's
+// interface addresses.
+const interfaceRefresh = time.Minute
+
+// selfAddrs is the set of addresses the proxy accepts connections on. A
+// listener bound to a wildcard address covers every interface address.
+type selfAddrs struct {
+	mu        sync.Mutex
+	exact     map[netip.AddrPort]bool
+	ports     map[uint16]bool // ports of all listeners
+	wildPorts map[uint16]bool
+	ifaces    map[netip.Addr]bool
+	refreshed time.Time
+}
+
+func (s *selfAddrs) add(addr net.Addr) {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ports == nil {
+		s.ports = make(map[uint16]bool)
+	}
+	s.ports[ap.Port()] = true
+	if ap.Addr().IsUnspecified() {
+		if s.wildPorts == nil {
+			s.wildPorts = make(map[uint16]bool)
+		}
+		s.wildPorts[ap.Port()] = true
+		return
+	}
+	if s.exact == nil {
+		s.exact = make(map[netip.AddrPort]bool)
+	}
+	s.exact[netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())] = true
+}
+
+// contains reports whether a connection to ap would reach one of our
+// listeners.
+func (s *selfAddrs) contains(ap netip.AddrPort) bool {
+	ip := ap.Addr().Unmap()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.exact[netip.AddrPortFrom(ip, ap.Port())] {
+		return true
+	}
+	if !s.wildPorts[ap.Port()] {
+		return false
+	}
+	if ip.IsUnspecified() || ip.IsLoopback() {
+		return true
+	}
+	if now := time.Now(); now.Sub(s.refreshed) > interfaceRefresh {
+		s.ifaces = interfaceAddrs()
+		s.refreshed = now
+	}
+	return s.ifaces[ip]
+}
+
+// listens reports whether any listener is bound to port.
+func (s *selfAddrs) listens(port uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ports[port]
+}
+
+// isDomainTarget reports whether ip is the target of a domains or
+// domain_sets entry. Those send clients to this proxy, so behind 1:1 NAT
+// they hold its public address, which no interface carries.
+func isDomainTarget(cfg *config.Config, ip netip.Addr) bool {
+	match := func(domains map[string]string) bool {
+		for _, target := range domains {
+			if a, err := netip.ParseAddr(target); err == nil && a.Unmap() == ip {
+				return true
+			}
+		}
+		return false
+	}
+	if match(cfg.Domains) {
+		return true
+	}
+	for _, set := range cfg.DomainSets {
+		if match(set.Domains) {
+			return true
+		}
+	}
+	return false
+}
+
+func interfaceAddrs() map[netip.Addr]bool {
+	out := make(map[netip.Addr]bool)
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return out
+	}
+	for _, a := range addrs {
+		if p, err := netip.ParsePrefix(a.String()); err == nil {
+			out[p.Addr().Unmap()] = true
+		}
+	}
+	return out
+}
+
+// loopGuard is a net.Dialer Control function refusing connections to our
+// own listeners, except to the local HTTPS target. It sees the final
+// address of every attempt, after resolution and Happy Eyeballs. Domain
+// targets count as our own addresses on every listener port.
+func (s *Server) loopGuard(network, address string, c syscall.RawConn) error {
+	self := &s.self
+	switch network {
+	case "tcp4", "tcp6":
+	case "udp4", "udp6":
+		self = &s.udpSelf
+	default:
+		return nil
+	}
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil || address == s.localTarget {
+		return nil
+	}
+	if self.contains(ap) || self.listens(ap.Port()) && isDomainTarget(s.cfg.Get(), ap.Addr().Unmap()) {
+		return errSelfLoop
+	}
+	return nil
+}
+
+// guardedControl chains the loop guard with the extra control of a source
+// address dialer.
+func (s *Server) guardedControl(extra func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if err := s.loopGuard(network, address, c); err != nil {
+			return err
+		}
+		return extra(network, address, c)
+	}
+}
@@ -0,0 +1,75 @@
+package sniproxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"testing"
+
+	"smartSNI/config"
+)
+
+func TestSelfAddrs(t *testing.T) {
+	var self selfAddrs
+	self.add(&net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 8443})
+	self.add(&net.TCPAddr{IP: net.IPv6unspecified, Port: 443})
+
+	for ap, want := range map[string]bool{
+		"192.0.2.10:8443":          true,
+		"[::ffff:192.0.2.10]:8443": true,
+		"192.0.2.10:443":           false, // not a local interface
+		"192.0.2.11:8443":          false,
+		"127.0.0.1:443":            true,
+		"[::1]:443":                true,
+		"0.0.0.0:443":              true,
+		"127.0.0.1:444":            false,
+	} {
+		if got := self.contains(netip.MustParseAddrPort(ap)); got != want {
+			t.Errorf("contains(%s) = %v, want %v", ap, got, want)
+		}
+	}
+
+	for ip := range interfaceAddrs() {
+		if !self.contains(netip.AddrPortFrom(ip, 443)) {
+			t.Errorf("interface address %s not covered by the wildcard listener", ip)
+		}
+	}
+}
+
+func TestLoopGuardDomainTargets(t *testing.T) {
+	// Behind 1:1 NAT the public address is only known from the domain
+	// targets handed out to clients
+	s := New(Options{Config: config.NewStore(&config.Config{
+		Domains:    map[string]string{"example.com": "203.0.113.5", "alias.test": "backend.test"},
+		DomainSets: map[string]config.DomainSet{"extra": {Domains: map[string]string{"*.example.net": "2001:db8::5"}}},
+	})})
+	s.self.add(&net.TCPAddr{IP: net.IPv4zero, Port: 443})
+
+	for _, tc := range []struct {
+		network, address string
+		want             error
+	}{
+		{"tcp4", "203.0.113.5:443", errSelfLoop},
+		{"tcp6", "[::ffff:203.0.113.5]:443", errSelfLoop},
+		{"tcp6", "[2001:db8::5]:443", errSelfLoop},
+		{"tcp4", "203.0.113.5:8443", nil}, // not a listener port
+		{"tcp4", "203.0.113.6:443", nil},
+		{"udp4", "203.0.113.5:443", nil}, // no QUIC listener
+	} {
+		if err := s.loopGuard(tc.network, tc.address, nil); err != tc.want {
+			t.Errorf("%s %s: got %v, want %v", tc.network, tc.address, err, tc.want)
+		}
+	}
+}
+
+func TestProxyRefusesToDialItself(t *testing.T) {
+	cfg := &config.Config{Host: "panel.test"}
+	proxy, m := startTestProxyConfig(t, cfg, "127.0.0.1:1")
+	cfg.SNIRoutes = []config.SNIRoute{{SNI: "loop.test", Backend: proxy}}
+
+	sendHello(t, proxy, &tls.Config{ServerName: "loop.test"})
+	stats := m.GetStats()
+	if stats["sni_self_loops"] != 1 || stats["sni_connections"] != 1 {
+		t.Fatalf("loop not refused at the first hop: %v", stats)
+	}
+}
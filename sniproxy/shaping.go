@@ -0,0 +1,110 @@
+package sniproxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"smartSNI/config"
+)
+
+// ======================== Bandwidth Shaping ========================
+
+// minShapedChunk is the smallest read of a shaped relay, unless a bucket
+// is smaller.
+const minShapedChunk = 512
+
+// bucket is the token bucket of one sni_rate_limits rule for one client
+// (or for everyone, when the rule is shared), per direction.
+type bucket struct {
+	in, out *rate.Limiter
+	refs    int
+}
+
+// shaper keeps the buckets of live connections, so concurrent connections
+// of a client draw from the same ones.
+type shaper struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// throttle paces one direction of a relay to every bucket it draws from.
+type throttle struct {
+	limiters []*rate.Limiter
+	chunk    int                 // largest read, so one wait never exceeds a bucket
+	waited   func(time.Duration) // reports time spent waiting for tokens
+}
+
+// wait blocks until n bytes may pass.
+func (t *throttle) wait(n int) {
+	now := time.Now()
+	var d time.Duration
+	for _, l := range t.limiters {
+		d = max(d, l.ReserveN(now, n).DelayFrom(now))
+	}
+	if d > 0 {
+		time.Sleep(d)
+		t.waited(d)
+	}
+}
+
+// acquire returns the throttles for the two directions of a connection
+// (nil when no rule applies) and the lowest rate among its rules. release
+// must be called when the connection ends.
+func (sh *shaper) acquire(rules []config.SNIRateLimit, sni, user, plan, clientIP string) (in, out *throttle, limit int64, release func()) {
+	client := user
+	if client == "" {
+		client = clientIP
+	}
+	var keys []string
+	chunk := int64(relayBufferSize)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for i := range rules {
+		l := &rules[i]
+		if !l.Matches(sni, user, plan) {
+			continue
+		}
+		burst := l.BurstBytes()
+		key := fmt.Sprintf("%s|%s|%s|%d|%d", l.SNI, l.User, l.Plan, l.Rate, burst)
+		if !l.Shared {
+			key += "|" + client
+		}
+		b, ok := sh.buckets[key]
+		if !ok {
+			if sh.buckets == nil {
+				sh.buckets = make(map[string]*bucket)
+			}
+			b = &bucket{
+				in:  rate.NewLimiter(rate.Limit(l.Rate), int(burst)),
+				out: rate.NewLimiter(rate.Limit(l.Rate), int(burst)),
+			}
+			sh.buckets[key] = b
+		}
+		b.refs++
+		keys = append(keys, key)
+		if in == nil {
+			in, out, limit = &throttle{}, &throttle{}, l.Rate
+		}
+		in.limiters = append(in.limiters, b.in)
+		out.limiters = append(out.limiters, b.out)
+		limit = min(limit, l.Rate)
+		chunk = min(chunk, burst, max(l.Rate/8, minShapedChunk))
+	}
+	if in != nil {
+		in.chunk, out.chunk = int(chunk), int(chunk)
+	}
+	return in, out, limit, func() {
+		sh.mu.Lock()
+		defer sh.mu.Unlock()
+		for _, key := range keys {
+			if b := sh.buckets[key]; b != nil {
+				if b.refs--; b.refs <= 0 {
+					delete(sh.buckets, key)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package sniproxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"smartSNI/config"
+)
+
+func TestShaperBuckets(t *testing.T) {
+	rules := []config.SNIRateLimit{
+		{Plan: "basic", Rate: 1000},
+		{SNI: "*.video.test", Rate: 50000, Shared: true},
+	}
+	var sh shaper
+
+	a1, _, limit, release1 := sh.acquire(rules, "www.video.test", "alice", "basic", "198.51.100.1")
+	a2, _, _, release2 := sh.acquire(rules, "other.test", "alice", "basic", "198.51.100.2")
+	b, _, _, release3 := sh.acquire(rules, "cdn.video.test", "bob", "basic", "198.51.100.3")
+	if limit != 1000 || len(a1.limiters) != 2 || len(a2.limiters) != 1 || len(b.limiters) != 2 {
+		t.Fatalf("limit %d, limiters %d/%d/%d", limit, len(a1.limiters), len(a2.limiters), len(b.limiters))
+	}
+	if a1.limiters[0] != a2.limiters[0] {
+		t.Error("connections of one user do not share the plan bucket")
+	}
+	if a1.limiters[0] == b.limiters[0] {
+		t.Error("two users share a per-client bucket")
+	}
+	if a1.limiters[1] != b.limiters[1] {
+		t.Error("shared rule gives separate buckets")
+	}
+	if a1.chunk > 1000 {
+		t.Errorf("chunk %d exceeds the 1000 byte bucket", a1.chunk)
+	}
+
+	if in, out, _, release := sh.acquire(rules, "other.test", "", "", "198.51.100.4"); in != nil || out != nil {
+		t.Error("unmatched connection throttled")
+	} else {
+		release()
+	}
+	release1()
+	release2()
+
+	// Buckets live only while a connection uses them: a new connection
+	// starts with a full bucket, while a live one keeps sharing its own
+	a3, _, _, release4 := sh.acquire(rules, "www.video.test", "alice", "basic", "198.51.100.1")
+	defer release4()
+	if a3.limiters[0] == a1.limiters[0] {
+		t.Error("plan bucket kept after its connections ended")
+	}
+	if a3.limiters[1] != b.limiters[1] {
+		t.Error("shared bucket replaced while in use")
+	}
+	release3()
+}
+
+func TestShapedRelay(t *testing.T) {
+	const size = 200 * 1024
+	backend := holdingBackend(t, func(c net.Conn) {
+		_, _ = c.Write(make([]byte, size))
+		_ = c.(*net.TCPConn).CloseWrite()
+		_, _ = io.Copy(io.Discard, c)
+	})
+	proxy, m := startTestProxyConfig(t, &config.Config{
+		SNIRoutes:     []config.SNIRoute{{SNI: "*", Backend: backend}},
+		SNIRateLimits: []config.SNIRateLimit{{Rate: 200 * 1024, Burst: 16 * 1024}},
+	}, "127.0.0.1:1")
+
+	// Two connections of one client share its 200KB/s
+	start := time.Now()
+	var wg sync.WaitGroup
+	took := make([]time.Duration, 2)
+	for i := range took {
+		conn := openRelay(t, proxy, "video.test")
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			if n, err := io.Copy(io.Discard, conn); n != size || err != nil {
+				t.Errorf("read %d bytes: %v", n, err)
+			}
+			took[i] = time.Since(start)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, d := range took {
+		if d < 1500*time.Millisecond || d > 4*time.Second {
+			t.Errorf("transfers took %v, want about 2s at the shared rate", took)
+			break
+		}
+	}
+	if diff := took[0] - took[1]; diff > 500*time.Millisecond || diff < -500*time.Millisecond {
+		t.Errorf("unfair share: transfers took %v", took)
+	}
+	bySNI, _ := m.SNITraffic()
+	if bySNI["video.test"].Throttled <= 0 {
+		t.Error("throttling not recorded")
+	}
+}
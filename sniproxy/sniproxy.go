@@ -0,0 +1,373 @@
+// Package sniproxy relays TLS connections to the host named in the
+// ClientHello's server_name extension without terminating TLS.
+package sniproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"smartSNI/config"
+	"smartSNI/internal/egress"
+	"smartSNI/metrics"
+	"smartSNI/users"
+)
+
+// Options configures a Server. Config is required; the rest default to
+// fresh instances.
+type Options struct {
+	Config  *config.Store
+	Users   *users.Store // users whose source_pool overrides the route's
+	Metrics *metrics.Metrics
+	Logger  *slog.Logger
+
+	// Resolver resolves backend host names (default: the system resolver).
+	Resolver Resolver
+
+	// LocalTarget receives connections for the configured host
+	// (default 127.0.0.1:8443, the local HTTPS server behind nginx).
+	LocalTarget string
+}
+
+// Server is an SNI proxy. Create it with New.
+type Server struct {
+	cfg           *config.Store
+	users         *users.Store
+	metrics       *metrics.Metrics
+	logger        *slog.Logger
+	localTarget   string
+	dialer        *net.Dialer
+	lb            *balancer
+	resolver      Resolver
+	addrs         addrCache
+	self          selfAddrs
+	udpSelf       selfAddrs // QUIC listeners
+	conns         connTracker
+	shaper        shaper
+	httpPort      string // backend port of the HTTP proxy
+	httpPrivateOK bool   // let the HTTP proxy reach private addresses (tests)
+}
+
+// New creates a Server from opts.
+func New(opts Options) *Server {
+	s := &Server{
+		cfg:         opts.Config,
+		users:       opts.Users,
+		metrics:     opts.Metrics,
+		logger:      opts.Logger,
+		localTarget: opts.LocalTarget,
+		dialer: &net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+		lb:       newBalancer(),
+		resolver: opts.Resolver,
+		httpPort: "80",
+	}
+	if s.metrics == nil {
+		s.metrics = metrics.New()
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+	s.dialer.Control = s.loopGuard
+	if s.resolver == nil {
+		s.resolver = systemResolver{}
+	}
+	if s.localTarget == "" {
+		s.localTarget = "127.0.0.1:8443"
+	}
+	return s
+}
+
+// ======================== TCP Proxy (SNI) ========================
+
+// clientUser returns the ID and plan of the registered user connecting
+// from clientIP, or empty strings.
+func (s *Server) clientUser(clientIP string) (id, plan string) {
+	if s.users == nil {
+		return "", ""
+	}
+	if u := s.users.ByIP(clientIP); u != nil {
+		return u.ID, u.Plan
+	}
+	return "", ""
+}
+
+// echAllowed counts a ClientHello offering Encrypted Client Hello and
+// applies sni_ech_policy to it. Such a hello only names the client-facing
+// server, so by default it is routed like any connection to that name.
+func (s *Server) echAllowed(cfg *config.Config, hello *ClientHelloInfo, proto, sni, clientAddr string) bool {
+	if !hello.ECH {
+		return true
+	}
+	s.metrics.IncSNIECH()
+	if cfg.SNIECHPolicy == config.ECHPolicyBlock {
+		s.logger.Info("SNI connection blocked for offering ECH", "proto", proto, "sni", sni, "client", clientAddr)
+		s.metrics.IncSNIBlocked()
+		return false
+	}
+	s.logger.Debug("SNI connection offers ECH, routing by the outer name", "proto", proto, "sni", sni, "client", clientAddr)
+	return true
+}
+
+// matchRoute returns the first sni_routes entry matching the connection, or
+// nil.
+func matchRoute(cfg *config.Config, sni string, alpn []string) *config.SNIRoute {
+	for i := range cfg.SNIRoutes {
+		if r := &cfg.SNIRoutes[i]; r.Matches(sni, alpn) {
+			return r
+		}
+	}
+	return nil
+}
+
+// defaultTarget is where connections no route handles go: the local HTTPS
+// server for the configured host, otherwise the server name itself.
+func (s *Server) defaultTarget(cfg *config.Config, sni string) string {
+	if sni == strings.ToLower(cfg.Host) {
+		return s.localTarget
+	}
+	return net.JoinHostPort(sni, "443")
+}
+
+// dial connects to the backend for a connection: one of the matching
+// route's backends, or target when there is no route, the route only sets
+// an egress, or it falls back after all its backends failed. The returned
+// release function must be called when the connection ends.
+func (s *Server) dial(cfg *config.Config, r *config.SNIRoute, target, clientIP string) (net.Conn, string, func(), error) {
+	ctx := context.Background()
+	base := &resolvingDialer{s: s, d: s.sourceDialer(cfg, r, clientIP)}
+	if r == nil {
+		conn, err := base.DialContext(ctx, "tcp", target)
+		return conn, target, func() {}, err
+	}
+
+	var d egress.ContextDialer = base
+	if len(r.Egress) > 0 {
+		ed, err := egress.New(r.Egress, base)
+		if err != nil {
+			return nil, target, nil, err
+		}
+		d = ed
+	}
+	if len(r.Targets()) == 0 {
+		conn, err := d.DialContext(ctx, "tcp", target)
+		return conn, target, func() {}, err
+	}
+
+	conn, addr, release, err := s.dialRoute(ctx, d, r, clientIP)
+	if err == nil || !r.Fallback {
+		return conn, addr, release, err
+	}
+	s.logger.Warn("SNI route backends unavailable, falling back", "target", target, "route", r.SNI, "error", err)
+	conn, err = base.DialContext(ctx, "tcp", target)
+	return conn, target, func() {}, err
+}
+
+func (s *Server) handleConnection(clientConn net.Conn) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Error("panic in SNI handler", "error", r, "stack", string(debug.Stack()))
+			s.metrics.IncErrors()
+		}
+		clientConn.Close()
+	}()
+
+	s.metrics.IncSNIConnections()
+	clientAddr := clientConn.RemoteAddr().String()
+
+	s.logger.Debug("SNI connection", "client", clientAddr)
+
+	// Deadline only for initial ClientHello capture
+	_ = clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	hello, clientHelloBytes, err := peekClientHello(clientConn)
+	if err != nil {
+		s.logger.Debug("SNI peek failed", "error", err, "client", clientAddr)
+		s.metrics.IncErrors()
+		return
+	}
+	_ = clientConn.SetReadDeadline(time.Time{}) // clear deadline
+
+	sni := strings.TrimSpace(strings.ToLower(hello.ServerName))
+	if sni == "" {
+		s.logger.Warn("SNI missing from ClientHello", "client", clientAddr, "ja4", hello.JA4)
+		s.metrics.IncErrors()
+		// Meaningful HTTP error for non-TLS/empty SNI traffic
+		httpError(clientConn, 421, "Misdirected Request", "SNI required")
+		return
+	}
+
+	cfg := s.cfg.Get()
+	if cfg.SNILogClientHello {
+		s.logger.Info("client hello", "sni", sni, "client", clientAddr,
+			"alpn", hello.ALPN, "versions", hello.SupportedVersions, "ech", hello.ECH,
+			"ciphers", len(hello.CipherSuites), "ja3", hello.JA3, "ja4", hello.JA4)
+	} else {
+		s.logger.Debug("SNI detected", "sni", sni, "client", clientAddr, "alpn", hello.ALPN, "ja4", hello.JA4)
+	}
+
+	for _, fp := range cfg.SNIBlockedFP {
+		if hello.MatchesFingerprint(fp) {
+			s.logger.Warn("SNI connection blocked by fingerprint", "sni", sni, "client", clientAddr, "fingerprint", fp)
+			s.metrics.IncSNIBlocked()
+			return
+		}
+	}
+	if !s.echAllowed(cfg, hello, "tls", sni, clientAddr) {
+		return
+	}
+
+	route := matchRoute(cfg, sni, hello.ALPN)
+	if route != nil && route.Block {
+		s.logger.Info("SNI connection blocked by route", "sni", sni, "client", clientAddr, "alpn", hello.ALPN)
+		s.metrics.IncSNIBlocked()
+		return
+	}
+
+	clientIP, _, _ := net.SplitHostPort(clientAddr)
+	backendConn, target, release, err := s.dial(cfg, route, s.defaultTarget(cfg, sni), clientIP)
+	if errors.Is(err, errSelfLoop) {
+		s.logger.Warn("SNI backend is this proxy, refusing to loop", "sni", sni, "target", target, "client", clientAddr)
+		s.metrics.IncSNISelfLoops()
+		return
+	}
+	if err != nil {
+		s.logger.Warn("backend dial failed", "target", target, "error", err, "client", clientAddr)
+		s.metrics.IncErrors()
+		return
+	}
+	defer release()
+	s.pipe(cfg, clientConn, backendConn, ConnInfo{Proto: "tls", SNI: sni, Backend: target}, clientHelloBytes)
+}
+
+// pipe relays between a client and its backend until both sides are done,
+// after replaying first, the client bytes read while routing. info carries
+// the connection's Proto, SNI and Backend. Shaping, accounting and the
+// lifetime limit apply here.
+func (s *Server) pipe(cfg *config.Config, clientConn, backendConn net.Conn, info ConnInfo, first []byte) {
+	defer backendConn.Close()
+	clientAddr := clientConn.RemoteAddr().String()
+	name := info.SNI
+
+	if _, err := backendConn.Write(first); err != nil {
+		s.logger.Debug("failed to replay client bytes", "error", err, "client", clientAddr)
+		s.metrics.IncErrors()
+		return
+	}
+
+	s.logger.Debug("proxying connection", "proto", info.Proto, "sni", name, "target", info.Backend, "client", clientAddr)
+
+	clientIP, _, _ := net.SplitHostPort(clientAddr)
+	user, plan := s.clientUser(clientIP)
+	upThrottle, downThrottle, limit, releaseShaping := s.shaper.acquire(cfg.SNIRateLimits, name, user, plan, clientIP)
+	defer releaseShaping()
+	info.User, info.RateLimit = user, limit
+	tc := s.conns.attach(clientConn, backendConn, info)
+	if tc == nil {
+		tc = &trackedConn{} // connection handled outside Serve
+	}
+	in := direction{throttle: upThrottle, count: func(n int64) { tc.in.Add(n); s.metrics.AddSNITraffic(name, user, uint64(n), 0) }}
+	out := direction{throttle: downThrottle, count: func(n int64) { tc.out.Add(n); s.metrics.AddSNITraffic(name, user, 0, uint64(n)) }}
+	if in.throttle != nil {
+		waited := func(d time.Duration) { s.metrics.AddSNIThrottled(name, user, d) }
+		in.throttle.waited, out.throttle.waited = waited, waited
+	}
+	if cfg.SNIMaxLifetime > 0 {
+		t := time.AfterFunc(time.Duration(cfg.SNIMaxLifetime)*time.Second, func() {
+			s.logger.Debug("connection reached its maximum lifetime", "sni", name, "client", clientAddr)
+			_ = clientConn.Close()
+			_ = backendConn.Close()
+		})
+		defer t.Stop()
+	}
+
+	start := time.Now()
+	s.metrics.SNIConnStart(name, user)
+	tc.in.Add(int64(len(first)))
+	s.metrics.AddSNITraffic(name, user, uint64(len(first)), 0)
+	relay(clientConn, backendConn, time.Duration(cfg.SNIIdleTimeout)*time.Second, in, out)
+	s.metrics.SNIConnEnd(name, user, time.Since(start))
+	s.logger.Debug("connection closed", "proto", info.Proto, "sni", name, "client", clientAddr,
+		"bytes_in", tc.in.Load(), "bytes_out", tc.out.Load(), "duration", time.Since(start))
+}
+
+// ListenAndServe listens on the configured sni_port (default 443) and
+// serves until ctx is cancelled.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	sniPort := s.cfg.Get().SNIPort
+	if sniPort == 0 {
+		sniPort = 443
+	}
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", sniPort))
+	if err != nil {
+		return fmt.Errorf("SNI: failed to listen: %w", err)
+	}
+	s.logger.Info("SNI proxy started", "port", sniPort)
+	return s.Serve(ctx, ln)
+}
+
+// Serve accepts connections on ln until ctx is cancelled, then waits up to
+// sni_drain_timeout for open relays before closing them. The proxy refuses
+// to dial ln's address as a backend.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	return s.serve(ctx, ln, s.handleConnection)
+}
+
+// serve runs handle on every connection accepted on ln within the
+// connection limits, and drains when ctx is cancelled.
+func (s *Server) serve(ctx context.Context, ln net.Listener, handle func(net.Conn)) error {
+	s.self.add(ln.Addr())
+	go func() {
+		<-ctx.Done()
+		s.logger.Info("SNI proxy shutting down")
+		_ = ln.Close()
+	}()
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				s.drain()
+				return nil
+			}
+			s.logger.Warn("SNI accept error", "error", err)
+			continue
+		}
+
+		cfg := s.cfg.Get()
+		ip, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+		if !s.conns.acquire(c, ip, cfg.SNIMaxConns, cfg.SNIMaxConnsPerIP) {
+			s.logger.Debug("SNI connection limit reached", "client", ip)
+			s.metrics.IncSNIRejected()
+			_ = c.Close()
+			continue
+		}
+		go func() {
+			defer s.conns.release(c, ip)
+			handle(c)
+		}()
+	}
+}
+
+// drain lets open relays finish, up to the configured deadline.
+func (s *Server) drain() {
+	n := s.conns.active()
+	if n == 0 {
+		return
+	}
+	timeout := defaultDrainTimeout
+	if secs := s.cfg.Get().SNIDrainTimeout; secs > 0 {
+		timeout = time.Duration(secs) * time.Second
+	}
+	s.logger.Info("SNI proxy draining connections", "active", n, "timeout", timeout)
+	if !s.conns.drain(timeout) {
+		s.logger.Warn("SNI drain deadline passed, closed remaining connections")
+	}
+}
@@ -0,0 +1,311 @@
+package sniproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"smartSNI/config"
+	"smartSNI/metrics"
+)
+
+// startTestProxy runs a proxy that sends the configured host to backend.
+func startTestProxy(t *testing.T, backend string) (string, *metrics.Metrics) {
+	t.Helper()
+	return startTestProxyConfig(t, &config.Config{Host: "panel.test"}, backend)
+}
+
+func startTestProxyConfig(t *testing.T, cfg *config.Config, backend string) (string, *metrics.Metrics) {
+	t.Helper()
+	m := metrics.New()
+	s := New(Options{
+		Config:      config.NewStore(cfg),
+		Metrics:     m,
+		Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		LocalTarget: backend,
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve(ctx, ln)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return ln.Addr().String(), m
+}
+
+func TestProxyRelaysToLocalTarget(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello from "+strings.ToLower(r.TLS.ServerName))
+	}))
+	defer backend.Close()
+	proxy, m := startTestProxy(t, backend.Listener.Addr().String())
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "tcp", proxy)
+			},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	resp, err := client.Get("https://PANEL.test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello from panel.test" {
+		t.Fatalf("got %q", body)
+	}
+	if got := m.GetStats()["sni_connections"]; got != uint64(1) {
+		t.Fatalf("sni_connections = %v, want 1", got)
+	}
+}
+
+// fragmentingConn splits the first record it writes into small records sent
+// as separate TCP segments.
+type fragmentingConn struct {
+	net.Conn
+	done bool
+}
+
+func (c *fragmentingConn) Write(b []byte) (int, error) {
+	if c.done {
+		return c.Conn.Write(b)
+	}
+	c.done = true
+	records := fragment(b, 300)
+	for len(records) > 0 {
+		n := min(len(records), 1000)
+		if _, err := c.Conn.Write(records[:n]); err != nil {
+			return 0, err
+		}
+		records = records[n:]
+		time.Sleep(time.Millisecond)
+	}
+	return len(b), nil
+}
+
+func TestProxyFragmentedClientHello(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+	proxy, _ := startTestProxy(t, backend.Listener.Addr().String())
+
+	raw, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = raw.SetDeadline(time.Now().Add(5 * time.Second))
+	protos := make([]string, 200)
+	for i := range protos {
+		protos[i] = strings.Repeat("x", 30) + string(rune('a'+i%26)) + strings.Repeat("y", i%7)
+	}
+	protos = append(protos, "http/1.1")
+	conn := tls.Client(&fragmentingConn{Conn: raw}, &tls.Config{ServerName: "panel.test", NextProtos: protos, InsecureSkipVerify: true})
+	defer conn.Close()
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("handshake through proxy: %v", err)
+	}
+	_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: panel.test\r\nConnection: close\r\n\r\n")
+	reply, _ := io.ReadAll(conn)
+	if !strings.HasSuffix(string(reply), "\r\n\r\nok") {
+		t.Fatalf("got %q", reply)
+	}
+}
+
+func TestProxyRequiresSNI(t *testing.T) {
+	proxy, m := startTestProxy(t, "127.0.0.1:1")
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(helloFor(t, "192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+	reply, _ := io.ReadAll(conn)
+	if !strings.HasPrefix(string(reply), "HTTP/1.1 421 ") {
+		t.Fatalf("got %q, want 421 Misdirected Request", reply)
+	}
+	if m.GetStats()["errors"] != uint64(1) {
+		t.Fatalf("error not counted: %v", m.GetStats())
+	}
+}
+
+func TestProxyDropsNonTLS(t *testing.T) {
+	proxy, _ := startTestProxy(t, "127.0.0.1:1")
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: panel.test\r\n\r\n")
+	_ = conn.(*net.TCPConn).CloseWrite()
+	if reply, _ := io.ReadAll(conn); len(reply) != 0 {
+		t.Fatalf("non-TLS client got %q", reply)
+	}
+}
+
+// echoServer accepts one connection and returns its first bytes.
+func echoServer(t *testing.T) (string, <-chan []byte) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln.Addr().String(), firstBytes(t, ln)
+}
+
+// firstBytes accepts one connection on ln and sends the first five bytes
+// read from it.
+func firstBytes(t *testing.T, ln net.Listener) <-chan []byte {
+	t.Cleanup(func() { ln.Close() })
+	got := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 5)
+		n, _ := io.ReadFull(conn, buf)
+		got <- buf[:n]
+	}()
+	return got
+}
+
+// sendHello writes a ClientHello and waits for the proxy to close the
+// connection.
+func sendHello(t *testing.T, proxy string, cfg *tls.Config) {
+	t.Helper()
+	sendRecords(t, proxy, clientHello(t, cfg))
+}
+
+// sendRecords is sendHello for prepared ClientHello records.
+func sendRecords(t *testing.T, proxy string, records []byte) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(records); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.(*net.TCPConn).CloseWrite()
+	_, _ = io.ReadAll(conn)
+}
+
+func TestProxyRoutesByALPN(t *testing.T) {
+	h2, h2Got := echoServer(t)
+	other, otherGot := echoServer(t)
+	proxy, _ := startTestProxyConfig(t, &config.Config{
+		Host: "panel.test",
+		SNIRoutes: []config.SNIRoute{
+			{SNI: "*.example.com", ALPN: []string{"h2"}, Backend: h2},
+			{SNI: "*.example.com", Backend: other},
+		},
+	}, "127.0.0.1:1")
+
+	sendHello(t, proxy, &tls.Config{ServerName: "www.example.com", NextProtos: []string{"h2", "http/1.1"}})
+	sendHello(t, proxy, &tls.Config{ServerName: "www.example.com", NextProtos: []string{"http/1.1"}})
+	for name, ch := range map[string]<-chan []byte{"h2": h2Got, "other": otherGot} {
+		select {
+		case b := <-ch:
+			if len(b) == 0 || b[0] != recordTypeHandshake {
+				t.Errorf("%s backend got %x, want the ClientHello", name, b)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s backend got no connection", name)
+		}
+	}
+}
+
+func TestProxyBlocks(t *testing.T) {
+	backend, got := echoServer(t)
+	hello := clientHello(t, &tls.Config{ServerName: "tracker.example.com"})
+	info, err := ParseClientHello(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, cfg := range map[string]*config.Config{
+		"route": {SNIRoutes: []config.SNIRoute{
+			{SNI: "tracker.example.com", Block: true},
+			{SNI: "*", Backend: backend},
+		}},
+		"ja3": {SNIBlockedFP: []string{strings.ToUpper(info.JA3)}, SNIRoutes: []config.SNIRoute{{SNI: "*", Backend: backend}}},
+		"ja4": {SNIBlockedFP: []string{info.JA4}, SNIRoutes: []config.SNIRoute{{SNI: "*", Backend: backend}}},
+	} {
+		proxy, m := startTestProxyConfig(t, cfg, "127.0.0.1:1")
+		sendHello(t, proxy, &tls.Config{ServerName: "tracker.example.com"})
+		if m.GetStats()["sni_blocked"] != uint64(1) {
+			t.Errorf("%s: block not counted: %v", name, m.GetStats())
+		}
+	}
+	select {
+	case b := <-got:
+		t.Fatalf("blocked connection reached the backend: %x", b)
+	default:
+	}
+}
+
+func TestProxyECHPolicy(t *testing.T) {
+	hello := withExtension(helloFor(t, "public.example"), extensionECH, []byte{echClientHelloOuter, 0, 1, 0, 1, 7, 0, 0, 0, 1, 0})
+	for _, policy := range []string{config.ECHPolicyOuter, config.ECHPolicyBlock} {
+		backend, got := echoServer(t)
+		proxy, m := startTestProxyConfig(t, &config.Config{
+			SNIECHPolicy: policy,
+			SNIRoutes:    []config.SNIRoute{{SNI: "public.example", Backend: backend}},
+		}, "127.0.0.1:1")
+		sendRecords(t, proxy, hello)
+
+		stats := m.GetStats()
+		if stats["sni_ech"] != 1 {
+			t.Errorf("%s: ECH not counted: %v", policy, stats)
+		}
+		if policy == config.ECHPolicyBlock {
+			if stats["sni_blocked"] != 1 {
+				t.Errorf("block: not counted as blocked: %v", stats)
+			}
+			select {
+			case b := <-got:
+				t.Errorf("block: connection reached the backend: %x", b)
+			default:
+			}
+			continue
+		}
+		select {
+		case b := <-got:
+			if len(b) == 0 || b[0] != recordTypeHandshake {
+				t.Errorf("outer: backend got %x, want the ClientHello", b)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("outer: not routed by the outer name")
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package sniproxy
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/netip"
+
+	"smartSNI/config"
+)
+
+// ======================== Source Addresses ========================
+
+// addrIn returns the address of p whose host bits are the low bits of r.
+// The all-zeros host (the subnet-router anycast address in IPv6) and, for
+// IPv4, the broadcast address are avoided.
+func addrIn(p netip.Prefix, r uint64) netip.Addr {
+	b := p.Addr().AsSlice()
+	hostBits := len(b)*8 - p.Bits()
+	if hostBits == 0 {
+		return p.Addr()
+	}
+	n := min(hostBits, 64)
+	mask := uint64(1)<<n - 1
+	host := r & mask
+	if host == 0 {
+		host = 1
+	}
+	if p.Addr().Is4() && host == mask && hostBits > 1 {
+		host--
+	}
+	for i := len(b) - 1; n > 0; i, n = i-1, n-8 {
+		b[i] |= byte(host)
+		host >>= 8
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// pickSource chooses the local address for a client from pool. Sticky pools
+// hash the client IP, so a client keeps its address while the pool is
+// unchanged; others rotate through the entries and pick random addresses
+// inside prefixes.
+func (lb *balancer) pickSource(name string, pool config.AddrPool, clientIP string) (netip.Addr, error) {
+	prefixes := make([]netip.Prefix, 0, len(pool.Addrs))
+	for _, a := range pool.Addrs {
+		p, err := config.ParseSourceAddr(a)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	if len(prefixes) == 0 {
+		return netip.Addr{}, nil
+	}
+
+	var pick, host uint64
+	if pool.Sticky {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(clientIP))
+		pick = h.Sum64()
+		host = pick
+	} else {
+		pick = lb.counter("pool "+name).Add(1) - 1
+		host = rand.Uint64()
+	}
+	return addrIn(prefixes[pick%uint64(len(prefixes))], host), nil
+}
+
+// sourceDialer returns the dialer for a connection: s.dialer bound to an
+// address from the client's user pool or else the route's pool, or plain
+// s.dialer when neither sets one.
+func (s *Server) sourceDialer(cfg *config.Config, r *config.SNIRoute, clientIP string) *net.Dialer {
+	name := ""
+	if r != nil {
+		name = r.Source
+	}
+	if s.users != nil {
+		if u := s.users.ByIP(clientIP); u != nil && u.Valid() && u.SourcePool != "" {
+			name = u.SourcePool
+		}
+	}
+	pool, ok := cfg.SourcePools[name]
+	if !ok {
+		return s.dialer
+	}
+
+	addr, err := s.lb.pickSource(name, pool, clientIP)
+	if err != nil || !addr.IsValid() {
+		s.logger.Warn("SNI source pool unusable", "pool", name, "error", err)
+		return s.dialer
+	}
+	d := *s.dialer
+	d.LocalAddr = &net.TCPAddr{IP: addr.AsSlice()}
+	d.Control = s.guardedControl(freebindControl)
+	s.logger.Debug("SNI source address", "pool", name, "addr", addr, "client", clientIP)
+	return &d
+}
@@ -0,0 +1,121 @@
+package sniproxy
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"smartSNI/config"
+	"smartSNI/users"
+)
+
+func TestAddrIn(t *testing.T) {
+	for _, tc := range []struct {
+		prefix string
+		r      uint64
+		want   string
+	}{
+		{"203.0.113.7/32", 99, "203.0.113.7"},
+		{"203.0.113.0/29", 5, "203.0.113.5"},
+		{"203.0.113.0/29", 8, "203.0.113.1"}, // network address avoided
+		{"203.0.113.0/29", 7, "203.0.113.6"}, // broadcast avoided
+		{"2001:db8:1:2::/64", 0xdeadbeef00000042, "2001:db8:1:2:dead:beef:0:42"},
+		{"2001:db8:1:2::/64", 0, "2001:db8:1:2::1"},
+		{"2001:db8::/120", 0x1234, "2001:db8::34"},
+	} {
+		if got := addrIn(netip.MustParsePrefix(tc.prefix), tc.r); got.String() != tc.want {
+			t.Errorf("addrIn(%s, %#x) = %s, want %s", tc.prefix, tc.r, got, tc.want)
+		}
+	}
+}
+
+func TestPickSource(t *testing.T) {
+	lb := newBalancer()
+	v6 := netip.MustParsePrefix("2001:db8:1:2::/64")
+
+	sticky := config.AddrPool{Addrs: []string{"2001:db8:1:2::/64"}, Sticky: true}
+	a, _ := lb.pickSource("v6", sticky, "198.51.100.1")
+	b, _ := lb.pickSource("v6", sticky, "198.51.100.1")
+	c, _ := lb.pickSource("v6", sticky, "198.51.100.2")
+	if a != b || a == c || !v6.Contains(a) || !v6.Contains(c) {
+		t.Errorf("sticky: %s %s %s", a, b, c)
+	}
+
+	rotating := config.AddrPool{Addrs: []string{"2001:db8:1:2::/64"}}
+	seen := map[netip.Addr]bool{}
+	for i := 0; i < 10; i++ {
+		addr, _ := lb.pickSource("rot", rotating, "198.51.100.1")
+		if !v6.Contains(addr) {
+			t.Fatalf("%s outside %s", addr, v6)
+		}
+		seen[addr] = true
+	}
+	if len(seen) < 9 {
+		t.Errorf("rotation reused addresses: %d distinct of 10", len(seen))
+	}
+
+	list := config.AddrPool{Addrs: []string{"192.0.2.1", "192.0.2.2"}}
+	first, _ := lb.pickSource("list", list, "")
+	second, _ := lb.pickSource("list", list, "")
+	if first.String() != "192.0.2.1" || second.String() != "192.0.2.2" {
+		t.Errorf("round robin: %s, %s", first, second)
+	}
+}
+
+// sourceOf dials the backend the way the proxy would and reports the source
+// address the backend saw.
+func sourceOf(t *testing.T, s *Server, cfg *config.Config, r *config.SNIRoute, clientIP string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	r.Backend = ln.Addr().String()
+
+	conn, _, release, err := s.dial(cfg, r, "example.com:443", clientIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	defer conn.Close()
+	_ = ln.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	host, _, _ := net.SplitHostPort(peer.RemoteAddr().String())
+	return host
+}
+
+func TestDialFromSourcePool(t *testing.T) {
+	userStore := users.NewStore(nil)
+	u, err := userStore.Create("alice", "", 1, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := userStore.AddIP(u.ID, "198.51.100.9"); err != nil {
+		t.Fatal(err)
+	}
+	_ = userStore.SetSourcePool(u.ID, "user")
+
+	cfg := &config.Config{SourcePools: map[string]config.AddrPool{
+		"route": {Addrs: []string{"127.0.0.2"}},
+		"user":  {Addrs: []string{"127.0.0.3"}},
+	}}
+	s := New(Options{Config: config.NewStore(cfg), Users: userStore, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+
+	if got := sourceOf(t, s, cfg, &config.SNIRoute{SNI: "*"}, "198.51.100.1"); got != "127.0.0.1" {
+		t.Errorf("no pool: dialled from %s", got)
+	}
+	if got := sourceOf(t, s, cfg, &config.SNIRoute{SNI: "*", Source: "route"}, "198.51.100.1"); got != "127.0.0.2" {
+		t.Errorf("route pool: dialled from %s", got)
+	}
+	if got := sourceOf(t, s, cfg, &config.SNIRoute{SNI: "*", Source: "route"}, "198.51.100.9"); got != "127.0.0.3" {
+		t.Errorf("user pool: dialled from %s", got)
+	}
+}
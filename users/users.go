@@ -0,0 +1,382 @@
+// Package users keeps the registered users and the client IPs and API keys
+// that identify them.
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// User represents a registered user with IP-based access
+type User struct {
+	ID          string    `json:"id"`                    // Unique user ID (also used as token)
+	Name        string    `json:"name"`                  // User's name/identifier
+	APIKey      string    `json:"api_key"`               // Unique API key for authentication (alternative to IP)
+	IPs         []string  `json:"ips"`                   // List of registered IPs (FIFO)
+	MaxIPs      int       `json:"max_ips"`               // Maximum number of IPs allowed
+	CreatedAt   time.Time `json:"created_at"`            // Registration time
+	ExpiresAt   time.Time `json:"expires_at"`            // Expiration time
+	IsActive    bool      `json:"is_active"`             // Active status
+	Description string    `json:"description"`           // Optional description
+	UsageCount  uint64    `json:"usage_count"`           // Number of DNS queries made
+	LastUsed    time.Time `json:"last_used"`             // Last query time
+	Plan        string    `json:"plan,omitempty"`        // Plan name from Config.Plans
+	DomainSets  []string  `json:"domain_sets,omitempty"` // Extra domain sets on top of the plan's
+	SourcePool  string    `json:"source_pool,omitempty"` // Config.SourcePools entry the SNI proxy dials from
+}
+
+// Valid reports whether u is active and not expired.
+func (u *User) Valid() bool {
+	return u.IsActive && !time.Now().After(u.ExpiresAt)
+}
+
+// Store holds users in memory.
+type Store struct {
+	users    sync.Map // map[userID]*User - user management
+	ipToUser sync.Map // map[IP]userID - IP to User mapping for fast lookup
+	logger   *slog.Logger
+}
+
+// NewStore returns an empty Store logging to logger (slog.Default() if nil).
+func NewStore(logger *slog.Logger) *Store {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Store{logger: logger}
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Generate unique API key for user (32 bytes = 64 hex chars)
+func generateAPIKey() (string, error) {
+	return randomHex(32)
+}
+
+// AuthorizeIP reports whether ip belongs to a valid user and records the use.
+func (s *Store) AuthorizeIP(ip string) bool {
+	user := s.ByIP(ip)
+	if user == nil || !user.Valid() {
+		return false
+	}
+
+	// Update usage stats
+	user.UsageCount++
+	user.LastUsed = time.Now()
+	s.users.Store(user.ID, user)
+
+	return true
+}
+
+// AuthorizeAPIKey reports whether apiKey belongs to a valid user and
+// records the use.
+func (s *Store) AuthorizeAPIKey(apiKey string) bool {
+	user := s.ByAPIKey(apiKey)
+	if user == nil || !user.Valid() {
+		return false
+	}
+
+	// Update usage stats
+	user.UsageCount++
+	user.LastUsed = time.Now()
+	s.users.Store(user.ID, user)
+
+	return true
+}
+
+// ByAPIKey returns the user with apiKey, or nil.
+func (s *Store) ByAPIKey(apiKey string) *User {
+	if apiKey == "" {
+		return nil
+	}
+
+	var foundUser *User
+	s.users.Range(func(key, value interface{}) bool {
+		user := value.(*User)
+		if user.APIKey == apiKey {
+			foundUser = user
+			return false // Stop iteration
+		}
+		return true
+	})
+
+	return foundUser
+}
+
+// ByIP returns the user that registered ip, or nil.
+func (s *Store) ByIP(ip string) *User {
+	userIDVal, ok := s.ipToUser.Load(ip)
+	if !ok {
+		return nil
+	}
+	return s.ByID(userIDVal.(string))
+}
+
+// ByID returns the user with id, or nil.
+func (s *Store) ByID(id string) *User {
+	if val, ok := s.users.Load(id); ok {
+		return val.(*User)
+	}
+	return nil
+}
+
+// Create adds a new active user valid for validDays.
+func (s *Store) Create(name, description string, maxIPs, validDays int) (*User, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey, err := generateAPIKey()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	user := &User{
+		ID:          id,
+		Name:        name,
+		APIKey:      apiKey,
+		IPs:         []string{},
+		MaxIPs:      maxIPs,
+		Description: description,
+		CreatedAt:   now,
+		ExpiresAt:   now.AddDate(0, 0, validDays),
+		IsActive:    true,
+	}
+
+	s.users.Store(id, user)
+	s.logger.Info("user created", "id", id, "name", name, "api_key", apiKey[:16]+"...", "max_ips", maxIPs, "expires", user.ExpiresAt)
+	return user, nil
+}
+
+// Put stores u as is, registering its IPs.
+func (s *Store) Put(u *User) {
+	s.users.Store(u.ID, u)
+	for _, ip := range u.IPs {
+		s.ipToUser.Store(ip, u.ID)
+	}
+}
+
+// Extend moves the expiry of a user by days.
+func (s *Store) Extend(userID string, days int) error {
+	user := s.ByID(userID)
+	if user == nil {
+		return errors.New("user not found")
+	}
+
+	user.ExpiresAt = user.ExpiresAt.AddDate(0, 0, days)
+	s.users.Store(userID, user)
+	s.logger.Info("user expiration extended", "id", userID, "new_expiry", user.ExpiresAt)
+	return nil
+}
+
+// Deactivate disables a user without deleting it.
+func (s *Store) Deactivate(userID string) error {
+	user := s.ByID(userID)
+	if user == nil {
+		return errors.New("user not found")
+	}
+
+	user.IsActive = false
+	s.users.Store(userID, user)
+	s.logger.Info("user deactivated", "id", userID)
+	return nil
+}
+
+// Delete removes a user and its IP mappings.
+func (s *Store) Delete(userID string) error {
+	user := s.ByID(userID)
+	if user == nil {
+		return errors.New("user not found")
+	}
+
+	// Remove all IP mappings
+	for _, ip := range user.IPs {
+		s.ipToUser.Delete(ip)
+	}
+
+	s.users.Delete(userID)
+	s.logger.Info("user deleted", "id", userID)
+	return nil
+}
+
+// AddIP registers clientIP for a user (FIFO - removes oldest if limit reached)
+func (s *Store) AddIP(userID, clientIP string) error {
+	user := s.ByID(userID)
+	if user == nil {
+		return errors.New("user not found")
+	}
+
+	if !user.IsActive {
+		return errors.New("user is inactive")
+	}
+
+	if time.Now().After(user.ExpiresAt) {
+		return errors.New("user expired")
+	}
+
+	// Check if IP already registered
+	for _, ip := range user.IPs {
+		if ip == clientIP {
+			s.logger.Info("IP already registered for user", "user_id", userID, "ip", clientIP)
+			return nil // Already registered, no error
+		}
+	}
+
+	// If max IPs reached, remove the oldest (FIFO)
+	if len(user.IPs) >= user.MaxIPs && user.MaxIPs > 0 {
+		oldestIP := user.IPs[0]
+		user.IPs = user.IPs[1:] // Remove first element
+		s.ipToUser.Delete(oldestIP)
+		s.logger.Info("removed oldest IP (FIFO)", "user_id", userID, "old_ip", oldestIP)
+	}
+
+	// Add new IP
+	user.IPs = append(user.IPs, clientIP)
+	s.ipToUser.Store(clientIP, userID)
+	s.users.Store(userID, user)
+
+	s.logger.Info("IP added to user", "user_id", userID, "ip", clientIP, "total_ips", len(user.IPs))
+	return nil
+}
+
+// SetDomainSets assigns a plan and extra domain sets to a user. The caller
+// checks that they exist in the configuration.
+func (s *Store) SetDomainSets(userID, plan string, sets []string) error {
+	user := s.ByID(userID)
+	if user == nil {
+		return errors.New("user not found")
+	}
+
+	user.Plan = plan
+	user.DomainSets = sets
+	s.users.Store(userID, user)
+	s.logger.Info("user domain sets updated", "id", userID, "plan", plan, "sets", sets)
+	return nil
+}
+
+// SetSourcePool assigns the outbound address pool of a user. The caller
+// checks that it exists in the configuration.
+func (s *Store) SetSourcePool(userID, pool string) error {
+	user := s.ByID(userID)
+	if user == nil {
+		return errors.New("user not found")
+	}
+
+	user.SourcePool = pool
+	s.users.Store(userID, user)
+	s.logger.Info("user source pool updated", "id", userID, "pool", pool)
+	return nil
+}
+
+// List returns a copy of every user.
+func (s *Store) List() []User {
+	var userList []User
+	s.users.Range(func(key, value interface{}) bool {
+		userList = append(userList, *value.(*User))
+		return true
+	})
+	return userList
+}
+
+// IPMappings returns the IP -> user ID table.
+func (s *Store) IPMappings() map[string]string {
+	ipMapping := make(map[string]string)
+	s.ipToUser.Range(func(key, value interface{}) bool {
+		ipMapping[key.(string)] = value.(string)
+		return true
+	})
+	return ipMapping
+}
+
+// Replace drops every user and loads list and ipMapping instead.
+func (s *Store) Replace(list []User, ipMapping map[string]string) {
+	s.users.Range(func(key, value interface{}) bool {
+		s.users.Delete(key)
+		return true
+	})
+	s.ipToUser.Range(func(key, value interface{}) bool {
+		s.ipToUser.Delete(key)
+		return true
+	})
+
+	for _, user := range list {
+		userCopy := user // Create a copy
+		s.users.Store(userCopy.ID, &userCopy)
+	}
+	for ip, userID := range ipMapping {
+		s.ipToUser.Store(ip, userID)
+	}
+}
+
+// MigrateAPIKeys gives users created before API keys existed a key.
+func (s *Store) MigrateAPIKeys() {
+	migratedCount := 0
+	s.users.Range(func(key, value interface{}) bool {
+		user := value.(*User)
+		if user.APIKey == "" {
+			// Generate API key for old user
+			apiKey, err := generateAPIKey()
+			if err != nil {
+				s.logger.Error("failed to generate API key for user", "user", user.Name, "error", err)
+				return true
+			}
+			user.APIKey = apiKey
+			s.users.Store(user.ID, user)
+			migratedCount++
+			s.logger.Info("migrated user with API key", "user", user.Name, "api_key", apiKey[:16]+"...")
+		}
+		return true
+	})
+
+	if migratedCount > 0 {
+		s.logger.Info("user migration completed", "migrated", migratedCount)
+	}
+}
+
+// RunExpirationChecker deactivates expired users every hour until ctx ends.
+func (s *Store) RunExpirationChecker(ctx context.Context) {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.CheckExpired()
+		}
+	}
+}
+
+// CheckExpired deactivates every active user past its expiry.
+func (s *Store) CheckExpired() {
+	now := time.Now()
+	expiredCount := 0
+
+	s.users.Range(func(key, value interface{}) bool {
+		user := value.(*User)
+		if user.IsActive && now.After(user.ExpiresAt) {
+			user.IsActive = false
+			s.users.Store(key, user)
+			expiredCount++
+			s.logger.Info("user expired and deactivated", "id", user.ID, "name", user.Name, "expired_at", user.ExpiresAt)
+		}
+		return true
+	})
+
+	if expiredCount > 0 {
+		s.logger.Info("expired users check completed", "deactivated_count", expiredCount)
+	}
+}
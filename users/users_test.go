@@ -0,0 +1,54 @@
+package users
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func newTestStore() *Store {
+	return NewStore(slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestAddIPEvictsOldest(t *testing.T) {
+	s := newTestStore()
+	u, err := s.Create("alice", "", 2, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		if err := s.AddIP(u.ID, ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s.AuthorizeIP("192.0.2.1") {
+		t.Fatal("oldest IP still authorized after the limit was reached")
+	}
+	if !s.AuthorizeIP("192.0.2.3") || !s.AuthorizeAPIKey(u.APIKey) {
+		t.Fatal("current IP and API key should be authorized")
+	}
+	if got := s.ByID(u.ID).UsageCount; got != 2 {
+		t.Fatalf("usage count %d, want 2", got)
+	}
+}
+
+func TestDeactivatedUserNotAuthorized(t *testing.T) {
+	s := newTestStore()
+	u, err := s.Create("bob", "", 1, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddIP(u.ID, "192.0.2.9"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Deactivate(u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if s.AuthorizeIP("192.0.2.9") {
+		t.Fatal("deactivated user authorized")
+	}
+	if s.AddIP(u.ID, "192.0.2.10") == nil {
+		t.Fatal("IP added to a deactivated user")
+	}
+}
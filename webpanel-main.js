@@ -97,7 +97,8 @@ async function loadDashboardData() {
         loadMetrics(),
         loadDomains(),
         loadHealth(),
-        loadUsers()
+        loadUsers(),
+        loadConnections()
     ]);
 }
 
@@ -317,6 +318,7 @@ function startAutoRefresh() {
     refreshInterval = setInterval(() => {
         loadMetrics();
         loadHealth();
+        loadConnections();
     }, 5000); // Refresh every 5 seconds
 }
 
@@ -347,6 +349,125 @@ function showError(elementId, message) {
     }, 5000);
 }
 
+function formatBytes(bytes) {
+    const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+    let i = 0;
+    while (bytes >= 1024 && i < units.length - 1) {
+        bytes /= 1024;
+        i++;
+    }
+    return `${bytes.toFixed(i === 0 ? 0 : 1)} ${units[i]}`;
+}
+
+function escapeHTML(text) {
+    const div = document.createElement('div');
+    div.textContent = text;
+    return div.innerHTML;
+}
+
+// ========== SNI Connections Functions ==========
+
+async function loadConnections() {
+    try {
+        const response = await fetch('/panel/api/connections', {
+            headers: { 'X-Session-ID': sessionId }
+        });
+
+        if (response.ok) {
+            const data = await response.json();
+            displayConnections(data);
+        } else {
+            document.getElementById('connectionsList').innerHTML = '<p>Failed to load connections</p>';
+        }
+    } catch (error) {
+        document.getElementById('connectionsList').innerHTML = '<p>Connection error</p>';
+    }
+}
+
+function displayConnections(data) {
+    const container = document.getElementById('connectionsList');
+    const names = data.user_names || {};
+    const active = data.active || [];
+    document.getElementById('connectionsCount').textContent = `(${active.length})`;
+
+    if (active.length === 0) {
+        container.innerHTML = '<p style="color: #666;">No active connections</p>';
+    } else {
+        let html = '<table style="width: 100%; border-collapse: collapse; font-size: 14px;">';
+        html += '<tr style="background: #f5f5f5; text-align: left;">';
+        html += '<th style="padding: 10px;">SNI</th><th>Client</th><th>User</th><th>Backend</th><th>Duration</th><th>In</th><th>Out</th><th>Limit</th><th>Actions</th>';
+        html += '</tr>';
+
+        active.forEach(conn => {
+            const seconds = (Date.now() - new Date(conn.started)) / 1000;
+            const user = conn.user ? escapeHTML(names[conn.user] || conn.user) : '<em style="color: #999;">-</em>';
+            html += `<tr style="border-bottom: 1px solid #eee;">
+                <td style="padding: 10px;"><strong>${escapeHTML(conn.sni || '-')}</strong></td>
+                <td style="font-family: monospace; font-size: 12px;">${escapeHTML(conn.client)}</td>
+                <td>${user}</td>
+                <td style="font-family: monospace; font-size: 12px;">${escapeHTML(conn.backend || '-')}</td>
+                <td>${seconds < 60 ? Math.floor(seconds) + 's' : formatUptime(seconds)}</td>
+                <td>${formatBytes(conn.bytes_in)}</td>
+                <td>${formatBytes(conn.bytes_out)}</td>
+                <td>${conn.rate_limit ? formatBytes(conn.rate_limit) + '/s' : '-'}</td>
+                <td>
+                    <button onclick="killConnection(${conn.id})" style="padding: 5px 10px; margin: 2px; background: #e74c3c; color: white; border: none; border-radius: 4px; cursor: pointer;">Kill</button>
+                </td>
+            </tr>`;
+        });
+
+        html += '</table>';
+        container.innerHTML = html;
+    }
+
+    // Busiest domains by total traffic
+    const domains = Object.entries(data.by_sni || {})
+        .sort((a, b) => (b[1].bytes_in + b[1].bytes_out) - (a[1].bytes_in + a[1].bytes_out))
+        .slice(0, 10);
+    const traffic = document.getElementById('trafficBySNI');
+    if (domains.length === 0) {
+        traffic.innerHTML = '';
+        return;
+    }
+    let html = '<table style="width: 100%; border-collapse: collapse; font-size: 14px;">';
+    html += '<tr style="background: #f5f5f5; text-align: left;">';
+    html += '<th style="padding: 10px;">Top Domains</th><th>Connections</th><th>In</th><th>Out</th>';
+    html += '</tr>';
+    domains.forEach(([sni, t]) => {
+        html += `<tr style="border-bottom: 1px solid #eee;">
+            <td style="padding: 10px;">${escapeHTML(sni)}</td>
+            <td>${t.connections.toLocaleString()}</td>
+            <td>${formatBytes(t.bytes_in)}</td>
+            <td>${formatBytes(t.bytes_out)}</td>
+        </tr>`;
+    });
+    html += '</table>';
+    traffic.innerHTML = html;
+}
+
+async function killConnection(id) {
+    if (!confirm('Close this connection?')) return;
+
+    try {
+        const response = await fetch('/panel/api/connections/kill', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+                'X-Session-ID': sessionId
+            },
+            body: JSON.stringify({ id: id })
+        });
+
+        if (!response.ok) {
+            const data = await response.json();
+            alert(data.error || 'Failed to close connection');
+        }
+        await loadConnections();
+    } catch (error) {
+        alert('Connection error');
+    }
+}
+
 // ========== User Management Functions ==========
 
 async function loadUsers() {